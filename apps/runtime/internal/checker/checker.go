@@ -0,0 +1,466 @@
+// Package checker performs the semantic analysis of IEC 61131-3 programs:
+// it resolves symbols across VAR sections and POUs, type-checks statements
+// and expressions, and reports unreachable code and unused variables.
+package checker
+
+import (
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/hyperdrive/core/apps/runtime/internal/diagnostics"
+	"github.com/hyperdrive/core/apps/runtime/internal/parser/ast"
+	"github.com/hyperdrive/core/apps/runtime/internal/stdlib"
+)
+
+// Codes of the diagnostics reported by the checker
+const (
+	CodeUndefined   = "undefined"
+	CodeDuplicate   = "duplicate"
+	CodeType        = "type-mismatch"
+	CodeConversion  = "implicit-conversion"
+	CodeUnreachable = "unreachable-code"
+	CodeUnused      = "unused-variable"
+	CodePragma      = "pragma"
+)
+
+// maxTypeDepth bounds the resolution of type aliases referring to each other
+const maxTypeDepth = 32
+
+// Checker checks compilation units against the POUs and types declared to it
+type Checker struct {
+	pous    map[string]*ast.Program
+	types   map[string]*ast.TypeDecl
+	enums   map[string]*ast.EnumType // Enumeration of every value name
+	globals map[string]*ast.VarDecl
+
+	diags diagnostics.List
+
+	// State of the POU being checked
+	scope map[string]*symbol
+	loops int
+	depth int
+}
+
+// symbol is a variable visible in the POU being checked
+type symbol struct {
+	decl *ast.VarDecl
+	typ  typ
+	used bool
+}
+
+// New creates a checker that knows the standard function blocks
+func New() *Checker {
+	c := &Checker{
+		pous:    make(map[string]*ast.Program),
+		types:   make(map[string]*ast.TypeDecl),
+		enums:   make(map[string]*ast.EnumType),
+		globals: make(map[string]*ast.VarDecl),
+	}
+	c.Declare(stdlib.Unit)
+	return c
+}
+
+// Check declares every unit to a new checker and checks each of them
+func Check(units ...*ast.CompilationUnit) diagnostics.List {
+	c := New()
+	for _, unit := range units {
+		c.Declare(unit)
+	}
+
+	var result diagnostics.List
+	for _, unit := range units {
+		result = append(result, c.Check(unit)...)
+	}
+	return result
+}
+
+// Declare makes the functions, function blocks, types and global variables
+// of a unit visible to the units checked afterwards
+func (c *Checker) Declare(unit *ast.CompilationUnit) {
+	for _, decl := range unit.Types {
+		c.types[decl.Name] = decl
+		c.declareEnum(decl.Type)
+	}
+	for _, decl := range unit.Globals {
+		c.globals[decl.Name] = decl
+		c.declareEnum(decl.Type)
+	}
+	for _, pou := range unit.POUs {
+		if pou.Type == ast.ProgramFC || pou.Type == ast.ProgramFB {
+			c.pous[pou.Name] = pou
+		}
+		// Enumerations may also be declared inline in a VAR section
+		for _, v := range pou.Vars {
+			c.declareEnum(v.Type)
+			if v.Section == ast.VarGlobal && pou.Type == ast.ProgramPRG {
+				c.globals[v.Name] = v
+			}
+		}
+	}
+}
+
+func (c *Checker) declareEnum(t ast.DataType) {
+	if enum, ok := t.(*ast.EnumType); ok {
+		for _, v := range enum.Values {
+			c.enums[v.Name] = enum
+		}
+	}
+}
+
+// Check type-checks the types and POUs of a unit and returns the problems found
+func (c *Checker) Check(unit *ast.CompilationUnit) diagnostics.List {
+	c.diags = nil
+
+	for _, msg := range unit.Messages {
+		c.diags = append(c.diags, diagnostics.New(msg.Position(), diagnostics.SeverityInfo, CodePragma, "%s", msg.Text))
+	}
+	for _, decl := range unit.Types {
+		c.checkTypeDecl(decl)
+	}
+	for _, decl := range unit.Globals {
+		c.checkQualifiers(decl)
+		t := c.resolve(decl, decl.Type)
+		c.checkLocation(decl, t)
+		if decl.InitExpr != nil {
+			c.checkInit(decl, t, decl.InitExpr)
+		}
+	}
+	for _, pou := range unit.POUs {
+		c.checkPOU(pou)
+	}
+
+	return c.diags
+}
+
+func (c *Checker) errorf(node ast.Node, code, format string, args ...interface{}) {
+	c.diags = append(c.diags, diagnostics.New(node.Position(), diagnostics.SeverityError, code, format, args...))
+}
+
+func (c *Checker) warnf(node ast.Node, code, format string, args ...interface{}) {
+	c.diags = append(c.diags, diagnostics.New(node.Position(), diagnostics.SeverityWarning, code, format, args...))
+}
+
+func (c *Checker) checkTypeDecl(decl *ast.TypeDecl) {
+	t := c.resolve(decl, decl.Type)
+	switch d := decl.Type.(type) {
+	case *ast.StructType:
+		c.checkFields(d)
+	case *ast.SubrangeType:
+		if d.Low > d.High {
+			c.errorf(decl, diagnostics.CodeSemantic, "empty subrange %d..%d", d.Low, d.High)
+		}
+	}
+	if decl.InitExpr != nil {
+		c.checkInit(decl, t, decl.InitExpr)
+	}
+}
+
+// checkFields checks the field types and initial values of a structure
+func (c *Checker) checkFields(s *ast.StructType) {
+	seen := make(map[string]bool)
+	for _, field := range s.Fields {
+		if seen[field.Name] {
+			c.errorf(field, CodeDuplicate, "duplicate field %s", field.Name)
+		}
+		seen[field.Name] = true
+
+		t := c.resolve(field, field.Type)
+		if nested, ok := field.Type.(*ast.StructType); ok && nested.Name == "" {
+			c.checkFields(nested)
+		}
+		if field.InitExpr != nil {
+			c.checkInit(field, t, field.InitExpr)
+		}
+	}
+}
+
+func (c *Checker) checkPOU(pou *ast.Program) {
+	c.scope = make(map[string]*symbol, len(pou.Vars)+1)
+	c.loops = 0
+
+	for _, decl := range pou.Vars {
+		if _, exists := c.scope[decl.Name]; exists {
+			c.errorf(decl, CodeDuplicate, "duplicate declaration of %s", decl.Name)
+			continue
+		}
+		c.checkSection(pou, decl)
+		t := c.resolve(decl, decl.Type)
+		if s, ok := decl.Type.(*ast.StructType); ok && s.Name == "" {
+			c.checkFields(s)
+		}
+		if decl.Section == ast.VarExternal {
+			c.checkExternal(decl, t)
+		}
+		if decl.Location != nil && pou.Type != ast.ProgramPRG {
+			c.errorf(decl, diagnostics.CodeSemantic, "located variable %s is not allowed in %s %s", decl.Name, pou.Type, pou.Name)
+		} else {
+			c.checkLocation(decl, t)
+		}
+		c.scope[decl.Name] = &symbol{decl: decl, typ: t}
+	}
+
+	// Initial values are checked once every variable is declared
+	for _, decl := range pou.Vars {
+		if sym, ok := c.scope[decl.Name]; ok && sym.decl == decl && decl.InitExpr != nil {
+			c.checkInit(decl, sym.typ, decl.InitExpr)
+		}
+	}
+
+	// The function name holds the return value
+	if pou.Type == ast.ProgramFC && pou.ReturnType != nil {
+		result := &ast.VarDecl{Name: pou.Name, Type: pou.ReturnType, Section: ast.VarOutput}
+		result.SetPosition(pou.Position())
+		c.scope[pou.Name] = &symbol{decl: result, typ: c.resolve(pou, pou.ReturnType), used: true}
+	}
+
+	c.checkStatements(pou.Body)
+
+	// Inputs and outputs are part of the interface and used by the caller
+	for _, decl := range pou.Vars {
+		sym := c.scope[decl.Name]
+		local := decl.Section == ast.VarLocal || decl.Section == ast.VarTemp
+		if sym != nil && sym.decl == decl && !sym.used && sym.typ.kind != kindInvalid && local {
+			c.warnf(decl, CodeUnused, "variable %s is declared but never used", decl.Name)
+		}
+	}
+
+	c.scope = nil
+}
+
+// checkInit checks an initial value against the declared type
+// checkSection reports variables declared in a section or with a qualifier
+// the kind of POU does not allow
+func (c *Checker) checkSection(pou *ast.Program, decl *ast.VarDecl) {
+	switch {
+	case decl.Section == ast.VarGlobal && pou.Type != ast.ProgramPRG:
+		c.errorf(decl, diagnostics.CodeSemantic, "VAR_GLOBAL %s is not allowed in %s %s", decl.Name, pou.Type, pou.Name)
+	case decl.Section == ast.VarInOut && pou.Type == ast.ProgramPRG:
+		c.errorf(decl, diagnostics.CodeSemantic, "VAR_IN_OUT %s is not allowed in PROGRAM %s", decl.Name, pou.Name)
+	}
+	c.checkQualifiers(decl)
+}
+
+func (c *Checker) checkQualifiers(decl *ast.VarDecl) {
+	switch decl.Section {
+	case ast.VarLocal, ast.VarGlobal, ast.VarExternal:
+	default:
+		if decl.Constant {
+			c.errorf(decl, diagnostics.CodeSemantic, "CONSTANT is not allowed in %s", decl.Section)
+		}
+	}
+	switch {
+	case decl.Retention == ast.NonRetain:
+	case decl.Constant:
+		c.errorf(decl, diagnostics.CodeSemantic, "constant %s cannot be %s", decl.Name, decl.Retention)
+	case decl.Section == ast.VarInOut || decl.Section == ast.VarTemp || decl.Section == ast.VarExternal:
+		c.errorf(decl, diagnostics.CodeSemantic, "%s is not allowed in %s", decl.Retention, decl.Section)
+	}
+}
+
+// checkLocation checks the direct address of a located variable against its type
+func (c *Checker) checkLocation(decl *ast.VarDecl, t typ) {
+	loc := decl.Location
+	if loc == nil {
+		return
+	}
+	switch decl.Section {
+	case ast.VarInOut, ast.VarTemp, ast.VarExternal:
+		c.errorf(decl, diagnostics.CodeSemantic, "located variables are not allowed in %s", decl.Section)
+		return
+	}
+
+	switch {
+	case loc.Size == 'X' && len(loc.Index) != 2:
+		c.errorf(decl, diagnostics.CodeSemantic, "bit address %s must give a byte and a bit", loc)
+	case loc.Size == 'X' && loc.Index[1] > 7:
+		c.errorf(decl, diagnostics.CodeSemantic, "bit %d of %s is out of range 0..7", loc.Index[1], loc)
+	case loc.Size != 'X' && len(loc.Index) != 1:
+		c.errorf(decl, diagnostics.CodeSemantic, "unsupported address %s", loc)
+	}
+
+	switch t.kind {
+	case kindInvalid:
+	case kindBool:
+		if loc.Size != 'X' {
+			c.errorf(decl, CodeType, "cannot locate BOOL at %s", loc)
+		}
+	case kindSigned, kindUnsigned, kindBits, kindReal:
+		if t.bits != loc.Bits() {
+			c.errorf(decl, CodeType, "cannot locate %s at %s", t, loc)
+		}
+	default:
+		c.errorf(decl, CodeType, "cannot locate a variable of type %s", t)
+	}
+}
+
+// checkExternal matches a VAR_EXTERNAL declaration to its global variable
+func (c *Checker) checkExternal(decl *ast.VarDecl, t typ) {
+	global, ok := c.globals[decl.Name]
+	if !ok {
+		c.errorf(decl, CodeUndefined, "undefined global variable %s", decl.Name)
+		return
+	}
+	if g := c.resolve(global, global.Type); g.name != t.name && g.kind != kindInvalid && t.kind != kindInvalid {
+		c.errorf(decl, CodeType, "VAR_EXTERNAL %s is %s, the global variable is %s", decl.Name, t, g)
+	}
+	if global.Constant && !decl.Constant {
+		c.errorf(decl, diagnostics.CodeSemantic, "VAR_EXTERNAL %s must be CONSTANT like its global variable", decl.Name)
+	}
+}
+
+func (c *Checker) checkInit(node ast.Node, t typ, init ast.Expression) {
+	if lit, ok := init.(*ast.ArrayLiteral); ok && t.kind == kindArray {
+		c.checkArrayLiteral(lit, t)
+		return
+	}
+	c.checkAssignable(init, c.expression(init), t)
+}
+
+// checkArrayLiteral checks the elements of an array initializer against the element type
+func (c *Checker) checkArrayLiteral(lit *ast.ArrayLiteral, t typ) {
+	arr := t.decl.(*ast.ArrayType)
+	elem := c.resolve(lit, arr.BaseType)
+
+	size := 1
+	for _, dim := range arr.Dims {
+		size *= dim.Len()
+	}
+
+	count := 0
+	for _, e := range lit.Elements {
+		count += e.Count
+		if e.Value != nil {
+			c.checkInit(e.Value, elem, e.Value)
+		}
+	}
+	if count > size {
+		c.errorf(lit, CodeType, "too many initial values for %s: %d", t, count)
+	}
+}
+
+// resolve returns the checker type of a declared type, reporting unknown names at node
+func (c *Checker) resolve(node ast.Node, t ast.DataType) typ {
+	if c.depth >= maxTypeDepth {
+		c.errorf(node, diagnostics.CodeSemantic, "type %s refers to itself", t.TypeName())
+		return invalid
+	}
+	c.depth++
+	defer func() { c.depth-- }()
+
+	switch d := t.(type) {
+	case nil:
+		return invalid
+	case *ast.StructType:
+		return typ{kind: kindStruct, name: d.TypeName(), decl: d}
+	case *ast.EnumType:
+		return typ{kind: kindEnum, name: d.TypeName(), decl: d}
+	case *ast.ArrayType:
+		for _, dim := range d.Dims {
+			if dim.Start > dim.End {
+				c.errorf(node, diagnostics.CodeSemantic, "empty array dimension %d..%d", dim.Start, dim.End)
+			}
+		}
+		c.resolve(node, d.BaseType)
+		return typ{kind: kindArray, name: d.String(), decl: d}
+	case *ast.SubrangeType:
+		base := c.resolve(node, d.Base)
+		if base.kind == kindInvalid {
+			return invalid
+		}
+		if !isInteger(base) {
+			c.errorf(node, diagnostics.CodeSemantic, "subrange of non-integer type %s", base)
+			return invalid
+		}
+		base.name = d.TypeName()
+		base.ranged, base.low, base.high = true, d.Low, d.High
+		return base
+	case *ast.StringType:
+		if d.Length < 1 {
+			c.errorf(node, diagnostics.CodeSemantic, "invalid string length %d", d.Length)
+		}
+		t := elementaryTypes[d.TypeName()]
+		t.name, t.length = d.String(), d.Length
+		return t
+	}
+
+	name := t.TypeName()
+	if e, ok := elementaryType(name); ok {
+		return e
+	}
+	if decl, ok := c.types[name]; ok {
+		return c.resolve(node, decl.Type)
+	}
+	if fb, ok := c.pous[name]; ok && fb.Type == ast.ProgramFB {
+		return typ{kind: kindFunctionBlock, name: fb.Name, fb: fb}
+	}
+
+	c.errorf(node, CodeUndefined, "unknown data type %s", name)
+	return invalid
+}
+
+// checkAssignable reports values that cannot be stored in a variable of type to
+func (c *Checker) checkAssignable(node ast.Node, from, to typ) {
+	switch convertible(from, to) {
+	case convNone:
+		c.errorf(node, CodeType, "cannot assign %s to %s", from, to)
+		return
+	case convNarrowing:
+		c.warnf(node, CodeConversion, "implicit conversion from %s to %s may lose data", from, to)
+		return
+	}
+
+	// Constants outside a subrange are rejected by the runtime, those outside
+	// the range of the type would wrap around
+	if low, high, ok := bounds(to); ok {
+		if n, ok := constantInt(node); ok && (n < low || n > high) {
+			c.errorf(node, CodeType, "value %d out of range %d..%d of %s", n, low, high, to)
+		}
+	}
+
+	// Longer strings are truncated by the runtime
+	if lit, ok := node.(*ast.Literal); ok && to.length > 0 {
+		if s, ok := lit.Value.(string); ok && utf8.RuneCountInString(s) > to.length {
+			c.warnf(node, CodeConversion, "string of %d characters is truncated to %s", utf8.RuneCountInString(s), to)
+		}
+	}
+}
+
+// constantInt returns the value of an integer literal, possibly negated
+func constantInt(node ast.Node) (int, bool) {
+	switch e := node.(type) {
+	case *ast.Literal:
+		n, ok := e.Value.(int)
+		return n, ok
+	case *ast.UnaryExpr:
+		if e.Operator == "-" {
+			n, ok := constantInt(e.Operand)
+			return -n, ok
+		}
+	}
+	return 0, false
+}
+
+// lookup resolves a variable or enumeration value name in the POU being checked
+func (c *Checker) lookup(node ast.Node, name string) (*symbol, typ, bool) {
+	if sym, ok := c.scope[name]; ok {
+		sym.used = true
+		return sym, sym.typ, true
+	}
+	if decl, ok := c.globals[name]; ok {
+		sym := &symbol{decl: decl, typ: c.resolve(decl, decl.Type), used: true}
+		c.scope[name] = sym
+		return sym, sym.typ, true
+	}
+	if enum, ok := c.enums[name]; ok {
+		return nil, typ{kind: kindEnum, name: enum.TypeName(), decl: enum}, true
+	}
+	c.errorf(node, CodeUndefined, "undefined variable %s", name)
+	return nil, invalid, false
+}
+
+func (c *Checker) describe(t typ) string {
+	if t.kind == kindFunctionBlock {
+		return fmt.Sprintf("function block %s", t)
+	}
+	return t.String()
+}
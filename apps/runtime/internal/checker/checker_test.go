@@ -0,0 +1,398 @@
+package checker_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hyperdrive/core/apps/runtime/internal/checker"
+	"github.com/hyperdrive/core/apps/runtime/internal/diagnostics"
+	"github.com/hyperdrive/core/apps/runtime/internal/parser"
+)
+
+func check(t *testing.T, code string) diagnostics.List {
+	t.Helper()
+	unit, err := parser.ParseFile("main.st", code)
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	return checker.Check(unit)
+}
+
+func TestValidProgram(t *testing.T) {
+	diags := check(t, `
+TYPE
+    Mode : (Off, Manual, Auto);
+    Point : STRUCT
+        x : REAL;
+        y : REAL;
+    END_STRUCT;
+    Percent : INT (0..100);
+END_TYPE
+
+FUNCTION Scale : REAL
+    VAR_INPUT
+        value : INT;
+        factor : REAL;
+    END_VAR
+    Scale := value * factor;
+END_FUNCTION
+
+FUNCTION_BLOCK Blinker
+    VAR_INPUT enable : BOOL; END_VAR
+    VAR_OUTPUT lamp : BOOL; END_VAR
+    VAR pulse : TON; END_VAR
+    pulse(IN := enable AND NOT pulse.Q, PT := T#500ms);
+    IF pulse.Q THEN
+        lamp := NOT lamp;
+    END_IF;
+END_FUNCTION_BLOCK
+
+PROGRAM Main
+    VAR
+        mode : Mode := Auto;
+        target : Point;
+        level : Percent := 50;
+        values : ARRAY[1..3] OF DINT := [1, 2, 3];
+        blink : Blinker;
+        total : LREAL;
+        elapsed : TIME;
+        i : INT;
+    END_VAR
+    blink(enable := mode = Mode#Auto);
+    FOR i := 1 TO 3 DO
+        total := total + values[i] + ABS(target.x);
+    END_FOR;
+    CASE mode OF
+        Off: level := 0;
+        Manual, Auto: level := MIN(level + 1, 100);
+    END_CASE;
+    target.y := Scale(level, 0.5);
+    elapsed := elapsed + T#10ms;
+    IF(elapsed > T#1s) AND(blink.lamp = BOOL#1) AND NOT(i > 3) THEN
+        elapsed := T#0s;
+    END_IF;
+    total := INT_TO_LREAL(i);
+END_PROGRAM
+`)
+	for _, d := range diags {
+		t.Errorf("Unexpected diagnostic: %s %s", d.Severity, d)
+	}
+}
+
+func TestCheckerDiagnostics(t *testing.T) {
+	diags := check(t, `
+FUNCTION Twice : INT
+    VAR_INPUT x : INT; END_VAR
+    Twice := x * 2;
+END_FUNCTION
+
+PROGRAM Main
+    VAR
+        count : INT;
+        big : DINT;
+        flag : BOOL;
+        ratio : REAL;
+        unused : INT;
+        values : ARRAY[1..3] OF INT;
+    END_VAR
+    IF count THEN
+        count := 1;
+    END_IF;
+    flag := count + 1;
+    count := ratio;
+    count := big;
+    missing := 1;
+    count := Twice(flag);
+    count := Twice(y := 1);
+    values[4] := 1;
+    WHILE flag DO
+        EXIT;
+        count := 0;
+    END_WHILE;
+    EXIT;
+END_PROGRAM
+`)
+
+	expected := []struct {
+		line     int
+		severity diagnostics.Severity
+		code     string
+		message  string
+	}{
+		{16, diagnostics.SeverityError, checker.CodeType, "IF condition must be BOOL, got INT"},
+		{19, diagnostics.SeverityError, checker.CodeType, "cannot assign INT to BOOL"},
+		{20, diagnostics.SeverityError, checker.CodeType, "cannot assign REAL to INT"},
+		{21, diagnostics.SeverityWarning, checker.CodeConversion, "implicit conversion from DINT to INT"},
+		{22, diagnostics.SeverityError, checker.CodeUndefined, "undefined variable missing"},
+		{23, diagnostics.SeverityError, checker.CodeType, "cannot assign BOOL to INT"},
+		{24, diagnostics.SeverityError, checker.CodeUndefined, "Twice has no input y"},
+		{25, diagnostics.SeverityError, checker.CodeType, "array index 4 out of bounds 1..3"},
+		{28, diagnostics.SeverityWarning, checker.CodeUnreachable, "unreachable code after EXIT"},
+		{30, diagnostics.SeverityError, diagnostics.CodeSemantic, "EXIT outside of loop"},
+		{13, diagnostics.SeverityWarning, checker.CodeUnused, "variable unused is declared but never used"},
+	}
+
+	if len(diags) != len(expected) {
+		t.Errorf("Expected %d diagnostics, got %d: %v", len(expected), len(diags), diags)
+	}
+	for i, want := range expected {
+		if i >= len(diags) {
+			break
+		}
+		d := diags[i]
+		if d.File != "main.st" || d.Line != want.line || d.Severity != want.severity || d.Code != want.code ||
+			!strings.Contains(d.Message, want.message) {
+			t.Errorf("Expected %s %s at line %d: %q, got %s %s %s", want.severity, want.code, want.line, want.message, d.Severity, d.Code, d)
+		}
+	}
+	if !diags.HasErrors() {
+		t.Errorf("Expected errors")
+	}
+}
+
+func TestCrossUnitDeclarations(t *testing.T) {
+	lib, err := parser.ParseFile("lib.st", `
+FUNCTION_BLOCK Counter
+    VAR_INPUT step : INT; END_VAR
+    VAR_OUTPUT count : INT; END_VAR
+    count := count + step;
+END_FUNCTION_BLOCK
+`)
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	main, err := parser.ParseFile("main.st", `
+PROGRAM Main
+    VAR
+        c : Counter;
+        n : INT;
+    END_VAR
+    c(step := 2);
+    n := c.count + c.missing;
+END_PROGRAM
+`)
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+
+	c := checker.New()
+	c.Declare(lib)
+	c.Declare(main)
+	diags := c.Check(main)
+	if len(diags) != 1 || diags[0].Message != "function block Counter has no member missing" {
+		t.Errorf("Unexpected diagnostics: %v", diags)
+	}
+}
+
+func TestVarSectionDiagnostics(t *testing.T) {
+	diags := check(t, `
+VAR_GLOBAL CONSTANT
+    limit : INT := 10;
+END_VAR
+
+FUNCTION_BLOCK Bump
+    VAR_IN_OUT value : INT; END_VAR
+    VAR_GLOBAL counter : INT; END_VAR
+    value := value + 1;
+END_FUNCTION_BLOCK
+
+PROGRAM Main
+    VAR
+        b : Bump;
+        x : INT;
+        r : REAL;
+        i : INT;
+    END_VAR
+    VAR CONSTANT step : INT := 1; END_VAR
+    VAR_TEMP scratch : INT; END_VAR
+    VAR_EXTERNAL limit : DINT; END_VAR
+    VAR_IN_OUT ref : INT; END_VAR
+    VAR_TEMP RETAIN kept : INT; END_VAR
+    step := 2;
+    b(value := x + 1);
+    b(value := r);
+    b();
+    FOR step := 1 TO 3 DO
+        i := x;
+    END_FOR;
+END_PROGRAM
+`)
+
+	expected := []struct {
+		line     int
+		severity diagnostics.Severity
+		code     string
+		message  string
+	}{
+		{8, diagnostics.SeverityError, diagnostics.CodeSemantic, "VAR_GLOBAL counter is not allowed in FUNCTION_BLOCK Bump"},
+		{21, diagnostics.SeverityError, checker.CodeType, "VAR_EXTERNAL limit is DINT, the global variable is INT"},
+		{21, diagnostics.SeverityError, diagnostics.CodeSemantic, "VAR_EXTERNAL limit must be CONSTANT like its global variable"},
+		{22, diagnostics.SeverityError, diagnostics.CodeSemantic, "VAR_IN_OUT ref is not allowed in PROGRAM Main"},
+		{23, diagnostics.SeverityError, diagnostics.CodeSemantic, "RETAIN is not allowed in VAR_TEMP"},
+		{24, diagnostics.SeverityError, diagnostics.CodeSemantic, "cannot assign to constant step"},
+		{25, diagnostics.SeverityError, checker.CodeType, "VAR_IN_OUT parameter value requires a variable"},
+		{26, diagnostics.SeverityError, checker.CodeType, "VAR_IN_OUT parameter value requires a INT variable, got REAL"},
+		{27, diagnostics.SeverityError, diagnostics.CodeSemantic, "VAR_IN_OUT parameter value of Bump is not connected"},
+		{28, diagnostics.SeverityError, diagnostics.CodeSemantic, "cannot assign to constant step"},
+		{20, diagnostics.SeverityWarning, checker.CodeUnused, "variable scratch is declared but never used"},
+		{23, diagnostics.SeverityWarning, checker.CodeUnused, "variable kept is declared but never used"},
+	}
+
+	if len(diags) != len(expected) {
+		t.Errorf("Expected %d diagnostics, got %d: %v", len(expected), len(diags), diags)
+	}
+	for i, want := range expected {
+		if i >= len(diags) {
+			break
+		}
+		d := diags[i]
+		if d.Line != want.line || d.Severity != want.severity || d.Code != want.code || !strings.Contains(d.Message, want.message) {
+			t.Errorf("Expected %s %s at line %d: %q, got %s %s %s", want.severity, want.code, want.line, want.message, d.Severity, d.Code, d)
+		}
+	}
+}
+
+func TestLocatedVariableDiagnostics(t *testing.T) {
+	diags := check(t, `
+FUNCTION_BLOCK Motor
+    VAR_INPUT run AT %IX0.1 : BOOL; END_VAR
+END_FUNCTION_BLOCK
+
+PROGRAM Main
+    VAR
+        ok AT %IX0.0 : BOOL;
+        speed AT %QW4 : INT;
+        level AT %ID2 : REAL;
+        wide AT %QW6 : DINT;
+        bit AT %IX1.8 : BOOL;
+        word AT %MB0 : BOOL;
+        name AT %MD1 : STRING;
+    END_VAR
+    speed := BOOL_TO_INT(ok) + REAL_TO_INT(level) + DINT_TO_INT(wide);
+    word := bit;
+    name := '';
+END_PROGRAM
+`)
+
+	expected := []string{
+		"located variable run is not allowed in FUNCTION_BLOCK Motor",
+		"cannot locate DINT at %QW6",
+		"bit 8 of %IX1.8 is out of range 0..7",
+		"cannot locate BOOL at %MB0",
+		"cannot locate a variable of type STRING",
+	}
+	if len(diags) != len(expected) {
+		t.Fatalf("Expected %d diagnostics, got %v", len(expected), diags)
+	}
+	for i, want := range expected {
+		if diags[i].Message != want {
+			t.Errorf("Expected %q, got %q", want, diags[i].Message)
+		}
+	}
+}
+
+func TestStandardFunctionDiagnostics(t *testing.T) {
+	diags := check(t, `
+PROGRAM Main
+    VAR
+        count : INT;
+        ratio : REAL;
+        flag : BOOL;
+    END_VAR
+    count := SEL(IN1 := count, G := flag, IN0 := 0);
+    ratio := LIMIT(MX := 1.0, IN := ratio, MN := 0.0);
+    count := SEL(G := count, IN0 := 1, IN1 := 2);
+    count := LIMIT(LOW := 0, IN := count, MX := 10);
+    count := MAX(count);
+    count := SQRT(ratio);
+END_PROGRAM
+`)
+
+	expected := []string{
+		"invalid arguments for SEL: INT, ANY_INT, ANY_INT",
+		"LIMIT has no input LOW",
+		"wrong number of arguments in call to MAX: 1",
+		"cannot assign REAL to INT",
+	}
+	if len(diags) != len(expected) {
+		t.Fatalf("Expected %d diagnostics, got %v", len(expected), diags)
+	}
+	for i, want := range expected {
+		if diags[i].Message != want {
+			t.Errorf("Expected %q, got %q", want, diags[i].Message)
+		}
+	}
+}
+
+func TestStringDiagnostics(t *testing.T) {
+	diags := check(t, `
+PROGRAM Main
+    VAR
+        name : STRING[4] := 'pump';
+        label : STRING[4] := 'conveyor';
+        wide : WSTRING;
+        count : INT;
+        empty : STRING[0];
+    END_VAR
+    name := LEFT(name, 2) + 'ab';
+    count := FIND(name, 'p') + LEN(wide);
+    wide := name + wide;
+    IF name < 'pz' AND name >= 'a' AND wide > name THEN
+        count := 1;
+    END_IF;
+    label := CONCAT(name, label);
+    empty := '';
+END_PROGRAM
+`)
+
+	expected := []string{
+		"invalid string length 0",
+		"string of 8 characters is truncated to STRING[4]",
+		"invalid operands for +: STRING[4] and WSTRING",
+		"invalid operands for >: WSTRING and STRING[4]",
+	}
+	if len(diags) != len(expected) {
+		t.Fatalf("Expected %d diagnostics, got %v", len(expected), diags)
+	}
+	for i, want := range expected {
+		if diags[i].Message != want {
+			t.Errorf("Expected %q, got %q", want, diags[i].Message)
+		}
+	}
+}
+
+func TestConstantRangeDiagnostics(t *testing.T) {
+	diags := check(t, `
+PROGRAM Main
+    VAR
+        i : INT;
+        s : SINT := -128;
+        u : USINT := 256;
+        w : WORD := 16#FFFF;
+        n : UDINT;
+    END_VAR
+    i := 40000;
+    i := -32768;
+    s := -129;
+    n := -1;
+    i := i + s;
+    n := u;
+    w := w AND 16#00FF;
+END_PROGRAM
+`)
+
+	expected := []string{
+		"value 256 out of range 0..255 of USINT",
+		"value 40000 out of range -32768..32767 of INT",
+		"value -129 out of range -128..127 of SINT",
+		"value -1 out of range 0..4294967295 of UDINT",
+	}
+	if len(diags) != len(expected) {
+		t.Fatalf("Expected %d diagnostics, got %v", len(expected), diags)
+	}
+	for i, want := range expected {
+		if diags[i].Message != want {
+			t.Errorf("Expected %q, got %q", want, diags[i].Message)
+		}
+	}
+}
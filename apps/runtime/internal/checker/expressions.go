@@ -0,0 +1,306 @@
+package checker
+
+import (
+	"github.com/hyperdrive/core/apps/runtime/internal/diagnostics"
+	"github.com/hyperdrive/core/apps/runtime/internal/parser"
+	"github.com/hyperdrive/core/apps/runtime/internal/parser/ast"
+)
+
+// expression returns the type of an expression, reporting the problems found in it
+func (c *Checker) expression(expr ast.Expression) typ {
+	switch e := expr.(type) {
+	case nil:
+		return invalid
+	case *ast.Literal:
+		return c.literal(e)
+	case *ast.Variable:
+		_, t, _ := c.lookup(e, e.Name)
+		return t
+	case *ast.BinaryExpr:
+		return c.binary(e)
+	case *ast.UnaryExpr:
+		return c.unary(e)
+	case *ast.CallExpr:
+		return c.checkCall(e, false)
+	case *ast.MemberAccess:
+		return c.member(e)
+	case *ast.ArrayAccess:
+		return c.index(e)
+	case *ast.ArrayLiteral:
+		for _, elem := range e.Elements {
+			c.expression(elem.Value)
+		}
+		return arrayLiteral
+	case *ast.NamedArg:
+		c.errorf(e, diagnostics.CodeSemantic, "named argument %s outside of a call", e.Name)
+		return invalid
+	}
+	c.errorf(expr, diagnostics.CodeSemantic, "unsupported expression %s", expr)
+	return invalid
+}
+
+func (c *Checker) literal(lit *ast.Literal) typ {
+	name := lit.Type.TypeName()
+	switch name {
+	case parser.AnyInt:
+		return anyIntType
+	case parser.AnyReal:
+		return anyRealType
+	}
+	if t, ok := elementaryType(name); ok {
+		return t
+	}
+
+	// Typed enumeration values such as State#Idle
+	t := c.resolve(lit, lit.Type)
+	if t.kind == kindEnum {
+		value, _ := lit.Value.(string)
+		for _, v := range t.decl.(*ast.EnumType).Values {
+			if v.Name == value {
+				return t
+			}
+		}
+		c.errorf(lit, CodeUndefined, "%s has no value %s", t, value)
+		return invalid
+	}
+	if t.kind != kindInvalid {
+		c.errorf(lit, CodeType, "invalid literal of type %s", t)
+	}
+	return invalid
+}
+
+func (c *Checker) binary(e *ast.BinaryExpr) typ {
+	l := c.expression(e.Left)
+	r := c.expression(e.Right)
+	if l.kind == kindInvalid || r.kind == kindInvalid {
+		return invalid
+	}
+
+	switch e.Operator {
+	case "AND", "OR", "XOR":
+		switch {
+		case l.kind == kindBool && r.kind == kindBool:
+			return boolType
+		case isInteger(l) && isInteger(r):
+			return commonNumeric(l, r)
+		}
+	case "=", "<>":
+		if equatable(l, r) {
+			return boolType
+		}
+	case "<", ">", "<=", ">=":
+		if ordered(l, r) {
+			return boolType
+		}
+	case "+", "-", "*", "/":
+		if t, ok := timeArithmetic(e.Operator, l, r); ok {
+			return t
+		}
+		if isNumeric(l) && isNumeric(r) {
+			return commonNumeric(l, r)
+		}
+		// + concatenates strings of the same width
+		if e.Operator == "+" && isString(l) && isString(r) && l.bits == r.bits {
+			return plain(l)
+		}
+	case "MOD":
+		if isInteger(l) && isInteger(r) {
+			return commonNumeric(l, r)
+		}
+	case "**":
+		if isNumeric(l) && isNumeric(r) {
+			return lrealType
+		}
+	}
+
+	c.errorf(e, CodeType, "invalid operands for %s: %s and %s", e.Operator, l, r)
+	return invalid
+}
+
+func (c *Checker) unary(e *ast.UnaryExpr) typ {
+	t := c.expression(e.Operand)
+	if t.kind == kindInvalid {
+		return invalid
+	}
+
+	switch e.Operator {
+	case "NOT":
+		if t.kind == kindBool || isInteger(t) {
+			return plain(t)
+		}
+	case "-", "+":
+		if isNumeric(t) || t.kind == kindTime {
+			return plain(t)
+		}
+	}
+
+	c.errorf(e, CodeType, "invalid operand for %s: %s", e.Operator, t)
+	return invalid
+}
+
+func (c *Checker) member(e *ast.MemberAccess) typ {
+	obj := c.expression(e.Object)
+
+	switch obj.kind {
+	case kindInvalid:
+		return invalid
+	case kindStruct:
+		if field, ok := obj.decl.(*ast.StructType).Field(e.Member); ok {
+			return c.resolve(e, field.Type)
+		}
+	case kindFunctionBlock:
+		for _, v := range obj.fb.Vars {
+			if v.Name == e.Member {
+				return c.resolve(e, v.Type)
+			}
+		}
+	default:
+		c.errorf(e, CodeType, "%s of type %s has no members", e.Object, obj)
+		return invalid
+	}
+
+	c.errorf(e, CodeUndefined, "%s has no member %s", c.describe(obj), e.Member)
+	return invalid
+}
+
+func (c *Checker) index(e *ast.ArrayAccess) typ {
+	obj := c.expression(e.Array)
+	for _, idx := range e.Indices {
+		t := c.expression(idx)
+		if !isInteger(t) && t.kind != kindInvalid {
+			c.errorf(idx, CodeType, "array index must be an integer, got %s", t)
+		}
+	}
+
+	switch obj.kind {
+	case kindInvalid:
+		return invalid
+	case kindArray:
+	default:
+		c.errorf(e, CodeType, "%s of type %s is not an array", e.Array, obj)
+		return invalid
+	}
+
+	arr := obj.decl.(*ast.ArrayType)
+	if len(e.Indices) != len(arr.Dims) {
+		c.errorf(e, CodeType, "%s has %d dimensions, got %d indices", e.Array, len(arr.Dims), len(e.Indices))
+		return c.resolve(e, arr.BaseType)
+	}
+
+	// Constant indices are checked against the bounds here rather than at scan time
+	for i, idx := range e.Indices {
+		dim := arr.Dims[i]
+		if n, ok := constantInt(idx); ok && (n < dim.Start || n > dim.End) {
+			c.errorf(idx, CodeType, "array index %d out of bounds %d..%d", n, dim.Start, dim.End)
+		}
+	}
+
+	return c.resolve(e, arr.BaseType)
+}
+
+// checkCall checks a function call or, in call statements, a function block
+// invocation and returns the type of the result
+func (c *Checker) checkCall(call *ast.CallExpr, statement bool) typ {
+	// Function block instances are invoked through a variable of the current POU
+	if sym, ok := c.scope[call.Function]; ok && sym.typ.kind == kindFunctionBlock {
+		sym.used = true
+		if !statement {
+			c.errorf(call, CodeType, "function block instance %s cannot be called in an expression", call.Function)
+		}
+		c.checkArgs(call, sym.typ.fb)
+		return invalid
+	}
+
+	fn, ok := c.pous[call.Function]
+	if !ok || fn.Type != ast.ProgramFC {
+		if sig, ok := standardFunction(call.Function); ok {
+			return c.checkStandardCall(call, sig)
+		}
+		for _, arg := range call.Args {
+			c.argument(arg)
+		}
+		c.errorf(call, CodeUndefined, "undefined function %s", call.Function)
+		return invalid
+	}
+
+	c.checkArgs(call, fn)
+
+	if fn.ReturnType == nil {
+		if !statement {
+			c.errorf(call, CodeType, "function %s does not return a value", fn.Name)
+		}
+		return invalid
+	}
+	return c.resolve(call, fn.ReturnType)
+}
+
+// checkArgs matches the actual parameters of a call to the inputs and in-out
+// parameters of the POU
+func (c *Checker) checkArgs(call *ast.CallExpr, pou *ast.Program) {
+	inputs := pou.Parameters()
+	connected := make(map[*ast.VarDecl]bool)
+
+	for i, arg := range call.Args {
+		var param *ast.VarDecl
+		value := arg
+		if named, ok := arg.(*ast.NamedArg); ok {
+			value = named.Value
+			for _, in := range inputs {
+				if in.Name == named.Name {
+					param = in
+				}
+			}
+			if param == nil {
+				c.expression(value)
+				c.errorf(arg, CodeUndefined, "%s has no input %s", pou.Name, named.Name)
+				continue
+			}
+		} else {
+			if i >= len(inputs) {
+				c.expression(value)
+				c.errorf(arg, CodeType, "too many arguments in call to %s", pou.Name)
+				continue
+			}
+			param = inputs[i]
+		}
+		connected[param] = true
+
+		if param.Section == ast.VarInOut {
+			c.checkInOut(value, param)
+			continue
+		}
+		c.checkAssignable(value, c.expression(value), c.resolve(param, param.Type))
+	}
+
+	for _, param := range inputs {
+		if param.Section == ast.VarInOut && !connected[param] {
+			c.errorf(call, diagnostics.CodeSemantic, "VAR_IN_OUT parameter %s of %s is not connected", param.Name, pou.Name)
+		}
+	}
+}
+
+// checkInOut checks the variable passed by reference to an in-out parameter,
+// which must have exactly the parameter's type
+func (c *Checker) checkInOut(value ast.Expression, param *ast.VarDecl) {
+	switch value.(type) {
+	case *ast.Variable, *ast.MemberAccess, *ast.ArrayAccess:
+	default:
+		c.expression(value)
+		c.errorf(value, CodeType, "VAR_IN_OUT parameter %s requires a variable", param.Name)
+		return
+	}
+
+	t := c.target(value)
+	want := c.resolve(param, param.Type)
+	if t.name != want.name && t.kind != kindInvalid && want.kind != kindInvalid {
+		c.errorf(value, CodeType, "VAR_IN_OUT parameter %s requires a %s variable, got %s", param.Name, want, t)
+	}
+}
+
+// argument checks an argument of a call to an unknown POU
+func (c *Checker) argument(arg ast.Expression) {
+	if named, ok := arg.(*ast.NamedArg); ok {
+		arg = named.Value
+	}
+	c.expression(arg)
+}
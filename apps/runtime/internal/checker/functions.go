@@ -0,0 +1,231 @@
+package checker
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/hyperdrive/core/apps/runtime/internal/parser/ast"
+	"github.com/hyperdrive/core/apps/runtime/internal/stdlib"
+)
+
+// signature types a call to an overloaded standard function: check validates
+// the argument types and returns the result type, or false if they do not match
+type signature struct {
+	min, max int // Number of arguments; max is -1 for extensible functions
+	check    func(args []typ) (typ, bool)
+}
+
+var (
+	intType    = elementaryTypes["INT"]
+	dintType   = elementaryTypes["DINT"]
+	stringType = elementaryTypes["STRING"]
+)
+
+// standardFunctions lists the IEC 61131-3 standard functions other than the
+// *_TO_* type conversions
+var standardFunctions = map[string]signature{
+	"ABS":   {1, 1, numericFunction},
+	"SQRT":  {1, 1, realFunction},
+	"LN":    {1, 1, realFunction},
+	"LOG":   {1, 1, realFunction},
+	"EXP":   {1, 1, realFunction},
+	"SIN":   {1, 1, realFunction},
+	"COS":   {1, 1, realFunction},
+	"TAN":   {1, 1, realFunction},
+	"ASIN":  {1, 1, realFunction},
+	"ACOS":  {1, 1, realFunction},
+	"ATAN":  {1, 1, realFunction},
+	"EXPT":  {2, 2, expt},
+	"TRUNC": {1, 1, trunc},
+	"SHL":   {2, 2, shift},
+	"SHR":   {2, 2, shift},
+	"ROL":   {2, 2, shift},
+	"ROR":   {2, 2, shift},
+	"MAX":   {2, -1, common},
+	"MIN":   {2, -1, common},
+	"LIMIT": {3, 3, common},
+	"SEL":   {3, 3, sel},
+	"MUX":   {2, -1, mux},
+
+	"LEN":     {1, 1, stringFunction(intType, isString)},
+	"LEFT":    {2, 2, stringFunction(stringType, isString, isInteger)},
+	"RIGHT":   {2, 2, stringFunction(stringType, isString, isInteger)},
+	"MID":     {3, 3, stringFunction(stringType, isString, isInteger, isInteger)},
+	"CONCAT":  {2, -1, concat},
+	"INSERT":  {3, 3, stringFunction(stringType, isString, isString, isInteger)},
+	"DELETE":  {3, 3, stringFunction(stringType, isString, isInteger, isInteger)},
+	"REPLACE": {4, 4, stringFunction(stringType, isString, isString, isInteger, isInteger)},
+	"FIND":    {2, 2, stringFunction(intType, isString, isString)},
+}
+
+// conversionPattern matches the names of type conversion functions such as INT_TO_REAL
+var conversionPattern = regexp.MustCompile(`^([A-Z_]+?)_TO_([A-Z_]+)$`)
+
+// standardFunction returns the signature of a standard function
+func standardFunction(name string) (signature, bool) {
+	name = strings.ToUpper(name)
+	if sig, ok := standardFunctions[name]; ok {
+		return sig, true
+	}
+
+	m := conversionPattern.FindStringSubmatch(name)
+	if m == nil {
+		return signature{}, false
+	}
+	from, ok := elementaryType(m[1])
+	if !ok {
+		return signature{}, false
+	}
+	to, ok := elementaryType(m[2])
+	if !ok {
+		return signature{}, false
+	}
+	return signature{1, 1, func(args []typ) (typ, bool) {
+		return to, convertible(args[0], from) != convNone
+	}}, true
+}
+
+func isString(t typ) bool { return t.kind == kindString }
+
+func numericFunction(args []typ) (typ, bool) {
+	return plain(args[0]), isNumeric(args[0])
+}
+
+// realFunction types the functions on ANY_REAL; integer arguments give an LREAL
+func realFunction(args []typ) (typ, bool) {
+	switch {
+	case args[0].kind == kindReal:
+		return args[0], true
+	case isNumeric(args[0]):
+		return lrealType, true
+	}
+	return invalid, false
+}
+
+func expt(args []typ) (typ, bool) {
+	result, ok := realFunction(args[:1])
+	return result, ok && isNumeric(args[1])
+}
+
+func trunc(args []typ) (typ, bool) {
+	return dintType, isReal(args[0])
+}
+
+func shift(args []typ) (typ, bool) {
+	return plain(args[0]), isInteger(args[0]) && isInteger(args[1])
+}
+
+// common types MAX, MIN and LIMIT, whose arguments and result share a type
+func common(args []typ) (typ, bool) {
+	result := args[0]
+	for _, arg := range args[1:] {
+		switch {
+		case isNumeric(result) && isNumeric(arg):
+			result = commonNumeric(result, arg)
+		case !ordered(result, arg):
+			return invalid, false
+		}
+	}
+	return plain(result), true
+}
+
+func sel(args []typ) (typ, bool) {
+	if args[0].kind != kindBool {
+		return invalid, false
+	}
+	return selected(args[1:])
+}
+
+func mux(args []typ) (typ, bool) {
+	if !isInteger(args[0]) {
+		return invalid, false
+	}
+	return selected(args[1:])
+}
+
+// selected types the inputs SEL and MUX choose between, which must be alike
+func selected(inputs []typ) (typ, bool) {
+	result := inputs[0]
+	for _, in := range inputs[1:] {
+		switch {
+		case isNumeric(result) && isNumeric(in):
+			result = commonNumeric(result, in)
+		case convertible(in, result) == convNone:
+			return invalid, false
+		}
+	}
+	return plain(result), true
+}
+
+func concat(args []typ) (typ, bool) {
+	for _, arg := range args {
+		if !isString(arg) {
+			return invalid, false
+		}
+	}
+	return plain(args[0]), true
+}
+
+// stringFunction types a string function with fixed parameter categories
+func stringFunction(result typ, params ...func(typ) bool) func(args []typ) (typ, bool) {
+	return func(args []typ) (typ, bool) {
+		for i, arg := range args {
+			if !params[i](arg) {
+				return invalid, false
+			}
+		}
+		// Functions returning a string keep the width of their first argument
+		if result.kind == kindString {
+			return plain(args[0]), true
+		}
+		return result, true
+	}
+}
+
+// checkStandardCall checks a call to a standard function and returns its result type
+func (c *Checker) checkStandardCall(call *ast.CallExpr, sig signature) typ {
+	names := make([]string, len(call.Args))
+	for i, arg := range call.Args {
+		if named, ok := arg.(*ast.NamedArg); ok {
+			names[i] = named.Name
+		}
+	}
+	positions, err := stdlib.Positions(call.Function, names)
+	if err != nil {
+		c.errorf(call, CodeType, "%v", err)
+		return invalid
+	}
+
+	// Arguments are typed in the order of the function's inputs
+	args := make([]typ, len(call.Args))
+	valid := true
+	for i, arg := range call.Args {
+		if named, ok := arg.(*ast.NamedArg); ok {
+			arg = named.Value
+		}
+		pos := positions[i]
+		args[pos] = c.expression(arg)
+		if args[pos].kind == kindInvalid {
+			valid = false
+		}
+	}
+
+	if len(args) < sig.min || (sig.max >= 0 && len(args) > sig.max) {
+		c.errorf(call, CodeType, "wrong number of arguments in call to %s: %d", call.Function, len(args))
+		return invalid
+	}
+	if !valid {
+		return invalid
+	}
+
+	result, ok := sig.check(args)
+	if !ok {
+		names := make([]string, len(args))
+		for i, arg := range args {
+			names[i] = arg.String()
+		}
+		c.errorf(call, CodeType, "invalid arguments for %s: %s", call.Function, strings.Join(names, ", "))
+		return invalid
+	}
+	return result
+}
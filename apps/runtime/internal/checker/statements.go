@@ -0,0 +1,183 @@
+package checker
+
+import (
+	"github.com/hyperdrive/core/apps/runtime/internal/diagnostics"
+	"github.com/hyperdrive/core/apps/runtime/internal/parser/ast"
+)
+
+// checkStatements checks a statement list and reports the first statement
+// following an unconditional EXIT, CONTINUE or RETURN as unreachable
+func (c *Checker) checkStatements(stmts []ast.Statement) {
+	for i, stmt := range stmts {
+		c.checkStatement(stmt)
+
+		switch stmt.(type) {
+		case *ast.ExitStatement, *ast.ContinueStatement, *ast.ReturnStatement:
+			if i+1 < len(stmts) {
+				c.warnf(stmts[i+1], CodeUnreachable, "unreachable code after %s", stmt)
+			}
+			// Keep checking the unreachable statements for errors
+			for _, rest := range stmts[i+1:] {
+				c.checkStatement(rest)
+			}
+			return
+		}
+	}
+}
+
+func (c *Checker) checkStatement(stmt ast.Statement) {
+	switch s := stmt.(type) {
+	case *ast.Assignment:
+		c.checkAssignment(s)
+	case *ast.IfStatement:
+		c.checkCondition(s.Condition, "IF")
+		c.checkStatements(s.Then)
+		for _, elseif := range s.ElseIf {
+			c.checkCondition(elseif.Condition, "ELSIF")
+			c.checkStatements(elseif.Then)
+		}
+		c.checkStatements(s.Else)
+	case *ast.CaseStatement:
+		c.checkCase(s)
+	case *ast.WhileStatement:
+		c.checkCondition(s.Condition, "WHILE")
+		c.checkLoopBody(s.Body)
+	case *ast.RepeatStatement:
+		c.checkLoopBody(s.Body)
+		c.checkCondition(s.Condition, "REPEAT")
+	case *ast.ForStatement:
+		c.checkFor(s)
+	case *ast.ExitStatement:
+		if c.loops == 0 {
+			c.errorf(s, diagnostics.CodeSemantic, "EXIT outside of loop")
+		}
+	case *ast.ContinueStatement:
+		if c.loops == 0 {
+			c.errorf(s, diagnostics.CodeSemantic, "CONTINUE outside of loop")
+		}
+	case *ast.ReturnStatement:
+	}
+}
+
+func (c *Checker) checkLoopBody(body []ast.Statement) {
+	c.loops++
+	c.checkStatements(body)
+	c.loops--
+}
+
+func (c *Checker) checkAssignment(s *ast.Assignment) {
+	// Call statements are assignments without a target
+	if s.Variable == nil {
+		call, ok := s.Value.(*ast.CallExpr)
+		if !ok {
+			c.errorf(s, diagnostics.CodeSemantic, "expression %s is not a statement", s.Value)
+			return
+		}
+		c.checkCall(call, true)
+		return
+	}
+
+	target := c.target(s.Variable)
+	if target.kind == kindFunctionBlock {
+		c.errorf(s, CodeType, "cannot assign to %s", c.describe(target))
+		return
+	}
+	if lit, ok := s.Value.(*ast.ArrayLiteral); ok && target.kind == kindArray {
+		c.checkArrayLiteral(lit, target)
+		return
+	}
+	c.checkAssignable(s.Value, c.expression(s.Value), target)
+}
+
+// target returns the type of the variable an assignment writes
+func (c *Checker) target(expr ast.Expression) typ {
+	switch e := expr.(type) {
+	case *ast.Variable:
+		sym, t, ok := c.lookup(e, e.Name)
+		if ok && sym == nil {
+			c.errorf(e, CodeType, "cannot assign to enumeration value %s", e.Name)
+			return invalid
+		}
+		c.checkWritable(e)
+		return t
+	case *ast.MemberAccess, *ast.ArrayAccess:
+		t := c.expression(e)
+		c.checkWritable(e)
+		return t
+	}
+	c.errorf(expr, CodeType, "cannot assign to %s", expr)
+	return invalid
+}
+
+// checkWritable reports writes to a constant or to a member or element of one
+func (c *Checker) checkWritable(expr ast.Expression) {
+	switch e := expr.(type) {
+	case *ast.Variable:
+		if sym, ok := c.scope[e.Name]; ok && c.constant(sym.decl) {
+			c.errorf(e, diagnostics.CodeSemantic, "cannot assign to constant %s", e.Name)
+		}
+	case *ast.MemberAccess:
+		c.checkWritable(e.Object)
+	case *ast.ArrayAccess:
+		c.checkWritable(e.Array)
+	}
+}
+
+// constant reports whether a variable is write-protected, either by its own
+// declaration or by that of the global variable it refers to
+func (c *Checker) constant(decl *ast.VarDecl) bool {
+	if decl.Section == ast.VarExternal {
+		if global, ok := c.globals[decl.Name]; ok && global.Constant {
+			return true
+		}
+	}
+	return decl.Constant
+}
+
+// checkCondition reports conditions of IF, ELSIF, WHILE and REPEAT that are not BOOL
+func (c *Checker) checkCondition(expr ast.Expression, construct string) {
+	t := c.expression(expr)
+	if t.kind != kindBool && t.kind != kindInvalid {
+		c.errorf(expr, CodeType, "%s condition must be BOOL, got %s", construct, t)
+	}
+}
+
+func (c *Checker) checkCase(s *ast.CaseStatement) {
+	selector := c.expression(s.Selector)
+	if !isInteger(selector) && selector.kind != kindEnum && selector.kind != kindInvalid {
+		c.errorf(s.Selector, CodeType, "CASE selector must be an integer or enumeration, got %s", selector)
+		selector = invalid
+	}
+
+	for _, branch := range s.Branches {
+		for _, label := range branch.Labels {
+			c.checkAssignable(label.Low, c.expression(label.Low), plain(selector))
+			if label.High != nil {
+				c.checkAssignable(label.High, c.expression(label.High), plain(selector))
+			}
+		}
+		c.checkStatements(branch.Body)
+	}
+	c.checkStatements(s.Else)
+}
+
+func (c *Checker) checkFor(s *ast.ForStatement) {
+	counter := invalid
+	if sym, t, ok := c.lookup(s, s.Variable); ok {
+		counter = t
+		if sym == nil || !isInteger(t) {
+			c.errorf(s, CodeType, "FOR control variable %s must be an integer variable, got %s", s.Variable, t)
+			counter = invalid
+		} else if c.constant(sym.decl) {
+			c.errorf(s, diagnostics.CodeSemantic, "cannot assign to constant %s", s.Variable)
+		}
+	}
+
+	c.checkAssignable(s.From, c.expression(s.From), counter)
+	c.checkAssignable(s.To, c.expression(s.To), plain(counter))
+	if s.By != nil {
+		c.checkAssignable(s.By, c.expression(s.By), plain(counter))
+	}
+
+	c.checkLoopBody(s.Body)
+}
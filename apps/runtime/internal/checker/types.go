@@ -0,0 +1,303 @@
+package checker
+
+import (
+	"math"
+	"strings"
+
+	"github.com/hyperdrive/core/apps/runtime/internal/parser"
+	"github.com/hyperdrive/core/apps/runtime/internal/parser/ast"
+)
+
+// kind groups types by the operations and conversions they allow
+type kind int
+
+const (
+	kindInvalid kind = iota // unknown or erroneous; suppresses follow-up errors
+	kindBool
+	kindSigned
+	kindUnsigned
+	kindBits
+	kindReal
+	kindTime
+	kindTOD
+	kindDate
+	kindDT
+	kindString
+	kindAnyInt  // untyped integer literal, adopts the type it is used with
+	kindAnyReal // untyped real literal
+	kindEnum
+	kindStruct
+	kindArray
+	kindArrayLiteral
+	kindFunctionBlock
+)
+
+// typ is the checker's view of a data type
+type typ struct {
+	kind kind
+	name string
+	bits int
+
+	// Bounds of subrange types
+	ranged    bool
+	low, high int
+
+	length int // Maximum length of STRING[n] and WSTRING[n]; 0 if unlimited
+
+	decl ast.DataType // Declaration of enum, struct and array types
+	fb   *ast.Program // Declaration of function block types
+}
+
+func (t typ) String() string { return t.name }
+
+var (
+	invalid      = typ{kind: kindInvalid, name: "invalid"}
+	boolType     = typ{kind: kindBool, name: "BOOL", bits: 1}
+	anyIntType   = typ{kind: kindAnyInt, name: parser.AnyInt}
+	anyRealType  = typ{kind: kindAnyReal, name: parser.AnyReal}
+	lrealType    = typ{kind: kindReal, name: "LREAL", bits: 64}
+	timeType     = typ{kind: kindTime, name: "TIME", bits: 64}
+	arrayLiteral = typ{kind: kindArrayLiteral, name: "array initializer"}
+)
+
+// elementaryTypes maps the IEC names of the elementary types to their checker type
+var elementaryTypes = map[string]typ{
+	"BOOL":          boolType,
+	"SINT":          {kind: kindSigned, name: "SINT", bits: 8},
+	"INT":           {kind: kindSigned, name: "INT", bits: 16},
+	"DINT":          {kind: kindSigned, name: "DINT", bits: 32},
+	"LINT":          {kind: kindSigned, name: "LINT", bits: 64},
+	"USINT":         {kind: kindUnsigned, name: "USINT", bits: 8},
+	"UINT":          {kind: kindUnsigned, name: "UINT", bits: 16},
+	"UDINT":         {kind: kindUnsigned, name: "UDINT", bits: 32},
+	"ULINT":         {kind: kindUnsigned, name: "ULINT", bits: 64},
+	"BYTE":          {kind: kindBits, name: "BYTE", bits: 8},
+	"WORD":          {kind: kindBits, name: "WORD", bits: 16},
+	"DWORD":         {kind: kindBits, name: "DWORD", bits: 32},
+	"LWORD":         {kind: kindBits, name: "LWORD", bits: 64},
+	"REAL":          {kind: kindReal, name: "REAL", bits: 32},
+	"LREAL":         lrealType,
+	"TIME":          timeType,
+	"LTIME":         {kind: kindTime, name: "LTIME", bits: 64},
+	"DATE":          {kind: kindDate, name: "DATE", bits: 64},
+	"TOD":           {kind: kindTOD, name: "TOD", bits: 64},
+	"TIME_OF_DAY":   {kind: kindTOD, name: "TOD", bits: 64},
+	"DT":            {kind: kindDT, name: "DT", bits: 64},
+	"DATE_AND_TIME": {kind: kindDT, name: "DT", bits: 64},
+	"STRING":        {kind: kindString, name: "STRING", bits: 8},
+	"WSTRING":       {kind: kindString, name: "WSTRING", bits: 16},
+}
+
+func elementaryType(name string) (typ, bool) {
+	t, ok := elementaryTypes[strings.ToUpper(name)]
+	return t, ok
+}
+
+func isInteger(t typ) bool {
+	switch t.kind {
+	case kindSigned, kindUnsigned, kindBits, kindAnyInt:
+		return true
+	}
+	return false
+}
+
+func isReal(t typ) bool {
+	return t.kind == kindReal || t.kind == kindAnyReal
+}
+
+func isNumeric(t typ) bool {
+	return isInteger(t) || isReal(t)
+}
+
+// conversion tells whether a value may be assigned to a variable of another type
+type conversion int
+
+const (
+	convNone      conversion = iota // Requires an explicit *_TO_* conversion
+	convImplicit                    // Converts without losing information
+	convNarrowing                   // Accepted, but may lose information or change the sign
+)
+
+// convertible applies the IEC 61131-3 implicit conversion rules. Conversions
+// the runtime performs by wrapping or rounding (DINT to INT, LREAL to REAL)
+// are narrowing rather than forbidden, so they are reported as warnings.
+func convertible(from, to typ) conversion {
+	if from.kind == kindInvalid || to.kind == kindInvalid {
+		return convImplicit
+	}
+
+	switch to.kind {
+	case kindSigned, kindUnsigned, kindBits:
+		switch {
+		case from.kind == kindAnyInt:
+			return convImplicit
+		case !isInteger(from):
+			return convNone
+		case from.kind == to.kind && from.bits <= to.bits:
+			return convImplicit
+		case from.kind == kindUnsigned && to.kind == kindSigned && from.bits < to.bits:
+			return convImplicit
+		}
+		return convNarrowing
+	case kindReal:
+		switch {
+		case from.kind == kindAnyInt || from.kind == kindAnyReal:
+			return convImplicit
+		case from.kind == kindReal:
+			if from.bits <= to.bits {
+				return convImplicit
+			}
+			return convNarrowing
+		case isInteger(from):
+			// REAL holds 16 bit integers exactly and LREAL 32 bit ones
+			if from.bits <= to.bits/2 {
+				return convImplicit
+			}
+			return convNarrowing
+		}
+		return convNone
+	case kindString:
+		if from.kind != kindString {
+			return convNone
+		}
+		if from.bits <= to.bits {
+			return convImplicit
+		}
+		return convNarrowing
+	case kindEnum, kindStruct:
+		if from.kind == to.kind && from.decl == to.decl {
+			return convImplicit
+		}
+		return convNone
+	case kindArray:
+		if from.kind == kindArrayLiteral || (from.kind == kindArray && from.name == to.name) {
+			return convImplicit
+		}
+		return convNone
+	case kindFunctionBlock:
+		return convNone
+	}
+
+	if from.kind == to.kind {
+		return convImplicit
+	}
+	return convNone
+}
+
+// commonNumeric returns the type arithmetic on two numeric operands yields:
+// REAL types win over integers, otherwise the wider operand type. Untyped
+// literals adopt the type of the other operand.
+func commonNumeric(l, r typ) typ {
+	switch {
+	case l.kind == kindAnyInt:
+		return plain(r)
+	case r.kind == kindAnyInt:
+		return plain(l)
+	case l.kind == kindAnyReal:
+		if r.kind == kindReal {
+			return r
+		}
+		return l
+	case r.kind == kindAnyReal:
+		if l.kind == kindReal {
+			return l
+		}
+		return r
+	case isReal(l) != isReal(r):
+		if isReal(l) {
+			return l
+		}
+		return r
+	case r.bits > l.bits:
+		return plain(r)
+	default:
+		return plain(l)
+	}
+}
+
+// bounds returns the values an integer type can hold
+func bounds(t typ) (low, high int, ok bool) {
+	switch {
+	case t.ranged:
+		return t.low, t.high, true
+	case t.kind == kindSigned && t.bits < 64:
+		return -1 << (t.bits - 1), 1<<(t.bits-1) - 1, true
+	case (t.kind == kindUnsigned || t.kind == kindBits) && t.bits < 64:
+		return 0, 1<<t.bits - 1, true
+	case t.kind == kindUnsigned || t.kind == kindBits:
+		return 0, math.MaxInt, true
+	}
+	return 0, 0, false
+}
+
+// plain drops the bounds of a subrange type and the length of a string type,
+// as the results of operations are not range checked
+func plain(t typ) typ {
+	if !t.ranged && t.length == 0 {
+		return t
+	}
+	for _, e := range elementaryTypes {
+		if e.kind == t.kind && e.bits == t.bits {
+			return e
+		}
+	}
+	return t
+}
+
+// equatable reports whether values of two types can be tested for equality
+func equatable(l, r typ) bool {
+	switch {
+	case l.kind == kindInvalid || r.kind == kindInvalid:
+		return true
+	case isNumeric(l) && isNumeric(r):
+		return true
+	case l.kind == kindEnum || r.kind == kindEnum:
+		return l.kind == r.kind && l.decl == r.decl
+	}
+	return l.kind == r.kind && l.kind != kindStruct && l.kind != kindArray && l.kind != kindFunctionBlock
+}
+
+// ordered reports whether values of two types can be compared with < and >
+func ordered(l, r typ) bool {
+	switch {
+	case l.kind == kindInvalid || r.kind == kindInvalid:
+		return true
+	case isNumeric(l) && isNumeric(r):
+		return true
+	case isString(l) && isString(r):
+		// Strings of the same width compare character by character
+		return l.bits == r.bits
+	}
+	switch l.kind {
+	case kindTime, kindTOD, kindDate, kindDT:
+		return l.kind == r.kind
+	}
+	return false
+}
+
+// timeArithmetic returns the result type of +, -, * and / on TIME, TOD, DATE and DT operands
+func timeArithmetic(op string, l, r typ) (typ, bool) {
+	switch op {
+	case "+":
+		if r.kind == kindTime {
+			switch l.kind {
+			case kindTime, kindTOD, kindDT:
+				return l, true
+			}
+		}
+	case "-":
+		switch {
+		case l.kind == kindTime && r.kind == kindTime:
+			return l, true
+		case (l.kind == kindTOD || l.kind == kindDT) && r.kind == kindTime:
+			return l, true
+		case l.kind == r.kind && (l.kind == kindTOD || l.kind == kindDate || l.kind == kindDT):
+			return timeType, true
+		}
+	case "*", "/":
+		if l.kind == kindTime && isNumeric(r) {
+			return l, true
+		}
+	}
+	return invalid, false
+}
@@ -69,15 +69,25 @@ func (db *DB) initialize(ctx context.Context) error {
 			time TIMESTAMPTZ NOT NULL,
 			tag_id INTEGER NOT NULL,
 			value_bool BOOLEAN,
-			value_int INTEGER,
+			value_int BIGINT,
 			value_float DOUBLE PRECISION,
 			value_string TEXT,
+			value_time TIMESTAMPTZ,
 			quality SMALLINT NOT NULL,
 			FOREIGN KEY (tag_id) REFERENCES tags(id)
 		)`); err != nil {
 		return fmt.Errorf("error creating tag_values table: %w", err)
 	}
 
+	// Upgrade tables created before 64-bit integers and DATE/DT values were stored
+	if _, err := db.pool.Exec(ctx, `
+		ALTER TABLE tag_values
+			ALTER COLUMN value_int TYPE BIGINT,
+			ADD COLUMN IF NOT EXISTS value_time TIMESTAMPTZ
+	`); err != nil {
+		return fmt.Errorf("error upgrading tag_values table: %w", err)
+	}
+
 	// Convert to hypertable if not already
 	if _, err := db.pool.Exec(ctx, `
 		SELECT create_hypertable('tag_values', 'time', if_not_exists => TRUE)
@@ -94,25 +104,57 @@ func (db *DB) Close() {
 	}
 }
 
-// InsertTagValue inserts a new value for a tag
+// InsertTagValue inserts a new value for a tag. Integers of every width are
+// stored in value_int; ULINT and LWORD values are stored as their two's
+// complement bit pattern, so the tag's data_type is needed to read them back.
+// Durations are stored as nanoseconds in value_int and times in value_time;
+// callers pass TIME, LTIME and TOD values as time.Duration and DATE and DT
+// values as time.Time.
 func (db *DB) InsertTagValue(ctx context.Context, tagID int, timestamp time.Time, value interface{}, quality int16) error {
 	query := `
-		INSERT INTO tag_values (time, tag_id, value_bool, value_int, value_float, value_string, quality)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		INSERT INTO tag_values (time, tag_id, value_bool, value_int, value_float, value_string, value_time, quality)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
 	`
 
 	var valueBool *bool
-	var valueInt *int
+	var valueInt *int64
 	var valueFloat *float64
 	var valueString *string
+	var valueTime *time.Time
+
+	setInt := func(n int64) { valueInt = &n }
+	setFloat := func(f float64) { valueFloat = &f }
+	setTime := func(t time.Time) { valueTime = &t }
 
 	switch v := value.(type) {
 	case bool:
 		valueBool = &v
 	case int:
-		valueInt = &v
+		setInt(int64(v))
+	case int8:
+		setInt(int64(v))
+	case int16:
+		setInt(int64(v))
+	case int32:
+		setInt(int64(v))
+	case int64:
+		setInt(v)
+	case uint8:
+		setInt(int64(v))
+	case uint16:
+		setInt(int64(v))
+	case uint32:
+		setInt(int64(v))
+	case uint64:
+		setInt(int64(v))
+	case float32:
+		setFloat(float64(v))
 	case float64:
-		valueFloat = &v
+		setFloat(v)
+	case time.Duration:
+		setInt(int64(v))
+	case time.Time:
+		setTime(v)
 	case string:
 		valueString = &v
 	default:
@@ -126,6 +168,7 @@ func (db *DB) InsertTagValue(ctx context.Context, tagID int, timestamp time.Time
 		valueInt,
 		valueFloat,
 		valueString,
+		valueTime,
 		quality,
 	)
 	return err
@@ -135,10 +178,11 @@ func (db *DB) InsertTagValue(ctx context.Context, tagID int, timestamp time.Time
 func (db *DB) GetTagValues(ctx context.Context, tagID int, start, end time.Time) (pgx.Rows, error) {
 	query := `
 		SELECT time,
-			COALESCE(value_bool, value_int::bool, value_float::bool) as bool_value,
+			COALESCE(value_bool, value_int <> 0, value_float <> 0) as bool_value,
 			COALESCE(value_int, value_float::int) as int_value,
 			COALESCE(value_float, value_int::float8) as float_value,
 			value_string,
+			value_time,
 			quality
 		FROM tag_values
 		WHERE tag_id = $1 AND time BETWEEN $2 AND $3
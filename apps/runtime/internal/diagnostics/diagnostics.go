@@ -0,0 +1,117 @@
+// Package diagnostics describes problems found in IEC 61131-3 sources by
+// their location, so editors can underline them
+package diagnostics
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/hyperdrive/core/apps/runtime/internal/parser/ast"
+)
+
+// Severity tells how serious a diagnostic is
+type Severity string
+
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+	SeverityInfo    Severity = "info"
+)
+
+// Codes identifying the stage that reported a diagnostic
+const (
+	CodeSyntax   = "syntax"
+	CodeSemantic = "semantic"
+	CodeRuntime  = "runtime"
+)
+
+// Diagnostic is a single problem reported at a position in a source file
+type Diagnostic struct {
+	File     string   `json:"file"`
+	Line     int      `json:"line"`
+	Column   int      `json:"column"`
+	Severity Severity `json:"severity"`
+	Code     string   `json:"code"`
+	Message  string   `json:"message"`
+
+	err error
+}
+
+// New creates a diagnostic at pos
+func New(pos ast.Position, severity Severity, code, format string, args ...interface{}) *Diagnostic {
+	return &Diagnostic{
+		File:     pos.File,
+		Line:     pos.Line,
+		Column:   pos.Column,
+		Severity: severity,
+		Code:     code,
+		Message:  fmt.Sprintf(format, args...),
+	}
+}
+
+// Wrap attaches the position pos to err. Errors that already carry a
+// diagnostic keep it, so the innermost position is the one reported.
+func Wrap(err error, pos ast.Position, code string) error {
+	if err == nil {
+		return nil
+	}
+	var d *Diagnostic
+	if errors.As(err, &d) {
+		return err
+	}
+	d = New(pos, SeverityError, code, "%s", err.Error())
+	d.err = err
+	return d
+}
+
+// Position returns where the diagnostic was reported
+func (d *Diagnostic) Position() ast.Position {
+	return ast.Position{File: d.File, Line: d.Line, Column: d.Column}
+}
+
+// Error formats the diagnostic as file:line:column: message, leaving out the
+// parts that are unknown
+func (d *Diagnostic) Error() string {
+	if d.Line == 0 {
+		if d.File == "" {
+			return d.Message
+		}
+		return fmt.Sprintf("%s: %s", d.File, d.Message)
+	}
+	return fmt.Sprintf("%s: %s", d.Position(), d.Message)
+}
+
+// Unwrap returns the error the diagnostic was created from
+func (d *Diagnostic) Unwrap() error {
+	return d.err
+}
+
+// List is a set of diagnostics reported for one or more files
+type List []*Diagnostic
+
+// HasErrors reports whether any diagnostic in the list is an error
+func (l List) HasErrors() bool {
+	for _, d := range l {
+		if d.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// FromError converts err into a diagnostic. Errors without a position are
+// reported at the start of file with the given code.
+func FromError(err error, file, code string) *Diagnostic {
+	var d *Diagnostic
+	if errors.As(err, &d) {
+		if d.File == "" {
+			copied := *d
+			copied.File = file
+			return &copied
+		}
+		return d
+	}
+	d = New(ast.Position{File: file}, SeverityError, code, "%s", err.Error())
+	d.err = err
+	return d
+}
@@ -2,6 +2,7 @@ package ast
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 )
 
@@ -13,22 +14,116 @@ type Node interface {
 
 // Position represents a position in the source code
 type Position struct {
+	File   string
 	Line   int
 	Column int
 }
 
+func (p Position) String() string {
+	if p.File == "" {
+		return fmt.Sprintf("%d:%d", p.Line, p.Column)
+	}
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Column)
+}
+
+// CompilationUnit represents every POU and type declared in a single source file
+type CompilationUnit struct {
+	position Position
+	Types    []*TypeDecl
+	Globals  []*VarDecl // VAR_GLOBAL sections declared outside a POU
+	POUs     []*Program
+	Messages []*Message // Compiler messages requested by {info} pragmas
+}
+
+func (u *CompilationUnit) String() string           { return fmt.Sprintf("%d POUs", len(u.POUs)) }
+func (u *CompilationUnit) Position() Position       { return u.position }
+func (u *CompilationUnit) SetPosition(pos Position) { u.position = pos }
+
+// Lookup returns the POU with the given name
+func (u *CompilationUnit) Lookup(name string) (*Program, bool) {
+	for _, pou := range u.POUs {
+		if pou.Name == name {
+			return pou, true
+		}
+	}
+	return nil, false
+}
+
+// LookupType returns the type declared under the given name
+func (u *CompilationUnit) LookupType(name string) (*TypeDecl, bool) {
+	for _, decl := range u.Types {
+		if decl.Name == name {
+			return decl, true
+		}
+	}
+	return nil, false
+}
+
+// MainProgram returns the PROGRAM named Main, or the first PROGRAM in the unit
+func (u *CompilationUnit) MainProgram() (*Program, bool) {
+	var first *Program
+	for _, pou := range u.POUs {
+		if pou.Type != ProgramPRG {
+			continue
+		}
+		if pou.Name == "Main" {
+			return pou, true
+		}
+		if first == nil {
+			first = pou
+		}
+	}
+	return first, first != nil
+}
+
+// Message is the text of an {info '...'} pragma, reported when the unit is compiled
+type Message struct {
+	position Position
+	Text     string
+}
+
+func (m *Message) String() string           { return m.Text }
+func (m *Message) Position() Position       { return m.position }
+func (m *Message) SetPosition(pos Position) { m.position = pos }
+
 // Program represents a complete IEC 61131-3 program
 type Program struct {
-	position Position
-	Name     string
-	Type     ProgramType
-	Vars     []*VarDecl
-	Body     []Statement
-	Comments []string
+	position   Position
+	Name       string
+	Type       ProgramType
+	ReturnType DataType // Only set for FUNCTION POUs
+	Vars       []*VarDecl
+	Body       []Statement
+	Comments   []string          // Comments preceding or inside the POU that are not attached to a variable
+	Attributes map[string]string // {attribute 'name' := 'value'} pragmas preceding the POU
 }
 
-func (p *Program) String() string     { return p.Name }
-func (p *Program) Position() Position { return p.position }
+func (p *Program) String() string           { return p.Name }
+func (p *Program) Position() Position       { return p.position }
+func (p *Program) SetPosition(pos Position) { p.position = pos }
+
+// VarsIn returns the variables declared in the given section
+func (p *Program) VarsIn(section VarSection) []*VarDecl {
+	var result []*VarDecl
+	for _, v := range p.Vars {
+		if v.Section == section {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// Parameters returns the VAR_INPUT and VAR_IN_OUT variables in declaration
+// order, which is the order of positional arguments in a call
+func (p *Program) Parameters() []*VarDecl {
+	var result []*VarDecl
+	for _, v := range p.Vars {
+		if v.Section == VarInput || v.Section == VarInOut {
+			result = append(result, v)
+		}
+	}
+	return result
+}
 
 type ProgramType string
 
@@ -38,17 +133,75 @@ const (
 	ProgramPRG ProgramType = "PROGRAM"
 )
 
+// VarSection identifies the VAR block a variable was declared in
+type VarSection string
+
+const (
+	VarLocal    VarSection = "VAR"
+	VarInput    VarSection = "VAR_INPUT"
+	VarOutput   VarSection = "VAR_OUTPUT"
+	VarInOut    VarSection = "VAR_IN_OUT"   // Passed by reference
+	VarGlobal   VarSection = "VAR_GLOBAL"   // Shared by every deployed program
+	VarExternal VarSection = "VAR_EXTERNAL" // Refers to a VAR_GLOBAL
+	VarTemp     VarSection = "VAR_TEMP"     // Re-initialized on every call
+)
+
+// Retention says whether a variable keeps its value when the runtime restarts
+type Retention string
+
+const (
+	NonRetain  Retention = ""
+	Retain     Retention = "RETAIN"     // Restored after a restart of the runtime
+	Persistent Retention = "PERSISTENT" // Also restored when the program is deployed again
+)
+
 // VarDecl represents a variable declaration
 type VarDecl struct {
-	position Position
-	Name     string
-	Type     DataType
-	InitExpr Expression
-	Comment  string
+	position   Position
+	Name       string
+	Type       DataType
+	Section    VarSection
+	Constant   bool // Declared in a CONSTANT section and never written after initialization
+	Retention  Retention
+	Location   *Location // Direct address given with AT; nil for unlocated variables
+	InitExpr   Expression
+	Comment    string            // Comment preceding or following the declaration
+	Attributes map[string]string // {attribute 'name' := 'value'} pragmas preceding the declaration
+}
+
+func (v *VarDecl) String() string           { return v.Name }
+func (v *VarDecl) Position() Position       { return v.position }
+func (v *VarDecl) SetPosition(pos Position) { v.position = pos }
+
+// Location is the direct address of a located variable such as %IX0.0 or %QW4
+type Location struct {
+	Area  byte  // 'I' input, 'Q' output or 'M' memory
+	Size  byte  // 'X' bit, 'B' byte, 'W' word, 'D' double word or 'L' long word
+	Index []int // Address fields separated by dots
+}
+
+func (l *Location) String() string {
+	fields := make([]string, len(l.Index))
+	for i, n := range l.Index {
+		fields[i] = strconv.Itoa(n)
+	}
+	return "%" + string(l.Area) + string(l.Size) + strings.Join(fields, ".")
 }
 
-func (v *VarDecl) String() string     { return v.Name }
-func (v *VarDecl) Position() Position { return v.position }
+// Bits returns the number of bits the size prefix addresses
+func (l *Location) Bits() int {
+	switch l.Size {
+	case 'B':
+		return 8
+	case 'W':
+		return 16
+	case 'D':
+		return 32
+	case 'L':
+		return 64
+	}
+	return 1
+}
 
 // DataType represents an IEC 61131-3 data type
 type DataType interface {
@@ -56,14 +209,121 @@ type DataType interface {
 	TypeName() string
 }
 
+// TypeDecl represents a named type declared in a TYPE ... END_TYPE block
+type TypeDecl struct {
+	position Position
+	Name     string
+	Type     DataType
+	InitExpr Expression
+}
+
+func (d *TypeDecl) String() string           { return d.Name }
+func (d *TypeDecl) Position() Position       { return d.position }
+func (d *TypeDecl) SetPosition(pos Position) { d.position = pos }
+
+// StructType represents a STRUCT ... END_STRUCT type
+type StructType struct {
+	position Position
+	Name     string // Empty for anonymous structs declared inline
+	Fields   []*VarDecl
+}
+
+func (t *StructType) String() string           { return t.TypeName() }
+func (t *StructType) Position() Position       { return t.position }
+func (t *StructType) SetPosition(pos Position) { t.position = pos }
+func (t *StructType) TypeName() string {
+	if t.Name == "" {
+		return "STRUCT"
+	}
+	return t.Name
+}
+
+// Field returns the declaration of the named field
+func (t *StructType) Field(name string) (*VarDecl, bool) {
+	for _, f := range t.Fields {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return nil, false
+}
+
+// EnumType represents an enumeration such as (Idle, Running, Fault)
+type EnumType struct {
+	position Position
+	Name     string // Empty for anonymous enumerations declared inline
+	Values   []*EnumValue
+}
+
+func (t *EnumType) String() string           { return t.TypeName() }
+func (t *EnumType) Position() Position       { return t.position }
+func (t *EnumType) SetPosition(pos Position) { t.position = pos }
+func (t *EnumType) TypeName() string {
+	if t.Name != "" {
+		return t.Name
+	}
+	names := make([]string, len(t.Values))
+	for i, v := range t.Values {
+		names[i] = v.Name
+	}
+	return "(" + strings.Join(names, ", ") + ")"
+}
+
+// EnumValue represents a single named value of an enumeration
+type EnumValue struct {
+	position Position
+	Name     string
+	Value    int
+}
+
+func (v *EnumValue) Position() Position       { return v.position }
+func (v *EnumValue) SetPosition(pos Position) { v.position = pos }
+
+// SubrangeType represents an integer type restricted to Low..High
+type SubrangeType struct {
+	position Position
+	Name     string // Empty for anonymous subranges declared inline
+	Base     DataType
+	Low      int
+	High     int
+}
+
+func (t *SubrangeType) String() string           { return t.TypeName() }
+func (t *SubrangeType) Position() Position       { return t.position }
+func (t *SubrangeType) SetPosition(pos Position) { t.position = pos }
+func (t *SubrangeType) TypeName() string {
+	if t.Name != "" {
+		return t.Name
+	}
+	return fmt.Sprintf("%s(%d..%d)", t.Base, t.Low, t.High)
+}
+
+// StringType represents STRING[n] and WSTRING[n], strings limited to Length characters
+type StringType struct {
+	position Position
+	Wide     bool
+	Length   int
+}
+
+func (t *StringType) String() string           { return fmt.Sprintf("%s[%d]", t.TypeName(), t.Length) }
+func (t *StringType) Position() Position       { return t.position }
+func (t *StringType) SetPosition(pos Position) { t.position = pos }
+func (t *StringType) TypeName() string {
+	if t.Wide {
+		return "WSTRING"
+	}
+	return "STRING"
+}
+
 // BasicType represents primitive data types
 type BasicType struct {
 	position Position
 	TypeName string
 }
 
-func (t *BasicType) String() string     { return t.TypeName }
-func (t *BasicType) Position() Position { return t.position }
+func (t *BasicType) String() string           { return t.TypeName }
+func (t *BasicType) Position() Position       { return t.position }
+func (t *BasicType) SetPosition(pos Position) { t.position = pos }
 
 // Statement represents a program statement
 type Statement interface {
@@ -87,8 +347,9 @@ type Assignment struct {
 func (a *Assignment) String() string {
 	return fmt.Sprintf("%s := %s", a.Variable, a.Value)
 }
-func (a *Assignment) Position() Position { return a.position }
-func (a *Assignment) statementNode()     {}
+func (a *Assignment) Position() Position       { return a.position }
+func (a *Assignment) SetPosition(pos Position) { a.position = pos }
+func (a *Assignment) statementNode()           {}
 
 // Variable represents a variable reference
 type Variable struct {
@@ -96,9 +357,10 @@ type Variable struct {
 	Name     string
 }
 
-func (v *Variable) String() string     { return v.Name }
-func (v *Variable) Position() Position { return v.position }
-func (v *Variable) expressionNode()    {}
+func (v *Variable) String() string           { return v.Name }
+func (v *Variable) Position() Position       { return v.position }
+func (v *Variable) SetPosition(pos Position) { v.position = pos }
+func (v *Variable) expressionNode()          {}
 
 // BinaryExpr represents a binary expression
 type BinaryExpr struct {
@@ -111,8 +373,26 @@ type BinaryExpr struct {
 func (b *BinaryExpr) String() string {
 	return fmt.Sprintf("(%s %s %s)", b.Left, b.Operator, b.Right)
 }
-func (b *BinaryExpr) Position() Position { return b.position }
-func (b *BinaryExpr) expressionNode()    {}
+func (b *BinaryExpr) Position() Position       { return b.position }
+func (b *BinaryExpr) SetPosition(pos Position) { b.position = pos }
+func (b *BinaryExpr) expressionNode()          {}
+
+// UnaryExpr represents a unary expression (negation or NOT)
+type UnaryExpr struct {
+	position Position
+	Operator string
+	Operand  Expression
+}
+
+func (u *UnaryExpr) String() string {
+	if u.Operator == "NOT" {
+		return fmt.Sprintf("(NOT %s)", u.Operand)
+	}
+	return fmt.Sprintf("(%s%s)", u.Operator, u.Operand)
+}
+func (u *UnaryExpr) Position() Position       { return u.position }
+func (u *UnaryExpr) SetPosition(pos Position) { u.position = pos }
+func (u *UnaryExpr) expressionNode()          {}
 
 // CallExpr represents a function/FB call
 type CallExpr struct {
@@ -128,8 +408,21 @@ func (c *CallExpr) String() string {
 	}
 	return fmt.Sprintf("%s(%s)", c.Function, strings.Join(args, ", "))
 }
-func (c *CallExpr) Position() Position { return c.position }
-func (c *CallExpr) expressionNode()    {}
+func (c *CallExpr) Position() Position       { return c.position }
+func (c *CallExpr) SetPosition(pos Position) { c.position = pos }
+func (c *CallExpr) expressionNode()          {}
+
+// NamedArg represents a formal argument (name := value) in a call
+type NamedArg struct {
+	position Position
+	Name     string
+	Value    Expression
+}
+
+func (n *NamedArg) String() string           { return fmt.Sprintf("%s := %s", n.Name, n.Value) }
+func (n *NamedArg) Position() Position       { return n.position }
+func (n *NamedArg) SetPosition(pos Position) { n.position = pos }
+func (n *NamedArg) expressionNode()          {}
 
 // Literal represents a literal value
 type Literal struct {
@@ -138,9 +431,10 @@ type Literal struct {
 	Value    interface{}
 }
 
-func (l *Literal) String() string     { return fmt.Sprintf("%v", l.Value) }
-func (l *Literal) Position() Position { return l.position }
-func (l *Literal) expressionNode()    {}
+func (l *Literal) String() string           { return fmt.Sprintf("%v", l.Value) }
+func (l *Literal) Position() Position       { return l.position }
+func (l *Literal) SetPosition(pos Position) { l.position = pos }
+func (l *Literal) expressionNode()          {}
 
 // FunctionBlockType represents a function block type
 type FunctionBlockType struct {
@@ -148,23 +442,37 @@ type FunctionBlockType struct {
 	Name     string
 }
 
-func (t *FunctionBlockType) String() string     { return t.Name }
-func (t *FunctionBlockType) Position() Position { return t.position }
-func (t *FunctionBlockType) TypeName() string   { return t.Name }
+func (t *FunctionBlockType) String() string           { return t.Name }
+func (t *FunctionBlockType) Position() Position       { return t.position }
+func (t *FunctionBlockType) SetPosition(pos Position) { t.position = pos }
+func (t *FunctionBlockType) TypeName() string         { return t.Name }
 
-// ArrayType represents an array type
+// ArrayType represents an array type with one or more dimensions
 type ArrayType struct {
 	position Position
-	Start    int
-	End      int
+	Dims     []ArrayDim
 	BaseType DataType
 }
 
+// ArrayDim represents the bounds of one array dimension
+type ArrayDim struct {
+	Start int
+	End   int
+}
+
+// Len returns the number of elements in the dimension
+func (d ArrayDim) Len() int { return d.End - d.Start + 1 }
+
 func (t *ArrayType) String() string {
-	return fmt.Sprintf("ARRAY[%d..%d] OF %s", t.Start, t.End, t.BaseType)
+	dims := make([]string, len(t.Dims))
+	for i, d := range t.Dims {
+		dims[i] = fmt.Sprintf("%d..%d", d.Start, d.End)
+	}
+	return fmt.Sprintf("ARRAY[%s] OF %s", strings.Join(dims, ", "), t.BaseType)
 }
-func (t *ArrayType) Position() Position { return t.position }
-func (t *ArrayType) TypeName() string   { return t.String() }
+func (t *ArrayType) Position() Position       { return t.position }
+func (t *ArrayType) SetPosition(pos Position) { t.position = pos }
+func (t *ArrayType) TypeName() string         { return t.String() }
 
 // FBCall represents a function block call with named arguments
 type FBCall struct {
@@ -173,9 +481,10 @@ type FBCall struct {
 	Inputs   []Expression
 }
 
-func (c *FBCall) String() string     { return fmt.Sprintf("%s(...)", c.Instance) }
-func (c *FBCall) Position() Position { return c.position }
-func (c *FBCall) expressionNode()    {}
+func (c *FBCall) String() string           { return fmt.Sprintf("%s(...)", c.Instance) }
+func (c *FBCall) Position() Position       { return c.position }
+func (c *FBCall) SetPosition(pos Position) { c.position = pos }
+func (c *FBCall) expressionNode()          {}
 
 // IfStatement represents an IF control structure
 type IfStatement struct {
@@ -186,9 +495,10 @@ type IfStatement struct {
 	Else      []Statement
 }
 
-func (s *IfStatement) String() string     { return "IF" }
-func (s *IfStatement) Position() Position { return s.position }
-func (s *IfStatement) statementNode()     {}
+func (s *IfStatement) String() string           { return "IF" }
+func (s *IfStatement) Position() Position       { return s.position }
+func (s *IfStatement) SetPosition(pos Position) { s.position = pos }
+func (s *IfStatement) statementNode()           {}
 
 // ElseIfClause represents an ELSIF clause
 type ElseIfClause struct {
@@ -197,6 +507,79 @@ type ElseIfClause struct {
 	Then      []Statement
 }
 
+func (c *ElseIfClause) Position() Position       { return c.position }
+func (c *ElseIfClause) SetPosition(pos Position) { c.position = pos }
+
+// CaseStatement represents a CASE selection
+type CaseStatement struct {
+	position Position
+	Selector Expression
+	Branches []*CaseBranch
+	Else     []Statement
+}
+
+func (s *CaseStatement) String() string           { return "CASE" }
+func (s *CaseStatement) Position() Position       { return s.position }
+func (s *CaseStatement) SetPosition(pos Position) { s.position = pos }
+func (s *CaseStatement) statementNode()           {}
+
+// CaseBranch represents the statements selected by one or more CASE labels
+type CaseBranch struct {
+	position Position
+	Labels   []*CaseLabel
+	Body     []Statement
+}
+
+func (b *CaseBranch) Position() Position       { return b.position }
+func (b *CaseBranch) SetPosition(pos Position) { b.position = pos }
+
+// CaseLabel matches a single value, or the range Low..High when High is set
+type CaseLabel struct {
+	position Position
+	Low      Expression
+	High     Expression
+}
+
+func (l *CaseLabel) Position() Position       { return l.position }
+func (l *CaseLabel) SetPosition(pos Position) { l.position = pos }
+
+func (l *CaseLabel) String() string {
+	if l.High != nil {
+		return fmt.Sprintf("%s..%s", l.Low, l.High)
+	}
+	return l.Low.String()
+}
+
+// ExitStatement represents an EXIT out of the innermost loop
+type ExitStatement struct {
+	position Position
+}
+
+func (s *ExitStatement) String() string           { return "EXIT" }
+func (s *ExitStatement) Position() Position       { return s.position }
+func (s *ExitStatement) SetPosition(pos Position) { s.position = pos }
+func (s *ExitStatement) statementNode()           {}
+
+// ContinueStatement represents a CONTINUE with the next iteration of the innermost loop
+type ContinueStatement struct {
+	position Position
+}
+
+func (s *ContinueStatement) String() string           { return "CONTINUE" }
+func (s *ContinueStatement) Position() Position       { return s.position }
+func (s *ContinueStatement) SetPosition(pos Position) { s.position = pos }
+func (s *ContinueStatement) statementNode()           {}
+
+// ReturnStatement represents a RETURN from the current POU
+type ReturnStatement struct {
+	position Position
+}
+
+func (s *ReturnStatement) String() string           { return "RETURN" }
+func (s *ReturnStatement) Position() Position       { return s.position }
+func (s *ReturnStatement) SetPosition(pos Position) { s.position = pos }
+func (s *ReturnStatement) statementNode()           {}
+
 // WhileStatement represents a WHILE loop
 type WhileStatement struct {
 	position  Position
@@ -204,9 +587,10 @@ type WhileStatement struct {
 	Body      []Statement
 }
 
-func (s *WhileStatement) String() string     { return "WHILE" }
-func (s *WhileStatement) Position() Position { return s.position }
-func (s *WhileStatement) statementNode()     {}
+func (s *WhileStatement) String() string           { return "WHILE" }
+func (s *WhileStatement) Position() Position       { return s.position }
+func (s *WhileStatement) SetPosition(pos Position) { s.position = pos }
+func (s *WhileStatement) statementNode()           {}
 
 // RepeatStatement represents a REPEAT loop
 type RepeatStatement struct {
@@ -215,9 +599,10 @@ type RepeatStatement struct {
 	Condition Expression
 }
 
-func (s *RepeatStatement) String() string     { return "REPEAT" }
-func (s *RepeatStatement) Position() Position { return s.position }
-func (s *RepeatStatement) statementNode()     {}
+func (s *RepeatStatement) String() string           { return "REPEAT" }
+func (s *RepeatStatement) Position() Position       { return s.position }
+func (s *RepeatStatement) SetPosition(pos Position) { s.position = pos }
+func (s *RepeatStatement) statementNode()           {}
 
 // ForStatement represents a FOR loop
 type ForStatement struct {
@@ -229,9 +614,10 @@ type ForStatement struct {
 	Body     []Statement
 }
 
-func (s *ForStatement) String() string     { return "FOR" }
-func (s *ForStatement) Position() Position { return s.position }
-func (s *ForStatement) statementNode()     {}
+func (s *ForStatement) String() string           { return "FOR" }
+func (s *ForStatement) Position() Position       { return s.position }
+func (s *ForStatement) SetPosition(pos Position) { s.position = pos }
+func (s *ForStatement) statementNode()           {}
 
 // MemberAccess represents a struct member access
 type MemberAccess struct {
@@ -240,17 +626,56 @@ type MemberAccess struct {
 	Member   string
 }
 
-func (m *MemberAccess) String() string     { return fmt.Sprintf("%s.%s", m.Object, m.Member) }
-func (m *MemberAccess) Position() Position { return m.position }
-func (m *MemberAccess) expressionNode()    {}
+func (m *MemberAccess) String() string           { return fmt.Sprintf("%s.%s", m.Object, m.Member) }
+func (m *MemberAccess) Position() Position       { return m.position }
+func (m *MemberAccess) SetPosition(pos Position) { m.position = pos }
+func (m *MemberAccess) expressionNode()          {}
 
-// ArrayAccess represents an array element access
+// ArrayAccess represents an array element access with one index per dimension
 type ArrayAccess struct {
 	position Position
 	Array    Expression
-	Index    Expression
+	Indices  []Expression
+}
+
+func (a *ArrayAccess) String() string {
+	indices := make([]string, len(a.Indices))
+	for i, idx := range a.Indices {
+		indices[i] = idx.String()
+	}
+	return fmt.Sprintf("%s[%s]", a.Array, strings.Join(indices, ", "))
+}
+func (a *ArrayAccess) Position() Position       { return a.position }
+func (a *ArrayAccess) SetPosition(pos Position) { a.position = pos }
+func (a *ArrayAccess) expressionNode()          {}
+
+// ArrayLiteral represents an array initializer such as [1, 2, 3(0)]
+type ArrayLiteral struct {
+	position Position
+	Elements []*ArrayElement
 }
 
-func (a *ArrayAccess) String() string     { return fmt.Sprintf("%s[%s]", a.Array, a.Index) }
-func (a *ArrayAccess) Position() Position { return a.position }
-func (a *ArrayAccess) expressionNode()    {}
+// ArrayElement is one initializer entry; Value is repeated Count times and
+// is nil when the elements keep their defaults
+type ArrayElement struct {
+	Count int
+	Value Expression
+}
+
+func (l *ArrayLiteral) String() string {
+	elems := make([]string, len(l.Elements))
+	for i, e := range l.Elements {
+		switch {
+		case e.Value == nil:
+			elems[i] = fmt.Sprintf("%d()", e.Count)
+		case e.Count != 1:
+			elems[i] = fmt.Sprintf("%d(%s)", e.Count, e.Value)
+		default:
+			elems[i] = e.Value.String()
+		}
+	}
+	return "[" + strings.Join(elems, ", ") + "]"
+}
+func (l *ArrayLiteral) Position() Position       { return l.position }
+func (l *ArrayLiteral) SetPosition(pos Position) { l.position = pos }
+func (l *ArrayLiteral) expressionNode()          {}
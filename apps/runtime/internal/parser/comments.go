@@ -0,0 +1,247 @@
+package parser
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/alecthomas/participle/v2/lexer"
+	"github.com/hyperdrive/core/apps/runtime/internal/diagnostics"
+	"github.com/hyperdrive/core/apps/runtime/internal/parser/ast"
+)
+
+// note is a comment or pragma the parser elides from the token stream
+type note struct {
+	pos     lexer.Position
+	endLine int
+	ownLine bool // Only whitespace precedes the note on its line
+	used    bool
+
+	text   string // Comment text without the delimiters
+	pragma string // Lower-case pragma name such as attribute or info; empty for comments
+	name   string // First quoted argument of a pragma
+	value  string // Value assigned to a pragma argument with :=
+}
+
+// pragmaPattern matches {name}, {name 'argument'} and {name 'argument' := 'value'}
+var pragmaPattern = regexp.MustCompile(`^\{\s*([A-Za-z_]\w*)\s*(?:'([^']*)'\s*(?::=\s*'([^']*)')?)?\s*\}$`)
+
+// scanComments lexes the code and returns its comments and pragmas in source order
+func scanComments(filename, code string) ([]*note, error) {
+	lex, err := iec61131Lexer.LexString(filename, code)
+	if err != nil {
+		return nil, err
+	}
+	symbols := iec61131Lexer.Symbols()
+
+	var (
+		notes []*note
+		open  *note
+		depth int
+		text  strings.Builder
+	)
+	for {
+		tok, err := lex.Next()
+		if err != nil {
+			return nil, syntaxError(filename, err)
+		}
+		if tok.EOF() {
+			break
+		}
+
+		switch tok.Type {
+		case symbols["LineComment"]:
+			n := newNote(code, tok)
+			n.text = strings.TrimSpace(strings.TrimPrefix(tok.Value, "//"))
+			n.endLine = tok.Pos.Line
+			notes = append(notes, n)
+		case symbols["Pragma"]:
+			// Pragmas other compilers understand are ignored
+			m := pragmaPattern.FindStringSubmatch(tok.Value)
+			if m == nil {
+				continue
+			}
+			n := newNote(code, tok)
+			n.pragma, n.name, n.value = strings.ToLower(m[1]), m[2], m[3]
+			notes = append(notes, n)
+		case symbols["CommentStart"]:
+			depth++
+			if depth == 1 {
+				open = newNote(code, tok)
+				text.Reset()
+				continue
+			}
+			text.WriteString(tok.Value)
+		case symbols["CommentEnd"]:
+			depth--
+			if depth == 0 {
+				open.text = strings.TrimSpace(text.String())
+				open.endLine = tok.Pos.Line
+				notes = append(notes, open)
+				continue
+			}
+			text.WriteString(tok.Value)
+		case symbols["CommentText"]:
+			text.WriteString(tok.Value)
+		}
+	}
+
+	if depth > 0 {
+		return nil, diagnostics.New(ast.Position{File: filename, Line: open.pos.Line, Column: open.pos.Column},
+			diagnostics.SeverityError, diagnostics.CodeSyntax, "unterminated comment")
+	}
+	return notes, nil
+}
+
+func newNote(code string, tok lexer.Token) *note {
+	lineStart := strings.LastIndexByte(code[:tok.Pos.Offset], '\n') + 1
+	return &note{
+		pos:     tok.Pos,
+		endLine: tok.Pos.Line + strings.Count(tok.Value, "\n"),
+		ownLine: strings.TrimSpace(code[lineStart:tok.Pos.Offset]) == "",
+	}
+}
+
+// attachComments documents the POUs and variables of a unit with the comments
+// and pragmas around them. Comments between two POUs belong to the POU that
+// follows, attribute pragmas to the next declaration.
+func attachComments(unit *ast.CompilationUnit, parsed *IEC61131Grammar, notes []*note) {
+	var ends []int
+	for _, block := range parsed.Types {
+		ends = append(ends, block.EndPos.Offset)
+	}
+	for _, section := range parsed.Globals {
+		ends = append(ends, section.EndPos.Offset)
+	}
+	for _, p := range parsed.Programs {
+		ends = append(ends, p.EndPos.Offset)
+	}
+
+	for _, n := range notes {
+		if n.pragma == "info" {
+			n.used = true
+			unit.Messages = append(unit.Messages, at(&ast.Message{Text: n.name}, n.pos))
+		}
+	}
+
+	// Global variables are documented like the variables of a POU
+	first := 0
+	for _, section := range parsed.Globals {
+		var inside []*note
+		for _, n := range notes {
+			if n.pos.Offset >= section.Pos.Offset && n.pos.Offset < section.EndPos.Offset {
+				inside = append(inside, n)
+			}
+		}
+		attachVarComments(inside, section.Vars, unit.Globals[first:first+len(section.Vars)])
+		first += len(section.Vars)
+	}
+
+	for i, p := range parsed.Programs {
+		pou := unit.POUs[i]
+
+		start := 0
+		for _, end := range ends {
+			if end <= p.Pos.Offset && end > start {
+				start = end
+			}
+		}
+		var header, inside []*note
+		for _, n := range notes {
+			switch {
+			case n.pos.Offset >= start && n.pos.Offset < p.Pos.Offset:
+				header = append(header, n)
+			case n.pos.Offset >= p.Pos.Offset && n.pos.Offset < p.EndPos.Offset:
+				inside = append(inside, n)
+			}
+		}
+
+		var vars []*VarNode
+		for _, section := range p.VarDecls {
+			vars = append(vars, section.Vars...)
+		}
+		attachVarComments(inside, vars, pou.Vars)
+
+		for _, n := range append(header, inside...) {
+			if n.used {
+				continue
+			}
+			switch {
+			case n.pragma == "":
+				pou.Comments = append(pou.Comments, n.text)
+			case n.pragma == "attribute" && n.pos.Offset < p.Pos.Offset:
+				pou.Attributes = addAttribute(pou.Attributes, n)
+			}
+			n.used = true
+		}
+	}
+}
+
+// attachVarComments attaches the comments of a POU to its variables: comments
+// on the lines directly above a declaration and a comment following it on the
+// same line, continued by comments aligned with it on the lines below
+func attachVarComments(notes []*note, vars []*VarNode, decls []*ast.VarDecl) {
+	trailing := make([][]string, len(vars))
+	for i, v := range vars {
+		for j, n := range notes {
+			if n.used || n.pragma != "" || n.ownLine || n.pos.Line != v.EndPos.Line || n.pos.Offset < v.EndPos.Offset {
+				continue
+			}
+			n.used = true
+			trailing[i] = append(trailing[i], n.text)
+			last := n
+			for _, next := range notes[j+1:] {
+				if next.used || next.pragma != "" || !next.ownLine || next.pos.Line != last.endLine+1 || next.pos.Column != n.pos.Column {
+					break
+				}
+				next.used = true
+				trailing[i] = append(trailing[i], next.text)
+				last = next
+			}
+			break
+		}
+	}
+
+	for i, v := range vars {
+		var leading []string
+		line := v.Pos.Line
+		for j := len(notes) - 1; j >= 0; j-- {
+			n := notes[j]
+			if n.pos.Offset >= v.Pos.Offset {
+				continue
+			}
+			if n.used || !n.ownLine || n.endLine != line-1 {
+				break
+			}
+			if n.pragma == "" {
+				n.used = true
+				leading = append([]string{n.text}, leading...)
+			}
+			line = n.pos.Line
+		}
+
+		if lines := append(leading, trailing[i]...); len(lines) > 0 {
+			decls[i].Comment = strings.Join(lines, "\n")
+		}
+	}
+
+	for _, n := range notes {
+		if n.used || n.pragma != "attribute" {
+			continue
+		}
+		for i, v := range vars {
+			if v.Pos.Offset > n.pos.Offset {
+				n.used = true
+				decls[i].Attributes = addAttribute(decls[i].Attributes, n)
+				break
+			}
+		}
+	}
+}
+
+func addAttribute(attrs map[string]string, n *note) map[string]string {
+	if attrs == nil {
+		attrs = make(map[string]string)
+	}
+	attrs[n.name] = n.value
+	return attrs
+}
@@ -1,20 +1,44 @@
 package parser
 
 import (
+	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 
 	"github.com/alecthomas/participle/v2"
 	"github.com/alecthomas/participle/v2/lexer"
+	"github.com/hyperdrive/core/apps/runtime/internal/diagnostics"
 	"github.com/hyperdrive/core/apps/runtime/internal/parser/ast"
 )
 
 // IEC61131Grammar defines the grammar for IEC 61131-3 programs
 type IEC61131Grammar struct {
-	Programs []*ProgramNode `parser:"@@*"`
+	Types    []*TypeBlockNode `parser:"( @@"`
+	Globals  []*VarDeclNode   `parser:"| @@"`
+	Programs []*ProgramNode   `parser:"| @@ )*"`
+}
+
+type TypeBlockNode struct {
+	EndPos lexer.Position
+
+	Decls   []*TypeDeclNode `parser:"'TYPE' @@*"`
+	EndType string          `parser:"@'END_TYPE'"`
+}
+
+type TypeDeclNode struct {
+	Pos lexer.Position
+
+	Name string          `parser:"@Ident"`
+	Type *TypeNode       `parser:"':' @@"`
+	Init *ExpressionNode `parser:"(':=' @@)?"`
+	Semi string          `parser:"@';'"`
 }
 
 type ProgramNode struct {
+	Pos    lexer.Position
+	EndPos lexer.Position
+
 	Type     string         `parser:"@('PROGRAM'|'FUNCTION'|'FUNCTION_BLOCK')"`
 	Name     string         `parser:"@Ident"`
 	RetType  *TypeNode      `parser:"(':' @@)?"`
@@ -28,41 +52,88 @@ type ProgramBody struct {
 }
 
 type VarDeclNode struct {
-	VarType string     `parser:"@('VAR'|'VAR_INPUT'|'VAR_OUTPUT')"`
-	Vars    []*VarNode `parser:"@@*"`
-	EndVar  string     `parser:"@'END_VAR'"`
+	Pos    lexer.Position
+	EndPos lexer.Position
+
+	VarType    string     `parser:"@('VAR' | 'VAR_INPUT' | 'VAR_OUTPUT' | 'VAR_IN_OUT' | 'VAR_GLOBAL' | 'VAR_EXTERNAL' | 'VAR_TEMP')"`
+	Qualifiers []string   `parser:"@('CONSTANT' | 'RETAIN' | 'PERSISTENT' | 'NON_RETAIN')*"`
+	Vars       []*VarNode `parser:"@@*"`
+	EndVar     string     `parser:"@'END_VAR'"`
 }
 
 type VarNode struct {
-	Name string          `parser:"@Ident"`
-	Type *TypeNode       `parser:"':' @@"`
-	Init *ExpressionNode `parser:"(':=' @@)?"`
-	Semi string          `parser:"@';'"`
+	Pos    lexer.Position
+	EndPos lexer.Position
+
+	Name     string          `parser:"@Ident"`
+	Location string          `parser:"('AT' @DirectAddress)?"`
+	Type     *TypeNode       `parser:"':' @@"`
+	Init     *ExpressionNode `parser:"(':=' @@)?"`
+	Semi     string          `parser:"@';'"`
 }
 
 type TypeNode struct {
-	Array  *ArrayTypeNode  `parser:"  @@"`
-	Struct *StructTypeNode `parser:"| @@"`
-	Basic  string          `parser:"| @Ident"`
+	Pos lexer.Position
+
+	Array    *ArrayTypeNode    `parser:"  @@"`
+	Struct   *StructTypeNode   `parser:"| @@"`
+	Enum     *EnumTypeNode     `parser:"| @@"`
+	Subrange *SubrangeTypeNode `parser:"| @@"`
+	String   *StringTypeNode   `parser:"| @@"`
+	Basic    string            `parser:"| @Ident"`
 }
 
 type ArrayTypeNode struct {
-	Start string    `parser:"'ARRAY' '[' @Number"`
-	End   string    `parser:"'..' @Number"`
-	Of    *TypeNode `parser:"']' 'OF' @@"`
+	Dims []*ArrayDimNode `parser:"'ARRAY' '[' @@ (',' @@)*"`
+	Of   *TypeNode       `parser:"']' 'OF' @@"`
+}
+
+type ArrayDimNode struct {
+	Start string `parser:"@('-'? Number)"`
+	End   string `parser:"'..' @('-'? Number)"`
 }
 
 type StructTypeNode struct {
 	Fields []*VarNode `parser:"'STRUCT' @@* 'END_STRUCT'"`
 }
 
+type EnumTypeNode struct {
+	Values []*EnumValueNode `parser:"'(' @@ (',' @@)* ')'"`
+}
+
+type EnumValueNode struct {
+	Pos lexer.Position
+
+	Name  string `parser:"@Ident"`
+	Value string `parser:"(':=' @('-'? Number))?"`
+}
+
+// SubrangeTypeNode matches INT (0..100); without the space INT( lexes as a FuncIdent
+type SubrangeTypeNode struct {
+	Base string `parser:"( @Ident '(' | @FuncIdent )"`
+	Low  string `parser:"@('-'? Number)"`
+	High string `parser:"'..' @('-'? Number) ')'"`
+}
+
+// StringTypeNode matches STRING[20] and WSTRING[20]
+type StringTypeNode struct {
+	Type   string `parser:"@('STRING' | 'WSTRING')"`
+	Length string `parser:"'[' @Number ']'"`
+}
+
 type StatementNode struct {
-	Assignment *AssignmentNode `parser:"  @@ ';'"`
-	CallStmt   *CallNode       `parser:"| @@ ';'"`
-	IfStmt     *IfNode         `parser:"| @@ ';'"`
-	WhileStmt  *WhileNode      `parser:"| @@ ';'"`
-	RepeatStmt *RepeatNode     `parser:"| @@ ';'"`
-	ForStmt    *ForNode        `parser:"| @@ ';'"`
+	Pos lexer.Position
+
+	CallStmt     *CallNode       `parser:"  @@ ';'"`
+	ExitStmt     bool            `parser:"| @'EXIT' ';'"`
+	ContinueStmt bool            `parser:"| @'CONTINUE' ';'"`
+	ReturnStmt   bool            `parser:"| @'RETURN' ';'"`
+	Assignment   *AssignmentNode `parser:"| @@ ';'"`
+	IfStmt       *IfNode         `parser:"| @@ ';'"`
+	CaseStmt     *CaseNode       `parser:"| @@ ';'"`
+	WhileStmt    *WhileNode      `parser:"| @@ ';'"`
+	RepeatStmt   *RepeatNode     `parser:"| @@ ';'"`
+	ForStmt      *ForNode        `parser:"| @@ ';'"`
 }
 
 type CallNode struct {
@@ -76,6 +147,8 @@ type AssignmentNode struct {
 }
 
 type NamedArgNode struct {
+	Pos lexer.Position
+
 	Name  string          `parser:"@Ident ':='"`
 	Value *ExpressionNode `parser:"@@"`
 }
@@ -85,13 +158,96 @@ type ArgumentNode struct {
 	Posit *ExpressionNode `parser:"| @@"`
 }
 
+// Expressions are layered by IEC 61131-3 operator precedence, lowest first:
+// OR, XOR, AND/&, = <>, < > <= >=, + -, * / MOD, unary - and NOT, **.
+// Operators of equal precedence associate left to right, so -2 ** 2 is
+// -(2 ** 2).
+
 type ExpressionNode struct {
-	Left  *TermNode     `parser:"@@"`
-	Right []*OpTermNode `parser:"@@*"`
+	Left  *XorExprNode `parser:"@@"`
+	Right []*OrOpNode  `parser:"@@*"`
+}
+
+type OrOpNode struct {
+	Op    string       `parser:"@'OR'"`
+	Right *XorExprNode `parser:"@@"`
+}
+
+type XorExprNode struct {
+	Left  *AndExprNode `parser:"@@"`
+	Right []*XorOpNode `parser:"@@*"`
+}
+
+type XorOpNode struct {
+	Op    string       `parser:"@'XOR'"`
+	Right *AndExprNode `parser:"@@"`
+}
+
+type AndExprNode struct {
+	Left  *EqualityNode `parser:"@@"`
+	Right []*AndOpNode  `parser:"@@*"`
+}
+
+type AndOpNode struct {
+	Op    string        `parser:"@('AND' | '&')"`
+	Right *EqualityNode `parser:"@@"`
+}
+
+type EqualityNode struct {
+	Left  *ComparisonNode   `parser:"@@"`
+	Right []*EqualityOpNode `parser:"@@*"`
+}
+
+type EqualityOpNode struct {
+	Op    string          `parser:"@('=' | '<>')"`
+	Right *ComparisonNode `parser:"@@"`
+}
+
+type ComparisonNode struct {
+	Left  *AddExprNode        `parser:"@@"`
+	Right []*ComparisonOpNode `parser:"@@*"`
+}
+
+type ComparisonOpNode struct {
+	Op    string       `parser:"@('<=' | '>=' | '<' | '>')"`
+	Right *AddExprNode `parser:"@@"`
+}
+
+type AddExprNode struct {
+	Left  *MulExprNode `parser:"@@"`
+	Right []*AddOpNode `parser:"@@*"`
+}
+
+type AddOpNode struct {
+	Op    string       `parser:"@('+' | '-')"`
+	Right *MulExprNode `parser:"@@"`
+}
+
+type MulExprNode struct {
+	Left  *UnaryNode   `parser:"@@"`
+	Right []*MulOpNode `parser:"@@*"`
+}
+
+type MulOpNode struct {
+	Op    string     `parser:"@('*' | '/' | 'MOD')"`
+	Right *UnaryNode `parser:"@@"`
+}
+
+type UnaryNode struct {
+	Pos lexer.Position
+
+	Op      string         `parser:"  ( @('-' | 'NOT')"`
+	Operand *UnaryNode     `parser:"    @@ )"`
+	Power   *PowerExprNode `parser:"| @@"`
+}
+
+type PowerExprNode struct {
+	Left  *TermNode      `parser:"@@"`
+	Right []*PowerOpNode `parser:"@@*"`
 }
 
-type OpTermNode struct {
-	Op    string    `parser:"@('+' | '-' | '*' | '/' | 'AND' | 'OR' | '=' | '<>' | '<' | '<=' | '>' | '>=')"`
+type PowerOpNode struct {
+	Op    string    `parser:"@'**'"`
 	Right *TermNode `parser:"@@"`
 }
 
@@ -101,19 +257,36 @@ type TermNode struct {
 }
 
 type AccessNode struct {
-	Dot    string          `parser:"  @'.'"`
-	Member *VariableNode   `parser:"  @@"`
-	Array  bool            `parser:"| @'['"`
-	Index  *ExpressionNode `parser:"  @@ ']'"`
+	Dot     string            `parser:"  @'.'"`
+	Member  *VariableNode     `parser:"  @@"`
+	Array   bool              `parser:"| @'['"`
+	Indices []*ExpressionNode `parser:"  @@ (',' @@)* ']'"`
 }
 
 type PrimaryNode struct {
-	Variable *VariableNode   `parser:"  @@"`
+	Pos lexer.Position
+
+	Bool     string          `parser:"  @('TRUE' | 'FALSE')"`
+	Typed    *TypedLiteral   `parser:"| @TypedLiteral"`
+	Variable *VariableNode   `parser:"| @@"`
 	Call     *ExprCallNode   `parser:"| @@"`
 	Number   string          `parser:"| @Number"`
 	String   string          `parser:"| @String"`
-	Bool     string          `parser:"| @('TRUE' | 'FALSE')"`
 	SubExpr  *ExpressionNode `parser:"| '(' @@ ')'"`
+	Array    *ArrayInitNode  `parser:"| @@"`
+}
+
+// ArrayInitNode matches initializer lists such as [1, 2, 3(0)]
+type ArrayInitNode struct {
+	Elements []*ArrayInitElementNode `parser:"'[' @@ (',' @@)* ']'"`
+}
+
+type ArrayInitElementNode struct {
+	Pos lexer.Position
+
+	Repeat string          `parser:"( @Number '(' "`
+	Value  *ExpressionNode `parser:"  @@? ')'"`
+	Single *ExpressionNode `parser:"| @@ )"`
 }
 
 type ExprCallNode struct {
@@ -134,10 +307,33 @@ type IfNode struct {
 }
 
 type ElseIfNode struct {
+	Pos lexer.Position
+
 	Condition *ExpressionNode  `parser:"'ELSIF' @@"`
 	Then      []*StatementNode `parser:"'THEN' @@*"`
 }
 
+type CaseNode struct {
+	Selector *ExpressionNode   `parser:"'CASE' @@ 'OF'"`
+	Branches []*CaseBranchNode `parser:"@@*"`
+	Else     []*StatementNode  `parser:"('ELSE' @@*)?"`
+	EndCase  string            `parser:"'END_CASE'"`
+}
+
+type CaseBranchNode struct {
+	Pos lexer.Position
+
+	Labels []*CaseLabelNode `parser:"@@ (',' @@)* ':'"`
+	Body   []*StatementNode `parser:"@@*"`
+}
+
+type CaseLabelNode struct {
+	Pos lexer.Position
+
+	Low  *ExpressionNode `parser:"@@"`
+	High *ExpressionNode `parser:"('..' @@)?"`
+}
+
 type WhileNode struct {
 	Condition *ExpressionNode  `parser:"'WHILE' @@"`
 	Do        []*StatementNode `parser:"'DO' @@*"`
@@ -159,26 +355,61 @@ type ForNode struct {
 	EndFor   string           `parser:"'END_FOR'"`
 }
 
+// typedLiteralPattern matches date and time literals, based integers (16#FF)
+// and literals with a type prefix (INT#5, WORD#16#FF, State#Idle)
+const typedLiteralPattern = `(?i:` +
+	`(?:DATE_AND_TIME|DT)#\d+-\d+-\d+-\d+:\d+(?::\d+(?:\.\d+)?)?` +
+	`|(?:TIME_OF_DAY|TOD)#\d+:\d+(?::\d+(?:\.\d+)?)?` +
+	`|(?:DATE|D)#\d+-\d+-\d+` +
+	`|(?:LTIME|TIME|LT|T)#-?(?:\d[\d_]*(?:\.\d+)?(?:ms|us|ns|d|h|m|s)_?)+` +
+	`|(?:2|8|16)#[0-9a-f_]+` +
+	`|[a-z_][a-z0-9_]*#(?:[-+]?(?:(?:2|8|16)#[0-9a-f_]+|\d[\d_]*(?:\.\d[\d_]*)?(?:e[-+]?\d+)?)|[a-z_][a-z0-9_]*)` +
+	`)`
+
+// keywordPattern matches the operators and statement keywords that may be
+// followed by an opening parenthesis
+const keywordPattern = `NOT|AND|OR|XOR|MOD|IF|THEN|ELSIF|ELSE|CASE|OF|WHILE|DO|REPEAT|UNTIL|TO|BY|RETURN`
+
+// iec61131Lexer elides comments and pragmas; scanComments collects them from
+// the same token stream. Block comments (* ... *) may be nested.
 var iec61131Lexer = lexer.MustStateful(lexer.Rules{
 	"Root": {
-		{"comment", `//[^\n]*\n?`, nil},
-		{"whitespace", `[\s\t\n\r]+`, nil},
-		{"Dots", `\.\.`, nil},
-		{"Number", `[-+]?(?:\d*\.)?\d+(?:[eE][-+]?\d+)?`, nil},
-		{"String", `'[^']*'|"[^"]*"`, nil},
-		{"FuncIdent", `[a-zA-Z_][a-zA-Z0-9_]*\(`, nil},
-		{"Ident", `[a-zA-Z_][a-zA-Z0-9_]*`, nil},
-		{"Semicolon", `;`, nil},
-		{"Operator", `(:=|<=|>=|<>|\+|-|\*|/|AND|OR|=|<|>|>=|<=|<>|\.)`, nil},
-		{"Punct", `[,()[\]:]`, nil},
+		{Name: "LineComment", Pattern: `//[^\n]*\n?`},
+		{Name: "CommentStart", Pattern: `\(\*`, Action: lexer.Push("BlockComment")},
+		{Name: "Pragma", Pattern: `\{[^}]*\}`},
+		{Name: "whitespace", Pattern: `[\s\t\n\r]+`},
+		{Name: "TypedLiteral", Pattern: typedLiteralPattern},
+		{Name: "Dots", Pattern: `\.\.`},
+		{Name: "Number", Pattern: `(?:\d[\d_]*)?\.\d[\d_]*(?:[eE][-+]?\d+)?|\d[\d_]*(?:[eE][-+]?\d+)?`},
+		{Name: "String", Pattern: `'(?:\$.|[^'$])*'|"(?:\$.|[^"$])*"`},
+		// Keywords followed by ( start an operand or a condition, not a call
+		{Name: "Keyword", Pattern: `(?:` + keywordPattern + `)\b`},
+		{Name: "FuncIdent", Pattern: `[a-zA-Z_][a-zA-Z0-9_]*\(`},
+		{Name: "Ident", Pattern: `[a-zA-Z_][a-zA-Z0-9_]*`},
+		{Name: "DirectAddress", Pattern: `%[IQM][XBWDL]?\d+(?:\.\d+)*`},
+		{Name: "Semicolon", Pattern: `;`},
+		{Name: "Operator", Pattern: `(:=|<=|>=|<>|\*\*|\+|-|\*|/|&|=|<|>|\.)`},
+		{Name: "Punct", Pattern: `[,()[\]:]`},
+	},
+	"BlockComment": {
+		{Name: "CommentStart", Pattern: `\(\*`, Action: lexer.Push("BlockComment")},
+		{Name: "CommentEnd", Pattern: `\*\)`, Action: lexer.Pop()},
+		{Name: "CommentText", Pattern: `[^(*]+|[(*]`},
 	},
 })
 
 var Parser = participle.MustBuild[IEC61131Grammar](
 	participle.Lexer(iec61131Lexer),
-	participle.Unquote("String"),
+	participle.Map(func(token lexer.Token) (lexer.Token, error) {
+		s, err := unquote(token.Value)
+		if err != nil {
+			return token, participle.Errorf(token.Pos, "invalid string %s: %v", token.Value, err)
+		}
+		token.Value = s
+		return token, nil
+	}, "String"),
 	participle.UseLookahead(3),
-	participle.Elide("comment", "whitespace"),
+	participle.Elide("LineComment", "CommentStart", "CommentEnd", "CommentText", "Pragma", "whitespace"),
 )
 
 // BasicType implements ast.DataType
@@ -187,96 +418,270 @@ type BasicType struct {
 	pos      ast.Position
 }
 
-func (t *BasicType) String() string         { return t.typeName }
-func (t *BasicType) Position() ast.Position { return t.pos }
-func (t *BasicType) TypeName() string       { return t.typeName }
+func (t *BasicType) String() string               { return t.typeName }
+func (t *BasicType) Position() ast.Position       { return t.pos }
+func (t *BasicType) SetPosition(pos ast.Position) { t.pos = pos }
+func (t *BasicType) TypeName() string             { return t.typeName }
+
+// positioned is implemented by every AST node
+type positioned interface {
+	SetPosition(pos ast.Position)
+}
+
+// at records pos as the source position of node and returns it
+func at[T positioned](node T, pos lexer.Position) T {
+	node.SetPosition(ast.Position{File: pos.Filename, Line: pos.Line, Column: pos.Column})
+	return node
+}
+
+// positionOf returns the source position of an expression, if any
+func positionOf(expr ast.Expression) ast.Position {
+	if expr == nil {
+		return ast.Position{}
+	}
+	return expr.Position()
+}
 
 // Parse parses the input code and returns the main program
 func Parse(code string) (*ast.Program, error) {
-	parsed, err := Parser.ParseString("", code)
+	unit, err := ParseCompilationUnit(code)
 	if err != nil {
 		return nil, err
 	}
 
-	// Find the main program
-	var mainProgram *ProgramNode
+	program, ok := unit.Lookup("Main")
+	if !ok || program.Type != ast.ProgramPRG {
+		return nil, fmt.Errorf("main program not found")
+	}
+
+	return program, nil
+}
+
+// ParseCompilationUnit parses the input code and returns every POU and type it declares
+func ParseCompilationUnit(code string) (*ast.CompilationUnit, error) {
+	return ParseFile("", code)
+}
+
+// ParseFile parses the code of the named source file. Positions of the nodes
+// and of syntax errors, reported as *diagnostics.Diagnostic, refer to that file.
+func ParseFile(filename, code string) (*ast.CompilationUnit, error) {
+	notes, err := scanComments(filename, code)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := Parser.ParseString(filename, code)
+	if err != nil {
+		return nil, syntaxError(filename, err)
+	}
+
+	unit := at(&ast.CompilationUnit{}, lexer.Position{Filename: filename, Line: 1, Column: 1})
+	for _, block := range parsed.Types {
+		for _, decl := range block.Decls {
+			unit.Types = append(unit.Types, convertTypeDecl(decl))
+		}
+	}
+	for _, section := range parsed.Globals {
+		// Only global variables may be declared outside a POU
+		if ast.VarSection(section.VarType) != ast.VarGlobal {
+			return nil, diagnostics.New(ast.Position{File: filename, Line: section.Pos.Line, Column: section.Pos.Column},
+				diagnostics.SeverityError, diagnostics.CodeSyntax, "%s must be declared inside a POU", section.VarType)
+		}
+		unit.Globals = append(unit.Globals, convertVarSection(section)...)
+	}
 	for _, p := range parsed.Programs {
-		if p.Type == "PROGRAM" && p.Name == "Main" {
-			mainProgram = p
-			break
+		unit.POUs = append(unit.POUs, convertProgram(p))
+	}
+
+	attachComments(unit, parsed, notes)
+	resolveTypes(unit)
+
+	return unit, nil
+}
+
+// resolveTypes resolves references to types and function blocks declared in the unit
+func resolveTypes(unit *ast.CompilationUnit) {
+	for _, decl := range unit.Types {
+		decl.Type = resolveTypeRef(unit, decl.Type)
+	}
+	for _, v := range unit.Globals {
+		v.Type = resolveTypeRef(unit, v.Type)
+	}
+	for _, pou := range unit.POUs {
+		for _, v := range pou.Vars {
+			v.Type = resolveTypeRef(unit, v.Type)
 		}
 	}
+}
 
-	if mainProgram == nil {
-		return nil, fmt.Errorf("main program not found")
+// syntaxError reports a participle error as a diagnostic at the offending token
+func syntaxError(filename string, err error) error {
+	var perr participle.Error
+	if !errors.As(err, &perr) {
+		return err
+	}
+	pos := perr.Position()
+	if pos.Filename == "" {
+		pos.Filename = filename
 	}
+	return diagnostics.New(ast.Position{File: pos.Filename, Line: pos.Line, Column: pos.Column},
+		diagnostics.SeverityError, diagnostics.CodeSyntax, "%s", perr.Message())
+}
 
-	// Convert to AST
-	program := &ast.Program{
-		Type: ast.ProgramPRG,
-		Name: mainProgram.Name,
+// resolveTypeRef replaces named type references with the type declared in the unit
+func resolveTypeRef(unit *ast.CompilationUnit, t ast.DataType) ast.DataType {
+	switch typ := t.(type) {
+	case *BasicType:
+		// Aliases of elementary types stay named so their declared default is kept
+		if decl, ok := unit.LookupType(typ.typeName); ok {
+			if _, alias := decl.Type.(*BasicType); !alias {
+				return decl.Type
+			}
+		}
+		if fb, ok := unit.Lookup(typ.typeName); ok && fb.Type == ast.ProgramFB {
+			return &ast.FunctionBlockType{Name: fb.Name}
+		}
+	case *ast.StructType:
+		for _, field := range typ.Fields {
+			field.Type = resolveTypeRef(unit, field.Type)
+		}
+	case *ast.ArrayType:
+		typ.BaseType = resolveTypeRef(unit, typ.BaseType)
+	}
+	return t
+}
+
+func convertTypeDecl(decl *TypeDeclNode) *ast.TypeDecl {
+	typ := convertType(decl.Type)
+
+	// Named structured types carry their declared name
+	switch t := typ.(type) {
+	case *ast.StructType:
+		t.Name = decl.Name
+	case *ast.EnumType:
+		t.Name = decl.Name
+	case *ast.SubrangeType:
+		t.Name = decl.Name
+	}
+
+	return at(&ast.TypeDecl{
+		Name:     decl.Name,
+		Type:     typ,
+		InitExpr: convertExpression(decl.Init),
+	}, decl.Pos)
+}
+
+func convertProgram(p *ProgramNode) *ast.Program {
+	program := at(&ast.Program{
+		Type: ast.ProgramType(p.Type),
+		Name: p.Name,
+	}, p.Pos)
+
+	if p.RetType != nil {
+		program.ReturnType = convertType(p.RetType)
 	}
 
 	// Convert variables
-	for _, varDecl := range mainProgram.VarDecls {
-		for _, v := range varDecl.Vars {
-			program.Vars = append(program.Vars, &ast.VarDecl{
-				Name: v.Name,
-				Type: convertType(v.Type),
-			})
-		}
+	for _, section := range p.VarDecls {
+		program.Vars = append(program.Vars, convertVarSection(section)...)
 	}
 
 	// Convert statements
-	for _, stmt := range mainProgram.Body.Statements {
-		if converted := convertStatement(stmt); converted != nil {
-			program.Body = append(program.Body, converted)
-		}
+	program.Body = convertStatements(p.Body.Statements)
+
+	return program
+}
+
+// convertVarSection converts the variables of a VAR block, which share its
+// section and qualifiers
+func convertVarSection(section *VarDeclNode) []*ast.VarDecl {
+	constant, retention := convertQualifiers(section.Qualifiers)
+	decls := make([]*ast.VarDecl, 0, len(section.Vars))
+	for _, v := range section.Vars {
+		decls = append(decls, at(&ast.VarDecl{
+			Name:      v.Name,
+			Type:      convertType(v.Type),
+			Section:   ast.VarSection(section.VarType),
+			Constant:  constant,
+			Retention: retention,
+			Location:  convertLocation(v.Location),
+			InitExpr:  convertExpression(v.Init),
+		}, v.Pos))
 	}
+	return decls
+}
 
-	return program, nil
+// convertQualifiers returns whether the CONSTANT, RETAIN and PERSISTENT
+// qualifiers of a VAR block make its variables constant or retained
+func convertQualifiers(qualifiers []string) (constant bool, retention ast.Retention) {
+	for _, q := range qualifiers {
+		switch q {
+		case "CONSTANT":
+			constant = true
+		case "RETAIN":
+			// VAR RETAIN PERSISTENT is as persistent as VAR PERSISTENT
+			if retention == ast.NonRetain {
+				retention = ast.Retain
+			}
+		case "PERSISTENT":
+			retention = ast.Persistent
+		}
+	}
+	return constant, retention
 }
 
-func convertNamedArgs(args []*NamedArgNode) []ast.Expression {
-	var result []ast.Expression
-	for _, arg := range args {
-		result = append(result, convertExpression(arg.Value))
+// convertLocation converts a direct address such as %IX0.0; an address
+// without size prefix addresses a bit
+func convertLocation(address string) *ast.Location {
+	if address == "" {
+		return nil
 	}
-	return result
+	loc := &ast.Location{Area: address[1], Size: 'X'}
+	fields := address[2:]
+	if c := fields[0]; c < '0' || c > '9' {
+		loc.Size = c
+		fields = fields[1:]
+	}
+	for _, field := range strings.Split(fields, ".") {
+		n, _ := strconv.Atoi(field)
+		loc.Index = append(loc.Index, n)
+	}
+	return loc
 }
 
-func convertAssignment(assign *AssignmentNode) *ast.Assignment {
-	return &ast.Assignment{
-		Variable: convertAccess(assign.Left.Primary.Variable, assign.Left.Access),
+func convertAssignment(assign *AssignmentNode, pos lexer.Position) *ast.Assignment {
+	return at(&ast.Assignment{
+		Variable: convertAccess(assign.Left.Primary.Variable, assign.Left.Access, assign.Left.Primary.Pos),
 		Value:    convertExpression(assign.Right),
-	}
+	}, pos)
 }
 
-func convertAccess(base *VariableNode, accesses []*AccessNode) ast.Expression {
-	var expr ast.Expression = convertVariable(base)
+// convertAccess converts a variable followed by member and index accesses;
+// every access is positioned at the start of the whole reference
+func convertAccess(base *VariableNode, accesses []*AccessNode, pos lexer.Position) ast.Expression {
+	var expr ast.Expression = convertVariable(base, pos)
 	for _, access := range accesses {
 		if access.Array {
-			expr = &ast.ArrayAccess{
-				Array: expr,
-				Index: convertExpression(access.Index),
-			}
+			expr = at(&ast.ArrayAccess{
+				Array:   expr,
+				Indices: convertExpressions(access.Indices),
+			}, pos)
 		} else if access.Member != nil {
-			expr = &ast.MemberAccess{
+			expr = at(&ast.MemberAccess{
 				Object: expr,
 				Member: access.Member.Name,
-			}
+			}, pos)
 		}
 	}
 	return expr
 }
 
-func convertVariable(v *VariableNode) *ast.Variable {
+func convertVariable(v *VariableNode, pos lexer.Position) *ast.Variable {
 	if v == nil {
 		return nil
 	}
-	return &ast.Variable{
+	return at(&ast.Variable{
 		Name: v.Name,
-	}
+	}, pos)
 }
 
 func convertExpression(expr *ExpressionNode) ast.Expression {
@@ -284,63 +689,137 @@ func convertExpression(expr *ExpressionNode) ast.Expression {
 		return nil
 	}
 
+	result := convertXorExpr(expr.Left)
+	for _, op := range expr.Right {
+		result = newBinaryExpr(result, op.Op, convertXorExpr(op.Right))
+	}
+	return result
+}
+
+func convertXorExpr(expr *XorExprNode) ast.Expression {
+	result := convertAndExpr(expr.Left)
+	for _, op := range expr.Right {
+		result = newBinaryExpr(result, op.Op, convertAndExpr(op.Right))
+	}
+	return result
+}
+
+func convertAndExpr(expr *AndExprNode) ast.Expression {
+	result := convertEquality(expr.Left)
+	for _, op := range expr.Right {
+		result = newBinaryExpr(result, op.Op, convertEquality(op.Right))
+	}
+	return result
+}
+
+func convertEquality(expr *EqualityNode) ast.Expression {
+	result := convertComparison(expr.Left)
+	for _, op := range expr.Right {
+		result = newBinaryExpr(result, op.Op, convertComparison(op.Right))
+	}
+	return result
+}
+
+func convertComparison(expr *ComparisonNode) ast.Expression {
+	result := convertAddExpr(expr.Left)
+	for _, op := range expr.Right {
+		result = newBinaryExpr(result, op.Op, convertAddExpr(op.Right))
+	}
+	return result
+}
+
+func convertAddExpr(expr *AddExprNode) ast.Expression {
+	result := convertMulExpr(expr.Left)
+	for _, op := range expr.Right {
+		result = newBinaryExpr(result, op.Op, convertMulExpr(op.Right))
+	}
+	return result
+}
+
+func convertMulExpr(expr *MulExprNode) ast.Expression {
+	result := convertUnary(expr.Left)
+	for _, op := range expr.Right {
+		result = newBinaryExpr(result, op.Op, convertUnary(op.Right))
+	}
+	return result
+}
+
+func convertUnary(expr *UnaryNode) ast.Expression {
+	if expr.Operand != nil {
+		return at(&ast.UnaryExpr{
+			Operator: expr.Op,
+			Operand:  convertUnary(expr.Operand),
+		}, expr.Pos)
+	}
+	return convertPowerExpr(expr.Power)
+}
+
+func convertPowerExpr(expr *PowerExprNode) ast.Expression {
 	result := convertTerm(expr.Left)
-	for _, opTerm := range expr.Right {
-		result = &ast.BinaryExpr{
-			Left:     result,
-			Operator: opTerm.Op,
-			Right:    convertTerm(opTerm.Right),
-		}
+	for _, op := range expr.Right {
+		result = newBinaryExpr(result, op.Op, convertTerm(op.Right))
 	}
 	return result
 }
 
+// newBinaryExpr builds a binary expression positioned at its left operand, normalizing & to AND
+func newBinaryExpr(left ast.Expression, op string, right ast.Expression) ast.Expression {
+	if op == "&" {
+		op = "AND"
+	}
+	expr := &ast.BinaryExpr{
+		Left:     left,
+		Operator: op,
+		Right:    right,
+	}
+	expr.SetPosition(positionOf(left))
+	return expr
+}
+
 func convertTerm(term *TermNode) ast.Expression {
 	if term.Primary != nil {
+		primary := term.Primary
 		var result ast.Expression = nil
 
-		if term.Primary.Variable != nil {
-			result = convertVariable(term.Primary.Variable)
-		} else if term.Primary.Call != nil {
-			funcName := term.Primary.Call.Name
-			if len(funcName) > 0 && funcName[len(funcName)-1] == '(' {
-				funcName = funcName[:len(funcName)-1]
-			}
-			result = &ast.CallExpr{
-				Function: funcName,
-				Args:     convertCallArgs(term.Primary.Call.Args),
-			}
-		} else if term.Primary.Number != "" {
-			result = &ast.Literal{
-				Type:  &BasicType{typeName: "REAL"},
-				Value: term.Primary.Number,
-			}
-		} else if term.Primary.Bool != "" {
-			result = &ast.Literal{
-				Type:  &BasicType{typeName: "BOOL"},
-				Value: term.Primary.Bool == "TRUE",
-			}
-		} else if term.Primary.String != "" {
-			result = &ast.Literal{
-				Type:  &BasicType{typeName: "STRING"},
-				Value: term.Primary.String,
-			}
-		} else if term.Primary.SubExpr != nil {
-			result = convertExpression(term.Primary.SubExpr)
+		if primary.Variable != nil {
+			result = convertVariable(primary.Variable, primary.Pos)
+		} else if primary.Call != nil {
+			result = at(&ast.CallExpr{
+				Function: strings.TrimSuffix(primary.Call.Name, "("),
+				Args:     convertCallArgs(primary.Call.Args),
+			}, primary.Pos)
+		} else if primary.Number != "" {
+			result = at(convertNumber(primary.Number), primary.Pos)
+		} else if primary.Bool != "" {
+			result = at(&ast.Literal{
+				Type:  at(&BasicType{typeName: "BOOL"}, primary.Pos),
+				Value: primary.Bool == "TRUE",
+			}, primary.Pos)
+		} else if primary.String != "" {
+			result = at(&ast.Literal{
+				Type:  at(&BasicType{typeName: "STRING"}, primary.Pos),
+				Value: primary.String,
+			}, primary.Pos)
+		} else if primary.Typed != nil {
+			result = at(primary.Typed.Literal, primary.Pos)
+		} else if primary.SubExpr != nil {
+			result = convertExpression(primary.SubExpr)
+		} else if primary.Array != nil {
+			result = at(convertArrayInit(primary.Array), primary.Pos)
 		}
 
 		// Handle member access and array indexing
 		for _, access := range term.Access {
 			if access.Dot != "" && access.Member != nil {
-				result = &ast.MemberAccess{
+				result = at(&ast.MemberAccess{
 					Object: result,
 					Member: access.Member.Name,
-				}
-			} else if access.Array && access.Index != nil {
-				result = &ast.ArrayAccess{
-					Array: result,
-					Index: convertExpression(access.Index),
-				}
+				}, primary.Pos)
+			} else if access.Array && len(access.Indices) > 0 {
+				result = at(&ast.ArrayAccess{
+					Array:   result,
+					Indices: convertExpressions(access.Indices),
+				}, primary.Pos)
 			}
 		}
 
@@ -350,11 +829,30 @@ func convertTerm(term *TermNode) ast.Expression {
 	return nil
 }
 
+// convertNumber converts a decimal literal to an INT or REAL literal
+func convertNumber(text string) *ast.Literal {
+	text = strings.ReplaceAll(text, "_", "")
+	if i, err := strconv.Atoi(text); err == nil {
+		return &ast.Literal{
+			Type:  &BasicType{typeName: AnyInt},
+			Value: i,
+		}
+	}
+	f, _ := strconv.ParseFloat(text, 64)
+	return &ast.Literal{
+		Type:  &BasicType{typeName: AnyReal},
+		Value: f,
+	}
+}
+
 func convertCallArgs(args []*ArgumentNode) []ast.Expression {
 	var result []ast.Expression
 	for _, arg := range args {
 		if arg.Named != nil {
-			result = append(result, convertExpression(arg.Named.Value))
+			result = append(result, at(&ast.NamedArg{
+				Name:  arg.Named.Name,
+				Value: convertExpression(arg.Named.Value),
+			}, arg.Named.Pos))
 		} else {
 			result = append(result, convertExpression(arg.Posit))
 		}
@@ -362,59 +860,131 @@ func convertCallArgs(args []*ArgumentNode) []ast.Expression {
 	return result
 }
 
+func convertExpressions(exprs []*ExpressionNode) []ast.Expression {
+	result := make([]ast.Expression, len(exprs))
+	for i, e := range exprs {
+		result[i] = convertExpression(e)
+	}
+	return result
+}
+
+func convertArrayInit(init *ArrayInitNode) *ast.ArrayLiteral {
+	result := &ast.ArrayLiteral{}
+	for _, elem := range init.Elements {
+		if elem.Repeat != "" {
+			// n(value) repeats value n times; n() keeps the element defaults
+			count, _ := strconv.Atoi(elem.Repeat)
+			result.Elements = append(result.Elements, &ast.ArrayElement{
+				Count: count,
+				Value: convertExpression(elem.Value),
+			})
+			continue
+		}
+		result.Elements = append(result.Elements, &ast.ArrayElement{
+			Count: 1,
+			Value: convertExpression(elem.Single),
+		})
+	}
+	return result
+}
+
 func convertType(t *TypeNode) ast.DataType {
 	if t.Basic != "" {
-		return &BasicType{typeName: t.Basic}
+		return at(&BasicType{typeName: t.Basic}, t.Pos)
 	}
 	if t.Array != nil {
-		start, _ := strconv.Atoi(t.Array.Start)
-		end, _ := strconv.Atoi(t.Array.End)
-		return &ast.ArrayType{
-			Start:    start,
-			End:      end,
-			BaseType: convertType(t.Array.Of),
+		result := at(&ast.ArrayType{BaseType: convertType(t.Array.Of)}, t.Pos)
+		for _, dim := range t.Array.Dims {
+			start, _ := strconv.Atoi(dim.Start)
+			end, _ := strconv.Atoi(dim.End)
+			result.Dims = append(result.Dims, ast.ArrayDim{Start: start, End: end})
 		}
+		return result
 	}
 	if t.Struct != nil {
-		// TODO: Implement struct type conversion
-		return &BasicType{typeName: "STRUCT"}
+		result := at(&ast.StructType{}, t.Pos)
+		for _, field := range t.Struct.Fields {
+			result.Fields = append(result.Fields, at(&ast.VarDecl{
+				Name:     field.Name,
+				Type:     convertType(field.Type),
+				InitExpr: convertExpression(field.Init),
+			}, field.Pos))
+		}
+		return result
 	}
-	return &BasicType{typeName: "UNKNOWN"}
+	if t.Enum != nil {
+		result := at(&ast.EnumType{}, t.Pos)
+		next := 0
+		for _, v := range t.Enum.Values {
+			// Values without an explicit number continue from the previous one
+			if v.Value != "" {
+				next, _ = strconv.Atoi(v.Value)
+			}
+			result.Values = append(result.Values, at(&ast.EnumValue{
+				Name:  v.Name,
+				Value: next,
+			}, v.Pos))
+			next++
+		}
+		return result
+	}
+	if t.String != nil {
+		length, _ := strconv.Atoi(t.String.Length)
+		return at(&ast.StringType{Wide: t.String.Type == "WSTRING", Length: length}, t.Pos)
+	}
+	if t.Subrange != nil {
+		low, _ := strconv.Atoi(t.Subrange.Low)
+		high, _ := strconv.Atoi(t.Subrange.High)
+		return at(&ast.SubrangeType{
+			Base: at(&BasicType{typeName: strings.TrimSuffix(t.Subrange.Base, "(")}, t.Pos),
+			Low:  low,
+			High: high,
+		}, t.Pos)
+	}
+	return at(&BasicType{typeName: "UNKNOWN"}, t.Pos)
 }
 
 func convertStatement(stmt *StatementNode) ast.Statement {
 	if stmt.Assignment != nil {
-		return convertAssignment(stmt.Assignment)
+		return convertAssignment(stmt.Assignment, stmt.Pos)
 	}
 	if stmt.CallStmt != nil {
-		// Remove the trailing ( from the function name
-		funcName := stmt.CallStmt.Name
-		if len(funcName) > 0 && funcName[len(funcName)-1] == '(' {
-			funcName = funcName[:len(funcName)-1]
-		}
-		return &ast.Assignment{
-			Value: &ast.CallExpr{
-				Function: funcName,
+		// Call statements are assignments without a target
+		return at(&ast.Assignment{
+			Value: at(&ast.CallExpr{
+				Function: strings.TrimSuffix(stmt.CallStmt.Name, "("),
 				Args:     convertCallArgs(stmt.CallStmt.Args),
-			},
-		}
+			}, stmt.Pos),
+		}, stmt.Pos)
 	}
 	if stmt.IfStmt != nil {
-		return convertIfStatement(stmt.IfStmt)
+		return at(convertIfStatement(stmt.IfStmt), stmt.Pos)
+	}
+	if stmt.CaseStmt != nil {
+		return at(convertCaseStatement(stmt.CaseStmt), stmt.Pos)
+	}
+	if stmt.ExitStmt {
+		return at(&ast.ExitStatement{}, stmt.Pos)
+	}
+	if stmt.ContinueStmt {
+		return at(&ast.ContinueStatement{}, stmt.Pos)
+	}
+	if stmt.ReturnStmt {
+		return at(&ast.ReturnStatement{}, stmt.Pos)
 	}
 	if stmt.WhileStmt != nil {
-		return convertWhileStatement(stmt.WhileStmt)
+		return at(convertWhileStatement(stmt.WhileStmt), stmt.Pos)
 	}
 	if stmt.RepeatStmt != nil {
-		return convertRepeatStatement(stmt.RepeatStmt)
+		return at(convertRepeatStatement(stmt.RepeatStmt), stmt.Pos)
 	}
 	if stmt.ForStmt != nil {
-		return convertForStatement(stmt.ForStmt)
+		return at(convertForStatement(stmt.ForStmt), stmt.Pos)
 	}
 	return nil
 }
 
-func convertIfStatement(ifStmt *IfNode) ast.Statement {
+func convertIfStatement(ifStmt *IfNode) *ast.IfStatement {
 	result := &ast.IfStatement{
 		Condition: convertExpression(ifStmt.Condition),
 		Then:      convertStatements(ifStmt.Then),
@@ -422,30 +992,52 @@ func convertIfStatement(ifStmt *IfNode) ast.Statement {
 	}
 
 	for _, elseif := range ifStmt.ElseIf {
-		result.ElseIf = append(result.ElseIf, &ast.ElseIfClause{
+		result.ElseIf = append(result.ElseIf, at(&ast.ElseIfClause{
 			Condition: convertExpression(elseif.Condition),
 			Then:      convertStatements(elseif.Then),
-		})
+		}, elseif.Pos))
+	}
+
+	return result
+}
+
+func convertCaseStatement(caseStmt *CaseNode) *ast.CaseStatement {
+	result := &ast.CaseStatement{
+		Selector: convertExpression(caseStmt.Selector),
+		Else:     convertStatements(caseStmt.Else),
+	}
+
+	for _, branch := range caseStmt.Branches {
+		converted := at(&ast.CaseBranch{
+			Body: convertStatements(branch.Body),
+		}, branch.Pos)
+		for _, label := range branch.Labels {
+			converted.Labels = append(converted.Labels, at(&ast.CaseLabel{
+				Low:  convertExpression(label.Low),
+				High: convertExpression(label.High),
+			}, label.Pos))
+		}
+		result.Branches = append(result.Branches, converted)
 	}
 
 	return result
 }
 
-func convertWhileStatement(whileStmt *WhileNode) ast.Statement {
+func convertWhileStatement(whileStmt *WhileNode) *ast.WhileStatement {
 	return &ast.WhileStatement{
 		Condition: convertExpression(whileStmt.Condition),
 		Body:      convertStatements(whileStmt.Do),
 	}
 }
 
-func convertRepeatStatement(repeatStmt *RepeatNode) ast.Statement {
+func convertRepeatStatement(repeatStmt *RepeatNode) *ast.RepeatStatement {
 	return &ast.RepeatStatement{
 		Body:      convertStatements(repeatStmt.Body),
 		Condition: convertExpression(repeatStmt.Condition),
 	}
 }
 
-func convertForStatement(forStmt *ForNode) ast.Statement {
+func convertForStatement(forStmt *ForNode) *ast.ForStatement {
 	return &ast.ForStatement{
 		Variable: forStmt.Variable,
 		From:     convertExpression(forStmt.From),
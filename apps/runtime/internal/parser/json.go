@@ -0,0 +1,1057 @@
+package parser
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/participle/v2/lexer"
+	"github.com/hyperdrive/core/apps/runtime/internal/diagnostics"
+	"github.com/hyperdrive/core/apps/runtime/internal/parser/ast"
+)
+
+// DeploySchema is the JSON Schema of the AST sent with deploy and compile
+// requests, the document DecodeJSON accepts
+//
+//go:embed deploy-ast.schema.json
+var DeploySchema []byte
+
+// DecodeJSON converts the deploy AST of the named file, described by
+// DeploySchema, to the compilation unit ParseFile builds from its source.
+// Nodes of unknown $type and fields the schema does not list are refused;
+// errors are reported as *diagnostics.Diagnostic naming the offending node.
+func DecodeJSON(filename string, data []byte) (*ast.CompilationUnit, error) {
+	d := &jsonDecoder{filename: filename}
+	unit := d.unit(data)
+	if d.err != nil {
+		return nil, d.err
+	}
+	resolveTypes(unit)
+	return unit, nil
+}
+
+// jsonNode holds the fields every node of the deploy AST may have
+type jsonNode struct {
+	Type   string      `json:"$type"`
+	Region *jsonRegion `json:"$textRegion"`
+}
+
+// jsonRegion is the source range Langium records for a node
+type jsonRegion struct {
+	Offset int `json:"offset"`
+	End    int `json:"end"`
+	Length int `json:"length"`
+	Range  *struct {
+		Start jsonTextPosition `json:"start"`
+		End   jsonTextPosition `json:"end"`
+	} `json:"range"`
+}
+
+// jsonTextPosition counts lines and characters from 0
+type jsonTextPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+// jsonReference refers to a declaration by name
+type jsonReference struct {
+	Ref     string `json:"$ref"`
+	RefText string `json:"$refText"`
+}
+
+// jsonPOU holds the fields shared by FunctionBlock, FunctionDef and ProgramDecl
+type jsonPOU struct {
+	jsonNode
+	Name            string            `json:"name"`
+	VarDeclarations []json.RawMessage `json:"varDeclarations"`
+	Body            json.RawMessage   `json:"body"`
+}
+
+var locationPattern = regexp.MustCompile(`^%[IQM][XBWDL]?\d+(?:\.\d+)*$`)
+
+// jsonDecoder converts the nodes of a deploy AST, keeping the first error
+type jsonDecoder struct {
+	filename string
+	current  *ast.Program // POU whose body is being decoded
+	err      error
+}
+
+// fail records an error at the node found under path
+func (d *jsonDecoder) fail(path, format string, args ...interface{}) {
+	if d.err == nil {
+		d.err = diagnostics.New(ast.Position{File: d.filename}, diagnostics.SeverityError, diagnostics.CodeSyntax,
+			"%s: %s", path, fmt.Sprintf(format, args...))
+	}
+}
+
+// open returns the $type and position of the node under path
+func (d *jsonDecoder) open(raw json.RawMessage, path string) (jsonNode, lexer.Position, bool) {
+	var n jsonNode
+	pos := lexer.Position{Filename: d.filename}
+	if d.err != nil {
+		return n, pos, false
+	}
+	if absent(raw) {
+		d.fail(path, "missing node")
+		return n, pos, false
+	}
+	if err := json.Unmarshal(raw, &n); err != nil {
+		d.fail(path, "%s", strings.TrimPrefix(err.Error(), "json: "))
+		return n, pos, false
+	}
+	if n.Type == "" {
+		d.fail(path, "node has no $type")
+		return n, pos, false
+	}
+	if n.Region != nil && n.Region.Range != nil {
+		pos.Line = n.Region.Range.Start.Line + 1
+		pos.Column = n.Region.Range.Start.Character + 1
+	}
+	return n, pos, true
+}
+
+// fields decodes the node under path into v, refusing fields v does not have
+func (d *jsonDecoder) fields(raw json.RawMessage, path string, v interface{}) bool {
+	if d.err != nil {
+		return false
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		d.fail(path, "%s", strings.TrimPrefix(err.Error(), "json: "))
+		return false
+	}
+	return true
+}
+
+// require reports an empty string field of the node under path
+func (d *jsonDecoder) require(path, field, value string) {
+	if value == "" {
+		d.fail(path, "missing %s", field)
+	}
+}
+
+// absent reports whether an optional field was left out or null
+func absent(raw json.RawMessage) bool {
+	return len(raw) == 0 || string(raw) == "null"
+}
+
+func (d *jsonDecoder) unit(data []byte) *ast.CompilationUnit {
+	var root struct {
+		jsonNode
+		EnumTypes      []json.RawMessage `json:"enumTypes"`
+		StructTypes    []json.RawMessage `json:"structTypes"`
+		FunctionBlocks []json.RawMessage `json:"functionBlocks"`
+		Functions      []json.RawMessage `json:"functions"`
+		Programs       []json.RawMessage `json:"programs"`
+	}
+	n, pos, ok := d.open(data, "$")
+	if !ok {
+		return nil
+	}
+	if n.Type != "Program" {
+		d.fail("$", "root node must be a Program, got %q", n.Type)
+		return nil
+	}
+	if !d.fields(data, "$", &root) {
+		return nil
+	}
+
+	unit := at(&ast.CompilationUnit{}, pos)
+	for i, raw := range root.EnumTypes {
+		unit.Types = append(unit.Types, d.enumType(raw, fmt.Sprintf("enumTypes[%d]", i)))
+	}
+	for i, raw := range root.StructTypes {
+		unit.Types = append(unit.Types, d.structType(raw, fmt.Sprintf("structTypes[%d]", i)))
+	}
+	for i, raw := range root.FunctionBlocks {
+		unit.POUs = append(unit.POUs, d.pou(raw, fmt.Sprintf("functionBlocks[%d]", i), "FunctionBlock"))
+	}
+	for i, raw := range root.Functions {
+		unit.POUs = append(unit.POUs, d.pou(raw, fmt.Sprintf("functions[%d]", i), "FunctionDef"))
+	}
+	for i, raw := range root.Programs {
+		unit.POUs = append(unit.POUs, d.pou(raw, fmt.Sprintf("programs[%d]", i), "ProgramDecl"))
+	}
+	return unit
+}
+
+// expect reports a node under path that is not of the wanted type
+func (d *jsonDecoder) expect(n jsonNode, path, want string) bool {
+	if n.Type != want {
+		d.fail(path, "expected %s, got %q", want, n.Type)
+		return false
+	}
+	return true
+}
+
+func (d *jsonDecoder) enumType(raw json.RawMessage, path string) *ast.TypeDecl {
+	var node struct {
+		jsonNode
+		Name       string            `json:"name"`
+		EnumValues []json.RawMessage `json:"enumValues"`
+	}
+	n, pos, ok := d.open(raw, path)
+	if !ok || !d.expect(n, path, "EnumType") || !d.fields(raw, path, &node) {
+		return nil
+	}
+	d.require(path, "name", node.Name)
+
+	typ := at(&ast.EnumType{Name: node.Name}, pos)
+	next := 0
+	for i, raw := range node.EnumValues {
+		var value struct {
+			jsonNode
+			Name  string `json:"name"`
+			Value *int   `json:"value"`
+		}
+		valuePath := fmt.Sprintf("%s.enumValues[%d]", path, i)
+		n, pos, ok := d.open(raw, valuePath)
+		if !ok || !d.expect(n, valuePath, "EnumValue") || !d.fields(raw, valuePath, &value) {
+			return nil
+		}
+		d.require(valuePath, "name", value.Name)
+		// Values without an explicit number continue from the previous one
+		if value.Value != nil {
+			next = *value.Value
+		}
+		typ.Values = append(typ.Values, at(&ast.EnumValue{Name: value.Name, Value: next}, pos))
+		next++
+	}
+	return at(&ast.TypeDecl{Name: node.Name, Type: typ}, pos)
+}
+
+func (d *jsonDecoder) structType(raw json.RawMessage, path string) *ast.TypeDecl {
+	var node struct {
+		jsonNode
+		Name    string            `json:"name"`
+		Members []json.RawMessage `json:"members"`
+	}
+	n, pos, ok := d.open(raw, path)
+	if !ok || !d.expect(n, path, "StructType") || !d.fields(raw, path, &node) {
+		return nil
+	}
+	d.require(path, "name", node.Name)
+
+	typ := at(&ast.StructType{Name: node.Name}, pos)
+	for i, raw := range node.Members {
+		var member struct {
+			jsonNode
+			Name         string          `json:"name"`
+			Type         json.RawMessage `json:"type"`
+			InitialValue json.RawMessage `json:"initialValue"`
+		}
+		memberPath := fmt.Sprintf("%s.members[%d]", path, i)
+		n, pos, ok := d.open(raw, memberPath)
+		if !ok || !d.expect(n, memberPath, "StructMember") || !d.fields(raw, memberPath, &member) {
+			return nil
+		}
+		d.require(memberPath, "name", member.Name)
+		typ.Fields = append(typ.Fields, at(&ast.VarDecl{
+			Name:     member.Name,
+			Type:     d.dataType(member.Type, memberPath+".type"),
+			InitExpr: d.optionalExpression(member.InitialValue, memberPath+".initialValue"),
+		}, pos))
+	}
+	return at(&ast.TypeDecl{Name: node.Name, Type: typ}, pos)
+}
+
+// pou decodes a function block, function or program, which is the node type want
+func (d *jsonDecoder) pou(raw json.RawMessage, path, want string) *ast.Program {
+	n, pos, ok := d.open(raw, path)
+	if !ok || !d.expect(n, path, want) {
+		return nil
+	}
+
+	var node jsonPOU
+	program := at(&ast.Program{}, pos)
+	switch want {
+	case "FunctionBlock":
+		program.Type = ast.ProgramFB
+		if !d.fields(raw, path, &node) {
+			return nil
+		}
+	case "FunctionDef":
+		var fn struct {
+			jsonPOU
+			ReturnType json.RawMessage   `json:"returnType"`
+			InnerTypes []json.RawMessage `json:"innerTypes"`
+		}
+		if !d.fields(raw, path, &fn) {
+			return nil
+		}
+		if len(fn.InnerTypes) > 0 {
+			d.fail(path, "types cannot be declared inside a function; declare them at the top level")
+			return nil
+		}
+		node = fn.jsonPOU
+		program.Type = ast.ProgramFC
+		program.ReturnType = d.dataType(fn.ReturnType, path+".returnType")
+	case "ProgramDecl":
+		program.Type = ast.ProgramPRG
+		if !d.fields(raw, path, &node) {
+			return nil
+		}
+	}
+	d.require(path, "name", node.Name)
+	program.Name = node.Name
+
+	for i, raw := range node.VarDeclarations {
+		program.Vars = append(program.Vars, d.varDeclaration(raw, fmt.Sprintf("%s.varDeclarations[%d]", path, i))...)
+	}
+
+	var body struct {
+		jsonNode
+		Statements []json.RawMessage `json:"statements"`
+	}
+	bodyPath := path + ".body"
+	n, _, ok = d.open(node.Body, bodyPath)
+	if !ok || !d.expect(n, bodyPath, "ProgramBody") || !d.fields(node.Body, bodyPath, &body) {
+		return nil
+	}
+	d.current = program
+	program.Body = d.statements(body.Statements, bodyPath+".statements")
+	d.current = nil
+
+	return program
+}
+
+// varDeclaration decodes the variables of a VAR block, which share its
+// section and qualifiers
+func (d *jsonDecoder) varDeclaration(raw json.RawMessage, path string) []*ast.VarDecl {
+	var node struct {
+		jsonNode
+		Section    string            `json:"section"`
+		Qualifiers []string          `json:"qualifiers"`
+		Variables  []json.RawMessage `json:"variables"`
+	}
+	n, _, ok := d.open(raw, path)
+	if !ok || !d.expect(n, path, "VarDeclaration") || !d.fields(raw, path, &node) {
+		return nil
+	}
+
+	section := ast.VarLocal
+	switch s := ast.VarSection(node.Section); s {
+	case "":
+	case ast.VarLocal, ast.VarInput, ast.VarOutput, ast.VarInOut, ast.VarGlobal, ast.VarExternal, ast.VarTemp:
+		section = s
+	default:
+		d.fail(path, "unknown section %q", node.Section)
+		return nil
+	}
+	for _, q := range node.Qualifiers {
+		switch q {
+		case "CONSTANT", "RETAIN", "PERSISTENT", "NON_RETAIN":
+		default:
+			d.fail(path, "unknown qualifier %q", q)
+			return nil
+		}
+	}
+	constant, retention := convertQualifiers(node.Qualifiers)
+
+	decls := make([]*ast.VarDecl, 0, len(node.Variables))
+	for i, raw := range node.Variables {
+		var v struct {
+			jsonNode
+			Name         string          `json:"name"`
+			Location     string          `json:"location"`
+			Type         json.RawMessage `json:"type"`
+			InitialValue json.RawMessage `json:"initialValue"`
+		}
+		varPath := fmt.Sprintf("%s.variables[%d]", path, i)
+		n, pos, ok := d.open(raw, varPath)
+		if !ok || !d.expect(n, varPath, "VariableDecl") || !d.fields(raw, varPath, &v) {
+			return nil
+		}
+		d.require(varPath, "name", v.Name)
+		if v.Location != "" && !locationPattern.MatchString(v.Location) {
+			d.fail(varPath, "invalid location %q", v.Location)
+			return nil
+		}
+		decls = append(decls, at(&ast.VarDecl{
+			Name:      v.Name,
+			Type:      d.dataType(v.Type, varPath+".type"),
+			Section:   section,
+			Constant:  constant,
+			Retention: retention,
+			Location:  convertLocation(v.Location),
+			InitExpr:  d.optionalExpression(v.InitialValue, varPath+".initialValue"),
+		}, pos))
+	}
+	return decls
+}
+
+func (d *jsonDecoder) dataType(raw json.RawMessage, path string) ast.DataType {
+	n, pos, ok := d.open(raw, path)
+	if !ok {
+		return nil
+	}
+
+	switch n.Type {
+	case "SimpleType":
+		var node struct {
+			jsonNode
+			Name            string `json:"name"`
+			RangeConstraint *struct {
+				Start json.RawMessage `json:"start"`
+				End   json.RawMessage `json:"end"`
+			} `json:"rangeConstraint"`
+		}
+		if !d.fields(raw, path, &node) {
+			return nil
+		}
+		d.require(path, "name", node.Name)
+		base := at(&BasicType{typeName: node.Name}, pos)
+		if node.RangeConstraint == nil {
+			return base
+		}
+		return at(&ast.SubrangeType{
+			Base: base,
+			Low:  d.constant(node.RangeConstraint.Start, path+".rangeConstraint.start"),
+			High: d.constant(node.RangeConstraint.End, path+".rangeConstraint.end"),
+		}, pos)
+
+	case "ArrayType":
+		var node struct {
+			jsonNode
+			Dimensions []json.RawMessage `json:"dimensions"`
+			Type       json.RawMessage   `json:"type"`
+		}
+		if !d.fields(raw, path, &node) {
+			return nil
+		}
+		if len(node.Dimensions) == 0 {
+			d.fail(path, "array has no dimensions")
+			return nil
+		}
+		typ := at(&ast.ArrayType{BaseType: d.dataType(node.Type, path+".type")}, pos)
+		for i, raw := range node.Dimensions {
+			var dim struct {
+				jsonNode
+				Start json.RawMessage `json:"start"`
+				End   json.RawMessage `json:"end"`
+			}
+			dimPath := fmt.Sprintf("%s.dimensions[%d]", path, i)
+			n, _, ok := d.open(raw, dimPath)
+			if !ok || !d.expect(n, dimPath, "ArrayDimension") || !d.fields(raw, dimPath, &dim) {
+				return nil
+			}
+			typ.Dims = append(typ.Dims, ast.ArrayDim{
+				Start: d.bound(dim.Start, dimPath+".start"),
+				End:   d.bound(dim.End, dimPath+".end"),
+			})
+		}
+		return typ
+
+	case "EnumTypeReference":
+		var node struct {
+			jsonNode
+			Type json.RawMessage `json:"type"`
+		}
+		if !d.fields(raw, path, &node) {
+			return nil
+		}
+		return at(&BasicType{typeName: d.reference(node.Type, path+".type")}, pos)
+	}
+
+	d.fail(path, "unknown type node %q", n.Type)
+	return nil
+}
+
+// reference returns the name a reference refers to
+func (d *jsonDecoder) reference(raw json.RawMessage, path string) string {
+	var ref jsonReference
+	if absent(raw) {
+		d.fail(path, "missing reference")
+		return ""
+	}
+	if !d.fields(raw, path, &ref) {
+		return ""
+	}
+	d.require(path, "$refText", ref.RefText)
+	return ref.RefText
+}
+
+// bound decodes an array bound, an integer given as a number or as text
+func (d *jsonDecoder) bound(raw json.RawMessage, path string) int {
+	if d.err != nil {
+		return 0
+	}
+	text := string(raw)
+	if unquoted, err := strconv.Unquote(text); err == nil {
+		text = unquoted
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(text))
+	if err != nil {
+		d.fail(path, "array bound must be an integer, got %s", raw)
+	}
+	return n
+}
+
+// constant decodes an expression that must be an integer literal, possibly negated
+func (d *jsonDecoder) constant(raw json.RawMessage, path string) int {
+	expr := d.expression(raw, path)
+	negate := false
+	if unary, ok := expr.(*ast.UnaryExpr); ok && unary.Operator == "-" {
+		negate, expr = true, unary.Operand
+	}
+	if lit, ok := expr.(*ast.Literal); ok {
+		if n, ok := lit.Value.(int); ok {
+			if negate {
+				n = -n
+			}
+			return n
+		}
+	}
+	if d.err == nil {
+		d.fail(path, "expected an integer literal")
+	}
+	return 0
+}
+
+func (d *jsonDecoder) statements(raws []json.RawMessage, path string) []ast.Statement {
+	var result []ast.Statement
+	for i, raw := range raws {
+		result = append(result, d.statement(raw, fmt.Sprintf("%s[%d]", path, i))...)
+	}
+	return result
+}
+
+// statement decodes a statement node; a RETURN with a value becomes an
+// assignment to the function result followed by the RETURN
+func (d *jsonDecoder) statement(raw json.RawMessage, path string) []ast.Statement {
+	n, pos, ok := d.open(raw, path)
+	if !ok {
+		return nil
+	}
+
+	switch n.Type {
+	case "Assignment":
+		var node struct {
+			jsonNode
+			Target json.RawMessage `json:"target"`
+			Value  json.RawMessage `json:"value"`
+		}
+		if !d.fields(raw, path, &node) {
+			return nil
+		}
+		targetPath := path + ".target"
+		target, _, ok := d.open(node.Target, targetPath)
+		if !ok || !d.expect(target, targetPath, "LeftExpression") {
+			return nil
+		}
+		return []ast.Statement{at(&ast.Assignment{
+			Variable: d.elements(node.Target, targetPath, pos),
+			Value:    d.expression(node.Value, path+".value"),
+		}, pos)}
+
+	case "FunctionCall":
+		var node struct {
+			jsonNode
+			Call json.RawMessage `json:"call"`
+		}
+		if !d.fields(raw, path, &node) {
+			return nil
+		}
+		call := d.call(node.Call, path+".call", pos)
+		if _, ok := call.(*ast.CallExpr); !ok {
+			if d.err == nil {
+				d.fail(path, "call statement must call a func or a variable")
+			}
+			return nil
+		}
+		// Call statements are assignments without a target
+		return []ast.Statement{at(&ast.Assignment{Value: call}, pos)}
+
+	case "IfStatement":
+		var node struct {
+			jsonNode
+			Condition        json.RawMessage     `json:"condition"`
+			ThenStatements   []json.RawMessage   `json:"thenStatements"`
+			ElseIfConditions []json.RawMessage   `json:"elseIfConditions"`
+			ElseIfStatements [][]json.RawMessage `json:"elseIfStatements"`
+			ElseStatements   []json.RawMessage   `json:"elseStatements"`
+		}
+		if !d.fields(raw, path, &node) {
+			return nil
+		}
+		if len(node.ElseIfConditions) != len(node.ElseIfStatements) {
+			d.fail(path, "%d elseIfConditions but %d elseIfStatements", len(node.ElseIfConditions), len(node.ElseIfStatements))
+			return nil
+		}
+		stmt := at(&ast.IfStatement{
+			Condition: d.expression(node.Condition, path+".condition"),
+			Then:      d.statements(node.ThenStatements, path+".thenStatements"),
+			Else:      d.statements(node.ElseStatements, path+".elseStatements"),
+		}, pos)
+		for i, raw := range node.ElseIfConditions {
+			cond := d.expression(raw, fmt.Sprintf("%s.elseIfConditions[%d]", path, i))
+			clause := &ast.ElseIfClause{
+				Condition: cond,
+				Then:      d.statements(node.ElseIfStatements[i], fmt.Sprintf("%s.elseIfStatements[%d]", path, i)),
+			}
+			clause.SetPosition(positionOf(cond))
+			stmt.ElseIf = append(stmt.ElseIf, clause)
+		}
+		return []ast.Statement{stmt}
+
+	case "CaseStatement":
+		var node struct {
+			jsonNode
+			Expression        json.RawMessage   `json:"expression"`
+			Branches          []json.RawMessage `json:"branches"`
+			DefaultStatements []json.RawMessage `json:"defaultStatements"`
+		}
+		if !d.fields(raw, path, &node) {
+			return nil
+		}
+		stmt := at(&ast.CaseStatement{
+			Selector: d.expression(node.Expression, path+".expression"),
+			Else:     d.statements(node.DefaultStatements, path+".defaultStatements"),
+		}, pos)
+		for i, raw := range node.Branches {
+			stmt.Branches = append(stmt.Branches, d.caseBranch(raw, fmt.Sprintf("%s.branches[%d]", path, i)))
+		}
+		return []ast.Statement{stmt}
+
+	case "ForStatement":
+		var node struct {
+			jsonNode
+			Variable   string            `json:"variable"`
+			Start      json.RawMessage   `json:"start"`
+			End        json.RawMessage   `json:"end"`
+			Step       json.RawMessage   `json:"step"`
+			Statements []json.RawMessage `json:"statements"`
+		}
+		if !d.fields(raw, path, &node) {
+			return nil
+		}
+		d.require(path, "variable", node.Variable)
+		return []ast.Statement{at(&ast.ForStatement{
+			Variable: node.Variable,
+			From:     d.expression(node.Start, path+".start"),
+			To:       d.expression(node.End, path+".end"),
+			By:       d.optionalExpression(node.Step, path+".step"),
+			Body:     d.statements(node.Statements, path+".statements"),
+		}, pos)}
+
+	case "WhileStatement", "RepeatStatement":
+		var node struct {
+			jsonNode
+			Condition  json.RawMessage   `json:"condition"`
+			Statements []json.RawMessage `json:"statements"`
+		}
+		if !d.fields(raw, path, &node) {
+			return nil
+		}
+		cond := d.expression(node.Condition, path+".condition")
+		body := d.statements(node.Statements, path+".statements")
+		if n.Type == "WhileStatement" {
+			return []ast.Statement{at(&ast.WhileStatement{Condition: cond, Body: body}, pos)}
+		}
+		return []ast.Statement{at(&ast.RepeatStatement{Body: body, Condition: cond}, pos)}
+
+	case "ExitStatement", "ContinueStatement":
+		var node jsonNode
+		if !d.fields(raw, path, &node) {
+			return nil
+		}
+		if n.Type == "ExitStatement" {
+			return []ast.Statement{at(&ast.ExitStatement{}, pos)}
+		}
+		return []ast.Statement{at(&ast.ContinueStatement{}, pos)}
+
+	case "ReturnStatement":
+		var node struct {
+			jsonNode
+			Value json.RawMessage `json:"value"`
+		}
+		if !d.fields(raw, path, &node) {
+			return nil
+		}
+		ret := at(&ast.ReturnStatement{}, pos)
+		if absent(node.Value) {
+			return []ast.Statement{ret}
+		}
+		if d.current == nil || d.current.Type != ast.ProgramFC {
+			d.fail(path, "only a FUNCTION can return a value")
+			return nil
+		}
+		result := at(&ast.Assignment{
+			Variable: at(&ast.Variable{Name: d.current.Name}, pos),
+			Value:    d.expression(node.Value, path+".value"),
+		}, pos)
+		return []ast.Statement{result, ret}
+
+	case "TypeDeclaration":
+		d.fail(path, "types cannot be declared inside a body; declare them at the top level")
+		return nil
+	}
+
+	d.fail(path, "unknown statement node %q", n.Type)
+	return nil
+}
+
+func (d *jsonDecoder) caseBranch(raw json.RawMessage, path string) *ast.CaseBranch {
+	var node struct {
+		jsonNode
+		Labels     []json.RawMessage `json:"labels"`
+		Statements []json.RawMessage `json:"statements"`
+	}
+	n, pos, ok := d.open(raw, path)
+	if !ok || !d.expect(n, path, "CaseBranch") || !d.fields(raw, path, &node) {
+		return nil
+	}
+	if len(node.Labels) == 0 {
+		d.fail(path, "branch has no labels")
+		return nil
+	}
+
+	branch := at(&ast.CaseBranch{}, pos)
+	for i, raw := range node.Labels {
+		labelPath := fmt.Sprintf("%s.labels[%d]", path, i)
+		n, pos, ok := d.open(raw, labelPath)
+		if !ok {
+			return nil
+		}
+		if n.Type != "CaseRange" {
+			branch.Labels = append(branch.Labels, at(&ast.CaseLabel{Low: d.expression(raw, labelPath)}, pos))
+			continue
+		}
+		var label struct {
+			jsonNode
+			Start json.RawMessage `json:"start"`
+			End   json.RawMessage `json:"end"`
+		}
+		if !d.fields(raw, labelPath, &label) {
+			return nil
+		}
+		branch.Labels = append(branch.Labels, at(&ast.CaseLabel{
+			Low:  d.expression(label.Start, labelPath+".start"),
+			High: d.expression(label.End, labelPath+".end"),
+		}, pos))
+	}
+	branch.Body = d.statements(node.Statements, path+".statements")
+	return branch
+}
+
+// elements decodes the elements of a LeftExpression or VariableReference: a
+// variable followed by member and index accesses, all positioned at pos
+func (d *jsonDecoder) elements(raw json.RawMessage, path string, pos lexer.Position) ast.Expression {
+	var node struct {
+		jsonNode
+		Elements []json.RawMessage `json:"elements"`
+	}
+	if !d.fields(raw, path, &node) {
+		return nil
+	}
+	if len(node.Elements) == 0 {
+		d.fail(path, "reference has no elements")
+		return nil
+	}
+
+	var expr ast.Expression
+	for i, raw := range node.Elements {
+		var elem struct {
+			jsonNode
+			Member string          `json:"member"`
+			Index  json.RawMessage `json:"index"`
+		}
+		elemPath := fmt.Sprintf("%s.elements[%d]", path, i)
+		n, _, ok := d.open(raw, elemPath)
+		if !ok || !d.expect(n, elemPath, "ElementAccess") || !d.fields(raw, elemPath, &elem) {
+			return nil
+		}
+		d.require(elemPath, "member", elem.Member)
+
+		if expr == nil {
+			expr = at(&ast.Variable{Name: elem.Member}, pos)
+		} else {
+			expr = at(&ast.MemberAccess{Object: expr, Member: elem.Member}, pos)
+		}
+		if !absent(elem.Index) {
+			expr = at(&ast.ArrayAccess{
+				Array:   expr,
+				Indices: []ast.Expression{d.expression(elem.Index, elemPath+".index")},
+			}, pos)
+		}
+	}
+	return expr
+}
+
+// optionalExpression decodes an expression that may be left out
+func (d *jsonDecoder) optionalExpression(raw json.RawMessage, path string) ast.Expression {
+	if absent(raw) {
+		return nil
+	}
+	return d.expression(raw, path)
+}
+
+func (d *jsonDecoder) expression(raw json.RawMessage, path string) ast.Expression {
+	n, pos, ok := d.open(raw, path)
+	if !ok {
+		return nil
+	}
+
+	switch n.Type {
+	case "BinaryExpression":
+		var node struct {
+			jsonNode
+			Left     json.RawMessage `json:"left"`
+			Operator string          `json:"operator"`
+			Right    json.RawMessage `json:"right"`
+		}
+		if !d.fields(raw, path, &node) {
+			return nil
+		}
+		op := node.Operator
+		switch op {
+		case "&":
+			op = "AND"
+		case "OR", "XOR", "AND", "=", "<>", "<", "<=", ">", ">=", "+", "-", "*", "/", "MOD", "**":
+		default:
+			d.fail(path, "unknown operator %q", op)
+			return nil
+		}
+		return at(&ast.BinaryExpr{
+			Left:     d.expression(node.Left, path+".left"),
+			Operator: op,
+			Right:    d.expression(node.Right, path+".right"),
+		}, pos)
+
+	case "UnaryExpression":
+		var node struct {
+			jsonNode
+			Operator string          `json:"operator"`
+			Operand  json.RawMessage `json:"operand"`
+		}
+		if !d.fields(raw, path, &node) {
+			return nil
+		}
+		if node.Operator != "NOT" && node.Operator != "-" {
+			d.fail(path, "unknown operator %q", node.Operator)
+			return nil
+		}
+		return at(&ast.UnaryExpr{
+			Operator: node.Operator,
+			Operand:  d.expression(node.Operand, path+".operand"),
+		}, pos)
+
+	case "Literal":
+		var node struct {
+			jsonNode
+			Value json.RawMessage `json:"value"`
+		}
+		if !d.fields(raw, path, &node) {
+			return nil
+		}
+		lit := d.literal(node.Value, path+".value")
+		if lit == nil {
+			return nil
+		}
+		return at(lit, pos)
+
+	case "ParenExpression":
+		var node struct {
+			jsonNode
+			Expr json.RawMessage `json:"expr"`
+		}
+		if !d.fields(raw, path, &node) {
+			return nil
+		}
+		return d.expression(node.Expr, path+".expr")
+
+	case "VariableReference":
+		return d.elements(raw, path, pos)
+
+	case "EnumReference":
+		var node struct {
+			jsonNode
+			Value string `json:"value"`
+		}
+		if !d.fields(raw, path, &node) {
+			return nil
+		}
+		d.require(path, "value", node.Value)
+		if !strings.Contains(node.Value, "#") {
+			return at(&ast.Variable{Name: node.Value}, pos)
+		}
+		lit, err := ParseLiteral(node.Value)
+		if err != nil {
+			d.fail(path, "%v", err)
+			return nil
+		}
+		return at(lit, pos)
+
+	case "ArrayAccess":
+		var node struct {
+			jsonNode
+			Array json.RawMessage `json:"array"`
+			Index json.RawMessage `json:"index"`
+		}
+		if !d.fields(raw, path, &node) {
+			return nil
+		}
+		arrayPath := path + ".array"
+		array, arrayPos, ok := d.open(node.Array, arrayPath)
+		if !ok || !d.expect(array, arrayPath, "VariableReference") {
+			return nil
+		}
+		return at(&ast.ArrayAccess{
+			Array:   d.elements(node.Array, arrayPath, arrayPos),
+			Indices: []ast.Expression{d.expression(node.Index, path+".index")},
+		}, pos)
+
+	case "ArrayInitializer":
+		var node struct {
+			jsonNode
+			Elements []json.RawMessage `json:"elements"`
+		}
+		if !d.fields(raw, path, &node) {
+			return nil
+		}
+		lit := at(&ast.ArrayLiteral{}, pos)
+		for i, raw := range node.Elements {
+			lit.Elements = append(lit.Elements, &ast.ArrayElement{
+				Count: 1,
+				Value: d.expression(raw, fmt.Sprintf("%s.elements[%d]", path, i)),
+			})
+		}
+		return lit
+
+	case "FunctionCallExpression":
+		var node struct {
+			jsonNode
+			Call json.RawMessage `json:"call"`
+		}
+		if !d.fields(raw, path, &node) {
+			return nil
+		}
+		return d.call(node.Call, path+".call", pos)
+	}
+
+	d.fail(path, "unknown expression node %q", n.Type)
+	return nil
+}
+
+// call decodes a Call: a call of a function or function block instance, or
+// the member of an object read without arguments
+func (d *jsonDecoder) call(raw json.RawMessage, path string, pos lexer.Position) ast.Expression {
+	var node struct {
+		jsonNode
+		Func     json.RawMessage   `json:"func"`
+		Variable json.RawMessage   `json:"variable"`
+		Object   string            `json:"object"`
+		Member   string            `json:"member"`
+		Args     []json.RawMessage `json:"args"`
+	}
+	n, _, ok := d.open(raw, path)
+	if !ok || !d.expect(n, path, "Call") || !d.fields(raw, path, &node) {
+		return nil
+	}
+
+	var name string
+	switch {
+	case !absent(node.Func) && !absent(node.Variable):
+		d.fail(path, "call has both func and variable")
+		return nil
+	case !absent(node.Func):
+		name = d.reference(node.Func, path+".func")
+	case !absent(node.Variable):
+		name = d.reference(node.Variable, path+".variable")
+	case node.Object != "" && node.Member != "":
+		if len(node.Args) > 0 {
+			d.fail(path, "method calls are not supported")
+			return nil
+		}
+		return at(&ast.MemberAccess{
+			Object: at(&ast.Variable{Name: node.Object}, pos),
+			Member: node.Member,
+		}, pos)
+	default:
+		d.fail(path, "call has no func or variable")
+		return nil
+	}
+
+	call := at(&ast.CallExpr{Function: name}, pos)
+	for i, raw := range node.Args {
+		var arg struct {
+			jsonNode
+			Name  string          `json:"name"`
+			Value json.RawMessage `json:"value"`
+		}
+		argPath := fmt.Sprintf("%s.args[%d]", path, i)
+		n, argPos, ok := d.open(raw, argPath)
+		if !ok || !d.expect(n, argPath, "Argument") || !d.fields(raw, argPath, &arg) {
+			return nil
+		}
+		value := d.expression(arg.Value, argPath+".value")
+		if arg.Name == "" {
+			call.Args = append(call.Args, value)
+			continue
+		}
+		call.Args = append(call.Args, at(&ast.NamedArg{Name: arg.Name, Value: value}, argPos))
+	}
+	return call
+}
+
+// literal decodes the value of a Literal: a BOOL, a number whose JSON text
+// tells integers from reals, or the text of a string, typed, based or time literal
+func (d *jsonDecoder) literal(raw json.RawMessage, path string) *ast.Literal {
+	text := strings.TrimSpace(string(raw))
+	switch {
+	case absent(raw):
+		d.fail(path, "missing value")
+	case text == "true" || text == "false":
+		return &ast.Literal{Type: &BasicType{typeName: "BOOL"}, Value: text == "true"}
+	case text[0] == '"':
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			d.fail(path, "%s", strings.TrimPrefix(err.Error(), "json: "))
+			return nil
+		}
+		return d.textLiteral(s, path)
+	case strings.ContainsAny(text, ".eE"):
+		f, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			d.fail(path, "invalid number %s", text)
+			return nil
+		}
+		return &ast.Literal{Type: &BasicType{typeName: AnyReal}, Value: f}
+	default:
+		i, err := strconv.Atoi(text)
+		if err != nil {
+			d.fail(path, "invalid integer %s", text)
+			return nil
+		}
+		return &ast.Literal{Type: &BasicType{typeName: AnyInt}, Value: i}
+	}
+	return nil
+}
+
+// textLiteral decodes a literal written as text: a quoted string or a typed,
+// based or time literal
+func (d *jsonDecoder) textLiteral(text, path string) *ast.Literal {
+	if len(text) >= 2 && (text[0] == '\'' || text[0] == '"') && text[len(text)-1] == text[0] {
+		s, err := unquote(text)
+		if err != nil {
+			d.fail(path, "invalid string %s: %v", text, err)
+			return nil
+		}
+		return &ast.Literal{Type: &BasicType{typeName: "STRING"}, Value: s}
+	}
+	if strings.Contains(text, "#") {
+		lit, err := ParseLiteral(text)
+		if err != nil {
+			d.fail(path, "%v", err)
+			return nil
+		}
+		return lit
+	}
+	d.fail(path, "literal %q is neither a quoted string nor a typed literal", text)
+	return nil
+}
@@ -0,0 +1,282 @@
+package parser
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperdrive/core/apps/runtime/internal/parser/ast"
+)
+
+// Types of literals written without a type prefix. They take the type of the
+// variable or operand they are used with.
+const (
+	AnyInt  = "ANY_INT"
+	AnyReal = "ANY_REAL"
+)
+
+// TypedLiteral captures typed and based literals such as T#1s, 16#FF or INT#5,
+// decoding them while parsing so malformed values are reported with their position
+type TypedLiteral struct {
+	Literal *ast.Literal
+}
+
+func (t *TypedLiteral) Capture(values []string) error {
+	lit, err := ParseLiteral(values[0])
+	if err != nil {
+		return err
+	}
+	t.Literal = lit
+	return nil
+}
+
+var (
+	durationPart = regexp.MustCompile(`^(\d+(?:\.\d+)?)(d|h|ms|m|s|us|ns)`)
+	todPattern   = regexp.MustCompile(`^(\d+):(\d+)(?::(\d+(?:\.\d+)?))?$`)
+	datePattern  = regexp.MustCompile(`^(\d+)-(\d+)-(\d+)$`)
+)
+
+// typePrefixes maps the long and short literal prefixes to their type names
+var typePrefixes = map[string]string{
+	"T":             "TIME",
+	"TIME":          "TIME",
+	"LT":            "LTIME",
+	"LTIME":         "LTIME",
+	"D":             "DATE",
+	"DATE":          "DATE",
+	"TOD":           "TOD",
+	"TIME_OF_DAY":   "TOD",
+	"DT":            "DT",
+	"DATE_AND_TIME": "DT",
+}
+
+// ParseLiteral decodes the text of a typed or based literal. Durations are
+// returned as time.Duration, TOD as the time.Duration since midnight, DATE and
+// DT as a UTC time.Time, BOOL as bool, numbers as int or float64 and typed
+// enumeration values (State#Idle) as the value name.
+func ParseLiteral(text string) (*ast.Literal, error) {
+	hash := strings.Index(text, "#")
+	if hash < 0 {
+		return nil, fmt.Errorf("invalid literal %q", text)
+	}
+	prefix, body := strings.ToUpper(text[:hash]), text[hash+1:]
+
+	// Based integers such as 16#FF carry no type
+	switch prefix {
+	case "2", "8", "16":
+		n, err := parseBased(prefix, body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid literal %q: %w", text, err)
+		}
+		return &ast.Literal{Type: &BasicType{typeName: AnyInt}, Value: n}, nil
+	}
+
+	if prefix == "" || (prefix[0] >= '0' && prefix[0] <= '9') {
+		return nil, fmt.Errorf("invalid literal %q: unsupported base %s", text, prefix)
+	}
+
+	typeName, isTime := typePrefixes[prefix]
+	if !isTime {
+		typeName = text[:hash]
+	}
+
+	value, err := parseLiteralBody(strings.ToUpper(typeName), body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid literal %q: %w", text, err)
+	}
+	return &ast.Literal{Type: &BasicType{typeName: typeName}, Value: value}, nil
+}
+
+// unquote removes the quotes of a STRING ('...') or WSTRING ("...") literal
+// and decodes its escapes: $$, the quote preceded by $, $L or $N for a line
+// feed, $P for a form feed, $R, $T, and character codes of two hex digits in
+// a STRING or four in a WSTRING.
+func unquote(text string) (string, error) {
+	quote := text[0]
+	digits := 2
+	if quote == '"' {
+		digits = 4
+	}
+
+	var b strings.Builder
+	body := text[1 : len(text)-1]
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		if c != '$' {
+			b.WriteByte(c)
+			continue
+		}
+		if i+1 == len(body) {
+			return "", fmt.Errorf("unterminated escape $")
+		}
+		i++
+		switch e := body[i]; e {
+		case '$', '\'', '"':
+			if e != '$' && e != quote {
+				return "", fmt.Errorf("invalid escape $%c", e)
+			}
+			b.WriteByte(e)
+		case 'L', 'l', 'N', 'n':
+			b.WriteByte('\n')
+		case 'P', 'p':
+			b.WriteByte('\f')
+		case 'R', 'r':
+			b.WriteByte('\r')
+		case 'T', 't':
+			b.WriteByte('\t')
+		default:
+			if i+digits > len(body) {
+				return "", fmt.Errorf("invalid escape $%s", body[i:])
+			}
+			code, err := strconv.ParseUint(body[i:i+digits], 16, 32)
+			if err != nil {
+				return "", fmt.Errorf("invalid escape $%s", body[i:i+digits])
+			}
+			b.WriteRune(rune(code))
+			i += digits - 1
+		}
+	}
+	return b.String(), nil
+}
+
+func parseLiteralBody(typeName, body string) (interface{}, error) {
+	switch typeName {
+	case "TIME", "LTIME":
+		return parseDuration(body)
+	case "TOD":
+		return parseTimeOfDay(body)
+	case "DATE":
+		return parseDate(body)
+	case "DT":
+		// The time of day follows the last dash of the date
+		split := strings.LastIndex(body, "-")
+		if split < 0 {
+			return nil, fmt.Errorf("missing time of day")
+		}
+		date, err := parseDate(body[:split])
+		if err != nil {
+			return nil, err
+		}
+		tod, err := parseTimeOfDay(body[split+1:])
+		if err != nil {
+			return nil, err
+		}
+		return date.Add(tod), nil
+	case "BOOL":
+		// BOOL#0 and BOOL#1 are FALSE and TRUE
+		switch strings.ToUpper(body) {
+		case "TRUE", "1":
+			return true, nil
+		case "FALSE", "0":
+			return false, nil
+		}
+		return nil, fmt.Errorf("BOOL must be TRUE, FALSE, 0 or 1")
+	}
+
+	upper := strings.ToUpper(body)
+	switch {
+	case upper == "TRUE" || upper == "FALSE":
+		return upper == "TRUE", nil
+	case strings.Contains(body, "#"):
+		// Typed based integers such as WORD#16#FFFF
+		hash := strings.Index(body, "#")
+		return parseBased(body[:hash], body[hash+1:])
+	case body != "" && (body[0] == '-' || body[0] == '+' || (body[0] >= '0' && body[0] <= '9')):
+		return parseDecimal(body)
+	default:
+		// Typed enumeration values such as State#Idle
+		return body, nil
+	}
+}
+
+// parseDecimal parses an integer or real literal body, allowing _ separators
+func parseDecimal(text string) (interface{}, error) {
+	text = strings.ReplaceAll(text, "_", "")
+	if i, err := strconv.Atoi(text); err == nil {
+		return i, nil
+	}
+	return strconv.ParseFloat(text, 64)
+}
+
+// parseBased parses the digits of a base 2, 8 or 16 integer
+func parseBased(base, digits string) (int, error) {
+	b, err := strconv.Atoi(base)
+	if err != nil || (b != 2 && b != 8 && b != 16) {
+		return 0, fmt.Errorf("unsupported base %s", base)
+	}
+	n, err := strconv.ParseUint(strings.ReplaceAll(digits, "_", ""), b, 64)
+	if err != nil {
+		return 0, err
+	}
+	// Values above the signed range keep their bit pattern, as LWORD#16#FFFF_FFFF_FFFF_FFFF needs
+	return int(n), nil
+}
+
+// parseDuration parses the body of a TIME literal: an optionally negative
+// sequence of units from days down to nanoseconds, where the last unit may be fractional
+func parseDuration(body string) (time.Duration, error) {
+	s := strings.ReplaceAll(strings.ToLower(body), "_", "")
+	negative := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+	if s == "" {
+		return 0, fmt.Errorf("empty duration")
+	}
+
+	units := map[string]time.Duration{
+		"d":  24 * time.Hour,
+		"h":  time.Hour,
+		"m":  time.Minute,
+		"s":  time.Second,
+		"ms": time.Millisecond,
+		"us": time.Microsecond,
+		"ns": time.Nanosecond,
+	}
+
+	var total float64
+	for s != "" {
+		m := durationPart.FindStringSubmatch(s)
+		if m == nil {
+			return 0, fmt.Errorf("invalid duration %q", body)
+		}
+		n, _ := strconv.ParseFloat(m[1], 64)
+		total += n * float64(units[m[2]])
+		s = s[len(m[0]):]
+	}
+
+	d := time.Duration(math.Round(total))
+	if negative {
+		d = -d
+	}
+	return d, nil
+}
+
+// parseTimeOfDay parses hh:mm[:ss[.fff]] into the duration since midnight
+func parseTimeOfDay(body string) (time.Duration, error) {
+	m := todPattern.FindStringSubmatch(body)
+	if m == nil {
+		return 0, fmt.Errorf("invalid time of day %q", body)
+	}
+	hours, _ := strconv.Atoi(m[1])
+	minutes, _ := strconv.Atoi(m[2])
+	var seconds float64
+	if m[3] != "" {
+		seconds, _ = strconv.ParseFloat(m[3], 64)
+	}
+	if hours > 23 || minutes > 59 || seconds >= 60 {
+		return 0, fmt.Errorf("time of day %q out of range", body)
+	}
+	return time.Duration(hours)*time.Hour +
+		time.Duration(minutes)*time.Minute +
+		time.Duration(math.Round(seconds*float64(time.Second))), nil
+}
+
+// parseDate parses yyyy-mm-dd into midnight UTC of that day
+func parseDate(body string) (time.Time, error) {
+	if !datePattern.MatchString(body) {
+		return time.Time{}, fmt.Errorf("invalid date %q", body)
+	}
+	return time.Parse("2006-1-2", body)
+}
@@ -1,8 +1,13 @@
 package parser_test
 
 import (
+	"errors"
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/hyperdrive/core/apps/runtime/internal/diagnostics"
 	"github.com/hyperdrive/core/apps/runtime/internal/parser"
 	"github.com/hyperdrive/core/apps/runtime/internal/parser/ast"
 )
@@ -163,3 +168,749 @@ END_PROGRAM
 		t.Errorf("Expected second statement to be Assignment, got %T", program.Body[1])
 	}
 }
+
+func TestParseCompilationUnit(t *testing.T) {
+	code := `
+FUNCTION_BLOCK FB_Counter
+    VAR_INPUT
+        enable : BOOL;
+    END_VAR
+    VAR_OUTPUT
+        count : INT;
+    END_VAR
+    count := count + 1;
+END_FUNCTION_BLOCK
+
+FUNCTION Add : INT
+    VAR_INPUT
+        a : INT;
+        b : INT;
+    END_VAR
+    Add := a + b;
+END_FUNCTION
+
+PROGRAM Main
+    VAR
+        counter : FB_Counter;
+    END_VAR
+    counter(enable := TRUE);
+END_PROGRAM
+`
+
+	unit, err := parser.ParseCompilationUnit(code)
+	if err != nil {
+		t.Fatalf("Failed to parse compilation unit: %v", err)
+	}
+
+	if len(unit.POUs) != 3 {
+		t.Fatalf("Expected 3 POUs, got %d", len(unit.POUs))
+	}
+
+	fb, ok := unit.Lookup("FB_Counter")
+	if !ok || fb.Type != ast.ProgramFB {
+		t.Fatalf("Expected FUNCTION_BLOCK FB_Counter in unit")
+	}
+	if len(fb.VarsIn(ast.VarInput)) != 1 || len(fb.VarsIn(ast.VarOutput)) != 1 {
+		t.Errorf("Expected one input and one output on FB_Counter, got %d and %d",
+			len(fb.VarsIn(ast.VarInput)), len(fb.VarsIn(ast.VarOutput)))
+	}
+
+	fn, ok := unit.Lookup("Add")
+	if !ok || fn.Type != ast.ProgramFC {
+		t.Fatalf("Expected FUNCTION Add in unit")
+	}
+	if fn.ReturnType == nil || fn.ReturnType.TypeName() != "INT" {
+		t.Errorf("Expected Add to return INT, got %v", fn.ReturnType)
+	}
+
+	main, ok := unit.MainProgram()
+	if !ok || main.Name != "Main" {
+		t.Fatalf("Expected PROGRAM Main in unit")
+	}
+	if _, ok := main.Vars[0].Type.(*ast.FunctionBlockType); !ok {
+		t.Errorf("Expected counter to resolve to a function block type, got %T", main.Vars[0].Type)
+	}
+}
+
+func TestExpressionPrecedence(t *testing.T) {
+	tests := []struct {
+		expr     string
+		expected string
+	}{
+		{"1 + 2 * 3", "(1 + (2 * 3))"},
+		{"a - b - c", "((a - b) - c)"},
+		{"-a ** 2", "(-(a ** 2))"},
+		{"-2 ** 2", "(-(2 ** 2))"},
+		{"a ** 2 ** 3", "((a ** 2) ** 3)"},
+		{"a ** (-b)", "(a ** (-b))"},
+		{"a MOD 4 + 1", "((a MOD 4) + 1)"},
+		{"a < b = c > d", "((a < b) = (c > d))"},
+		{"a OR b AND NOT c XOR d", "(a OR ((b AND (NOT c)) XOR d))"},
+		{"a & b OR c", "((a AND b) OR c)"},
+		{"(1 + 2) * 3", "((1 + 2) * 3)"},
+		{"x-1", "(x - 1)"},
+		// Operator keywords followed by ( are not function calls
+		{"NOT(b)", "(NOT b)"},
+		{"b AND(c OR b)", "(b AND (c OR b))"},
+		{"7 MOD(3)", "(7 MOD 3)"},
+		{"b OR(c) XOR(d)", "(b OR (c XOR d))"},
+	}
+
+	for _, tt := range tests {
+		code := "PROGRAM Main\n    x := " + tt.expr + ";\nEND_PROGRAM"
+		program, err := parser.Parse(code)
+		if err != nil {
+			t.Errorf("Failed to parse %q: %v", tt.expr, err)
+			continue
+		}
+
+		assign, ok := program.Body[0].(*ast.Assignment)
+		if !ok {
+			t.Errorf("Expected assignment for %q, got %T", tt.expr, program.Body[0])
+			continue
+		}
+		if got := assign.Value.String(); got != tt.expected {
+			t.Errorf("Expected %q to parse as %s, got %s", tt.expr, tt.expected, got)
+		}
+	}
+}
+
+func TestParseCaseAndControlStatements(t *testing.T) {
+	code := `
+PROGRAM Main
+    VAR
+        state : INT;
+        i : INT;
+    END_VAR
+    CASE(state) OF
+        0: state := 1;
+        1, 2: state := 3;
+        10..20:
+            state := 0;
+            RETURN;
+    ELSE
+        state := -1;
+    END_CASE;
+    WHILE(TRUE) DO(* keywords may be followed by ( *)
+        CONTINUE;
+        EXIT;
+    END_WHILE;
+    IF(i > 0) THEN
+        i := 0;
+    ELSIF(i < 0) THEN
+        i := 1;
+    END_IF;
+    REPEAT
+        i := i + 1;
+    UNTIL(i > 3)
+    END_REPEAT;
+END_PROGRAM
+`
+
+	program, err := parser.Parse(code)
+	if err != nil {
+		t.Fatalf("Failed to parse program: %v", err)
+	}
+
+	caseStmt, ok := program.Body[0].(*ast.CaseStatement)
+	if !ok {
+		t.Fatalf("Expected CaseStatement, got %T", program.Body[0])
+	}
+	if len(caseStmt.Branches) != 3 {
+		t.Fatalf("Expected 3 CASE branches, got %d", len(caseStmt.Branches))
+	}
+	if len(caseStmt.Branches[1].Labels) != 2 {
+		t.Errorf("Expected 2 labels on second branch, got %d", len(caseStmt.Branches[1].Labels))
+	}
+	if label := caseStmt.Branches[2].Labels[0].String(); label != "10..20" {
+		t.Errorf("Expected range label 10..20, got %s", label)
+	}
+	if _, ok := caseStmt.Branches[2].Body[1].(*ast.ReturnStatement); !ok {
+		t.Errorf("Expected RETURN in third branch, got %T", caseStmt.Branches[2].Body[1])
+	}
+	if len(caseStmt.Else) != 1 {
+		t.Errorf("Expected 1 ELSE statement, got %d", len(caseStmt.Else))
+	}
+
+	loop, ok := program.Body[1].(*ast.WhileStatement)
+	if !ok {
+		t.Fatalf("Expected WhileStatement, got %T", program.Body[1])
+	}
+	if _, ok := loop.Body[0].(*ast.ContinueStatement); !ok {
+		t.Errorf("Expected CONTINUE, got %T", loop.Body[0])
+	}
+	if _, ok := loop.Body[1].(*ast.ExitStatement); !ok {
+		t.Errorf("Expected EXIT, got %T", loop.Body[1])
+	}
+	if _, ok := program.Body[2].(*ast.IfStatement); !ok {
+		t.Errorf("Expected IfStatement, got %T", program.Body[2])
+	}
+}
+
+func TestParseLiteral(t *testing.T) {
+	date := time.Date(2024, 3, 15, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		text     string
+		typeName string
+		value    interface{}
+	}{
+		{"T#1h30m", "TIME", 90 * time.Minute},
+		{"TIME#1.5s", "TIME", 1500 * time.Millisecond},
+		{"t#-2s_500ms", "TIME", -2500 * time.Millisecond},
+		{"LTIME#5us", "LTIME", 5 * time.Microsecond},
+		{"16#FF", parser.AnyInt, 255},
+		{"2#1010_1010", parser.AnyInt, 170},
+		{"8#17", parser.AnyInt, 15},
+		{"INT#-5", "INT", -5},
+		{"WORD#16#FFFF", "WORD", 65535},
+		{"REAL#2.5", "REAL", 2.5},
+		{"BOOL#TRUE", "BOOL", true},
+		{"BOOL#1", "BOOL", true},
+		{"BOOL#0", "BOOL", false},
+		{"State#Idle", "State", "Idle"},
+		{"D#2024-03-15", "DATE", date},
+		{"TOD#12:30:15.5", "TOD", 12*time.Hour + 30*time.Minute + 15500*time.Millisecond},
+		{"DT#2024-03-15-08:00:00", "DT", date.Add(8 * time.Hour)},
+	}
+
+	for _, tt := range tests {
+		lit, err := parser.ParseLiteral(tt.text)
+		if err != nil {
+			t.Errorf("%s: %v", tt.text, err)
+			continue
+		}
+		if lit.Type.TypeName() != tt.typeName {
+			t.Errorf("%s: expected type %s, got %s", tt.text, tt.typeName, lit.Type.TypeName())
+		}
+		if lit.Value != tt.value {
+			t.Errorf("%s: expected %v, got %v", tt.text, tt.value, lit.Value)
+		}
+	}
+
+	for _, text := range []string{"D#2024-13-01", "TOD#25:00", "T#5x", "3#12", "BOOL#2", "BOOL#on"} {
+		if _, err := parser.ParseLiteral(text); err == nil {
+			t.Errorf("%s: expected error", text)
+		}
+	}
+
+	// Malformed literals in source code are reported by the parser
+	_, err := parser.ParseCompilationUnit(`
+PROGRAM Main
+    VAR
+        d : DATE := D#2024-02-30;
+    END_VAR
+END_PROGRAM
+`)
+	if err == nil {
+		t.Errorf("Expected parse error for invalid date literal")
+	}
+}
+
+func TestSourcePositions(t *testing.T) {
+	unit, err := parser.ParseFile("main.st", `PROGRAM Main
+    VAR
+        count : INT;
+    END_VAR
+
+    IF count > 10 THEN
+        count := -count;
+    END_IF;
+END_PROGRAM
+`)
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+
+	prog := unit.POUs[0]
+	ifStmt := prog.Body[0].(*ast.IfStatement)
+	cond := ifStmt.Condition.(*ast.BinaryExpr)
+	assign := ifStmt.Then[0].(*ast.Assignment)
+	negate := assign.Value.(*ast.UnaryExpr)
+
+	tests := []struct {
+		node         ast.Node
+		line, column int
+	}{
+		{prog, 1, 1},
+		{prog.Vars[0], 3, 9},
+		{prog.Vars[0].Type, 3, 17},
+		{ifStmt, 6, 5},
+		{cond, 6, 8},
+		{cond.Right, 6, 16},
+		{assign, 7, 9},
+		{assign.Variable, 7, 9},
+		{negate, 7, 18},
+		{negate.Operand, 7, 19},
+	}
+	for _, tt := range tests {
+		pos := tt.node.Position()
+		if pos.File != "main.st" || pos.Line != tt.line || pos.Column != tt.column {
+			t.Errorf("%s: expected main.st:%d:%d, got %s", tt.node, tt.line, tt.column, pos)
+		}
+	}
+
+	// Syntax errors are reported as diagnostics at the offending token
+	_, err = parser.ParseFile("main.st", "PROGRAM Main\n    x := ;\nEND_PROGRAM")
+	var d *diagnostics.Diagnostic
+	if !errors.As(err, &d) {
+		t.Fatalf("Expected a diagnostic, got %v", err)
+	}
+	if d.File != "main.st" || d.Line != 2 || d.Severity != diagnostics.SeverityError || d.Code != diagnostics.CodeSyntax {
+		t.Errorf("Unexpected diagnostic %+v", d)
+	}
+}
+
+func TestCommentsAndPragmas(t *testing.T) {
+	unit, err := parser.ParseFile("main.st", `(* Mixer control (* nested *) *)
+{attribute 'qualified_only'}
+PROGRAM Main
+VAR
+    // Speed setpoint
+    speed : INT; (* in rpm *)
+    {attribute 'hide'}
+    level : REAL := 0.5;    (* fill level, *)
+                            (* 0 to 1 *)
+    running : BOOL; // pump state
+END_VAR
+
+{info 'check the level scaling'}
+(* Program logic *)
+speed := 10; (* slow *)
+END_PROGRAM
+`)
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+
+	prog := unit.POUs[0]
+	comments := []string{"Mixer control (* nested *)", "Program logic", "slow"}
+	if len(prog.Comments) != len(comments) {
+		t.Fatalf("Expected program comments %q, got %q", comments, prog.Comments)
+	}
+	for i, c := range comments {
+		if prog.Comments[i] != c {
+			t.Errorf("Expected program comment %q, got %q", c, prog.Comments[i])
+		}
+	}
+	if _, ok := prog.Attributes["qualified_only"]; !ok {
+		t.Errorf("Expected attribute qualified_only, got %v", prog.Attributes)
+	}
+
+	vars := []struct {
+		comment    string
+		attributes map[string]string
+	}{
+		{"Speed setpoint\nin rpm", nil},
+		{"fill level,\n0 to 1", map[string]string{"hide": ""}},
+		{"pump state", nil},
+	}
+	for i, want := range vars {
+		v := prog.Vars[i]
+		if v.Comment != want.comment {
+			t.Errorf("%s: expected comment %q, got %q", v.Name, want.comment, v.Comment)
+		}
+		if len(v.Attributes) != len(want.attributes) {
+			t.Errorf("%s: expected attributes %v, got %v", v.Name, want.attributes, v.Attributes)
+		}
+		for name, value := range want.attributes {
+			if got, ok := v.Attributes[name]; !ok || got != value {
+				t.Errorf("%s: expected attribute %s = %q, got %v", v.Name, name, value, v.Attributes)
+			}
+		}
+	}
+
+	if len(unit.Messages) != 1 || unit.Messages[0].Text != "check the level scaling" || unit.Messages[0].Position().Line != 13 {
+		t.Errorf("Unexpected info messages %v", unit.Messages)
+	}
+
+	// Comments inside a statement are skipped like whitespace
+	unit, err = parser.ParseFile("main.st", "PROGRAM Main\nVAR x : INT; END_VAR\nx := (* one *) 1 (* plus *) + 2;\nEND_PROGRAM")
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	if len(unit.POUs[0].Body) != 1 {
+		t.Errorf("Expected one statement, got %v", unit.POUs[0].Body)
+	}
+
+	_, err = parser.ParseFile("main.st", "PROGRAM Main\n(* open (* nested *)\nEND_PROGRAM")
+	var d *diagnostics.Diagnostic
+	if !errors.As(err, &d) || d.Line != 2 || d.Message != "unterminated comment" {
+		t.Errorf("Expected an unterminated comment diagnostic, got %v", err)
+	}
+}
+
+func TestVarSections(t *testing.T) {
+	unit, err := parser.ParseFile("main.st", `
+VAR_GLOBAL RETAIN
+    total : DINT;
+END_VAR
+
+FUNCTION_BLOCK Scale
+    VAR_IN_OUT value : INT; END_VAR
+    VAR_TEMP tmp : INT; END_VAR
+    VAR_EXTERNAL CONSTANT limit : INT; END_VAR
+    tmp := value * 2;
+    value := tmp;
+END_FUNCTION_BLOCK
+
+PROGRAM Main
+    VAR CONSTANT factor : INT := 3; END_VAR
+    VAR PERSISTENT RETAIN counter : INT; END_VAR
+    VAR_GLOBAL CONSTANT limit : INT := 100; END_VAR
+END_PROGRAM
+`)
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+
+	if len(unit.Globals) != 1 || unit.Globals[0].Section != ast.VarGlobal || unit.Globals[0].Retention != ast.Retain {
+		t.Errorf("Unexpected globals %+v", unit.Globals)
+	}
+
+	expected := []struct {
+		pou, name string
+		section   ast.VarSection
+		constant  bool
+		retention ast.Retention
+	}{
+		{"Scale", "value", ast.VarInOut, false, ast.NonRetain},
+		{"Scale", "tmp", ast.VarTemp, false, ast.NonRetain},
+		{"Scale", "limit", ast.VarExternal, true, ast.NonRetain},
+		{"Main", "factor", ast.VarLocal, true, ast.NonRetain},
+		{"Main", "counter", ast.VarLocal, false, ast.Persistent},
+		{"Main", "limit", ast.VarGlobal, true, ast.NonRetain},
+	}
+	var decls []*ast.VarDecl
+	for _, pou := range unit.POUs {
+		decls = append(decls, pou.Vars...)
+	}
+	if len(decls) != len(expected) {
+		t.Fatalf("Expected %d variables, got %d", len(expected), len(decls))
+	}
+	for i, want := range expected {
+		d := decls[i]
+		if d.Name != want.name || d.Section != want.section || d.Constant != want.constant || d.Retention != want.retention {
+			t.Errorf("Expected %s.%s in %s (constant %v, %q), got %+v", want.pou, want.name, want.section, want.constant, want.retention, d)
+		}
+	}
+
+	if params := unit.POUs[0].Parameters(); len(params) != 1 || params[0].Name != "value" {
+		t.Errorf("Unexpected parameters %v", params)
+	}
+
+	if _, err := parser.ParseFile("main.st", "VAR_INPUT x : INT; END_VAR"); err == nil {
+		t.Errorf("Expected VAR_INPUT outside a POU to be rejected")
+	}
+}
+
+func TestLocatedVariables(t *testing.T) {
+	unit, err := parser.ParseFile("main.st", `
+PROGRAM Main
+    VAR
+        StartButton AT %IX0.0 : BOOL;
+        Speed AT %QW4 : INT;
+        Flag AT %M2 : BOOL;
+        Plain : INT;
+    END_VAR
+END_PROGRAM
+`)
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+
+	expected := []string{"%IX0.0", "%QW4", "%MX2", ""}
+	for i, want := range expected {
+		loc := unit.POUs[0].Vars[i].Location
+		got := ""
+		if loc != nil {
+			got = loc.String()
+		}
+		if got != want {
+			t.Errorf("Expected location %q, got %q", want, got)
+		}
+	}
+	if loc := unit.POUs[0].Vars[1].Location; loc.Area != 'Q' || loc.Size != 'W' || loc.Bits() != 16 {
+		t.Errorf("Unexpected location %+v", loc)
+	}
+}
+
+func TestStringTypes(t *testing.T) {
+	unit, err := parser.ParseFile("main.st", `
+TYPE Label : STRING[16]; END_TYPE
+
+PROGRAM Main
+    VAR
+        name : STRING[20] := 'pump';
+        wide : WSTRING[8];
+        plain : STRING;
+    END_VAR
+END_PROGRAM
+`)
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+
+	if got := unit.Types[0].Type.(*ast.StringType); got.Length != 16 || got.Wide {
+		t.Errorf("Unexpected type %s", got)
+	}
+	expected := []string{"STRING[20]", "WSTRING[8]", "STRING"}
+	for i, want := range expected {
+		if got := unit.POUs[0].Vars[i].Type.String(); got != want {
+			t.Errorf("Expected type %s, got %s", want, got)
+		}
+	}
+	if got := unit.POUs[0].Vars[1].Type.TypeName(); got != "WSTRING" {
+		t.Errorf("Expected WSTRING[8] to name WSTRING, got %s", got)
+	}
+
+	// $ escapes are decoded in both kinds of literals
+	escapes := map[string]string{
+		`'it$'s'`:         "it's",
+		`'$$5 "quoted"'`:  `$5 "quoted"`,
+		`'a$Lb$nc$R$T$P'`: "a\nb\nc\r\t\f",
+		`'$41$42'`:        "AB",
+		`"say $"hi$""`:    `say "hi"`,
+		`"$00E9t$00e9"`:   "été",
+		`'it''s'`:         "",
+		`'$'`:             "",
+		`'$G1'`:           "",
+		`"$'"`:            "",
+	}
+	for literal, want := range escapes {
+		unit, err := parser.ParseFile("main.st", "PROGRAM Main\n    VAR s : STRING; END_VAR\n    s := "+literal+";\nEND_PROGRAM")
+		if want == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error", literal)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", literal, err)
+			continue
+		}
+		got := unit.POUs[0].Body[0].(*ast.Assignment).Value.(*ast.Literal).Value
+		if got != want {
+			t.Errorf("%s: expected %q, got %q", literal, want, got)
+		}
+	}
+}
+
+// deployAST is the deploy AST of deploySource
+const deployAST = `{
+	"$type": "Program",
+	"enumTypes": [{"$type": "EnumType", "name": "Mode", "enumValues": [
+		{"$type": "EnumValue", "name": "Idle"}, {"$type": "EnumValue", "name": "Run", "value": 5}
+	]}],
+	"functionBlocks": [{
+		"$type": "FunctionBlock", "name": "Counter",
+		"varDeclarations": [
+			{"$type": "VarDeclaration", "section": "VAR_INPUT", "variables": [
+				{"$type": "VariableDecl", "name": "step", "type": {"$type": "SimpleType", "name": "INT"}}
+			]},
+			{"$type": "VarDeclaration", "section": "VAR_OUTPUT", "qualifiers": ["RETAIN"], "variables": [
+				{"$type": "VariableDecl", "name": "total", "type": {"$type": "SimpleType", "name": "INT"}}
+			]}
+		],
+		"body": {"$type": "ProgramBody", "statements": [{
+			"$type": "Assignment",
+			"target": {"$type": "LeftExpression", "elements": [{"$type": "ElementAccess", "member": "total"}]},
+			"value": {"$type": "BinaryExpression", "operator": "+",
+				"left": {"$type": "VariableReference", "elements": [{"$type": "ElementAccess", "member": "total"}]},
+				"right": {"$type": "VariableReference", "elements": [{"$type": "ElementAccess", "member": "step"}]}}
+		}]}
+	}],
+	"functions": [{
+		"$type": "FunctionDef", "name": "Twice", "returnType": {"$type": "SimpleType", "name": "INT"},
+		"varDeclarations": [{"$type": "VarDeclaration", "section": "VAR_INPUT", "variables": [
+			{"$type": "VariableDecl", "name": "x", "type": {"$type": "SimpleType", "name": "INT"}}
+		]}],
+		"body": {"$type": "ProgramBody", "statements": [{
+			"$type": "ReturnStatement",
+			"value": {"$type": "BinaryExpression", "operator": "*",
+				"left": {"$type": "VariableReference", "elements": [{"$type": "ElementAccess", "member": "x"}]},
+				"right": {"$type": "Literal", "value": 2}}
+		}]}
+	}],
+	"programs": [{
+		"$type": "ProgramDecl", "name": "Main",
+		"varDeclarations": [{"$type": "VarDeclaration", "variables": [
+			{"$type": "VariableDecl", "name": "c", "type": {"$type": "SimpleType", "name": "Counter"}},
+			{"$type": "VariableDecl", "name": "mode", "type": {"$type": "EnumTypeReference", "type": {"$refText": "Mode"}}},
+			{"$type": "VariableDecl", "name": "level", "type": {"$type": "SimpleType", "name": "INT",
+				"rangeConstraint": {"start": {"$type": "Literal", "value": 0}, "end": {"$type": "Literal", "value": 100}}}},
+			{"$type": "VariableDecl", "name": "buf", "type": {"$type": "ArrayType",
+				"dimensions": [{"$type": "ArrayDimension", "start": 1, "end": "3"}], "type": {"$type": "SimpleType", "name": "REAL"}},
+				"initialValue": {"$type": "ArrayInitializer", "elements": [{"$type": "Literal", "value": 1.5}]}},
+			{"$type": "VariableDecl", "name": "lamp", "location": "%QX0.1", "type": {"$type": "SimpleType", "name": "BOOL"}}
+		]}],
+		"body": {"$type": "ProgramBody", "statements": [
+			{"$type": "FunctionCall", "call": {"$type": "Call", "variable": {"$refText": "c"}, "args": [
+				{"$type": "Argument", "name": "step", "value": {"$type": "FunctionCallExpression",
+					"call": {"$type": "Call", "func": {"$refText": "Twice"}, "args": [{"$type": "Argument", "value": {"$type": "Literal", "value": 3}}]}}}
+			]}},
+			{"$type": "IfStatement",
+				"condition": {"$type": "BinaryExpression", "operator": ">",
+					"left": {"$type": "FunctionCallExpression", "call": {"$type": "Call", "object": "c", "member": "total"}},
+					"right": {"$type": "Literal", "value": 100}},
+				"thenStatements": [{"$type": "Assignment",
+					"target": {"$type": "LeftExpression", "elements": [{"$type": "ElementAccess", "member": "mode"}]},
+					"value": {"$type": "EnumReference", "value": "Mode#Run"}}],
+				"elseIfConditions": [{"$type": "UnaryExpression", "operator": "NOT",
+					"operand": {"$type": "ParenExpression", "expr": {"$type": "VariableReference", "elements": [{"$type": "ElementAccess", "member": "lamp"}]}}}],
+				"elseIfStatements": [[{"$type": "Assignment",
+					"target": {"$type": "LeftExpression", "elements": [{"$type": "ElementAccess", "member": "buf", "index": {"$type": "Literal", "value": 2}}]},
+					"value": {"$type": "Literal", "value": 0.5}}]],
+				"elseStatements": [{"$type": "Assignment",
+					"target": {"$type": "LeftExpression", "elements": [{"$type": "ElementAccess", "member": "mode"}]},
+					"value": {"$type": "EnumReference", "value": "Idle"}}]},
+			{"$type": "CaseStatement", "expression": {"$type": "VariableReference", "elements": [{"$type": "ElementAccess", "member": "level"}]},
+				"branches": [{"$type": "CaseBranch",
+					"labels": [{"$type": "Literal", "value": 1}, {"$type": "CaseRange", "start": {"$type": "Literal", "value": 5}, "end": {"$type": "Literal", "value": 9}}],
+					"statements": [{"$type": "Assignment",
+						"target": {"$type": "LeftExpression", "elements": [{"$type": "ElementAccess", "member": "lamp"}]},
+						"value": {"$type": "Literal", "value": true}}]}],
+				"defaultStatements": [{"$type": "ExitStatement"}]}
+		]}
+	}]
+}`
+
+const deploySource = `
+TYPE Mode : (Idle, Run := 5); END_TYPE
+
+FUNCTION_BLOCK Counter
+    VAR_INPUT step : INT; END_VAR
+    VAR_OUTPUT RETAIN total : INT; END_VAR
+    total := total + step;
+END_FUNCTION_BLOCK
+
+FUNCTION Twice : INT
+    VAR_INPUT x : INT; END_VAR
+    Twice := x * 2;
+    RETURN;
+END_FUNCTION
+
+PROGRAM Main
+    VAR
+        c : Counter;
+        mode : Mode;
+        level : INT(0..100);
+        buf : ARRAY[1..3] OF REAL := [1.5];
+        lamp AT %QX0.1 : BOOL;
+    END_VAR
+    c(step := Twice(3));
+    IF c.total > 100 THEN
+        mode := Mode#Run;
+    ELSIF NOT (lamp) THEN
+        buf[2] := 0.5;
+    ELSE
+        mode := Idle;
+    END_IF;
+    CASE level OF
+        1, 5..9: lamp := TRUE;
+    ELSE
+        EXIT;
+    END_CASE;
+END_PROGRAM
+`
+
+// dump renders statements with their nested statements for comparison
+func dump(stmts []ast.Statement) string {
+	var b strings.Builder
+	for _, stmt := range stmts {
+		switch s := stmt.(type) {
+		case *ast.IfStatement:
+			fmt.Fprintf(&b, "IF %s {%s}", s.Condition, dump(s.Then))
+			for _, clause := range s.ElseIf {
+				fmt.Fprintf(&b, " ELSIF %s {%s}", clause.Condition, dump(clause.Then))
+			}
+			fmt.Fprintf(&b, " ELSE {%s}", dump(s.Else))
+		case *ast.CaseStatement:
+			fmt.Fprintf(&b, "CASE %s", s.Selector)
+			for _, branch := range s.Branches {
+				fmt.Fprintf(&b, " %v {%s}", branch.Labels, dump(branch.Body))
+			}
+			fmt.Fprintf(&b, " ELSE {%s}", dump(s.Else))
+		default:
+			fmt.Fprint(&b, stmt)
+		}
+		b.WriteString("; ")
+	}
+	return b.String()
+}
+
+func TestDecodeJSON(t *testing.T) {
+	decoded, err := parser.DecodeJSON("main.st", []byte(deployAST))
+	if err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+	parsed, err := parser.ParseFile("main.st", deploySource)
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+
+	// The decoded unit matches the one parsed from the same program's source
+	if got, want := decoded.Types[0].Type.(*ast.EnumType).Values[1].Value, 5; got != want {
+		t.Errorf("Expected Run to be %d, got %d", want, got)
+	}
+	if len(decoded.POUs) != len(parsed.POUs) {
+		t.Fatalf("Expected %d POUs, got %d", len(parsed.POUs), len(decoded.POUs))
+	}
+	for i, want := range parsed.POUs {
+		got := decoded.POUs[i]
+		if got.Name != want.Name || got.Type != want.Type || fmt.Sprint(got.ReturnType) != fmt.Sprint(want.ReturnType) {
+			t.Errorf("Expected %s %s, got %s %s", want.Type, want.Name, got.Type, got.Name)
+		}
+		if len(got.Vars) != len(want.Vars) {
+			t.Fatalf("Expected %d variables in %s, got %d", len(want.Vars), want.Name, len(got.Vars))
+		}
+		for j, w := range want.Vars {
+			g := got.Vars[j]
+			if g.Name != w.Name || g.Section != w.Section || g.Retention != w.Retention ||
+				g.Type.String() != w.Type.String() || fmt.Sprint(g.InitExpr) != fmt.Sprint(w.InitExpr) ||
+				fmt.Sprint(g.Location) != fmt.Sprint(w.Location) {
+				t.Errorf("Expected variable %+v, got %+v", w, g)
+			}
+		}
+		if got, want := dump(got.Body), dump(want.Body); got != want {
+			t.Errorf("Expected body of %s\n  %s\ngot\n  %s", parsed.POUs[i].Name, want, got)
+		}
+	}
+	if _, ok := decoded.POUs[2].Vars[0].Type.(*ast.FunctionBlockType); !ok {
+		t.Errorf("Expected c to be an instance of Counter, got %T", decoded.POUs[2].Vars[0].Type)
+	}
+}
+
+func TestDecodeJSONRejectsUnknownNodes(t *testing.T) {
+	program := func(statement string) string {
+		return `{"$type": "Program", "programs": [{"$type": "ProgramDecl", "name": "Main",
+			"body": {"$type": "ProgramBody", "statements": [` + statement + `]}}]}`
+	}
+	tests := []struct {
+		name string
+		ast  string
+		want string
+	}{
+		{"root", `{"name": "Main", "statements": []}`, "$: node has no $type"},
+		{"statement", program(`{"$type": "GotoStatement"}`), `programs[0].body.statements[0]: unknown statement node "GotoStatement"`},
+		{"expression", program(`{"$type": "Assignment",
+			"target": {"$type": "LeftExpression", "elements": [{"$type": "ElementAccess", "member": "x"}]},
+			"value": {"$type": "IntLiteral", "value": 1}}`), `programs[0].body.statements[0].value: unknown expression node "IntLiteral"`},
+		{"field", program(`{"$type": "ExitStatement", "label": "outer"}`), `programs[0].body.statements[0]: unknown field "label"`},
+		{"call", program(`{"$type": "FunctionCall", "call": {"$type": "Call", "args": []}}`), "programs[0].body.statements[0].call: call has no func or variable"},
+		{"literal", program(`{"$type": "Assignment",
+			"target": {"$type": "LeftExpression", "elements": [{"$type": "ElementAccess", "member": "x"}]},
+			"value": {"$type": "Literal", "value": "abc"}}`), `programs[0].body.statements[0].value.value: literal "abc" is neither a quoted string nor a typed literal`},
+	}
+	for _, tt := range tests {
+		_, err := parser.DecodeJSON("main.st", []byte(tt.ast))
+		var d *diagnostics.Diagnostic
+		if !errors.As(err, &d) {
+			t.Errorf("%s: expected a diagnostic, got %v", tt.name, err)
+			continue
+		}
+		if d.Message != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.want, d.Message)
+		}
+	}
+}
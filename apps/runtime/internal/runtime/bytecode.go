@@ -0,0 +1,698 @@
+package runtime
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/hyperdrive/core/apps/runtime/internal/parser/ast"
+	"github.com/hyperdrive/core/apps/runtime/internal/stdlib"
+)
+
+// opcode is a bytecode instruction. The operands a, b and c index the tables
+// of the chunk, the variable slots of the frame it runs against, the locals
+// of the run or the code itself for jumps.
+type opcode uint8
+
+const (
+	opConst     opcode = iota // Push consts[a]
+	opLoad                    // Push the value of slot a
+	opStore                   // Pop a value and assign it to slot a
+	opRef                     // Push the variable in slot a
+	opMember                  // Replace the variable on top by its member names[a]; names[b] is the object
+	opIndex                   // Pop a indices and replace the array variable below by the element; names[b] and names[c] are the access and the array
+	opValue                   // Replace the variable on top by its value
+	opAssign                  // Pop a value and the variable below it and assign the value
+	opWritable                // Fail if the variable in slot a is CONSTANT
+	opBinary                  // Pop two operands and push the result of operator names[a]; b selects a fast path
+	opUnary                   // Pop an operand and push the result of operator names[a]
+	opList                    // Pop the elements of array initializer lists[a] and push the values
+	opCall                    // Pop the arguments of calls[a] and push the result of the function
+	opStandard                // Pop the arguments of standard[a] and push the result of the function
+	opInvoke                  // Pop the arguments of calls[a] and invoke the instance in slot b
+	opPop                     // Discard the top of the stack
+	opJump                    // Continue at a
+	opJumpFalse               // Pop a condition and continue at a if it is FALSE; names[b] is the construct
+	opJumpTrue                // Pop a BOOL and continue at a if it is TRUE
+	opSetLocal                // Pop a value into local a
+	opGetLocal                // Push local a
+	opForInit                 // Pop FROM, TO and BY, keep TO and BY in locals b and b+1 and assign FROM to slot a
+	opForTest                 // Continue at c if the counter in slot a has passed TO in local b
+	opForStep                 // Add BY in local b+1 to the counter in slot a, continuing at c if it overflows
+	opReturn                  // End the body
+)
+
+// instr is one bytecode instruction with its operands
+type instr struct {
+	op      opcode
+	a, b, c int
+}
+
+// chunk is the bytecode of a POU body. Variables are referenced by slot; the
+// slots are bound to the variables of an instance or call frame before the
+// chunk runs, so executing it takes no name lookups.
+type chunk struct {
+	code     []instr
+	stmts    []ast.Statement // Statement each instruction belongs to, for error positions
+	consts   []interface{}
+	names    []string // Operators, member names and expressions for error messages
+	slots    []string // Variable bound to each slot
+	counters []bool   // Slots of FOR counters not declared in the POU
+	calls    []*callSite
+	standard []*standardSite
+	lists    [][]int // Repeat counts of the elements of array initializers
+	locals   int     // Values kept while running, such as the bounds of FOR loops
+
+	revision uint64 // Library revision the chunk was compiled against
+	err      error  // Why the body could not be compiled
+}
+
+// callSite is a call to a function or function block
+type callSite struct {
+	pou   *ast.Program
+	names []string // Formal parameter of each argument; "" if passed by position
+	refs  []bool   // Arguments passed as a variable to a VAR_IN_OUT parameter
+}
+
+// args pops the arguments of the call from the stack
+func (s *callSite) args(stack []interface{}) ([]callArg, []interface{}) {
+	base := len(stack) - len(s.names)
+	args := make([]callArg, len(s.names))
+	for i, name := range s.names {
+		args[i].Name = name
+		if s.refs[i] {
+			args[i].Ref = stack[base+i].(*Variable)
+		} else {
+			args[i].Value = stack[base+i]
+		}
+	}
+	return args, stack[:base]
+}
+
+// standardSite is a call to a standard function whose arguments have been
+// mapped onto the function's inputs
+type standardSite struct {
+	name      string
+	fn        standardFunc
+	positions []int
+}
+
+// compiler translates a POU body into a chunk
+type compiler struct {
+	p     *Program
+	c     *chunk
+	decls map[string]*ast.VarDecl
+	slots map[string]int
+	stmt  ast.Statement // Statement being compiled
+	loops []*loopJumps  // Enclosing loops, innermost last
+}
+
+// loopJumps collects the EXIT and CONTINUE jumps of a loop until their
+// targets are known
+type loopJumps struct {
+	exits, continues []int
+}
+
+// chunkFor returns the bytecode of a POU body, compiling it on first use and
+// again whenever the library changes. It returns nil for bodies that run on
+// the tree walker.
+func (p *Program) chunkFor(pou *ast.Program) *chunk {
+	if p.interpretAST {
+		return nil
+	}
+
+	revision := p.lib.Revision()
+	c, ok := p.chunks[pou]
+	if !ok || c.revision != revision {
+		var err error
+		if c, err = p.compile(pou); err != nil {
+			log.Printf("%s: running %s on the tree walker: %v", p.Name, pou.Name, err)
+			c = &chunk{err: err}
+		}
+		c.revision = revision
+		if p.chunks == nil {
+			p.chunks = make(map[*ast.Program]*chunk)
+		}
+		p.chunks[pou] = c
+	}
+	if c.err != nil {
+		return nil
+	}
+	return c
+}
+
+// compile translates the body of a POU. Constructs the compiler does not
+// handle are reported as errors, leaving the body to the tree walker.
+func (p *Program) compile(pou *ast.Program) (*chunk, error) {
+	comp := &compiler{
+		p:     p,
+		c:     &chunk{},
+		decls: make(map[string]*ast.VarDecl, len(pou.Vars)+1),
+		slots: make(map[string]int),
+	}
+	for _, decl := range pou.Vars {
+		comp.decls[decl.Name] = decl
+	}
+	// The function name acts as the variable holding the return value
+	if pou.Type == ast.ProgramFC && pou.ReturnType != nil {
+		comp.decls[pou.Name] = &ast.VarDecl{Name: pou.Name, Type: pou.ReturnType}
+	}
+
+	if err := comp.statements(pou.Body); err != nil {
+		return nil, err
+	}
+	return comp.c, nil
+}
+
+func (comp *compiler) emit(op opcode, a, b, c int) int {
+	comp.c.code = append(comp.c.code, instr{op: op, a: a, b: b, c: c})
+	comp.c.stmts = append(comp.c.stmts, comp.stmt)
+	return len(comp.c.code) - 1
+}
+
+// patch points the jump at pc to the next instruction
+func (comp *compiler) patch(pc int) {
+	comp.c.code[pc].a = len(comp.c.code)
+}
+
+func (comp *compiler) constant(val interface{}) int {
+	comp.c.consts = append(comp.c.consts, val)
+	return len(comp.c.consts) - 1
+}
+
+func (comp *compiler) name(s string) int {
+	comp.c.names = append(comp.c.names, s)
+	return len(comp.c.names) - 1
+}
+
+func (comp *compiler) local() int {
+	comp.c.locals++
+	return comp.c.locals - 1
+}
+
+// variable returns the slot of a variable declared in the POU or globally
+func (comp *compiler) variable(name string) (int, bool) {
+	if slot, ok := comp.slots[name]; ok {
+		return slot, true
+	}
+	if _, ok := comp.decls[name]; !ok {
+		if _, ok := comp.p.lib.Global(name); !ok {
+			return 0, false
+		}
+	}
+	return comp.addSlot(name, false), true
+}
+
+func (comp *compiler) addSlot(name string, counter bool) int {
+	slot := len(comp.c.slots)
+	comp.c.slots = append(comp.c.slots, name)
+	comp.c.counters = append(comp.c.counters, counter)
+	comp.slots[name] = slot
+	return slot
+}
+
+// decl returns the declaration of a variable visible in the POU
+func (comp *compiler) decl(name string) (*ast.VarDecl, bool) {
+	if decl, ok := comp.decls[name]; ok {
+		return decl, true
+	}
+	if g, ok := comp.p.lib.global(name); ok {
+		return g.decl, true
+	}
+	return nil, false
+}
+
+func (comp *compiler) statements(stmts []ast.Statement) error {
+	saved := comp.stmt
+	defer func() { comp.stmt = saved }()
+
+	for _, stmt := range stmts {
+		comp.stmt = stmt
+		if err := comp.statement(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (comp *compiler) statement(stmt ast.Statement) error {
+	switch s := stmt.(type) {
+	case *ast.Assignment:
+		return comp.assignment(s)
+	case *ast.IfStatement:
+		return comp.ifStatement(s)
+	case *ast.CaseStatement:
+		return comp.caseStatement(s)
+	case *ast.WhileStatement:
+		return comp.whileStatement(s)
+	case *ast.RepeatStatement:
+		return comp.repeatStatement(s)
+	case *ast.ForStatement:
+		return comp.forStatement(s)
+	case *ast.ExitStatement:
+		if len(comp.loops) == 0 {
+			return errExit
+		}
+		loop := comp.loops[len(comp.loops)-1]
+		loop.exits = append(loop.exits, comp.emit(opJump, 0, 0, 0))
+	case *ast.ContinueStatement:
+		if len(comp.loops) == 0 {
+			return errContinue
+		}
+		loop := comp.loops[len(comp.loops)-1]
+		loop.continues = append(loop.continues, comp.emit(opJump, 0, 0, 0))
+	case *ast.ReturnStatement:
+		comp.emit(opReturn, 0, 0, 0)
+	default:
+		return fmt.Errorf("unsupported statement type: %T", stmt)
+	}
+	return nil
+}
+
+func (comp *compiler) assignment(s *ast.Assignment) error {
+	// Invocations of function block instances
+	if call, ok := s.Value.(*ast.CallExpr); ok {
+		if decl, ok := comp.decl(call.Function); ok {
+			if fb, ok := comp.p.lib.FunctionBlock(decl.Type.TypeName()); ok {
+				slot, _ := comp.variable(call.Function)
+				site, err := comp.arguments(fb, call.Args)
+				if err != nil {
+					return err
+				}
+				comp.emit(opInvoke, site, slot, 0)
+				return nil
+			}
+		}
+	}
+
+	if err := comp.expression(s.Value); err != nil {
+		return err
+	}
+
+	switch target := s.Variable.(type) {
+	case nil:
+		// Call statements are represented as assignments without a target
+		comp.emit(opPop, 0, 0, 0)
+	case *ast.Variable:
+		slot, ok := comp.variable(target.Name)
+		if !ok {
+			return fmt.Errorf("undefined variable: %s", target.Name)
+		}
+		comp.emit(opStore, slot, 0, 0)
+	default:
+		if err := comp.reference(target); err != nil {
+			return err
+		}
+		if err := comp.writable(target); err != nil {
+			return err
+		}
+		comp.emit(opAssign, 0, 0, 0)
+	}
+	return nil
+}
+
+// writable checks at run time that the variable at the root of a member or
+// element access is not CONSTANT
+func (comp *compiler) writable(expr ast.Expression) error {
+	for {
+		switch e := expr.(type) {
+		case *ast.Variable:
+			slot, ok := comp.variable(e.Name)
+			if !ok {
+				return fmt.Errorf("undefined variable: %s", e.Name)
+			}
+			comp.emit(opWritable, slot, 0, 0)
+			return nil
+		case *ast.MemberAccess:
+			expr = e.Object
+		case *ast.ArrayAccess:
+			expr = e.Array
+		default:
+			return fmt.Errorf("invalid variable reference: %s", expr)
+		}
+	}
+}
+
+func (comp *compiler) ifStatement(s *ast.IfStatement) error {
+	var ends []int
+	branch := func(cond ast.Expression, construct string, body []ast.Statement) error {
+		if err := comp.expression(cond); err != nil {
+			return err
+		}
+		next := comp.emit(opJumpFalse, 0, comp.name(construct), 0)
+		if err := comp.statements(body); err != nil {
+			return err
+		}
+		ends = append(ends, comp.emit(opJump, 0, 0, 0))
+		comp.patch(next)
+		return nil
+	}
+
+	if err := branch(s.Condition, "IF", s.Then); err != nil {
+		return err
+	}
+	for _, elseIf := range s.ElseIf {
+		if err := branch(elseIf.Condition, "ELSIF", elseIf.Then); err != nil {
+			return err
+		}
+	}
+	if err := comp.statements(s.Else); err != nil {
+		return err
+	}
+	for _, end := range ends {
+		comp.patch(end)
+	}
+	return nil
+}
+
+func (comp *compiler) caseStatement(s *ast.CaseStatement) error {
+	if err := comp.expression(s.Selector); err != nil {
+		return err
+	}
+	selector := comp.local()
+	comp.emit(opSetLocal, selector, 0, 0)
+
+	// Labels are tested in order; each match jumps to the body of its branch
+	matches := make([][]int, len(s.Branches))
+	for i, branch := range s.Branches {
+		for _, label := range branch.Labels {
+			comp.emit(opGetLocal, selector, 0, 0)
+			if err := comp.expression(label.Low); err != nil {
+				return err
+			}
+			if label.High == nil {
+				comp.binary("=")
+				matches[i] = append(matches[i], comp.emit(opJumpTrue, 0, 0, 0))
+				continue
+			}
+
+			comp.binary(">=")
+			below := comp.emit(opJumpFalse, 0, comp.name("CASE"), 0)
+			comp.emit(opGetLocal, selector, 0, 0)
+			if err := comp.expression(label.High); err != nil {
+				return err
+			}
+			comp.binary("<=")
+			matches[i] = append(matches[i], comp.emit(opJumpTrue, 0, 0, 0))
+			comp.patch(below)
+		}
+	}
+
+	var ends []int
+	if err := comp.statements(s.Else); err != nil {
+		return err
+	}
+	ends = append(ends, comp.emit(opJump, 0, 0, 0))
+	for i, branch := range s.Branches {
+		for _, match := range matches[i] {
+			comp.patch(match)
+		}
+		if err := comp.statements(branch.Body); err != nil {
+			return err
+		}
+		ends = append(ends, comp.emit(opJump, 0, 0, 0))
+	}
+	for _, end := range ends {
+		comp.patch(end)
+	}
+	return nil
+}
+
+// loop compiles a loop body, returning the jumps of its EXIT and CONTINUE statements
+func (comp *compiler) loop(body []ast.Statement) (*loopJumps, error) {
+	jumps := &loopJumps{}
+	comp.loops = append(comp.loops, jumps)
+	defer func() { comp.loops = comp.loops[:len(comp.loops)-1] }()
+
+	return jumps, comp.statements(body)
+}
+
+// close points the EXIT jumps of a loop to the next instruction and its
+// CONTINUE jumps to next
+func (comp *compiler) close(jumps *loopJumps, next int) {
+	for _, pc := range jumps.continues {
+		comp.c.code[pc].a = next
+	}
+	for _, pc := range jumps.exits {
+		comp.patch(pc)
+	}
+}
+
+func (comp *compiler) whileStatement(s *ast.WhileStatement) error {
+	top := len(comp.c.code)
+	if err := comp.expression(s.Condition); err != nil {
+		return err
+	}
+	end := comp.emit(opJumpFalse, 0, comp.name("WHILE"), 0)
+	jumps, err := comp.loop(s.Body)
+	if err != nil {
+		return err
+	}
+	comp.emit(opJump, top, 0, 0)
+	comp.patch(end)
+	comp.close(jumps, top)
+	return nil
+}
+
+func (comp *compiler) repeatStatement(s *ast.RepeatStatement) error {
+	top := len(comp.c.code)
+	jumps, err := comp.loop(s.Body)
+	if err != nil {
+		return err
+	}
+	cond := len(comp.c.code)
+	if err := comp.expression(s.Condition); err != nil {
+		return err
+	}
+	comp.emit(opJumpFalse, top, comp.name("UNTIL"), 0)
+	comp.close(jumps, cond)
+	return nil
+}
+
+func (comp *compiler) forStatement(s *ast.ForStatement) error {
+	counter, declared := comp.variable(s.Variable)
+	if !declared {
+		// The control variable only exists for the loop's duration
+		counter = comp.addSlot(s.Variable, true)
+		defer delete(comp.slots, s.Variable)
+	}
+
+	if err := comp.expression(s.From); err != nil {
+		return err
+	}
+	if err := comp.expression(s.To); err != nil {
+		return err
+	}
+	if s.By != nil {
+		if err := comp.expression(s.By); err != nil {
+			return err
+		}
+	} else {
+		comp.emit(opConst, comp.constant(1), 0, 0)
+	}
+
+	bounds := comp.local()
+	comp.local()
+	comp.emit(opForInit, counter, bounds, 0)
+	test := comp.emit(opForTest, counter, bounds, 0)
+	jumps, err := comp.loop(s.Body)
+	if err != nil {
+		return err
+	}
+	step := comp.emit(opForStep, counter, bounds, 0)
+	comp.emit(opJump, test, 0, 0)
+	comp.c.code[test].c = len(comp.c.code)
+	comp.c.code[step].c = len(comp.c.code)
+	comp.close(jumps, step)
+	return nil
+}
+
+// binary operators with a fast path for operands of the same type
+const (
+	fastNone = iota
+	fastAdd
+	fastSub
+	fastMul
+	fastLT
+	fastGT
+	fastLE
+	fastGE
+	fastEQ
+	fastNE
+	fastAnd
+	fastOr
+	fastXor
+)
+
+var fastOperators = map[string]int{
+	"+":   fastAdd,
+	"-":   fastSub,
+	"*":   fastMul,
+	"<":   fastLT,
+	">":   fastGT,
+	"<=":  fastLE,
+	">=":  fastGE,
+	"=":   fastEQ,
+	"<>":  fastNE,
+	"AND": fastAnd,
+	"&":   fastAnd,
+	"OR":  fastOr,
+	"XOR": fastXor,
+}
+
+func (comp *compiler) binary(op string) {
+	comp.emit(opBinary, comp.name(op), fastOperators[op], 0)
+}
+
+func (comp *compiler) expression(expr ast.Expression) error {
+	switch e := expr.(type) {
+	case *ast.Variable:
+		if slot, ok := comp.variable(e.Name); ok {
+			comp.emit(opLoad, slot, 0, 0)
+			return nil
+		}
+		if enum, ok := comp.p.lib.EnumValue(e.Name); ok {
+			comp.emit(opConst, comp.constant(enum), 0, 0)
+			return nil
+		}
+		return fmt.Errorf("undefined variable: %s", e.Name)
+	case *ast.Literal:
+		val, err := comp.p.literalValue(e)
+		if err != nil {
+			return err
+		}
+		comp.emit(opConst, comp.constant(val), 0, 0)
+	case *ast.NamedArg:
+		return comp.expression(e.Value)
+	case *ast.BinaryExpr:
+		if err := comp.expression(e.Left); err != nil {
+			return err
+		}
+		if err := comp.expression(e.Right); err != nil {
+			return err
+		}
+		comp.binary(e.Operator)
+	case *ast.UnaryExpr:
+		if err := comp.expression(e.Operand); err != nil {
+			return err
+		}
+		comp.emit(opUnary, comp.name(e.Operator), 0, 0)
+	case *ast.CallExpr:
+		return comp.call(e)
+	case *ast.ArrayAccess, *ast.MemberAccess:
+		if err := comp.reference(e); err != nil {
+			return err
+		}
+		comp.emit(opValue, 0, 0, 0)
+	case *ast.ArrayLiteral:
+		counts := make([]int, len(e.Elements))
+		for i, elem := range e.Elements {
+			if elem.Value == nil {
+				comp.emit(opConst, comp.constant(nil), 0, 0)
+			} else if err := comp.expression(elem.Value); err != nil {
+				return err
+			}
+			counts[i] = elem.Count
+		}
+		comp.c.lists = append(comp.c.lists, counts)
+		comp.emit(opList, len(comp.c.lists)-1, 0, 0)
+	default:
+		return fmt.Errorf("unsupported expression type: %T", expr)
+	}
+	return nil
+}
+
+// reference compiles an expression that pushes the variable it refers to
+func (comp *compiler) reference(expr ast.Expression) error {
+	switch e := expr.(type) {
+	case *ast.Variable:
+		slot, ok := comp.variable(e.Name)
+		if !ok {
+			return fmt.Errorf("undefined variable: %s", e.Name)
+		}
+		comp.emit(opRef, slot, 0, 0)
+	case *ast.MemberAccess:
+		if err := comp.reference(e.Object); err != nil {
+			return err
+		}
+		comp.emit(opMember, comp.name(e.Member), comp.name(e.Object.String()), 0)
+	case *ast.ArrayAccess:
+		if err := comp.reference(e.Array); err != nil {
+			return err
+		}
+		for _, idx := range e.Indices {
+			if err := comp.expression(idx); err != nil {
+				return err
+			}
+		}
+		comp.emit(opIndex, len(e.Indices), comp.name(e.String()), comp.name(e.Array.String()))
+	default:
+		return fmt.Errorf("invalid variable reference: %s", expr)
+	}
+	return nil
+}
+
+// call compiles a call to a user-defined or standard function
+func (comp *compiler) call(e *ast.CallExpr) error {
+	if fn, ok := comp.p.lib.Function(e.Function); ok {
+		site, err := comp.arguments(fn, e.Args)
+		if err != nil {
+			return err
+		}
+		comp.emit(opCall, site, 0, 0)
+		return nil
+	}
+
+	fn, ok := standardFunction(e.Function)
+	if !ok {
+		return fmt.Errorf("undefined function: %s", e.Function)
+	}
+	// Named arguments are mapped onto the function's inputs once, here
+	names := make([]string, len(e.Args))
+	for i, arg := range e.Args {
+		if named, ok := arg.(*ast.NamedArg); ok {
+			names[i] = named.Name
+			arg = named.Value
+		}
+		if err := comp.expression(arg); err != nil {
+			return err
+		}
+	}
+	positions, err := stdlib.Positions(e.Function, names)
+	if err != nil {
+		return err
+	}
+	comp.c.standard = append(comp.c.standard, &standardSite{name: e.Function, fn: fn, positions: positions})
+	comp.emit(opStandard, len(comp.c.standard)-1, 0, 0)
+	return nil
+}
+
+// arguments compiles the actual parameters of a call to pou and returns its call site
+func (comp *compiler) arguments(pou *ast.Program, args []ast.Expression) (int, error) {
+	params := pou.Parameters()
+	site := &callSite{pou: pou}
+	for i, arg := range args {
+		var name string
+		if named, ok := arg.(*ast.NamedArg); ok {
+			name = named.Name
+			arg = named.Value
+		}
+
+		// VAR_IN_OUT parameters take the variable itself
+		inOut := false
+		if param := parameter(params, name, i); param != nil && param.Section == ast.VarInOut {
+			inOut = true
+			if err := comp.reference(arg); err != nil {
+				return 0, err
+			}
+			if err := comp.writable(arg); err != nil {
+				return 0, err
+			}
+		} else if err := comp.expression(arg); err != nil {
+			return 0, err
+		}
+		site.names = append(site.names, name)
+		site.refs = append(site.refs, inOut)
+	}
+	comp.c.calls = append(comp.c.calls, site)
+	return len(comp.c.calls) - 1, nil
+}
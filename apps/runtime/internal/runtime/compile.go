@@ -0,0 +1,95 @@
+package runtime
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/hyperdrive/core/apps/runtime/internal/checker"
+	"github.com/hyperdrive/core/apps/runtime/internal/diagnostics"
+	"github.com/hyperdrive/core/apps/runtime/internal/parser"
+	"github.com/hyperdrive/core/apps/runtime/internal/parser/ast"
+)
+
+// CompileError is returned when source code is refused because it has errors
+type CompileError struct {
+	Diagnostics diagnostics.List
+}
+
+func (e *CompileError) Error() string {
+	var messages []string
+	for _, d := range e.Diagnostics {
+		if d.Severity == diagnostics.SeverityError {
+			messages = append(messages, d.Error())
+		}
+	}
+	return "compilation failed: " + strings.Join(messages, "; ")
+}
+
+// Compile checks the files of a project without deploying them and returns
+// the problems found. Files are compiled against each other and the deployed
+// files they do not replace, as a deploy would, so POUs declared in one file
+// can be used from another.
+func (r *Runtime) Compile(files []DeployRequest) diagnostics.List {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	paths, err := filePaths(files)
+	if err != nil {
+		return diagnostics.List{diagnostics.FromError(err, "", diagnostics.CodeSemantic)}
+	}
+	_, diags := compile(files, r.deployedFiles(paths))
+	return diags
+}
+
+// compile parses and checks files. The files in context only contribute their
+// declarations and are not reported on. It returns the unit of every file, nil
+// for files that could not be parsed.
+func compile(files []DeployRequest, context []DeployRequest) ([]*ast.CompilationUnit, diagnostics.List) {
+	var result diagnostics.List
+	c := checker.New()
+
+	for _, file := range context {
+		if unit, err := parseFile(file); err == nil {
+			c.Declare(unit)
+		}
+	}
+
+	units := make([]*ast.CompilationUnit, len(files))
+	for i, file := range files {
+		unit, err := parseFile(file)
+		if err != nil {
+			result = append(result, diagnostics.FromError(err, file.FilePath, diagnostics.CodeSyntax))
+			continue
+		}
+		c.Declare(unit)
+		units[i] = unit
+	}
+
+	for _, unit := range units {
+		if unit != nil {
+			result = append(result, c.Check(unit)...)
+		}
+	}
+
+	return units, result
+}
+
+// parseFile returns the unit declared by a file: its AST decoded or, without
+// an AST, its source code parsed. The editor sends both and accepts dialects
+// the native parser does not, so its AST is what gets deployed; either way
+// the unit is checked before it is deployed.
+func parseFile(file DeployRequest) (*ast.CompilationUnit, error) {
+	if len(file.AST) > 0 && string(file.AST) != "null" {
+		unit, err := parser.DecodeJSON(file.FilePath, file.AST)
+		if err != nil && file.SourceCode != "" {
+			log.Printf("Could not decode the AST of %s, parsing its source: %v", file.FilePath, err)
+			return parser.ParseFile(file.FilePath, file.SourceCode)
+		}
+		return unit, err
+	}
+	if file.SourceCode == "" {
+		return nil, fmt.Errorf("%s has neither source code nor an AST", file.FilePath)
+	}
+	return parser.ParseFile(file.FilePath, file.SourceCode)
+}
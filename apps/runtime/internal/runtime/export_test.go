@@ -0,0 +1,19 @@
+package runtime
+
+import "time"
+
+// ExecuteCycle runs one scan of the deployed tasks
+func (r *Runtime) ExecuteCycle() {
+	r.executeCycle()
+}
+
+// InterpretAST makes the program run its POU bodies on the tree walker
+// instead of compiling them to bytecode
+func (p *Program) InterpretAST() {
+	p.interpretAST = true
+}
+
+// RunDue runs the tasks due at now as the scheduler does
+func (r *Runtime) RunDue(now time.Time) time.Time {
+	return r.runDue(now)
+}
@@ -0,0 +1,326 @@
+package runtime
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+
+	"github.com/hyperdrive/core/apps/runtime/internal/parser/ast"
+	"github.com/hyperdrive/core/apps/runtime/internal/stdlib"
+)
+
+// standardFunc implements a standard function on arguments ordered by position
+type standardFunc func(args []interface{}) (interface{}, error)
+
+// standardFunctions implements the IEC 61131-3 standard functions other than
+// the *_TO_* type conversions. The checker has verified the number and types
+// of the arguments; the overload is selected by the runtime type of the values.
+var standardFunctions = map[string]standardFunc{
+	"ABS":   abs,
+	"SQRT":  realFunction(math.Sqrt),
+	"LN":    realFunction(math.Log),
+	"LOG":   realFunction(math.Log10),
+	"EXP":   realFunction(math.Exp),
+	"SIN":   realFunction(math.Sin),
+	"COS":   realFunction(math.Cos),
+	"TAN":   realFunction(math.Tan),
+	"ASIN":  realFunction(math.Asin),
+	"ACOS":  realFunction(math.Acos),
+	"ATAN":  realFunction(math.Atan),
+	"EXPT":  expt,
+	"TRUNC": trunc,
+	"SHL":   shift(func(bits uint64, n, width uint) uint64 { return bits << n }),
+	"SHR":   shift(func(bits uint64, n, width uint) uint64 { return bits >> n }),
+	"ROL":   shift(func(bits uint64, n, width uint) uint64 { return bits<<(n%width) | bits>>(width-n%width) }),
+	"ROR":   shift(func(bits uint64, n, width uint) uint64 { return bits>>(n%width) | bits<<(width-n%width) }),
+	"MAX":   extreme(func(a, b interface{}) (bool, error) { return less(b, a) }),
+	"MIN":   extreme(less),
+	"LIMIT": limit,
+	"SEL":   sel,
+	"MUX":   mux,
+
+	"LEN":     stringLen,
+	"LEFT":    stringLeft,
+	"RIGHT":   stringRight,
+	"MID":     stringMid,
+	"CONCAT":  stringConcat,
+	"INSERT":  stringInsert,
+	"DELETE":  stringDelete,
+	"REPLACE": stringReplace,
+	"FIND":    stringFind,
+}
+
+// conversionPattern matches the names of type conversion functions such as INT_TO_REAL
+var conversionPattern = regexp.MustCompile(`^([A-Z_]+?)_TO_([A-Z_]+)$`)
+
+// standardFunction returns the implementation of a standard function
+func standardFunction(name string) (standardFunc, bool) {
+	name = strings.ToUpper(name)
+	if fn, ok := standardFunctions[name]; ok {
+		return fn, true
+	}
+
+	m := conversionPattern.FindStringSubmatch(name)
+	if m == nil {
+		return nil, false
+	}
+	from, ok := elementaryType(m[1])
+	if !ok {
+		return nil, false
+	}
+	to, ok := elementaryType(m[2])
+	if !ok {
+		return nil, false
+	}
+	return func(args []interface{}) (interface{}, error) {
+		// Untyped literals take the source type before being converted
+		val := args[0]
+		if _, typed := valueType(val); !typed {
+			var err error
+			if val, err = coerce(val, from); err != nil {
+				return nil, err
+			}
+		}
+		return convertValue(val, to)
+	}, true
+}
+
+// callStandard calls a standard function on n arguments evaluated by eval.
+// Named arguments such as SEL(G := ..., IN0 := ..., IN1 := ...) are ordered by
+// the function's inputs; names holds "" for arguments passed by position.
+func callStandard(name string, fn standardFunc, names []string, eval func(i int) (interface{}, error)) (interface{}, error) {
+	positions, err := stdlib.Positions(name, names)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]interface{}, len(names))
+	for i := range names {
+		val, err := eval(i)
+		if err != nil {
+			return nil, err
+		}
+		values[positions[i]] = val
+	}
+	result, err := fn(values)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return result, nil
+}
+
+// evaluateStandardCall evaluates a call to a standard function
+func (p *Program) evaluateStandardCall(name string, fn standardFunc, args []ast.Expression) (interface{}, error) {
+	names := make([]string, len(args))
+	exprs := make([]ast.Expression, len(args))
+	for i, arg := range args {
+		exprs[i] = arg
+		if named, ok := arg.(*ast.NamedArg); ok {
+			names[i], exprs[i] = named.Name, named.Value
+		}
+	}
+	return callStandard(name, fn, names, func(i int) (interface{}, error) {
+		return p.evaluateExpression(exprs[i])
+	})
+}
+
+func abs(args []interface{}) (interface{}, error) {
+	switch v := args[0].(type) {
+	case int:
+		if v < 0 {
+			return -v, nil
+		}
+		return v, nil
+	case float32:
+		return float32(math.Abs(float64(v))), nil
+	case float64:
+		return math.Abs(v), nil
+	}
+
+	t, _ := valueType(args[0])
+	bits, ok := integerBits(args[0])
+	if !ok {
+		return nil, fmt.Errorf("invalid argument %s", typeNameOf(args[0]))
+	}
+	if elementaryTypes[t].class == classSigned && int64(bits) < 0 {
+		bits = -bits
+	}
+	return wrapInteger(bits, t), nil
+}
+
+// realFunction implements a function on ANY_REAL: REAL arguments give a REAL
+// and other numbers an LREAL
+func realFunction(f func(float64) float64) standardFunc {
+	return func(args []interface{}) (interface{}, error) {
+		if v, ok := args[0].(float32); ok {
+			return float32(f(float64(v))), nil
+		}
+		v, ok := toFloat(args[0])
+		if !ok {
+			return nil, fmt.Errorf("invalid argument %s", typeNameOf(args[0]))
+		}
+		return f(v), nil
+	}
+}
+
+func expt(args []interface{}) (interface{}, error) {
+	exp, ok := toFloat(args[1])
+	if !ok {
+		return nil, fmt.Errorf("invalid exponent %s", typeNameOf(args[1]))
+	}
+	return realFunction(func(base float64) float64 { return math.Pow(base, exp) })(args[:1])
+}
+
+// trunc rounds a REAL towards zero to a DINT
+func trunc(args []interface{}) (interface{}, error) {
+	v, ok := toFloat(args[0])
+	if !ok {
+		return nil, fmt.Errorf("invalid argument %s", typeNameOf(args[0]))
+	}
+	return int32(math.Trunc(v)), nil
+}
+
+// shift implements the bit shift and rotate functions on the width of the
+// shifted value; untyped literals are shifted as 64 bit values
+func shift(op func(bits uint64, n, width uint) uint64) standardFunc {
+	return func(args []interface{}) (interface{}, error) {
+		bits, ok := integerBits(args[0])
+		if !ok {
+			return nil, fmt.Errorf("invalid argument %s", typeNameOf(args[0]))
+		}
+		n, ok := toInt(args[1])
+		if !ok || n < 0 {
+			return nil, fmt.Errorf("invalid shift count %v", args[1])
+		}
+
+		t, typed := valueType(args[0])
+		width := uint(64)
+		if typed {
+			width = uint(elementaryTypes[t].bits)
+		}
+		mask := uint64(math.MaxUint64) >> (64 - width)
+		result := op(bits&mask, uint(n), width) & mask
+		if !typed {
+			return int(result), nil
+		}
+		return wrapInteger(result, t), nil
+	}
+}
+
+// unify converts numeric arguments to the widest of their types, which untyped
+// literals adopt. Other arguments are returned unchanged.
+func unify(args []interface{}) ([]interface{}, error) {
+	var common DataType
+	typed := false
+	for _, arg := range args {
+		if _, ok := toFloat(arg); !ok {
+			return args, nil
+		}
+		if t, ok := valueType(arg); ok {
+			if typed {
+				common = widerType(common, t)
+			} else {
+				common, typed = t, true
+			}
+		}
+	}
+	if !typed {
+		return args, nil
+	}
+
+	result := make([]interface{}, len(args))
+	for i, arg := range args {
+		val, err := coerce(arg, common)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = val
+	}
+	return result, nil
+}
+
+// less compares numbers, strings and time values
+func less(a, b interface{}) (bool, error) {
+	if s, ok := a.(string); ok {
+		if t, ok := b.(string); ok {
+			return s < t, nil
+		}
+	}
+	result, err := evaluateBinaryOp(a, "<", b)
+	if err != nil {
+		return false, err
+	}
+	lt, _ := result.(bool)
+	return lt, nil
+}
+
+// extreme implements MAX and MIN, returning the argument that comes first
+// in the order given by before
+func extreme(before func(a, b interface{}) (bool, error)) standardFunc {
+	return func(args []interface{}) (interface{}, error) {
+		args, err := unify(args)
+		if err != nil {
+			return nil, err
+		}
+		result := args[0]
+		for _, arg := range args[1:] {
+			first, err := before(arg, result)
+			if err != nil {
+				return nil, err
+			}
+			if first {
+				result = arg
+			}
+		}
+		return result, nil
+	}
+}
+
+// limit implements LIMIT(MN, IN, MX)
+func limit(args []interface{}) (interface{}, error) {
+	args, err := unify(args)
+	if err != nil {
+		return nil, err
+	}
+	mn, in, mx := args[0], args[1], args[2]
+	if below, err := less(in, mn); err != nil || below {
+		return mn, err
+	}
+	if above, err := less(mx, in); err != nil || above {
+		return mx, err
+	}
+	return in, nil
+}
+
+// sel implements SEL(G, IN0, IN1), selecting IN1 if G is TRUE
+func sel(args []interface{}) (interface{}, error) {
+	g, ok := args[0].(bool)
+	if !ok {
+		return nil, fmt.Errorf("invalid selector %s", typeNameOf(args[0]))
+	}
+	inputs, err := unify(args[1:])
+	if err != nil {
+		return nil, err
+	}
+	if g {
+		return inputs[1], nil
+	}
+	return inputs[0], nil
+}
+
+// mux implements MUX(K, IN0, ..., INn), selecting input K
+func mux(args []interface{}) (interface{}, error) {
+	k, ok := toInt(args[0])
+	if !ok {
+		return nil, fmt.Errorf("invalid selector %s", typeNameOf(args[0]))
+	}
+	inputs, err := unify(args[1:])
+	if err != nil {
+		return nil, err
+	}
+	if k < 0 || k >= len(inputs) {
+		return nil, fmt.Errorf("selector %d out of range 0..%d", k, len(inputs)-1)
+	}
+	return inputs[k], nil
+}
@@ -0,0 +1,229 @@
+package runtime
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/hyperdrive/core/apps/runtime/internal/parser/ast"
+)
+
+// ProcessImage holds the input, output and memory areas located variables
+// are mapped to. Bit addresses %IX4.2 select bit 2 of byte 4; byte, word,
+// double and long word addresses count in units of their own size, so %IW1
+// covers bytes 2 and 3. Multi-byte values are stored little-endian.
+type ProcessImage struct {
+	Inputs  []byte `json:"inputs"`
+	Outputs []byte `json:"outputs"`
+	Memory  []byte `json:"memory"`
+}
+
+// area returns the part of the image a location addresses
+func (img *ProcessImage) area(loc *ast.Location) *[]byte {
+	switch loc.Area {
+	case 'I':
+		return &img.Inputs
+	case 'Q':
+		return &img.Outputs
+	}
+	return &img.Memory
+}
+
+func (img *ProcessImage) clone() ProcessImage {
+	return ProcessImage{
+		Inputs:  append([]byte(nil), img.Inputs...),
+		Outputs: append([]byte(nil), img.Outputs...),
+		Memory:  append([]byte(nil), img.Memory...),
+	}
+}
+
+// ioBinding maps a located variable onto the process image
+type ioBinding struct {
+	loc    *ast.Location
+	offset int // First byte addressed
+	bit    int // Bit within the byte, for bit addresses
+	v      *Variable
+}
+
+// locate checks that a variable fits the location it is declared at and
+// returns its mapping onto the process image
+func locate(v *Variable, loc *ast.Location) (ioBinding, error) {
+	b := ioBinding{loc: loc, v: v}
+	switch {
+	case loc.Size == 'X' && len(loc.Index) == 2:
+		b.offset, b.bit = loc.Index[0], loc.Index[1]
+		if b.bit > 7 {
+			return b, fmt.Errorf("bit %d of %s is out of range 0..7", b.bit, loc)
+		}
+	case loc.Size != 'X' && len(loc.Index) == 1:
+		b.offset = loc.Index[0] * loc.Bits() / 8
+	default:
+		return b, fmt.Errorf("unsupported address %s", loc)
+	}
+
+	info, ok := elementaryTypes[v.DataType]
+	if !ok {
+		return b, fmt.Errorf("cannot locate a variable of type %s", v.DataType)
+	}
+	switch info.class {
+	case classBool:
+		if loc.Size == 'X' {
+			return b, nil
+		}
+	case classSigned, classUnsigned, classBits, classReal:
+		if info.bits == loc.Bits() {
+			return b, nil
+		}
+	default:
+		return b, fmt.Errorf("cannot locate a variable of type %s", v.DataType)
+	}
+	return b, fmt.Errorf("cannot locate %s at %s", v.DataType, loc)
+}
+
+// size returns the number of bytes a binding covers
+func (b ioBinding) size() int {
+	return (b.loc.Bits() + 7) / 8
+}
+
+// read sets the variable from the image
+func (b ioBinding) read(img *ProcessImage) {
+	data := *img.area(b.loc)
+	size := b.size()
+	if b.offset+size > len(data) {
+		return
+	}
+
+	if b.loc.Size == 'X' {
+		b.v.Value = data[b.offset]&(1<<b.bit) != 0
+		return
+	}
+	var buf [8]byte
+	copy(buf[:], data[b.offset:b.offset+size])
+	bits := binary.LittleEndian.Uint64(buf[:])
+	switch b.v.DataType {
+	case TypeFloat:
+		b.v.Value = math.Float32frombits(uint32(bits))
+	case TypeLReal:
+		b.v.Value = math.Float64frombits(bits)
+	default:
+		b.v.Value = wrapInteger(bits, b.v.DataType)
+	}
+}
+
+// write stores the variable in the image, growing the area as needed
+func (b ioBinding) write(img *ProcessImage) {
+	data := img.area(b.loc)
+	if b.loc.Size == 'X' {
+		grow(data, b.offset+1)
+		on, _ := b.v.Value.(bool)
+		if on {
+			(*data)[b.offset] |= 1 << b.bit
+		} else {
+			(*data)[b.offset] &^= 1 << b.bit
+		}
+		return
+	}
+
+	var bits uint64
+	switch value := b.v.Value.(type) {
+	case float32:
+		bits = uint64(math.Float32bits(value))
+	case float64:
+		bits = math.Float64bits(value)
+	default:
+		bits, _ = integerBits(value)
+	}
+	size := b.size()
+	grow(data, b.offset+size)
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], bits)
+	copy((*data)[b.offset:b.offset+size], buf[:size])
+}
+
+// grow extends an image area to at least n bytes
+func grow(data *[]byte, n int) {
+	if len(*data) < n {
+		*data = append(*data, make([]byte, n-len(*data))...)
+	}
+}
+
+// bindLocated maps the located variables of the deployed programs and the
+// globals onto the process image. Memory already in the image is kept, so
+// a redeployed program continues with the values it left there; memory
+// addressed for the first time starts with the variable's initial value.
+func (r *Runtime) bindLocated() {
+	r.imageMu.Lock()
+	defer r.imageMu.Unlock()
+
+	r.located = r.located[:0]
+	for _, v := range r.variables {
+		if v.location == nil {
+			continue
+		}
+		// Declarations were checked when the variable was created
+		b, err := locate(v, v.location)
+		if err != nil {
+			continue
+		}
+		r.located = append(r.located, b)
+
+		// Make room for the variable so drivers see the full image
+		area := r.image.area(b.loc)
+		allocated := b.offset+b.size() <= len(*area)
+		grow(area, b.offset+b.size())
+		if b.loc.Area == 'M' {
+			if allocated {
+				b.read(&r.image)
+			} else {
+				b.write(&r.image)
+			}
+		}
+	}
+}
+
+// readInputs copies the input and memory areas into the located variables
+// at the start of a scan
+func (r *Runtime) readInputs() {
+	r.imageMu.Lock()
+	defer r.imageMu.Unlock()
+	for _, b := range r.located {
+		if b.loc.Area != 'Q' {
+			b.read(&r.image)
+		}
+	}
+}
+
+// writeOutputs copies the located output and memory variables into the
+// image at the end of a scan
+func (r *Runtime) writeOutputs() {
+	r.imageMu.Lock()
+	defer r.imageMu.Unlock()
+	for _, b := range r.located {
+		if b.loc.Area != 'I' {
+			b.write(&r.image)
+		}
+	}
+}
+
+// WriteInputs copies data into the input image at the given byte offset.
+// The programs see the new inputs from the next scan on.
+func (r *Runtime) WriteInputs(offset int, data []byte) {
+	r.imageMu.Lock()
+	defer r.imageMu.Unlock()
+	grow(&r.image.Inputs, offset+len(data))
+	copy(r.image.Inputs[offset:], data)
+}
+
+// ReadOutputs returns the output image as written by the last completed scan
+func (r *Runtime) ReadOutputs() []byte {
+	r.imageMu.Lock()
+	defer r.imageMu.Unlock()
+	return append([]byte(nil), r.image.Outputs...)
+}
+
+// ProcessImage returns a copy of the input, output and memory areas
+func (r *Runtime) ProcessImage() ProcessImage {
+	r.imageMu.Lock()
+	defer r.imageMu.Unlock()
+	return r.image.clone()
+}
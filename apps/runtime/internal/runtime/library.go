@@ -0,0 +1,273 @@
+package runtime
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hyperdrive/core/apps/runtime/internal/parser/ast"
+	"github.com/hyperdrive/core/apps/runtime/internal/stdlib"
+)
+
+// Library holds the FUNCTION and FUNCTION_BLOCK POUs, the user-defined
+// types and the global variables available to deployed programs
+type Library struct {
+	mu         sync.RWMutex
+	pous       map[string]*ast.Program
+	types      map[string]*ast.TypeDecl
+	enumValues map[string]EnumValue
+	globals    map[string]*globalVar
+	revision   atomic.Uint64 // Incremented whenever declarations change
+}
+
+// globalVar is a VAR_GLOBAL variable shared by every program using the library
+type globalVar struct {
+	decl *ast.VarDecl
+	v    *Variable
+}
+
+// NewLibrary creates a POU library holding the standard function blocks
+func NewLibrary() *Library {
+	l := &Library{
+		pous:       make(map[string]*ast.Program),
+		types:      make(map[string]*ast.TypeDecl),
+		enumValues: make(map[string]EnumValue),
+		globals:    make(map[string]*globalVar),
+	}
+	l.Register(stdlib.Unit)
+	return l
+}
+
+// Register adds every FUNCTION, FUNCTION_BLOCK and TYPE from a compilation unit,
+// replacing previously registered declarations with the same name
+func (l *Library) Register(unit *ast.CompilationUnit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	defer l.revision.Add(1)
+
+	for _, decl := range unit.Types {
+		l.types[decl.Name] = decl
+		l.registerEnum(decl.Type)
+	}
+
+	for _, pou := range unit.POUs {
+		if pou.Type == ast.ProgramFC || pou.Type == ast.ProgramFB {
+			l.pous[pou.Name] = pou
+		}
+		// Enumerations may also be declared inline in a VAR section
+		for _, v := range pou.Vars {
+			l.registerEnum(v.Type)
+		}
+	}
+}
+
+// clone returns a copy of the library to try declarations on without
+// affecting the programs using l. The copied globals are variables of their
+// own holding the same values.
+func (l *Library) clone() *Library {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	c := &Library{
+		pous:       make(map[string]*ast.Program, len(l.pous)),
+		types:      make(map[string]*ast.TypeDecl, len(l.types)),
+		enumValues: make(map[string]EnumValue, len(l.enumValues)),
+		globals:    make(map[string]*globalVar, len(l.globals)),
+	}
+	for name, pou := range l.pous {
+		c.pous[name] = pou
+	}
+	for name, decl := range l.types {
+		c.types[name] = decl
+	}
+	for name, value := range l.enumValues {
+		c.enumValues[name] = value
+	}
+	for name, g := range l.globals {
+		v := *g.v
+		c.globals[name] = &globalVar{decl: g.decl, v: &v}
+	}
+	return c
+}
+
+func (l *Library) registerEnum(t ast.DataType) {
+	enum, ok := t.(*ast.EnumType)
+	if !ok {
+		return
+	}
+	for _, v := range enum.Values {
+		value := EnumValue{Type: enum.TypeName(), Name: v.Name, Value: v.Value}
+		// Values are found by plain name and by typed name such as State#Idle
+		l.enumValues[v.Name] = value
+		l.enumValues[value.Type+"#"+v.Name] = value
+	}
+}
+
+// Type returns the user-defined type with the given name
+func (l *Library) Type(name string) (*ast.TypeDecl, bool) {
+	if l == nil {
+		return nil, false
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	decl, ok := l.types[name]
+	return decl, ok
+}
+
+// EnumValue returns the enumeration value with the given name
+func (l *Library) EnumValue(name string) (EnumValue, bool) {
+	if l == nil {
+		return EnumValue{}, false
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	v, ok := l.enumValues[name]
+	return v, ok
+}
+
+// Function returns the FUNCTION with the given name
+func (l *Library) Function(name string) (*ast.Program, bool) {
+	return l.lookup(name, ast.ProgramFC)
+}
+
+// FunctionBlock returns the FUNCTION_BLOCK with the given name
+func (l *Library) FunctionBlock(name string) (*ast.Program, bool) {
+	return l.lookup(name, ast.ProgramFB)
+}
+
+func (l *Library) lookup(name string, kind ast.ProgramType) (*ast.Program, bool) {
+	if l == nil {
+		return nil, false
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	pou, ok := l.pous[name]
+	if !ok || pou.Type != kind {
+		return nil, false
+	}
+	return pou, true
+}
+
+// DeclareGlobals creates the VAR_GLOBAL variables of a unit, declared outside
+// a POU or in a PROGRAM, and returns the declarations it created variables
+// for. A global already declared with the same type keeps its current value
+// so redeploying one program does not reset the state it shares with others.
+func (l *Library) DeclareGlobals(unit *ast.CompilationUnit) ([]*ast.VarDecl, error) {
+	decls := append([]*ast.VarDecl(nil), unit.Globals...)
+	for _, pou := range unit.POUs {
+		if pou.Type == ast.ProgramPRG {
+			decls = append(decls, pou.VarsIn(ast.VarGlobal)...)
+		}
+	}
+
+	// Variables are initialized without holding the lock, as their types and
+	// initial values are looked up in the library
+	init := &Program{Name: "VAR_GLOBAL", Vars: make(map[string]*Variable), lib: l}
+	var created []*ast.VarDecl
+	for _, decl := range decls {
+		if existing, ok := l.global(decl.Name); ok && existing.decl.Type.TypeName() == decl.Type.TypeName() {
+			l.mu.Lock()
+			existing.decl = decl
+			err := existing.v.declare(decl)
+			l.mu.Unlock()
+			if err != nil {
+				return created, fmt.Errorf("global %s: %w", decl.Name, err)
+			}
+			continue
+		}
+
+		v, err := init.newVariable(decl)
+		if err == nil {
+			err = v.declare(decl)
+		}
+		if err != nil {
+			return created, fmt.Errorf("global %s: %w", decl.Name, err)
+		}
+
+		l.mu.Lock()
+		l.globals[decl.Name] = &globalVar{decl: decl, v: v}
+		l.mu.Unlock()
+		l.revision.Add(1)
+		created = append(created, decl)
+	}
+	return created, nil
+}
+
+// ResetGlobals gives every global variable its initial value again. The
+// variables are replaced, so programs have to be instantiated again to use them.
+func (l *Library) ResetGlobals() error {
+	l.mu.RLock()
+	globals := make([]*globalVar, 0, len(l.globals))
+	for _, g := range l.globals {
+		globals = append(globals, g)
+	}
+	l.mu.RUnlock()
+
+	init := &Program{Name: "VAR_GLOBAL", Vars: make(map[string]*Variable), lib: l}
+	for _, g := range globals {
+		v, err := init.newVariable(g.decl)
+		if err == nil {
+			err = v.declare(g.decl)
+		}
+		if err != nil {
+			return fmt.Errorf("global %s: %w", g.decl.Name, err)
+		}
+		l.mu.Lock()
+		g.v = v
+		l.mu.Unlock()
+	}
+	l.revision.Add(1)
+	return nil
+}
+
+// Revision identifies the current set of declarations. Code compiled against
+// the library has to be compiled again once the revision changes.
+func (l *Library) Revision() uint64 {
+	if l == nil {
+		return 0
+	}
+	return l.revision.Load()
+}
+
+// Global returns the global variable with the given name
+func (l *Library) Global(name string) (*Variable, bool) {
+	g, ok := l.global(name)
+	if !ok {
+		return nil, false
+	}
+	return g.v, true
+}
+
+// Globals returns every global variable by name
+func (l *Library) Globals() map[string]*Variable {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	result := make(map[string]*Variable, len(l.globals))
+	for name, g := range l.globals {
+		result[name] = g.v
+	}
+	return result
+}
+
+func (l *Library) global(name string) (*globalVar, bool) {
+	if l == nil {
+		return nil, false
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	g, ok := l.globals[name]
+	return g, ok
+}
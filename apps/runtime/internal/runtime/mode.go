@@ -0,0 +1,183 @@
+package runtime
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Mode is the operating mode of the runtime
+type Mode string
+
+const (
+	ModeRun   Mode = "RUN"   // Tasks run as scheduled
+	ModePause Mode = "PAUSE" // Tasks are suspended and the outputs keep their values
+	ModeStop  Mode = "STOP"  // Tasks are suspended and the outputs are cleared
+)
+
+// ParseMode returns the mode with the given name in any case
+func ParseMode(name string) (Mode, error) {
+	mode := Mode(strings.ToUpper(name))
+	switch mode {
+	case ModeRun, ModePause, ModeStop:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown mode %q", name)
+}
+
+// status returns how GetStatus reports the mode
+func (m Mode) status() string {
+	switch m {
+	case ModeRun:
+		return "running"
+	case ModePause:
+		return "paused"
+	}
+	return "stopped"
+}
+
+// OnModeChange registers fn to be called with the new mode after every change
+// of the operating mode
+func (r *Runtime) OnModeChange(fn func(Mode)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.modeListeners = append(r.modeListeners, fn)
+}
+
+// Mode returns the operating mode
+func (r *Runtime) Mode() Mode {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.mode
+}
+
+// SetMode switches the operating mode. Cyclic tasks resumed in RUN start a
+// new period rather than catching up on the time they were suspended.
+func (r *Runtime) SetMode(mode Mode) error {
+	switch mode {
+	case ModeRun, ModePause, ModeStop:
+	default:
+		return fmt.Errorf("unknown mode %q", mode)
+	}
+
+	r.mu.Lock()
+	switch mode {
+	case ModeRun:
+		for _, task := range r.tasks {
+			task.next = time.Time{}
+		}
+	case ModeStop:
+		r.clearOutputs()
+	}
+	notify := r.setMode(mode)
+	r.mu.Unlock()
+
+	notify()
+	return nil
+}
+
+// Step runs a single cycle of every task, as executeCycle does, while the
+// runtime is paused or stopped
+func (r *Runtime) Step() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.mode == ModeRun {
+		return fmt.Errorf("cannot run a single cycle in %s", r.mode)
+	}
+	r.runCycle()
+	return nil
+}
+
+// Restart instantiates the programs of the tasks and the global variables
+// again and switches to RUN. A warm restart keeps the values of RETAIN and
+// PERSISTENT variables; a cold restart only those of PERSISTENT variables and
+// also clears the memory area of the process image.
+func (r *Runtime) Restart(cold bool) error {
+	r.mu.Lock()
+	if err := r.restart(cold); err != nil {
+		r.mu.Unlock()
+		return err
+	}
+	notify := r.setMode(ModeRun)
+	r.mu.Unlock()
+
+	notify()
+	return nil
+}
+
+func (r *Runtime) restart(cold bool) error {
+	r.collectRetained()
+	if cold {
+		for name, saved := range r.retained {
+			if !saved.Persistent {
+				delete(r.retained, name)
+			}
+		}
+	}
+
+	// Programs refer to the globals they use, so those are replaced first
+	if err := r.library.ResetGlobals(); err != nil {
+		return fmt.Errorf("failed to reset globals: %w", err)
+	}
+	for name, v := range r.library.Globals() {
+		r.restoreRetained(globalNamespace+"."+name, v, true)
+		r.registerVariable(globalNamespace, globalNamespace+"."+name, v)
+	}
+
+	r.deployed = make(map[string]bool)
+	for path, old := range r.programs {
+		prog, err := newProgram(old.Name, old.ast, r.library)
+		if err != nil {
+			return err
+		}
+		prog.Code = old.Code
+		r.registerProgram(DeployRequest{FilePath: path, SourceCode: prog.Code}, prog)
+		r.programs[path] = prog
+		r.replaceProgram(old, prog)
+	}
+	for _, task := range r.tasks {
+		task.Stats = TaskStats{}
+		task.next, task.sampled = time.Time{}, false
+	}
+	r.generation++
+
+	r.imageMu.Lock()
+	r.image.Outputs = make([]byte, len(r.image.Outputs))
+	if cold {
+		r.image.Memory = nil
+	}
+	r.imageMu.Unlock()
+	r.bindLocated()
+
+	kind := "Warm"
+	if cold {
+		kind = "Cold"
+	}
+	log.Printf("%s restart of %d programs", kind, len(r.programs))
+	return nil
+}
+
+// setMode switches to mode while the caller holds the lock. It returns the
+// function telling the listeners about the change, which is called once the
+// lock is released.
+func (r *Runtime) setMode(mode Mode) func() {
+	log.Printf("Runtime mode %s -> %s", r.mode, mode)
+	r.mode = mode
+	listeners := append([]func(Mode){}, r.modeListeners...)
+	return func() {
+		for _, fn := range listeners {
+			fn(mode)
+		}
+	}
+}
+
+// clearOutputs sets the output area of the process image to zero
+func (r *Runtime) clearOutputs() {
+	r.imageMu.Lock()
+	defer r.imageMu.Unlock()
+	for i := range r.image.Outputs {
+		r.image.Outputs[i] = 0
+	}
+}
@@ -0,0 +1,102 @@
+package runtime_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hyperdrive/core/apps/runtime/internal/runtime"
+)
+
+func TestOperatingModes(t *testing.T) {
+	rt, err := runtime.New(runtime.Config{ScanTime: time.Millisecond})
+	if err != nil {
+		t.Fatalf("Failed to create runtime: %v", err)
+	}
+	var modes []runtime.Mode
+	rt.OnModeChange(func(mode runtime.Mode) {
+		modes = append(modes, mode)
+	})
+	if status := rt.GetStatus(); status.Status != "stopped" || status.Mode != runtime.ModeStop {
+		t.Errorf("Expected a new runtime to be stopped, got %s in %s", status.Status, status.Mode)
+	}
+
+	err = rt.DeployCode(runtime.DeployRequest{FilePath: "ctrl.st", SourceCode: `
+PROGRAM Ctrl
+    VAR n : INT; Out AT %QB0 : BYTE; END_VAR
+    VAR RETAIN r : INT; END_VAR
+    VAR PERSISTENT p : INT; END_VAR
+    n := n + 1;
+    r := r + 1;
+    p := p + 1;
+    Out := 5;
+END_PROGRAM
+`})
+	if err != nil {
+		t.Fatalf("Failed to deploy: %v", err)
+	}
+	expect := func(when string, n, r, p int16) {
+		t.Helper()
+		for name, want := range map[string]int16{"n": n, "r": r, "p": p} {
+			if v, _ := rt.GetVariable("ctrl." + name); v.Value != want {
+				t.Errorf("%s: expected %s = %d, got %v", when, name, want, v.Value)
+			}
+		}
+	}
+
+	if err := rt.Step(); err != nil {
+		t.Fatalf("Failed to run a single cycle: %v", err)
+	}
+	expect("after a single cycle", 1, 1, 1)
+
+	if err := rt.SetMode(runtime.ModeRun); err != nil {
+		t.Fatalf("Failed to switch to RUN: %v", err)
+	}
+	if err := rt.Step(); err == nil {
+		t.Errorf("Expected a single cycle to be refused in RUN")
+	}
+
+	// Pausing keeps the outputs, stopping clears them
+	if err := rt.SetMode(runtime.ModePause); err != nil {
+		t.Fatalf("Failed to pause: %v", err)
+	}
+	if out := rt.ReadOutputs(); len(out) != 1 || out[0] != 5 {
+		t.Errorf("Expected the outputs to be kept in PAUSE, got %v", out)
+	}
+	if err := rt.SetMode(runtime.ModeStop); err != nil {
+		t.Fatalf("Failed to stop: %v", err)
+	}
+	if out := rt.ReadOutputs(); len(out) != 1 || out[0] != 0 {
+		t.Errorf("Expected the outputs to be cleared in STOP, got %v", out)
+	}
+	if status := rt.GetStatus(); status.Status != "stopped" {
+		t.Errorf("Expected status stopped, got %s", status.Status)
+	}
+	if err := rt.SetMode("FAST"); err == nil {
+		t.Errorf("Expected an unknown mode to be refused")
+	}
+
+	rt.Step()
+	rt.Step()
+	expect("after three cycles", 3, 3, 3)
+
+	if err := rt.Restart(false); err != nil {
+		t.Fatalf("Failed to restart warm: %v", err)
+	}
+	expect("after a warm restart", 0, 3, 3)
+
+	rt.SetMode(runtime.ModeStop)
+	rt.Step()
+	if err := rt.Restart(true); err != nil {
+		t.Fatalf("Failed to restart cold: %v", err)
+	}
+	expect("after a cold restart", 0, 0, 4)
+
+	want := []runtime.Mode{runtime.ModeRun, runtime.ModePause, runtime.ModeStop, runtime.ModeRun, runtime.ModeStop, runtime.ModeRun}
+	if fmt.Sprint(modes) != fmt.Sprint(want) {
+		t.Errorf("Expected mode changes %v, got %v", want, modes)
+	}
+	if status := rt.GetStatus(); status.Status != "running" || status.Tasks[0].Stats.Cycles != 0 {
+		t.Errorf("Expected a restart to run with fresh statistics, got %+v", status)
+	}
+}
@@ -0,0 +1,103 @@
+package runtime
+
+import (
+	"log"
+	"strings"
+
+	"github.com/hyperdrive/core/apps/runtime/internal/parser/ast"
+)
+
+// onlineChange carries the state of old, the running instance of a program,
+// over to prog, the instance replacing it. Variables keep their values where
+// their name and type are unchanged; new variables, those whose type changed
+// and constants start from their initial values.
+func onlineChange(old, prog *Program) {
+	removed := make(map[string]bool)
+	for _, decl := range old.ast.Vars {
+		if ownsVariable(decl) {
+			removed[decl.Name] = true
+		}
+	}
+
+	var kept, initialized int
+	for _, decl := range prog.ast.Vars {
+		if !ownsVariable(decl) {
+			continue
+		}
+		delete(removed, decl.Name)
+		if prev, ok := old.Vars[decl.Name]; ok && carryOver(prog.Vars[decl.Name], prev) {
+			kept++
+		} else {
+			initialized++
+		}
+	}
+	log.Printf("Online change of %s: %d variables kept, %d initialized, %d removed",
+		prog.Name, kept, initialized, len(removed))
+}
+
+// carryOver copies the value of src to dst where both have the same type.
+// Members of structs and function block instances are copied by name and
+// elements of arrays with the same bounds by index, so members added to a
+// type start from their initial values. It reports whether anything was
+// copied.
+func carryOver(dst, src *Variable) bool {
+	if dst.constant {
+		return false
+	}
+
+	switch d := dst.Value.(type) {
+	case *StructValue:
+		s, ok := src.Value.(*StructValue)
+		return ok && s.Type.TypeName() == d.Type.TypeName() && carryMembers(d, s)
+	case *FBInstance:
+		s, ok := src.Value.(*FBInstance)
+		return ok && s.Type.Name == d.Type.Name && carryMembers(d, s)
+	case *ArrayValue:
+		s, ok := src.Value.(*ArrayValue)
+		if !ok || len(s.Type.Dims) != len(d.Type.Dims) {
+			return false
+		}
+		for i, dim := range d.Type.Dims {
+			if s.Type.Dims[i] != dim {
+				return false
+			}
+		}
+		copied := false
+		for i, elem := range d.Elems {
+			copied = carryOver(elem, s.Elems[i]) || copied
+		}
+		return copied
+	case EnumValue:
+		// Inline enumerations are named by their values, so they keep their
+		// name only as long as no value is added or removed
+		s, ok := src.Value.(EnumValue)
+		enum, isEnum := dst.typ.(*ast.EnumType)
+		if !ok || !isEnum || (s.Type != d.Type && !strings.HasPrefix(d.Type, "(")) {
+			return false
+		}
+		for _, ev := range enum.Values {
+			if ev.Name == s.Name {
+				dst.Value = EnumValue{Type: d.Type, Name: ev.Name, Value: ev.Value}
+				return true
+			}
+		}
+		return false
+	}
+
+	if dst.DataType != src.DataType {
+		return false
+	}
+	return assign(dst, src.Value) == nil
+}
+
+// carryMembers copies the members of src to the members of dst with the same name
+func carryMembers(dst, src composite) bool {
+	copied := false
+	for _, name := range dst.members() {
+		dv, _ := dst.member(name)
+		if sv, ok := src.member(name); ok {
+			copied = carryOver(dv, sv) || copied
+		}
+	}
+	return copied
+}
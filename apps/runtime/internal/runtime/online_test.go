@@ -0,0 +1,183 @@
+package runtime_test
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hyperdrive/core/apps/runtime/internal/runtime"
+	"github.com/hyperdrive/core/apps/runtime/internal/storage"
+)
+
+func TestOnlineChange(t *testing.T) {
+	rt, err := runtime.New(runtime.Config{ScanTime: time.Millisecond})
+	if err != nil {
+		t.Fatalf("Failed to create runtime: %v", err)
+	}
+
+	value := func(name string) interface{} {
+		t.Helper()
+		v, ok := rt.GetVariable("line." + name)
+		if !ok {
+			t.Fatalf("Variable %s not registered", name)
+		}
+		return v.Value
+	}
+
+	// The first version runs in a task with a short watchdog
+	err = rt.DeployProject([]runtime.DeployRequest{{FilePath: "line.st", SourceCode: `
+TYPE Stats : STRUCT good : INT; bad : INT; END_STRUCT; END_TYPE
+PROGRAM Line
+    VAR
+        count : INT;
+        stats : Stats;
+        edge : R_TRIG;
+        level : INT;
+        old : BOOL;
+        samples : ARRAY[1..3] OF INT;
+        stuck : BOOL;
+    END_VAR
+    count := count + 1;
+    stats.good := stats.good + 2;
+    edge(CLK := TRUE);
+    level := 5;
+    samples[count] := count * 10;
+    WHILE stuck DO
+        count := count;
+    END_WHILE;
+END_PROGRAM
+`}}, []storage.TaskConfig{{Name: "LineTask", Interval: "10ms", Watchdog: "5ms", Program: "Line"}})
+	if err != nil {
+		t.Fatalf("Failed to deploy: %v", err)
+	}
+	rt.ExecuteCycle()
+	rt.ExecuteCycle()
+
+	// A task stopped by its watchdog runs again once its program is replaced
+	v, _ := rt.GetVariable("line.stuck")
+	v.Value = true
+	rt.ExecuteCycle()
+	if state := rt.GetStatus().Tasks[0].State; state != "faulted" {
+		t.Fatalf("Expected the task to be faulted, got %s", state)
+	}
+	v, _ = rt.GetVariable("line.stuck")
+	v.Value = false
+
+	// The second version changes the layout
+	err = rt.DeployCode(runtime.DeployRequest{FilePath: "line.st", SourceCode: `
+TYPE Stats : STRUCT good : INT; bad : INT; scrap : INT := 9; END_STRUCT; END_TYPE
+PROGRAM Line
+    VAR
+        count : INT;
+        stats : Stats;
+        edge : R_TRIG;
+        level : REAL := 1.5;
+        added : INT := 4;
+        samples : ARRAY[1..3] OF INT;
+        stuck : BOOL;
+    END_VAR
+    count := count + 1;
+END_PROGRAM
+`})
+	if err != nil {
+		t.Fatalf("Failed to redeploy: %v", err)
+	}
+	status := rt.GetStatus()
+	if status.TaskCount != 1 || status.Tasks[0].State != "running" {
+		t.Fatalf("Expected the redeploy to replace the task, got %+v", status.Tasks)
+	}
+
+	for name, want := range map[string]interface{}{
+		"count":       int16(3),
+		"stats.good":  int16(6),
+		"stats.scrap": int16(9),
+		"edge.M":      true,
+		"level":       float32(1.5),
+		"added":       int16(4),
+		"samples[2]":  int16(20),
+	} {
+		if got := value(name); got != want {
+			t.Errorf("Expected %s to be %v after the online change, got %v", name, want, got)
+		}
+	}
+	if _, ok := rt.GetVariable("line.old"); ok {
+		t.Errorf("Expected the removed variable to be unregistered")
+	}
+
+	rt.ExecuteCycle()
+	if got := value("count"); got != int16(4) {
+		t.Errorf("Expected count to continue at 4, got %v", got)
+	}
+}
+
+func TestRefusedDeployChangesNothing(t *testing.T) {
+	rt, err := runtime.New(runtime.Config{ScanTime: time.Millisecond})
+	if err != nil {
+		t.Fatalf("Failed to create runtime: %v", err)
+	}
+
+	source := func(step int, extra string) []runtime.DeployRequest {
+		return []runtime.DeployRequest{
+			{FilePath: "lib.st", SourceCode: fmt.Sprintf(`
+FUNCTION_BLOCK Cnt
+    VAR_OUTPUT n : INT; END_VAR
+    n := n + %d;
+END_FUNCTION_BLOCK
+VAR_GLOBAL Total : INT; %s END_VAR
+`, step, extra)},
+			{FilePath: "main.st", SourceCode: `
+PROGRAM Main
+    VAR_EXTERNAL Total : INT; END_VAR
+    VAR c : Cnt; out : INT; END_VAR
+    c();
+    out := c.n;
+    Total := Total + 1;
+END_PROGRAM
+`},
+		}
+	}
+	names := func() []string {
+		var names []string
+		for _, vars := range rt.GetAllVariables() {
+			for _, v := range vars {
+				names = append(names, v.Name)
+			}
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	if err := rt.DeployProject(source(1, ""), nil); err != nil {
+		t.Fatalf("Failed to deploy: %v", err)
+	}
+	rt.ExecuteCycle()
+	before := names()
+
+	// The tasks are refused only after the files compiled
+	err = rt.DeployProject(source(10, "Added : INT;"),
+		[]storage.TaskConfig{{Name: "T", Interval: "10ms", Program: "Missing"}})
+	if err == nil || !strings.Contains(err.Error(), "program Missing is not in the project") {
+		t.Fatalf("Expected the deploy to be refused, got %v", err)
+	}
+	if after := names(); !reflect.DeepEqual(after, before) {
+		t.Errorf("Expected the variables %v, got %v", before, after)
+	}
+	if _, ok := rt.GetVariable("global.Added"); ok {
+		t.Errorf("Expected the global of the refused deploy not to be declared")
+	}
+
+	// The running program still uses the function block deployed before
+	rt.ExecuteCycle()
+	if v, _ := rt.GetVariable("main.out"); v.Value != int16(2) {
+		t.Errorf("Expected out = 2, got %v", v.Value)
+	}
+	if v, _ := rt.GetVariable("global.Total"); v.Value != int16(2) {
+		t.Errorf("Expected Total = 2, got %v", v.Value)
+	}
+	if got := rt.GetStatus().TaskCount; got != 1 {
+		t.Errorf("Expected the task deployed before to keep running, got %d tasks", got)
+	}
+}
@@ -0,0 +1,473 @@
+package runtime
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hyperdrive/core/apps/runtime/internal/diagnostics"
+	"github.com/hyperdrive/core/apps/runtime/internal/parser/ast"
+)
+
+// maxCallDepth bounds nested FB/function calls; IEC 61131-3 forbids recursion
+const maxCallDepth = 64
+
+// FBInstance holds the state of one function block instance between calls
+type FBInstance struct {
+	Type  *ast.Program
+	Vars  map[string]*Variable
+	frame frameCache // Variables bound to the slots of the compiled body
+}
+
+// MarshalJSON encodes the instance as a map of its variable values
+func (i *FBInstance) MarshalJSON() ([]byte, error) {
+	values := make(map[string]interface{}, len(i.Vars))
+	for name, v := range i.Vars {
+		values[name] = v.Value
+	}
+	return json.Marshal(values)
+}
+
+// callArg is an evaluated actual parameter; Name is empty for positional arguments
+type callArg struct {
+	Name  string
+	Value interface{}
+	Ref   *Variable // Variable passed to a VAR_IN_OUT parameter
+}
+
+// declareVariable creates the variable of a POU declaration. VAR_GLOBAL and
+// VAR_EXTERNAL declarations refer to the global variable shared through the
+// library; the other sections get a variable of their own.
+func (p *Program) declareVariable(decl *ast.VarDecl) (*Variable, error) {
+	if decl.Section == ast.VarGlobal || decl.Section == ast.VarExternal {
+		g, ok := p.lib.global(decl.Name)
+		if !ok {
+			return nil, fmt.Errorf("undefined global variable %s", decl.Name)
+		}
+		if g.decl.Type.TypeName() != decl.Type.TypeName() {
+			return nil, fmt.Errorf("%s is declared as %s, but the global variable is %s",
+				decl.Name, decl.Type.TypeName(), g.decl.Type.TypeName())
+		}
+		return g.v, nil
+	}
+
+	v, err := p.newVariable(decl)
+	if err != nil {
+		return nil, err
+	}
+	if err := v.declare(decl); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// declare applies the qualifiers and location of a declaration to its variable
+func (v *Variable) declare(decl *ast.VarDecl) error {
+	v.constant = decl.Constant
+	v.retain = decl.Retention
+	v.location = decl.Location
+	if decl.Location != nil {
+		if _, err := locate(v, decl.Location); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newVariable creates and initializes a variable from its declaration in the current scope
+func (p *Program) newVariable(decl *ast.VarDecl) (*Variable, error) {
+	variable := &Variable{
+		Name:      decl.Name,
+		Quality:   QualityGood,
+		Timestamp: time.Now(),
+	}
+
+	// Variables typed by a function block hold their own instance state
+	if fb, ok := p.lib.FunctionBlock(decl.Type.TypeName()); ok {
+		inst, err := p.newFBInstance(fb)
+		if err != nil {
+			return nil, err
+		}
+		variable.DataType = TypeFunctionBlock
+		variable.Value = inst
+		return variable, nil
+	}
+
+	typ, typeInit := p.resolveType(decl.Type)
+	dataType, err := convertDataType(typ)
+	if err != nil {
+		return nil, err
+	}
+	variable.typ = typ
+	variable.DataType = dataType
+
+	val, err := p.zeroValue(typ)
+	if err != nil {
+		return nil, err
+	}
+	variable.Value = val
+
+	// Set initial value if provided, falling back to the default of a named type
+	init := decl.InitExpr
+	if init == nil {
+		init = typeInit
+	}
+	if init != nil {
+		val, err := p.evaluateExpression(init)
+		if err != nil {
+			return nil, err
+		}
+		if err := assign(variable, val); err != nil {
+			return nil, err
+		}
+	}
+
+	return variable, nil
+}
+
+// newFBInstance allocates and initializes the variables of a function block instance
+func (p *Program) newFBInstance(fb *ast.Program) (*FBInstance, error) {
+	// Guards against function blocks that (indirectly) contain an instance of themselves
+	if p.depth >= maxCallDepth {
+		return nil, fmt.Errorf("function block %s cannot be instantiated: nesting too deep", fb.Name)
+	}
+	p.depth++
+	defer func() { p.depth-- }()
+
+	inst := &FBInstance{
+		Type: fb,
+		Vars: make(map[string]*Variable, len(fb.Vars)),
+	}
+
+	err := p.withScope(inst.Vars, func() error {
+		for _, decl := range fb.Vars {
+			// VAR_IN_OUT parameters are bound to the caller's variables on every call
+			if decl.Section == ast.VarInOut {
+				continue
+			}
+			v, err := p.declareVariable(decl)
+			if err != nil {
+				return fmt.Errorf("%s.%s: %w", fb.Name, decl.Name, diagnostics.Wrap(err, decl.Position(), diagnostics.CodeSemantic))
+			}
+			inst.Vars[decl.Name] = v
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return inst, nil
+}
+
+// invokeFunctionBlock binds the inputs of an instance and executes its body
+func (p *Program) invokeFunctionBlock(inst *FBInstance, args []callArg) error {
+	// VAR_IN_OUT and VAR_TEMP variables only exist for the duration of the call.
+	// Instances without them keep the slot bindings of their compiled body.
+	scope, cache := inst.Vars, &inst.frame
+	temps := inst.Type.VarsIn(ast.VarTemp)
+	if len(temps) > 0 || len(inst.Type.VarsIn(ast.VarInOut)) > 0 {
+		cache = nil
+		scope = make(map[string]*Variable, len(inst.Type.Vars))
+		for name, v := range inst.Vars {
+			scope[name] = v
+		}
+	}
+
+	err := p.withScope(scope, func() error {
+		for _, decl := range temps {
+			v, err := p.declareVariable(decl)
+			if err != nil {
+				return fmt.Errorf("%s.%s: %w", inst.Type.Name, decl.Name, err)
+			}
+			scope[decl.Name] = v
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := bindInputs(inst.Type, scope, args); err != nil {
+		return err
+	}
+	if body := standardBodies[inst.Type]; body != nil {
+		body(fbState(scope))
+		return nil
+	}
+	return p.executeBody(inst.Type, scope, cache)
+}
+
+// invokeFunction executes a function in a fresh frame and returns its result
+func (p *Program) invokeFunction(fn *ast.Program, args []callArg) (interface{}, error) {
+	frame := make(map[string]*Variable, len(fn.Vars)+1)
+
+	// Locals and parameters are re-initialized on every call
+	err := p.withScope(frame, func() error {
+		for _, decl := range fn.Vars {
+			if decl.Section == ast.VarInOut {
+				continue
+			}
+			v, err := p.declareVariable(decl)
+			if err != nil {
+				return fmt.Errorf("%s.%s: %w", fn.Name, decl.Name, err)
+			}
+			frame[decl.Name] = v
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The function name acts as the variable holding the return value
+	var result *Variable
+	if fn.ReturnType != nil {
+		err := p.withScope(frame, func() error {
+			var err error
+			result, err = p.newVariable(&ast.VarDecl{Name: fn.Name, Type: fn.ReturnType})
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		frame[fn.Name] = result
+	}
+
+	if err := bindInputs(fn, frame, args); err != nil {
+		return nil, err
+	}
+
+	if err := p.executeBody(fn, frame, nil); err != nil {
+		return nil, err
+	}
+
+	if result == nil {
+		return nil, nil
+	}
+	return result.Value, nil
+}
+
+// bindInputs assigns actual parameters to the VAR_INPUT variables of a POU
+// and binds its VAR_IN_OUT parameters to the variables passed for them
+func bindInputs(pou *ast.Program, vars map[string]*Variable, args []callArg) error {
+	params := pou.Parameters()
+	inOuts := pou.VarsIn(ast.VarInOut)
+
+	for i, arg := range args {
+		name := arg.Name
+		if name == "" {
+			if i >= len(params) {
+				return fmt.Errorf("too many arguments in call to %s", pou.Name)
+			}
+			name = params[i].Name
+		}
+
+		if param := parameter(inOuts, name, -1); param != nil {
+			if arg.Ref == nil {
+				return fmt.Errorf("%s.%s: VAR_IN_OUT parameter requires a variable", pou.Name, name)
+			}
+			vars[name] = arg.Ref
+			continue
+		}
+
+		v, ok := vars[name]
+		if !ok {
+			return fmt.Errorf("%s has no parameter %s", pou.Name, name)
+		}
+		if err := assign(v, arg.Value); err != nil {
+			return fmt.Errorf("%s.%s: %w", pou.Name, name, err)
+		}
+	}
+
+	// Unlike inputs, VAR_IN_OUT parameters have no value of their own to fall back on
+	for i, param := range inOuts {
+		connected := false
+		for j, arg := range args {
+			if arg.Name == param.Name || (arg.Name == "" && j < len(params) && params[j] == inOuts[i]) {
+				connected = true
+				break
+			}
+		}
+		if !connected {
+			return fmt.Errorf("%s: VAR_IN_OUT parameter %s is not connected", pou.Name, param.Name)
+		}
+	}
+
+	return nil
+}
+
+// parameter returns the parameter an argument is passed to: the one named
+// name, or the one at position i for positional arguments
+func parameter(params []*ast.VarDecl, name string, i int) *ast.VarDecl {
+	if name == "" {
+		if i >= 0 && i < len(params) {
+			return params[i]
+		}
+		return nil
+	}
+	for _, param := range params {
+		if param.Name == name {
+			return param
+		}
+	}
+	return nil
+}
+
+// executeBody runs the statements of a POU against the given variable scope,
+// as bytecode unless the body is left to the tree walker. cache keeps the slot
+// bindings of the bytecode between calls; it is nil when the variables in
+// scope change from one call to the next.
+func (p *Program) executeBody(pou *ast.Program, scope map[string]*Variable, cache *frameCache) error {
+	if p.depth >= maxCallDepth {
+		return fmt.Errorf("maximum call depth exceeded in %s", pou.Name)
+	}
+
+	p.depth++
+	defer func() { p.depth-- }()
+
+	if c := p.chunkFor(pou); c != nil {
+		return p.executeChunk(c, pou, scope, cache)
+	}
+	return p.withScope(scope, func() error {
+		err := p.executeStatements(pou.Body)
+		if errors.Is(err, errReturn) {
+			return nil
+		}
+		return err
+	})
+}
+
+// withScope runs fn with scope as the variables visible to expressions and statements
+func (p *Program) withScope(scope map[string]*Variable, fn func() error) error {
+	saved := p.scope
+	p.scope = scope
+	defer func() { p.scope = saved }()
+
+	return fn()
+}
+
+// currentScope returns the variables of the POU currently executing
+func (p *Program) currentScope() map[string]*Variable {
+	if p.scope != nil {
+		return p.scope
+	}
+	return p.Vars
+}
+
+// lookupVariable resolves a name in the scope of the POU currently executing,
+// falling back to the global variables
+func (p *Program) lookupVariable(name string) (*Variable, bool) {
+	if v, ok := p.currentScope()[name]; ok {
+		return v, true
+	}
+	return p.lib.Global(name)
+}
+
+// checkWritable reports writes to a CONSTANT variable or to a member or element of one
+func (p *Program) checkWritable(expr ast.Expression) error {
+	switch e := expr.(type) {
+	case *ast.Variable:
+		if v, ok := p.lookupVariable(e.Name); ok && v.constant {
+			return fmt.Errorf("cannot assign to constant %s", e.Name)
+		}
+	case *ast.MemberAccess:
+		return p.checkWritable(e.Object)
+	case *ast.ArrayAccess:
+		return p.checkWritable(e.Array)
+	}
+	return nil
+}
+
+// fbInstance returns the function block instance stored in the named variable
+func (p *Program) fbInstance(name string) (*FBInstance, bool) {
+	v, ok := p.lookupVariable(name)
+	if !ok {
+		return nil, false
+	}
+	inst, ok := v.Value.(*FBInstance)
+	return inst, ok
+}
+
+// resolveVariable returns the variable an expression such as x or fb.out refers to
+func (p *Program) resolveVariable(expr ast.Expression) (*Variable, error) {
+	switch e := expr.(type) {
+	case *ast.Variable:
+		v, ok := p.lookupVariable(e.Name)
+		if !ok {
+			return nil, fmt.Errorf("undefined variable: %s", e.Name)
+		}
+		return v, nil
+	case *ast.MemberAccess:
+		obj, err := p.resolveVariable(e.Object)
+		if err != nil {
+			return nil, err
+		}
+		value, ok := obj.Value.(composite)
+		if !ok {
+			return nil, fmt.Errorf("%s has no members", e.Object)
+		}
+		member, ok := value.member(e.Member)
+		if !ok {
+			return nil, fmt.Errorf("%s has no member %s", e.Object, e.Member)
+		}
+		return member, nil
+	case *ast.ArrayAccess:
+		obj, err := p.resolveVariable(e.Array)
+		if err != nil {
+			return nil, err
+		}
+		arr, ok := obj.Value.(*ArrayValue)
+		if !ok {
+			return nil, fmt.Errorf("%s is not an array", e.Array)
+		}
+		indices := make([]int, len(e.Indices))
+		for i, idx := range e.Indices {
+			if indices[i], err = p.evaluateInteger(idx, "array index"); err != nil {
+				return nil, err
+			}
+		}
+		elem, err := arr.element(indices)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", e, err)
+		}
+		return elem, nil
+	default:
+		return nil, fmt.Errorf("invalid variable reference: %s", expr)
+	}
+}
+
+// evaluateArgs evaluates the actual parameters of a call to pou in the current
+// scope. Arguments of VAR_IN_OUT parameters are resolved to the variable passed.
+func (p *Program) evaluateArgs(pou *ast.Program, args []ast.Expression) ([]callArg, error) {
+	params := pou.Parameters()
+
+	result := make([]callArg, 0, len(args))
+	for i, arg := range args {
+		var name string
+		if named, ok := arg.(*ast.NamedArg); ok {
+			name = named.Name
+			arg = named.Value
+		}
+
+		if param := parameter(params, name, i); param != nil && param.Section == ast.VarInOut {
+			ref, err := p.resolveVariable(arg)
+			if err != nil {
+				return nil, fmt.Errorf("%s.%s: VAR_IN_OUT parameter requires a variable: %w", pou.Name, param.Name, err)
+			}
+			if err := p.checkWritable(arg); err != nil {
+				return nil, err
+			}
+			result = append(result, callArg{Name: name, Ref: ref})
+			continue
+		}
+
+		val, err := p.evaluateExpression(arg)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, callArg{Name: name, Value: val})
+	}
+	return result, nil
+}
@@ -1,16 +1,24 @@
 package runtime
 
 import (
+	"errors"
 	"fmt"
-	"log"
-	"strconv"
-	"strings"
+	"math"
 	"time"
 
+	"github.com/hyperdrive/core/apps/runtime/internal/diagnostics"
 	"github.com/hyperdrive/core/apps/runtime/internal/parser"
 	"github.com/hyperdrive/core/apps/runtime/internal/parser/ast"
 )
 
+// Control-flow signals propagate through executeStatement as errors until the
+// enclosing loop or POU body consumes them
+var (
+	errExit     = errors.New("EXIT outside of loop")
+	errContinue = errors.New("CONTINUE outside of loop")
+	errReturn   = errors.New("RETURN")
+)
+
 // Program represents an executable IEC 61131-3 program
 type Program struct {
 	Name     string
@@ -19,45 +27,71 @@ type Program struct {
 	Modified time.Time
 	ast      *ast.Program
 	Vars     map[string]*Variable // Public field for easier debugging
-	code     []interface{}        // Raw statements from AST JSON
+	lib      *Library             // Functions and function blocks callable from this program
+	scope    map[string]*Variable // Variables of the FB/function body currently executing
+	depth    int                  // Current call nesting depth
+
+	chunks       map[*ast.Program]*chunk // Bytecode of the POU bodies run by this program
+	frame        frameCache              // Slot bindings of the program body
+	interpretAST bool                    // Run POU bodies on the tree walker instead of bytecode
+
+	deadline   time.Time // When the watchdog aborts the cycle; zero for no watchdog
+	iterations uint      // Loop iterations since the clock was last read
 }
 
 // NewProgram creates a new program from source code
 func NewProgram(name, code string) (*Program, error) {
-	astProg, err := parser.Parse(code)
+	return NewProgramWithLibrary(name, code, NewLibrary())
+}
+
+// NewProgramWithLibrary creates a new program from source code. The functions
+// and function blocks declared in the code are registered in lib, so programs
+// sharing the library can call POUs declared in other files.
+func NewProgramWithLibrary(name, code string, lib *Library) (*Program, error) {
+	unit, err := parser.ParseFile(name, code)
 	if err != nil {
 		return nil, fmt.Errorf("parse error: %w", err)
 	}
+	lib.Register(unit)
+	if _, err := lib.DeclareGlobals(unit); err != nil {
+		return nil, fmt.Errorf("initialization error: %w", err)
+	}
 
+	astProg, ok := unit.MainProgram()
+	if !ok {
+		return nil, fmt.Errorf("parse error: no PROGRAM declared")
+	}
+
+	prog, err := newProgram(name, astProg, lib)
+	if err != nil {
+		return nil, err
+	}
+	prog.Code = code
+	return prog, nil
+}
+
+// newProgram instantiates a PROGRAM whose unit is registered in lib
+func newProgram(name string, astProg *ast.Program, lib *Library) (*Program, error) {
 	prog := &Program{
 		Name:     name,
-		Code:     code,
 		Version:  "1.0",
 		Modified: time.Now(),
 		ast:      astProg,
 		Vars:     make(map[string]*Variable),
+		lib:      lib,
 	}
 
 	// Initialize variables
 	for _, v := range astProg.Vars {
-		variable := &Variable{
-			Name:      v.Name,
-			DataType:  convertDataType(v.Type),
-			Quality:   QualityGood,
-			Timestamp: time.Now(),
+		// A program run by a task has no caller to pass it a reference
+		if v.Section == ast.VarInOut {
+			return nil, fmt.Errorf("initialization error: %w", diagnostics.New(v.Position(), diagnostics.SeverityError,
+				diagnostics.CodeSemantic, "VAR_IN_OUT %s is not allowed in PROGRAM %s", v.Name, astProg.Name))
 		}
-
-		// Set initial value if provided
-		if v.InitExpr != nil {
-			val, err := prog.evaluateExpression(v.InitExpr)
-			if err != nil {
-				return nil, fmt.Errorf("initialization error: %w", err)
-			}
-			variable.Value = val
-		} else {
-			variable.Value = defaultValue(variable.DataType)
+		variable, err := prog.declareVariable(v)
+		if err != nil {
+			return nil, fmt.Errorf("initialization error: %w", diagnostics.Wrap(err, v.Position(), diagnostics.CodeSemantic))
 		}
-
 		prog.Vars[v.Name] = variable
 	}
 
@@ -66,38 +100,21 @@ func NewProgram(name, code string) (*Program, error) {
 
 // Execute runs one cycle of the program
 func (p *Program) Execute() error {
-	if p.ast == nil {
-		// fmt.Printf("Warning: Program %s has nil AST\n", p.Name)
-	} else {
-		// fmt.Printf("Executing program: %s with %d statements\n", p.Name, len(p.ast.Body))
-	}
-
-	// If we have a traditional AST, execute it
-	if p.ast != nil && len(p.ast.Body) > 0 {
-		for _, stmt := range p.ast.Body {
-			// fmt.Printf("Statement %d: %T\n", i, stmt)
-			if err := p.executeStatement(stmt); err != nil {
-				return err
-			}
+	// VAR_TEMP variables start from their initial value in every cycle
+	temps := p.ast.VarsIn(ast.VarTemp)
+	for _, decl := range temps {
+		v, err := p.declareVariable(decl)
+		if err != nil {
+			return diagnostics.Wrap(err, decl.Position(), diagnostics.CodeRuntime)
 		}
-		return nil
+		p.Vars[decl.Name] = v
 	}
 
-	// Otherwise, if we have raw statements from JSON, execute those
-	if len(p.code) > 0 {
-		// fmt.Printf("Executing from raw JSON with %d statements\n", len(p.code))
-		for _, stmt := range p.code {
-			// fmt.Printf("Raw statement %d: %T\n", i, stmt)
-			if err := p.executeRawStatement(stmt); err != nil {
-				return err
-			}
-		}
-		return nil
+	cache := &p.frame
+	if len(temps) > 0 {
+		cache = nil
 	}
-
-	// If we reach here, there was nothing to execute
-	// fmt.Printf("Program %s has no statements to execute\n", p.Name)
-	return nil
+	return p.executeBody(p.ast, p.Vars, cache)
 }
 
 // executeStatement executes a single statement
@@ -108,10 +125,13 @@ func (p *Program) executeStatement(stmt ast.Statement) error {
 	case *ast.Assignment:
 		// Check if the assignment's value is a function call (common for FB invocations)
 		if callExpr, ok := s.Value.(*ast.CallExpr); ok {
-			// Check if this is a TON timer call
-			if instance, ok := isTimerExpression(callExpr.Function); ok {
-				// fmt.Printf("Detected timer call: %s with %d args\n", instance, len(callExpr.Args))
-				return p.executeTONTimer(instance, callExpr.Args)
+			// Invoke function block instances declared in the current scope
+			if inst, ok := p.fbInstance(callExpr.Function); ok {
+				args, err := p.evaluateArgs(inst.Type, callExpr.Args)
+				if err != nil {
+					return err
+				}
+				return p.invokeFunctionBlock(inst, args)
 			}
 		}
 
@@ -120,376 +140,369 @@ func (p *Program) executeStatement(stmt ast.Statement) error {
 		if err != nil {
 			return err
 		}
-		v, ok := p.Vars[s.Variable.String()]
-		if !ok {
-			return fmt.Errorf("undefined variable: %s", s.Variable.String())
-		}
-		v.Value = val
-		v.Timestamp = time.Now()
-		return nil
-	default:
-		return fmt.Errorf("unsupported statement type: %T", stmt)
-	}
-}
 
-// executeRawStatement executes a statement from raw JSON AST
-func (p *Program) executeRawStatement(stmt interface{}) error {
-	stmtMap, ok := stmt.(map[string]interface{})
-	if !ok {
-		return fmt.Errorf("invalid statement format: not a map")
-	}
+		// Call statements are represented as assignments without a target
+		if s.Variable == nil {
+			return nil
+		}
 
-	stmtType, ok := stmtMap["$type"].(string)
-	if !ok {
-		return fmt.Errorf("invalid statement format: missing $type")
-	}
-
-	switch stmtType {
-	case "AssignmentStatement":
-		// Check if this is a function call assignment
-		expr, hasExpr := stmtMap["expression"].(map[string]interface{})
-		if hasExpr && expr["$type"] == "FunctionCallExpression" {
-			// It's a function call, check if it's a timer
-			callObj, hasCall := expr["call"].(map[string]interface{})
-			if hasCall && callObj["$type"] == "MemberAccess" {
-				// Get the instance name
-				instance, hasInstance := callObj["object"].(map[string]interface{})
-				if hasInstance && instance["$type"] == "VariableReference" {
-					instanceName, hasName := instance["name"].(string)
-					if hasName && isTimerInstance(instanceName) {
-						// Handle timer call
-						return p.executeRawTONTimer(instanceName, expr["arguments"])
-					}
-				}
-			} else if hasCall && callObj["$type"] == "VariableReference" {
-				// Direct function call like Timer(...)
-				instanceName, hasName := callObj["name"].(string)
-				if hasName && isTimerInstance(instanceName) {
-					// Handle timer call
-					return p.executeRawTONTimer(instanceName, expr["arguments"])
-				}
-			}
+		v, err := p.resolveVariable(s.Variable)
+		if err != nil {
+			return err
 		}
-		return p.executeRawAssignment(stmtMap)
-	case "IfStatement":
-		return p.executeRawIfStatement(stmtMap)
-	case "FunctionCall":
-		// Direct function call statement
-		callObj, hasCall := stmtMap["call"].(map[string]interface{})
-		if hasCall {
-			if callObj["$type"] == "VariableReference" {
-				instanceName, hasName := callObj["name"].(string)
-				if hasName && isTimerInstance(instanceName) {
-					// Handle timer call
-					return p.executeRawTONTimer(instanceName, stmtMap["arguments"])
-				}
-			}
+		if err := p.checkWritable(s.Variable); err != nil {
+			return err
 		}
-		// Fall through to default for unsupported function calls
-		fallthrough
+		return assign(v, val)
+	case *ast.IfStatement:
+		return p.executeIfStatement(s)
+	case *ast.CaseStatement:
+		return p.executeCaseStatement(s)
+	case *ast.WhileStatement:
+		return p.executeWhileStatement(s)
+	case *ast.RepeatStatement:
+		return p.executeRepeatStatement(s)
+	case *ast.ForStatement:
+		return p.executeForStatement(s)
+	case *ast.ExitStatement:
+		return errExit
+	case *ast.ContinueStatement:
+		return errContinue
+	case *ast.ReturnStatement:
+		return errReturn
 	default:
-		// Log unsupported statement type but don't fail
-		// fmt.Printf("Unsupported statement type: %s\n", stmtType)
-		return nil
+		return fmt.Errorf("unsupported statement type: %T", stmt)
 	}
 }
 
-// executeRawAssignment executes an assignment statement from raw JSON AST
-func (p *Program) executeRawAssignment(stmt map[string]interface{}) error {
-	// Get variable name
-	varRef, ok := stmt["variable"].(map[string]interface{})
-	if !ok {
-		return fmt.Errorf("invalid assignment: missing variable reference")
-	}
-
-	varName, ok := varRef["name"].(string)
-	if !ok {
-		return fmt.Errorf("invalid assignment: missing variable name")
-	}
-
-	// Find the variable in our program
-	variable, ok := p.Vars[varName]
-	if !ok {
-		return fmt.Errorf("undefined variable: %s", varName)
-	}
-
-	// Get the expression to evaluate
-	expr, ok := stmt["expression"]
-	if !ok {
-		return fmt.Errorf("invalid assignment: missing expression")
-	}
-
-	// Evaluate the expression
-	value, err := p.evaluateRawExpression(expr)
-	if err != nil {
-		return err
+// executeStatements executes a statement list, stopping at the first error or control-flow signal
+func (p *Program) executeStatements(stmts []ast.Statement) error {
+	for _, stmt := range stmts {
+		if err := p.executeStatement(stmt); err != nil {
+			return runtimeError(err, stmt)
+		}
 	}
-
-	// Assign the value to the variable
-	variable.Value = value
-	variable.Timestamp = time.Now()
-
 	return nil
 }
 
-// executeRawIfStatement executes an if statement from raw JSON AST
-func (p *Program) executeRawIfStatement(stmt map[string]interface{}) error {
-	// Get condition
-	condition, ok := stmt["condition"]
-	if !ok {
-		return fmt.Errorf("invalid if statement: missing condition")
+// runtimeError reports err at the position of the statement that failed.
+// Control-flow signals are passed through unchanged.
+func runtimeError(err error, stmt ast.Statement) error {
+	if errors.Is(err, errExit) || errors.Is(err, errContinue) || errors.Is(err, errReturn) {
+		return err
 	}
+	return diagnostics.Wrap(err, stmt.Position(), diagnostics.CodeRuntime)
+}
 
-	// Evaluate condition
-	condValue, err := p.evaluateRawExpression(condition)
+// executeIfStatement runs the branch of the first true condition, or the ELSE branch
+func (p *Program) executeIfStatement(s *ast.IfStatement) error {
+	cond, err := p.evaluateCondition(s.Condition, "IF")
 	if err != nil {
 		return err
 	}
-
-	// Check if condition is true
-	condBool, ok := condValue.(bool)
-	if !ok {
-		return fmt.Errorf("invalid condition result: not a boolean")
+	if cond {
+		return p.executeStatements(s.Then)
 	}
 
-	// Execute then or else branch
-	if condBool {
-		// Execute then branch
-		thenBlock, ok := stmt["then"].([]interface{})
-		if !ok {
-			// It might be a single statement
-			if thenStmt, ok := stmt["then"].(map[string]interface{}); ok {
-				return p.executeRawStatement(thenStmt)
-			}
-			return fmt.Errorf("invalid then branch")
+	for _, elseIf := range s.ElseIf {
+		cond, err := p.evaluateCondition(elseIf.Condition, "ELSIF")
+		if err != nil {
+			return err
+		}
+		if cond {
+			return p.executeStatements(elseIf.Then)
 		}
+	}
 
-		for _, thenStmt := range thenBlock {
-			if err := p.executeRawStatement(thenStmt); err != nil {
-				return err
-			}
+	return p.executeStatements(s.Else)
+}
+
+// executeWhileStatement repeats the body while the condition holds
+func (p *Program) executeWhileStatement(s *ast.WhileStatement) error {
+	for {
+		cond, err := p.evaluateCondition(s.Condition, "WHILE")
+		if err != nil {
+			return err
 		}
-	} else if elseExpr, hasElse := stmt["else"]; hasElse {
-		// Execute else branch if exists
-		elseBlock, ok := elseExpr.([]interface{})
-		if !ok {
-			// It might be a single statement
-			if elseStmt, ok := elseExpr.(map[string]interface{}); ok {
-				return p.executeRawStatement(elseStmt)
-			}
-			return fmt.Errorf("invalid else branch")
+		if !cond {
+			return nil
 		}
 
-		for _, elseStmt := range elseBlock {
-			if err := p.executeRawStatement(elseStmt); err != nil {
-				return err
-			}
+		stop, err := p.executeLoopBody(s.Body)
+		if err != nil || stop {
+			return err
 		}
 	}
-
-	return nil
 }
 
-// executeTONTimer executes a TON timer function block
-func (p *Program) executeTONTimer(instance string, inputs []ast.Expression) error {
-	// TON timer has inputs: IN (BOOL), PT (TIME)
-	// and outputs: Q (BOOL), ET (TIME)
-	var inValue bool
-	var ptValue time.Duration
+// executeRepeatStatement runs the body at least once, until the condition holds
+func (p *Program) executeRepeatStatement(s *ast.RepeatStatement) error {
+	for {
+		stop, err := p.executeLoopBody(s.Body)
+		if err != nil || stop {
+			return err
+		}
 
-	// If inputs are provided, evaluate them
-	if len(inputs) >= 1 {
-		in, err := p.evaluateExpression(inputs[0])
+		cond, err := p.evaluateCondition(s.Condition, "UNTIL")
 		if err != nil {
 			return err
 		}
-		inBool, ok := in.(bool)
-		if !ok {
-			return fmt.Errorf("IN parameter must be boolean")
+		if cond {
+			return nil
 		}
-		inValue = inBool
 	}
+}
 
-	if len(inputs) >= 2 {
-		pt, err := p.evaluateExpression(inputs[1])
+// executeForStatement runs a counted loop. From, To and BY are evaluated once
+// before the first iteration; a negative step counts down. A control variable
+// that is not declared in the enclosing POU only exists for the loop's duration.
+func (p *Program) executeForStatement(s *ast.ForStatement) error {
+	from, err := p.evaluateInteger(s.From, "FOR start")
+	if err != nil {
+		return err
+	}
+	to, err := p.evaluateInteger(s.To, "FOR end")
+	if err != nil {
+		return err
+	}
+	step := 1
+	if s.By != nil {
+		step, err = p.evaluateInteger(s.By, "FOR step")
 		if err != nil {
 			return err
 		}
-
-		// Convert to time.Duration
-		switch v := pt.(type) {
-		case time.Duration:
-			ptValue = v
-		case string:
-			// Parse IEC time format (e.g. T#2s)
-			ptValue = parseIECTime(v)
-		default:
-			return fmt.Errorf("PT parameter must be TIME")
+		if step == 0 {
+			return fmt.Errorf("FOR step must not be zero")
 		}
 	}
 
-	// Debug info
-	// fmt.Printf("TON Timer: %s, IN=%v, PT=%v\n", instance, inValue, ptValue)
-
-	// Timer state variables (standard TON interface)
-	timerQ := instance + ".Q"   // Output: timer expired flag
-	timerET := instance + ".ET" // Output: elapsed time
+	counter, declared := p.lookupVariable(s.Variable)
+	if declared && counter.constant {
+		return fmt.Errorf("cannot assign to constant %s", s.Variable)
+	}
+	if !declared {
+		counter = &Variable{
+			Name:     s.Variable,
+			DataType: TypeInt,
+			Quality:  QualityGood,
+		}
+		scope := p.currentScope()
+		scope[s.Variable] = counter
+		defer delete(scope, s.Variable)
+	}
 
-	// Internal state variables
-	timerRunning := instance + ".Running"     // Internal: is timer running
-	timerStartTime := instance + ".StartTime" // Internal: when timer started
+	if err := assign(counter, from); err != nil {
+		return err
+	}
 
-	// Ensure all timer variables exist
-	if _, ok := p.Vars[timerQ]; !ok {
-		p.Vars[timerQ] = &Variable{
-			Name:      timerQ,
-			DataType:  TypeBool,
-			Value:     false,
-			Quality:   QualityGood,
-			Timestamp: time.Now(),
+	for {
+		// The body may assign the control variable, so re-read it every iteration
+		current, ok := toInt(counter.Value)
+		if !ok {
+			return fmt.Errorf("FOR control variable %s must be an integer, got %T", s.Variable, counter.Value)
+		}
+		if (step > 0 && current > to) || (step < 0 && current < to) {
+			return nil
 		}
-	}
 
-	if _, ok := p.Vars[timerET]; !ok {
-		p.Vars[timerET] = &Variable{
-			Name:      timerET,
-			DataType:  TypeString,
-			Value:     "0s",
-			Quality:   QualityGood,
-			Timestamp: time.Now(),
+		stop, err := p.executeLoopBody(s.Body)
+		if err != nil || stop {
+			return err
 		}
-	}
 
-	if _, ok := p.Vars[timerRunning]; !ok {
-		p.Vars[timerRunning] = &Variable{
-			Name:      timerRunning,
-			DataType:  TypeBool,
-			Value:     false,
-			Quality:   QualityGood,
-			Timestamp: time.Now(),
+		current, ok = toInt(counter.Value)
+		if !ok {
+			return fmt.Errorf("FOR control variable %s must be an integer, got %T", s.Variable, counter.Value)
+		}
+		if stepped, err := stepCounter(counter, current, step); err != nil || !stepped {
+			return err
 		}
 	}
+}
 
-	if _, ok := p.Vars[timerStartTime]; !ok {
-		p.Vars[timerStartTime] = &Variable{
-			Name:      timerStartTime,
-			DataType:  TypeString,
-			Value:     time.Now().Format(time.RFC3339Nano),
-			Quality:   QualityGood,
-			Timestamp: time.Now(),
-		}
+// stepCounter adds step to current, the value of the FOR control variable
+// counter. It reports false when the sum does not fit the type of counter,
+// which ends the loop rather than wrapping around to run it again.
+func stepCounter(counter *Variable, current, step int) (bool, error) {
+	if err := assign(counter, current+step); err != nil {
+		return false, err
+	}
+	if next, _ := toInt(counter.Value); next != current+step {
+		return false, assign(counter, current)
 	}
+	return true, nil
+}
 
-	// Get variable references
-	qVar := p.Vars[timerQ]
-	etVar := p.Vars[timerET]
-	runningVar := p.Vars[timerRunning]
-	startTimeVar := p.Vars[timerStartTime]
+// executeLoopBody runs one loop iteration and reports whether EXIT ended the loop
+func (p *Program) executeLoopBody(body []ast.Statement) (bool, error) {
+	if err := p.checkWatchdog(); err != nil {
+		return false, err
+	}
+	err := p.executeStatements(body)
+	switch {
+	case errors.Is(err, errExit):
+		return true, nil
+	case errors.Is(err, errContinue):
+		return false, nil
+	default:
+		return false, err
+	}
+}
 
-	// Debug current state
-	// fmt.Printf("  Before - Q=%v, ET=%v, Running=%v\n",
-	// 	qVar.Value, etVar.Value, runningVar.Value)
+// checkWatchdog is called on every loop iteration and fails once the cycle
+// has run past its deadline. The clock is read every watchdogStride
+// iterations, which keeps tight loops fast.
+func (p *Program) checkWatchdog() error {
+	if p.deadline.IsZero() {
+		return nil
+	}
+	p.iterations++
+	if p.iterations%watchdogStride != 0 {
+		return nil
+	}
+	if time.Now().After(p.deadline) {
+		return errWatchdog
+	}
+	return nil
+}
 
-	// TON behavior implementation
-	if inValue {
-		// Timer input is TRUE
-		running, _ := runningVar.Value.(bool)
+// evaluateCondition evaluates an expression that must yield a BOOL
+func (p *Program) evaluateCondition(expr ast.Expression, construct string) (bool, error) {
+	val, err := p.evaluateExpression(expr)
+	if err != nil {
+		return false, err
+	}
+	cond, ok := val.(bool)
+	if !ok {
+		return false, fmt.Errorf("%s condition must be BOOL, got %T", construct, val)
+	}
+	return cond, nil
+}
 
-		if !running {
-			// Timer just started
-			runningVar.Value = true
-			startTimeVar.Value = time.Now().Format(time.RFC3339Nano)
-			qVar.Value = false
-			// fmt.Printf("  Timer starting now\n")
-		}
+// evaluateInteger evaluates an expression that must yield an integer
+func (p *Program) evaluateInteger(expr ast.Expression, what string) (int, error) {
+	val, err := p.evaluateExpression(expr)
+	if err != nil {
+		return 0, err
+	}
+	i, ok := toInt(val)
+	if !ok {
+		return 0, fmt.Errorf("%s must be an integer, got %s", what, typeNameOf(val))
+	}
+	return i, nil
+}
 
-		// Calculate elapsed time
-		startTime, _ := time.Parse(time.RFC3339Nano, startTimeVar.Value.(string))
-		elapsed := time.Since(startTime)
-		etVar.Value = elapsed.String()
+// executeCaseStatement runs the first branch with a label matching the selector,
+// or the ELSE branch when no label matches
+func (p *Program) executeCaseStatement(s *ast.CaseStatement) error {
+	selector, err := p.evaluateExpression(s.Selector)
+	if err != nil {
+		return err
+	}
 
-		// Check if timer has expired
-		if elapsed >= ptValue {
-			if qVar.Value != true {
-				// fmt.Printf("  Timer expired after %v (preset: %v)\n", elapsed, ptValue)
+	for _, branch := range s.Branches {
+		for _, label := range branch.Labels {
+			matched, err := p.matchCaseLabel(selector, label)
+			if err != nil {
+				return err
+			}
+			if matched {
+				return p.executeStatements(branch.Body)
 			}
-			qVar.Value = true
-		}
-	} else {
-		// Timer input is FALSE, reset timer
-		if runningVar.Value.(bool) {
-			// fmt.Printf("  Timer being reset\n")
 		}
-		runningVar.Value = false
-		etVar.Value = "0s"
-		qVar.Value = false
 	}
 
-	// Debug final state
-	// fmt.Printf("  After - Q=%v, ET=%v, Running=%v\n",
-	// 	qVar.Value, etVar.Value, runningVar.Value)
-
-	return nil
+	return p.executeStatements(s.Else)
 }
 
-// parseIECTime parses an IEC 61131-3 time literal
-func parseIECTime(iecTime string) time.Duration {
-	// Strip the T# prefix if present
-	s := iecTime
-	if strings.HasPrefix(strings.ToUpper(s), "T#") {
-		s = s[2:]
+// matchCaseLabel reports whether the selector equals a label value or lies within a label range
+func (p *Program) matchCaseLabel(selector interface{}, label *ast.CaseLabel) (bool, error) {
+	low, err := p.evaluateExpression(label.Low)
+	if err != nil {
+		return false, err
 	}
 
-	var duration time.Duration
+	if label.High == nil {
+		equal, err := evaluateBinaryOp(selector, "=", low)
+		if err != nil {
+			return false, err
+		}
+		return equal.(bool), nil
+	}
 
-	// Parse days
-	if idx := strings.Index(s, "d"); idx >= 0 {
-		days, _ := strconv.Atoi(s[:idx])
-		duration += time.Duration(days) * 24 * time.Hour
-		s = s[idx+1:]
+	high, err := p.evaluateExpression(label.High)
+	if err != nil {
+		return false, err
 	}
 
-	// Parse hours
-	if idx := strings.Index(s, "h"); idx >= 0 {
-		hours, _ := strconv.Atoi(s[:idx])
-		duration += time.Duration(hours) * time.Hour
-		s = s[idx+1:]
+	aboveLow, err := evaluateBinaryOp(selector, ">=", low)
+	if err != nil {
+		return false, err
 	}
+	belowHigh, err := evaluateBinaryOp(selector, "<=", high)
+	if err != nil {
+		return false, err
+	}
+	return aboveLow.(bool) && belowHigh.(bool), nil
+}
 
-	// Parse minutes
-	if idx := strings.Index(s, "m"); idx >= 0 && !strings.Contains(s[:idx], "s") {
-		mins, _ := strconv.Atoi(s[:idx])
-		duration += time.Duration(mins) * time.Minute
-		s = s[idx+1:]
+// literalValue converts a parsed literal to its runtime value. Literals without
+// a type prefix stay untyped so they adopt the type they are used with.
+func (p *Program) literalValue(lit *ast.Literal) (interface{}, error) {
+	if lit.Type == nil {
+		return lit.Value, nil
+	}
+	name := lit.Type.TypeName()
+	if name == parser.AnyInt || name == parser.AnyReal {
+		return lit.Value, nil
 	}
 
-	// Parse seconds
-	if idx := strings.Index(s, "s"); idx >= 0 && !strings.Contains(s[:idx], "m") {
-		secs, _ := strconv.Atoi(s[:idx])
-		duration += time.Duration(secs) * time.Second
-		s = s[idx+1:]
+	dt, ok := elementaryType(name)
+	if !ok {
+		// Typed enumeration values such as State#Idle
+		if valueName, ok := lit.Value.(string); ok {
+			if enum, ok := p.lib.EnumValue(name + "#" + valueName); ok {
+				return enum, nil
+			}
+		}
+		return nil, fmt.Errorf("invalid literal %s#%v", name, lit.Value)
 	}
 
-	// Parse milliseconds
-	if idx := strings.Index(s, "ms"); idx >= 0 {
-		ms, _ := strconv.Atoi(s[:idx])
-		duration += time.Duration(ms) * time.Millisecond
+	switch v := lit.Value.(type) {
+	case time.Duration:
+		if dt == TypeTOD {
+			return TimeOfDay(v), nil
+		}
+		return Duration(v), nil
+	case time.Time:
+		if dt == TypeDate {
+			return Date(v), nil
+		}
+		return DateTime(v), nil
 	}
 
-	return duration
+	val, err := coerce(lit.Value, dt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid literal %s#%v: %w", name, lit.Value, err)
+	}
+	return val, nil
 }
 
 // evaluateExpression evaluates an expression
 func (p *Program) evaluateExpression(expr ast.Expression) (interface{}, error) {
 	switch e := expr.(type) {
 	case *ast.Variable:
-		v, ok := p.Vars[e.Name]
-		if !ok {
-			return nil, fmt.Errorf("undefined variable: %s", e.Name)
+		if v, ok := p.lookupVariable(e.Name); ok {
+			return v.Value, nil
+		}
+		if enum, ok := p.lib.EnumValue(e.Name); ok {
+			return enum, nil
 		}
-		return v.Value, nil
+		return nil, fmt.Errorf("undefined variable: %s", e.Name)
 	case *ast.Literal:
-		return e.Value, nil
+		return p.literalValue(e)
+	case *ast.NamedArg:
+		return p.evaluateExpression(e.Value)
 	case *ast.BinaryExpr:
 		left, err := p.evaluateExpression(e.Left)
 		if err != nil {
@@ -500,187 +513,107 @@ func (p *Program) evaluateExpression(expr ast.Expression) (interface{}, error) {
 			return nil, err
 		}
 		return evaluateBinaryOp(left, e.Operator, right)
-	case *ast.CallExpr:
-		// Handle function calls
-		if instance, ok := isTimerExpression(e.Function); ok {
-			// For timer calls, we handle these separately in executeTONTimer
-			// Just return a placeholder value
-			log.Printf("Function call to timer instance: %s", instance)
-			return true, nil
+	case *ast.UnaryExpr:
+		operand, err := p.evaluateExpression(e.Operand)
+		if err != nil {
+			return nil, err
 		}
-
-		// For other function calls, log and return a default
-		log.Printf("Unhandled function call: %s", e.Function)
-		return false, nil
-	case *ast.MemberAccess:
-		// Handle member access (e.g., Timer.Q)
-		if obj, ok := e.Object.(*ast.Variable); ok {
-			if isTimerInstance(obj.Name) {
-				// Look for Timer.Q, Timer.ET properties
-				propertyName := obj.Name + "." + e.Member
-				if property, ok := p.Vars[propertyName]; ok {
-					return property.Value, nil
-				}
+		return evaluateUnaryOp(e.Operator, operand)
+	case *ast.CallExpr:
+		// Handle user-defined functions from this or other deployed files
+		if fn, ok := p.lib.Function(e.Function); ok {
+			args, err := p.evaluateArgs(fn, e.Args)
+			if err != nil {
+				return nil, err
 			}
+			return p.invokeFunction(fn, args)
 		}
-		return nil, fmt.Errorf("unhandled member access: %s", e)
-	default:
-		return nil, fmt.Errorf("unsupported expression type: %T", expr)
-	}
-}
-
-// evaluateRawExpression evaluates an expression from raw JSON AST
-func (p *Program) evaluateRawExpression(expr interface{}) (interface{}, error) {
-	exprMap, ok := expr.(map[string]interface{})
-	if !ok {
-		return nil, fmt.Errorf("invalid expression format: not a map")
-	}
-
-	exprType, ok := exprMap["$type"].(string)
-	if !ok {
-		return nil, fmt.Errorf("invalid expression format: missing $type")
-	}
-
-	switch exprType {
-	case "IntLiteral", "BooleanLiteral", "RealLiteral", "StringLiteral":
-		// Return the value of the literal
-		return exprMap["value"], nil
-
-	case "VariableReference":
-		// Get variable value
-		varName, ok := exprMap["name"].(string)
-		if !ok {
-			return nil, fmt.Errorf("invalid variable reference: missing name")
+		if fn, ok := standardFunction(e.Function); ok {
+			return p.evaluateStandardCall(e.Function, fn, e.Args)
 		}
-
-		variable, ok := p.Vars[varName]
-		if !ok {
-			return nil, fmt.Errorf("undefined variable: %s", varName)
-		}
-
-		return variable.Value, nil
-
-	case "MemberAccess":
-		// Handle member access (e.g., Timer.Q, Timer.ET)
-		object, hasObj := exprMap["object"].(map[string]interface{})
-		if !hasObj {
-			return nil, fmt.Errorf("invalid member access: missing object")
-		}
-
-		member, hasMember := exprMap["member"].(string)
-		if !hasMember {
-			return nil, fmt.Errorf("invalid member access: missing member name")
+		return nil, fmt.Errorf("undefined function: %s", e.Function)
+	case *ast.ArrayAccess:
+		elem, err := p.resolveVariable(e)
+		if err != nil {
+			return nil, err
 		}
-
-		// Handle object.member syntax (especially for timers)
-		if object["$type"] == "VariableReference" {
-			objName, hasName := object["name"].(string)
-			if hasName {
-				// Check if this is a timer property access
-				if isTimerInstance(objName) {
-					// Look for Timer.Q, Timer.ET properties
-					propertyName := objName + "." + member
-					if property, ok := p.Vars[propertyName]; ok {
-						return property.Value, nil
-					}
+		return elem.Value, nil
+	case *ast.ArrayLiteral:
+		var values []interface{}
+		for _, elem := range e.Elements {
+			var val interface{}
+			if elem.Value != nil {
+				var err error
+				if val, err = p.evaluateExpression(elem.Value); err != nil {
+					return nil, err
 				}
 			}
+			for i := 0; i < elem.Count; i++ {
+				values = append(values, val)
+			}
 		}
-
-		return nil, fmt.Errorf("unhandled member access: %s.%s",
-			object["name"], member)
-
-	case "BinaryExpression":
-		// Evaluate binary expression
-		left, err := p.evaluateRawExpression(exprMap["left"])
-		if err != nil {
-			return nil, err
-		}
-
-		right, err := p.evaluateRawExpression(exprMap["right"])
+		return values, nil
+	case *ast.MemberAccess:
+		// Handle struct fields and function block outputs (e.g., motor.speed, fb.out1)
+		member, err := p.resolveVariable(e)
 		if err != nil {
 			return nil, err
 		}
-
-		operator, ok := exprMap["operator"].(string)
-		if !ok {
-			return nil, fmt.Errorf("invalid binary expression: missing operator")
-		}
-
-		return evaluateBinaryOp(left, operator, right)
-
-	case "FunctionCallExpression":
-		// Handle function calls
-		call, hasCall := exprMap["call"].(map[string]interface{})
-		if !hasCall {
-			return nil, fmt.Errorf("invalid function call: missing call object")
-		}
-
-		// Check if it's a timer function call
-		if call["$type"] == "VariableReference" {
-			instanceName, hasName := call["name"].(string)
-			if hasName && isTimerInstance(instanceName) {
-				// This is a timer call, for now just return true since we handle timers separately
-				return true, nil
-			}
-		} else if call["$type"] == "MemberAccess" {
-			// Handle member access function calls (obj.method())
-			obj, hasObj := call["object"].(map[string]interface{})
-			member, hasMember := call["member"].(string)
-
-			if hasObj && hasMember && obj["$type"] == "VariableReference" {
-				instanceName, hasName := obj["name"].(string)
-				if hasName && isTimerInstance(instanceName) {
-					// This is a timer property access (like Timer.Q)
-					propertyName := instanceName + "." + member
-					if property, ok := p.Vars[propertyName]; ok {
-						return property.Value, nil
-					}
-				}
-			}
-		}
-
-		// For other function calls, just return a default value for now
-		return false, nil
-
+		return member.Value, nil
 	default:
-		return nil, fmt.Errorf("unsupported expression type: %s", exprType)
+		return nil, fmt.Errorf("unsupported expression type: %T", expr)
 	}
 }
 
 // Helper functions
-func convertDataType(t ast.DataType) DataType {
-	switch t.TypeName() {
-	case "BOOL":
-		return TypeBool
-	case "INT":
-		return TypeInt
-	case "REAL":
-		return TypeFloat
-	case "STRING":
-		return TypeString
-	default:
-		return TypeString
+// convertDataType maps a declared type to the runtime data type of its values
+func convertDataType(t ast.DataType) (DataType, error) {
+	switch typ := t.(type) {
+	case *ast.StructType:
+		return TypeStruct, nil
+	case *ast.EnumType:
+		return TypeEnum, nil
+	case *ast.SubrangeType:
+		return convertDataType(typ.Base)
+	case *ast.ArrayType:
+		return TypeArray, nil
 	}
-}
 
-func defaultValue(t DataType) interface{} {
-	switch t {
-	case TypeBool:
-		return false
-	case TypeInt:
-		return 0
-	case TypeFloat:
-		return 0.0
-	case TypeString:
-		return ""
-	default:
-		return nil
+	if dt, ok := elementaryType(t.TypeName()); ok {
+		return dt, nil
 	}
+	return 0, fmt.Errorf("unknown data type %s", t.TypeName())
 }
 
 func evaluateBinaryOp(left interface{}, op string, right interface{}) (interface{}, error) {
+	// TIME, TOD, DATE and DT have their own arithmetic
+	if isTimeValue(left) || isTimeValue(right) {
+		return evaluateTimeOp(left, op, right)
+	}
+
+	// ** always yields an LREAL
+	if op == "**" {
+		return evaluatePower(left, right)
+	}
+
+	// Operands are computed in a common representation and the result is
+	// wrapped to the wider operand type, so INT + INT overflows like an INT
+	left, right, resultType, typed := unifyOperands(left, right)
+
+	result, err := evaluateArithmetic(left, op, right)
+	if err != nil || !typed {
+		return result, err
+	}
+	if _, isBool := result.(bool); isBool {
+		return result, nil
+	}
+	return coerce(result, resultType)
+}
+
+func evaluateArithmetic(left interface{}, op string, right interface{}) (interface{}, error) {
 	switch op {
+	case "AND", "&", "OR", "XOR":
+		return evaluateLogical(left, op, right)
 	case "+":
 		return evaluateAdd(left, right)
 	case "-":
@@ -689,6 +622,8 @@ func evaluateBinaryOp(left interface{}, op string, right interface{}) (interface
 		return evaluateMultiply(left, right)
 	case "/":
 		return evaluateDivide(left, right)
+	case "MOD":
+		return evaluateModulo(left, right)
 	case "<":
 		return evaluateLessThan(left, right)
 	case ">":
@@ -706,13 +641,257 @@ func evaluateBinaryOp(left interface{}, op string, right interface{}) (interface
 	}
 }
 
+func evaluateUnaryOp(op string, operand interface{}) (interface{}, error) {
+	t, typed := valueType(operand)
+
+	switch op {
+	case "NOT":
+		// NOT is a boolean negation on BOOL and a bitwise complement on integers
+		if v, ok := operand.(bool); ok {
+			return !v, nil
+		}
+		if bits, ok := integerBits(operand); ok {
+			if !typed {
+				return ^operand.(int), nil
+			}
+			return wrapInteger(^bits, t), nil
+		}
+	case "-":
+		switch v := operand.(type) {
+		case int:
+			return -v, nil
+		case float32:
+			return -v, nil
+		case float64:
+			return -v, nil
+		case Duration:
+			return -v, nil
+		}
+		if bits, ok := integerBits(operand); ok {
+			return wrapInteger(-bits, t), nil
+		}
+	case "+":
+		if _, ok := toFloat(operand); ok {
+			return operand, nil
+		}
+		if d, ok := operand.(Duration); ok {
+			return d, nil
+		}
+	default:
+		return nil, fmt.Errorf("unsupported operator: %s", op)
+	}
+	return nil, fmt.Errorf("invalid operand for %s: %s", op, typeNameOf(operand))
+}
+
+// unifyOperands converts numeric operands to a common representation: int for
+// signed integers, uint64 for unsigned integers and bit strings and float64 for
+// REAL and LREAL. It also returns the type of the result, which is the wider of
+// the operand types; untyped integer literals adopt the type of the other operand.
+func unifyOperands(left, right interface{}) (interface{}, interface{}, DataType, bool) {
+	_, lNum := toFloat(left)
+	_, rNum := toFloat(right)
+	if !lNum || !rNum {
+		return left, right, 0, false
+	}
+
+	lt, lTyped := valueType(left)
+	rt, rTyped := valueType(right)
+
+	var result DataType
+	switch {
+	case lTyped && rTyped:
+		result = widerType(lt, rt)
+	case lTyped:
+		result = lt
+	case rTyped:
+		result = rt
+	default:
+		return left, right, 0, false
+	}
+
+	switch elementaryTypes[result].class {
+	case classReal:
+		l, _ := toFloat(left)
+		r, _ := toFloat(right)
+		return l, r, result, true
+	case classUnsigned, classBits:
+		l, _ := integerBits(left)
+		r, _ := integerBits(right)
+		return l, r, result, true
+	default:
+		l, _ := toInt(left)
+		r, _ := toInt(right)
+		return l, r, result, true
+	}
+}
+
+// widerType returns the numeric type able to represent both operand types;
+// REAL types win over integers
+func widerType(a, b DataType) DataType {
+	ai, bi := elementaryTypes[a], elementaryTypes[b]
+	aReal, bReal := ai.class == classReal, bi.class == classReal
+	switch {
+	case aReal != bReal:
+		if aReal {
+			return a
+		}
+		return b
+	case bi.bits > ai.bits:
+		return b
+	default:
+		return a
+	}
+}
+
+func isTimeValue(v interface{}) bool {
+	switch v.(type) {
+	case Duration, TimeOfDay, Date, DateTime:
+		return true
+	}
+	return false
+}
+
+// timeOrdinal returns a comparable nanosecond count for a time value
+func timeOrdinal(v interface{}) (int64, bool) {
+	switch t := v.(type) {
+	case Duration:
+		return int64(t), true
+	case TimeOfDay:
+		return int64(t), true
+	case Date:
+		return time.Time(t).UnixNano(), true
+	case DateTime:
+		return time.Time(t).UnixNano(), true
+	}
+	return 0, false
+}
+
+// evaluateTimeOp implements comparisons of time values and the arithmetic of
+// ADD_TIME, SUB_TIME, MUL_TIME, DIV_TIME and their TOD, DATE and DT variants
+func evaluateTimeOp(left interface{}, op string, right interface{}) (interface{}, error) {
+	switch op {
+	case "=", "<>", "<", ">", "<=", ">=":
+		lt, _ := valueType(left)
+		rt, _ := valueType(right)
+		l, lok := timeOrdinal(left)
+		r, rok := timeOrdinal(right)
+		if lok && rok && lt == rt {
+			return evaluateArithmetic(int(l), op, int(r))
+		}
+	case "+":
+		if d, ok := right.(Duration); ok {
+			switch l := left.(type) {
+			case Duration:
+				return l + d, nil
+			case TimeOfDay:
+				return timeOfDay(time.Duration(l) + time.Duration(d)), nil
+			case DateTime:
+				return DateTime(time.Time(l).Add(time.Duration(d))), nil
+			}
+		}
+	case "-":
+		switch l := left.(type) {
+		case Duration:
+			if r, ok := right.(Duration); ok {
+				return l - r, nil
+			}
+		case TimeOfDay:
+			switch r := right.(type) {
+			case Duration:
+				return timeOfDay(time.Duration(l) - time.Duration(r)), nil
+			case TimeOfDay:
+				return Duration(l - r), nil
+			}
+		case Date:
+			if r, ok := right.(Date); ok {
+				return Duration(time.Time(l).Sub(time.Time(r))), nil
+			}
+		case DateTime:
+			switch r := right.(type) {
+			case Duration:
+				return DateTime(time.Time(l).Add(-time.Duration(r))), nil
+			case DateTime:
+				return Duration(time.Time(l).Sub(time.Time(r))), nil
+			}
+		}
+	case "*", "/":
+		l, ok := left.(Duration)
+		if !ok {
+			break
+		}
+		f, ok := toFloat(right)
+		if !ok {
+			break
+		}
+		if op == "*" {
+			return Duration(float64(l) * f), nil
+		}
+		if f == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return Duration(float64(l) / f), nil
+	default:
+		return nil, fmt.Errorf("unsupported operator: %s", op)
+	}
+	return nil, fmt.Errorf("invalid operands for %s: %s and %s", op, typeNameOf(left), typeNameOf(right))
+}
+
+// Logical operations: boolean on BOOL operands, bitwise on integer operands
+func evaluateLogical(left interface{}, op string, right interface{}) (interface{}, error) {
+	switch l := left.(type) {
+	case bool:
+		if r, ok := right.(bool); ok {
+			switch op {
+			case "AND", "&":
+				return l && r, nil
+			case "OR":
+				return l || r, nil
+			case "XOR":
+				return l != r, nil
+			}
+		}
+	case int:
+		if r, ok := right.(int); ok {
+			switch op {
+			case "AND", "&":
+				return l & r, nil
+			case "OR":
+				return l | r, nil
+			case "XOR":
+				return l ^ r, nil
+			}
+		}
+	case uint64:
+		if r, ok := right.(uint64); ok {
+			switch op {
+			case "AND", "&":
+				return l & r, nil
+			case "OR":
+				return l | r, nil
+			case "XOR":
+				return l ^ r, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("invalid operands for %s: %T and %T", op, left, right)
+}
+
 // Arithmetic operations
 func evaluateAdd(left, right interface{}) (interface{}, error) {
 	switch l := left.(type) {
+	case string:
+		// + concatenates strings like CONCAT
+		if r, ok := right.(string); ok {
+			return l + r, nil
+		}
 	case int:
 		if r, ok := right.(int); ok {
 			return l + r, nil
 		}
+	case uint64:
+		if r, ok := right.(uint64); ok {
+			return l + r, nil
+		}
 	case float64:
 		if r, ok := right.(float64); ok {
 			return l + r, nil
@@ -727,6 +906,10 @@ func evaluateSubtract(left, right interface{}) (interface{}, error) {
 		if r, ok := right.(int); ok {
 			return l - r, nil
 		}
+	case uint64:
+		if r, ok := right.(uint64); ok {
+			return l - r, nil
+		}
 	case float64:
 		if r, ok := right.(float64); ok {
 			return l - r, nil
@@ -741,6 +924,10 @@ func evaluateMultiply(left, right interface{}) (interface{}, error) {
 		if r, ok := right.(int); ok {
 			return l * r, nil
 		}
+	case uint64:
+		if r, ok := right.(uint64); ok {
+			return l * r, nil
+		}
 	case float64:
 		if r, ok := right.(float64); ok {
 			return l * r, nil
@@ -758,6 +945,13 @@ func evaluateDivide(left, right interface{}) (interface{}, error) {
 			}
 			return l / r, nil
 		}
+	case uint64:
+		if r, ok := right.(uint64); ok {
+			if r == 0 {
+				return nil, fmt.Errorf("division by zero")
+			}
+			return l / r, nil
+		}
 	case float64:
 		if r, ok := right.(float64); ok {
 			if r == 0 {
@@ -769,13 +963,54 @@ func evaluateDivide(left, right interface{}) (interface{}, error) {
 	return nil, fmt.Errorf("invalid operands for /: %T and %T", left, right)
 }
 
-// Comparison operations
+func evaluateModulo(left, right interface{}) (interface{}, error) {
+	switch l := left.(type) {
+	case int:
+		if r, ok := right.(int); ok {
+			if r == 0 {
+				return nil, fmt.Errorf("division by zero")
+			}
+			return l % r, nil
+		}
+	case uint64:
+		if r, ok := right.(uint64); ok {
+			if r == 0 {
+				return nil, fmt.Errorf("division by zero")
+			}
+			return l % r, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid operands for MOD: %T and %T", left, right)
+}
+
+// evaluatePower implements ** which, like EXPT, always yields a REAL
+func evaluatePower(left, right interface{}) (interface{}, error) {
+	base, ok := toFloat(left)
+	if !ok {
+		return nil, fmt.Errorf("invalid operands for **: %T and %T", left, right)
+	}
+	exp, ok := toFloat(right)
+	if !ok {
+		return nil, fmt.Errorf("invalid operands for **: %T and %T", left, right)
+	}
+	return math.Pow(base, exp), nil
+}
+
+// Comparison operations; strings compare character by character
 func evaluateLessThan(left, right interface{}) (interface{}, error) {
 	switch l := left.(type) {
+	case string:
+		if r, ok := right.(string); ok {
+			return l < r, nil
+		}
 	case int:
 		if r, ok := right.(int); ok {
 			return l < r, nil
 		}
+	case uint64:
+		if r, ok := right.(uint64); ok {
+			return l < r, nil
+		}
 	case float64:
 		if r, ok := right.(float64); ok {
 			return l < r, nil
@@ -786,10 +1021,18 @@ func evaluateLessThan(left, right interface{}) (interface{}, error) {
 
 func evaluateGreaterThan(left, right interface{}) (interface{}, error) {
 	switch l := left.(type) {
+	case string:
+		if r, ok := right.(string); ok {
+			return l > r, nil
+		}
 	case int:
 		if r, ok := right.(int); ok {
 			return l > r, nil
 		}
+	case uint64:
+		if r, ok := right.(uint64); ok {
+			return l > r, nil
+		}
 	case float64:
 		if r, ok := right.(float64); ok {
 			return l > r, nil
@@ -800,10 +1043,18 @@ func evaluateGreaterThan(left, right interface{}) (interface{}, error) {
 
 func evaluateLessEqual(left, right interface{}) (interface{}, error) {
 	switch l := left.(type) {
+	case string:
+		if r, ok := right.(string); ok {
+			return l <= r, nil
+		}
 	case int:
 		if r, ok := right.(int); ok {
 			return l <= r, nil
 		}
+	case uint64:
+		if r, ok := right.(uint64); ok {
+			return l <= r, nil
+		}
 	case float64:
 		if r, ok := right.(float64); ok {
 			return l <= r, nil
@@ -814,10 +1065,18 @@ func evaluateLessEqual(left, right interface{}) (interface{}, error) {
 
 func evaluateGreaterEqual(left, right interface{}) (interface{}, error) {
 	switch l := left.(type) {
+	case string:
+		if r, ok := right.(string); ok {
+			return l >= r, nil
+		}
 	case int:
 		if r, ok := right.(int); ok {
 			return l >= r, nil
 		}
+	case uint64:
+		if r, ok := right.(uint64); ok {
+			return l >= r, nil
+		}
 	case float64:
 		if r, ok := right.(float64); ok {
 			return l >= r, nil
@@ -833,184 +1092,3 @@ func evaluateEqual(left, right interface{}) (interface{}, error) {
 func evaluateNotEqual(left, right interface{}) (interface{}, error) {
 	return left != right, nil
 }
-
-// isTimerExpression checks if the expression refers to a timer and returns the instance name
-func isTimerExpression(expr interface{}) (string, bool) {
-	// For string inputs (from old code)
-	if name, ok := expr.(string); ok {
-		if name == "Timer" || strings.HasSuffix(name, "Timer") {
-			return name, true
-		}
-		return "", false
-	}
-
-	// For AST expression types
-	switch e := expr.(type) {
-	case *ast.Variable:
-		if e.Name == "Timer" || strings.HasSuffix(e.Name, "Timer") {
-			return e.Name, true
-		}
-	case *ast.MemberAccess:
-		// Check for timer member access like Timer.Q
-		if obj, ok := e.Object.(*ast.Variable); ok {
-			if obj.Name == "Timer" || strings.HasSuffix(obj.Name, "Timer") {
-				return obj.Name, true
-			}
-		}
-	}
-	return "", false
-}
-
-// isTimerInstance checks if a variable name is a timer instance
-func isTimerInstance(name string) bool {
-	return name == "Timer" || strings.HasSuffix(name, "Timer")
-}
-
-// executeRawTONTimer executes a TON timer function block from raw AST
-func (p *Program) executeRawTONTimer(instance string, argsObj interface{}) error {
-	args, ok := argsObj.([]interface{})
-	if !ok {
-		// No arguments or invalid format
-		return nil
-	}
-
-	var inValue bool
-	var ptValue time.Duration
-
-	// Process arguments (IN, PT)
-	for _, arg := range args {
-		argMap, ok := arg.(map[string]interface{})
-		if !ok {
-			continue
-		}
-
-		// Get parameter name and value
-		paramName, hasName := argMap["name"].(string)
-		if !hasName {
-			continue
-		}
-
-		value, hasValue := argMap["value"].(map[string]interface{})
-		if !hasValue {
-			continue
-		}
-
-		switch paramName {
-		case "IN":
-			// Parse boolean value
-			if value["$type"] == "BooleanLiteral" {
-				inValue, _ = value["value"].(bool)
-			} else if value["$type"] == "VariableReference" {
-				varName, ok := value["name"].(string)
-				if ok {
-					if v, exists := p.Vars[varName]; exists {
-						if boolVal, ok := v.Value.(bool); ok {
-							inValue = boolVal
-						}
-					}
-				}
-			}
-		case "PT":
-			// Parse time value
-			if value["$type"] == "TimeLiteral" {
-				if timeStr, ok := value["value"].(string); ok {
-					ptValue = parseIECTime(timeStr)
-				}
-			} else if value["$type"] == "VariableReference" {
-				varName, ok := value["name"].(string)
-				if ok {
-					if v, exists := p.Vars[varName]; exists {
-						if timeStr, ok := v.Value.(string); ok {
-							ptValue = parseIECTime(timeStr)
-						}
-					}
-				}
-			}
-		}
-	}
-
-	// Timer state variables (standard TON interface)
-	timerQ := instance + ".Q"   // Output: timer expired flag
-	timerET := instance + ".ET" // Output: elapsed time
-
-	// Internal state variables
-	timerRunning := instance + ".Running"     // Internal: is timer running
-	timerStartTime := instance + ".StartTime" // Internal: when timer started
-
-	// Ensure all timer variables exist
-	if _, ok := p.Vars[timerQ]; !ok {
-		p.Vars[timerQ] = &Variable{
-			Name:      timerQ,
-			DataType:  TypeBool,
-			Value:     false,
-			Quality:   QualityGood,
-			Timestamp: time.Now(),
-		}
-	}
-
-	if _, ok := p.Vars[timerET]; !ok {
-		p.Vars[timerET] = &Variable{
-			Name:      timerET,
-			DataType:  TypeString,
-			Value:     "0s",
-			Quality:   QualityGood,
-			Timestamp: time.Now(),
-		}
-	}
-
-	if _, ok := p.Vars[timerRunning]; !ok {
-		p.Vars[timerRunning] = &Variable{
-			Name:      timerRunning,
-			DataType:  TypeBool,
-			Value:     false,
-			Quality:   QualityGood,
-			Timestamp: time.Now(),
-		}
-	}
-
-	if _, ok := p.Vars[timerStartTime]; !ok {
-		p.Vars[timerStartTime] = &Variable{
-			Name:      timerStartTime,
-			DataType:  TypeString,
-			Value:     time.Now().Format(time.RFC3339Nano),
-			Quality:   QualityGood,
-			Timestamp: time.Now(),
-		}
-	}
-
-	// Get variable references
-	qVar := p.Vars[timerQ]
-	etVar := p.Vars[timerET]
-	runningVar := p.Vars[timerRunning]
-	startTimeVar := p.Vars[timerStartTime]
-
-	// TON behavior implementation
-	if inValue {
-		// Timer input is TRUE
-		running, _ := runningVar.Value.(bool)
-
-		if !running {
-			// Timer just started
-			runningVar.Value = true
-			startTimeVar.Value = time.Now().Format(time.RFC3339Nano)
-			qVar.Value = false
-		}
-
-		// Calculate elapsed time
-		startTime, _ := time.Parse(time.RFC3339Nano, startTimeVar.Value.(string))
-		elapsed := time.Since(startTime)
-		etVar.Value = elapsed.String()
-
-		// Check if timer has expired
-		if elapsed >= ptValue {
-			qVar.Value = true
-		}
-	} else {
-		// Timer input is FALSE, reset timer
-		runningVar.Value = false
-		etVar.Value = "0s"
-		qVar.Value = false
-	}
-
-	return nil
-}
@@ -0,0 +1,276 @@
+package runtime
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/hyperdrive/core/apps/runtime/internal/parser/ast"
+)
+
+// retainFile is the file in Config.DataDir holding the RETAIN and PERSISTENT values
+const retainFile = "retain.json"
+
+// retainInterval is how often retained values are saved while the runtime runs
+const retainInterval = 5 * time.Second
+
+// globalNamespace is the namespace global variables are registered under
+const globalNamespace = "global"
+
+// retainedValue is the saved value of an elementary variable declared RETAIN
+// or PERSISTENT, or of a member or element of one
+type retainedValue struct {
+	Type       string          `json:"type"`
+	Value      json.RawMessage `json:"value"`
+	Persistent bool            `json:"persistent,omitempty"`
+}
+
+// walkRetained calls fn for the elementary variables of v, recursing into
+// members and elements, that are retained by their own declaration or by the
+// variable containing them
+func walkRetained(name string, v *Variable, retention ast.Retention, fn func(string, *Variable, ast.Retention)) {
+	if v.retain != ast.NonRetain {
+		retention = v.retain
+	}
+
+	switch value := v.Value.(type) {
+	case composite:
+		for _, member := range value.members() {
+			if mv, ok := value.member(member); ok {
+				walkRetained(name+"."+member, mv, retention, fn)
+			}
+		}
+	case *ArrayValue:
+		for i, elem := range value.Elems {
+			walkRetained(name+value.indexLabel(i), elem, retention, fn)
+		}
+	default:
+		if retention != ast.NonRetain {
+			fn(name, v, retention)
+		}
+	}
+}
+
+// retainedType names the type a retained value is saved with; values are only
+// restored into variables of the same type
+func retainedType(v *Variable) string {
+	if enum, ok := v.Value.(EnumValue); ok {
+		return enum.Type
+	}
+	return v.DataType.String()
+}
+
+func encodeRetained(val interface{}) (json.RawMessage, error) {
+	switch v := val.(type) {
+	case Duration:
+		return json.Marshal(int64(v))
+	case TimeOfDay:
+		return json.Marshal(int64(v))
+	case Date:
+		return json.Marshal(time.Time(v))
+	case DateTime:
+		return json.Marshal(time.Time(v))
+	case EnumValue:
+		return json.Marshal(v.Name)
+	}
+	return json.Marshal(val)
+}
+
+// decodeRetained restores a saved value into a variable of the same type
+func decodeRetained(v *Variable, saved retainedValue) error {
+	if saved.Type != retainedType(v) {
+		return fmt.Errorf("saved as %s, declared as %s", saved.Type, retainedType(v))
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(saved.Value))
+	dec.UseNumber()
+	var raw interface{}
+	if err := dec.Decode(&raw); err != nil {
+		return err
+	}
+
+	var val interface{}
+	switch current := v.Value.(type) {
+	case EnumValue:
+		name, _ := raw.(string)
+		enum, ok := v.typ.(*ast.EnumType)
+		if !ok {
+			return fmt.Errorf("unknown enumeration %s", current.Type)
+		}
+		for _, ev := range enum.Values {
+			if ev.Name == name {
+				val = EnumValue{Type: current.Type, Name: ev.Name, Value: ev.Value}
+			}
+		}
+		if val == nil {
+			return fmt.Errorf("%s has no value %s", current.Type, name)
+		}
+	default:
+		info, ok := elementaryTypes[v.DataType]
+		if !ok {
+			return fmt.Errorf("cannot restore a value of type %s", v.DataType)
+		}
+		var err error
+		if val, err = decodeElementary(raw, info.class, v.DataType); err != nil {
+			return err
+		}
+	}
+
+	return assign(v, val)
+}
+
+func decodeElementary(raw interface{}, class typeClass, t DataType) (interface{}, error) {
+	switch class {
+	case classBool:
+		if b, ok := raw.(bool); ok {
+			return b, nil
+		}
+	case classSigned, classUnsigned, classBits, classReal, classTime, classTOD:
+		n, ok := raw.(json.Number)
+		if !ok {
+			break
+		}
+		switch class {
+		case classReal:
+			f, err := n.Float64()
+			if err != nil {
+				return nil, err
+			}
+			return coerce(f, t)
+		case classTime, classTOD:
+			ns, err := n.Int64()
+			if err != nil {
+				return nil, err
+			}
+			if class == classTOD {
+				return TimeOfDay(ns), nil
+			}
+			return Duration(ns), nil
+		}
+		if i, err := strconv.ParseInt(n.String(), 10, 64); err == nil {
+			return wrapInteger(uint64(i), t), nil
+		}
+		u, err := strconv.ParseUint(n.String(), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		return wrapInteger(u, t), nil
+	case classDate, classDT:
+		s, _ := raw.(string)
+		tm, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return nil, err
+		}
+		if class == classDate {
+			return Date(tm), nil
+		}
+		return DateTime(tm), nil
+	case classString:
+		if s, ok := raw.(string); ok {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid saved value %v", raw)
+}
+
+// loadRetained reads the values saved by a previous run of the runtime
+func (r *Runtime) loadRetained() error {
+	if r.config.DataDir == "" {
+		return nil
+	}
+	data, err := os.ReadFile(filepath.Join(r.config.DataDir, retainFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &r.retained)
+}
+
+// collectRetained records the current values of the retained variables of
+// the deployed programs and of the globals
+func (r *Runtime) collectRetained() {
+	collect := func(name string, v *Variable) {
+		walkRetained(name, v, ast.NonRetain, func(name string, leaf *Variable, retention ast.Retention) {
+			value, err := encodeRetained(leaf.Value)
+			if err != nil {
+				return
+			}
+			r.retained[name] = retainedValue{
+				Type:       retainedType(leaf),
+				Value:      value,
+				Persistent: retention == ast.Persistent,
+			}
+		})
+	}
+
+	for _, prog := range r.programs {
+		namespace := namespaceOf(prog.Name)
+		for _, decl := range prog.ast.Vars {
+			if v, ok := prog.Vars[decl.Name]; ok && ownsVariable(decl) {
+				collect(namespace+"."+decl.Name, v)
+			}
+		}
+	}
+	for name, v := range r.library.Globals() {
+		collect(globalNamespace+"."+name, v)
+	}
+}
+
+// saveRetained writes the current retained values to Config.DataDir
+func (r *Runtime) saveRetained() error {
+	if r.config.DataDir == "" {
+		return nil
+	}
+	r.collectRetained()
+	if len(r.retained) == 0 {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(r.retained, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(r.config.DataDir, 0755); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash never leaves a truncated file
+	path := filepath.Join(r.config.DataDir, retainFile)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// restoreRetained restores the saved values of a variable. PERSISTENT values
+// are always restored; RETAIN values only when the variable is deployed for
+// the first time since the runtime started.
+func (r *Runtime) restoreRetained(name string, v *Variable, restart bool) {
+	walkRetained(name, v, ast.NonRetain, func(name string, leaf *Variable, retention ast.Retention) {
+		saved, ok := r.retained[name]
+		if !ok || (retention == ast.Retain && !restart) {
+			return
+		}
+		if err := decodeRetained(leaf, saved); err != nil {
+			log.Printf("Not restoring retained %s: %v", name, err)
+		}
+	})
+}
+
+// ownsVariable reports whether a program declaration has a variable of its
+// own, rather than a global or one only existing during a cycle
+func ownsVariable(decl *ast.VarDecl) bool {
+	switch decl.Section {
+	case ast.VarGlobal, ast.VarExternal, ast.VarTemp:
+		return false
+	}
+	return true
+}
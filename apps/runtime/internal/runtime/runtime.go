@@ -5,18 +5,20 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"math/rand"
 	"path/filepath"
-	"regexp"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/hyperdrive/core/apps/runtime/internal/diagnostics"
+	"github.com/hyperdrive/core/apps/runtime/internal/parser/ast"
+	"github.com/hyperdrive/core/apps/runtime/internal/storage"
 )
 
 type Config struct {
 	ScanTime time.Duration
 	DataDir  string
+	Watchdog time.Duration // Longest cycle of a task that sets no watchdog of its own
 }
 
 type Runtime struct {
@@ -24,13 +26,26 @@ type Runtime struct {
 	config        Config
 	variables     map[string]*Variable
 	tasks         []*Task
-	version       *Version
+	programs      map[string]*Program // Instances of the deployed PROGRAMs by file path
+	generation    uint64              // Incremented whenever a deploy swaps programs or tasks
+	version       *Version            // Active version
+	versions      []*Version          // Every version, oldest first
+	shadow        *shadow             // Programs of the version in Testing
 	done          chan struct{}
 	scanTime      time.Duration
 	lastScan      time.Time
 	astStore      map[string]json.RawMessage // Store for ASTs by file path
 	codeStore     map[string]string          // Store for source code by file path
+	library       *Library                   // Functions and function blocks from all deployed files
+	retained      map[string]retainedValue   // Last saved RETAIN and PERSISTENT values by variable name
+	deployed      map[string]bool            // Namespaces deployed since the runtime started
+	image         ProcessImage               // Inputs, outputs and memory of the located variables
+	imageMu       sync.Mutex                 // Guards image, which I/O drivers access between scans
+	located       []ioBinding
 	lastNoVarsLog time.Time
+	mode          Mode         // Operating mode; STOP until the runtime is started
+	modeListeners []func(Mode) // Called after every change of the mode
+	started       bool
 }
 
 type Variable struct {
@@ -39,7 +54,11 @@ type Variable struct {
 	Value     interface{}
 	Quality   Quality
 	Timestamp time.Time
-	Path      string // Add path to track file/folder structure
+	Path      string        // Add path to track file/folder structure
+	typ       ast.DataType  // Declared IEC type; nil for variables not declared in ST
+	constant  bool          // Declared CONSTANT; statements cannot write it
+	retain    ast.Retention // RETAIN and PERSISTENT values are saved in Config.DataDir
+	location  *ast.Location // Direct address of a located variable in the process image
 }
 
 type DataType int
@@ -47,10 +66,51 @@ type DataType int
 const (
 	TypeBool DataType = iota
 	TypeInt
-	TypeFloat
+	TypeFloat // REAL
 	TypeString
+	TypeFunctionBlock
+	TypeStruct
+	TypeEnum
+	TypeArray
+	TypeSInt
+	TypeDInt
+	TypeLInt
+	TypeUSInt
+	TypeUInt
+	TypeUDInt
+	TypeULInt
+	TypeByte
+	TypeWord
+	TypeDWord
+	TypeLWord
+	TypeLReal
+	TypeTime
+	TypeLTime
+	TypeDate
+	TypeTOD
+	TypeDT
+	TypeWString
 )
 
+// String returns the IEC name of the data type
+func (t DataType) String() string {
+	if info, ok := elementaryTypes[t]; ok {
+		return info.name
+	}
+	switch t {
+	case TypeFunctionBlock:
+		return "FUNCTION_BLOCK"
+	case TypeStruct:
+		return "STRUCT"
+	case TypeEnum:
+		return "ENUM"
+	case TypeArray:
+		return "ARRAY"
+	default:
+		return fmt.Sprintf("UNKNOWN(%d)", int(t))
+	}
+}
+
 type Quality int
 
 const (
@@ -62,16 +122,29 @@ const (
 type Task struct {
 	Name     string
 	Program  *Program
-	Interval time.Duration
-	Priority int
-}
-
+	Kind     TaskKind
+	Interval time.Duration           // Period of a cyclic task
+	Event    string                  // BOOL variable whose rising edge runs an event task
+	Priority int                     // 0 is the highest; equal priorities run in the order added
+	Watchdog time.Duration           // Longest cycle before it is aborted
+	Fault    *diagnostics.Diagnostic // Error of the last cycle, nil when it completed
+	Stats    TaskStats
+	next     time.Time // When a cyclic task is due
+	sampled  bool      // Value of the event variable when last sampled
+	faulted  bool      // Stopped by the watchdog
+}
+
+// Version is a deployed or staged set of files and the tasks running them.
+// Parent is the version that was active before this one was activated.
 type Version struct {
-	ID        string
-	Timestamp time.Time
-	State     VersionState
-	Program   *Program
-	Parent    *Version
+	ID         string
+	Timestamp  time.Time
+	State      VersionState
+	Author     string
+	Files      []DeployRequest
+	Tasks      []storage.TaskConfig
+	Parent     *Version
+	Comparison Comparison // Outputs compared with the active version while Testing
 }
 
 type VersionState int
@@ -85,280 +158,299 @@ const (
 
 // DeployRequest represents the data needed to deploy code to the runtime
 type DeployRequest struct {
-	AST        json.RawMessage `json:"ast"`        // AST in JSON format from Langium
+	AST        json.RawMessage `json:"ast"`        // Deploy AST described by parser.DeploySchema, used without SourceCode
 	SourceCode string          `json:"sourceCode"` // Original source code
 	FilePath   string          `json:"filePath"`   // Path of the file
 }
 
+// ProjectRequest holds the files compiled or deployed together as a project:
+// those in Files or, without Files, the single file of the embedded request.
+// Project is the project.json of the project, whose tasks run its programs.
+// Author names who deploys the project in the version it becomes.
+type ProjectRequest struct {
+	DeployRequest
+	Files   []DeployRequest        `json:"files"`
+	Project *storage.ProjectConfig `json:"project"`
+	Author  string                 `json:"author"`
+}
+
+// FileList returns the files of the project
+func (p ProjectRequest) FileList() []DeployRequest {
+	if len(p.Files) > 0 {
+		return p.Files
+	}
+	return []DeployRequest{p.DeployRequest}
+}
+
+// TaskList returns the tasks declared in the project.json of the project
+func (p ProjectRequest) TaskList() []storage.TaskConfig {
+	if p.Project == nil {
+		return nil
+	}
+	return p.Project.Tasks
+}
+
 // RuntimeStatus represents the current status of the runtime
 type RuntimeStatus struct {
 	ScanTime      time.Duration `json:"scanTime"`
 	LastScan      time.Time     `json:"lastScan"`
 	VariableCount int           `json:"variableCount"`
 	TaskCount     int           `json:"taskCount"`
-	Status        string        `json:"status"`
+	Status        string        `json:"status"` // running, paused or stopped
+	Mode          Mode          `json:"mode"`
+	// Runtime errors of the tasks that failed in their last cycle
+	Diagnostics []*diagnostics.Diagnostic `json:"diagnostics,omitempty"`
+	Tasks       []TaskStatus              `json:"tasks"`
 }
 
 func New(config Config) (*Runtime, error) {
-	// Initialize random seed for variable simulation
-	rand.Seed(time.Now().UnixNano())
-
 	runtime := &Runtime{
 		config:    config,
 		variables: make(map[string]*Variable),
 		tasks:     make([]*Task, 0),
+		programs:  make(map[string]*Program),
 		done:      make(chan struct{}),
 		scanTime:  config.ScanTime,
 		astStore:  make(map[string]json.RawMessage),
 		codeStore: make(map[string]string),
+		library:   NewLibrary(),
+		retained:  make(map[string]retainedValue),
+		deployed:  make(map[string]bool),
+		mode:      ModeStop,
+	}
+
+	if err := runtime.loadRetained(); err != nil {
+		log.Printf("Could not load retained values: %v", err)
 	}
 
 	return runtime, nil
 }
 
+// Start starts the scheduler in RUN
 func (r *Runtime) Start(ctx context.Context) error {
-	go r.scanCycle(ctx)
-	return nil
-}
+	r.mu.Lock()
+	if r.started {
+		r.mu.Unlock()
+		return fmt.Errorf("runtime already started")
+	}
+	r.started = true
+	notify := r.setMode(ModeRun)
+	r.mu.Unlock()
 
-func (r *Runtime) Stop(ctx context.Context) error {
-	close(r.done)
+	notify()
+	go r.schedule(ctx)
 	return nil
 }
 
-func (r *Runtime) scanCycle(ctx context.Context) {
-	ticker := time.NewTicker(r.config.ScanTime)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-r.done:
-			return
-		case <-ticker.C:
-			r.executeCycle()
-		}
-	}
-}
-
-func (r *Runtime) executeCycle() {
+// Stop shuts the scheduler down and saves the retained values
+func (r *Runtime) Stop(ctx context.Context) error {
 	r.mu.Lock()
-	defer r.mu.Unlock()
-
-	r.lastScan = time.Now()
-
-	// Start a timer if none are running
-	r.ensureTimerRunning()
+	select {
+	case <-r.done:
+	default:
+		close(r.done)
+	}
+	notify := r.setMode(ModeStop)
+	err := r.saveRetained()
+	r.mu.Unlock()
 
-	// Create a list of all timer bases to update
-	timerBases := make(map[string]bool)
+	notify()
+	return err
+}
 
-	// Find all timer variables to update
-	for name := range r.variables {
-		if strings.HasSuffix(name, ".ET") || strings.HasSuffix(name, ".Q") {
-			// Extract the timer base name
-			timerBase := strings.TrimSuffix(name, ".ET")
-			if strings.HasSuffix(timerBase, ".Q") {
-				timerBase = strings.TrimSuffix(name, ".Q")
-			}
-			timerBases[timerBase] = true
-		}
+// DeployCode deploys the code of one file to the runtime
+func (r *Runtime) DeployCode(req DeployRequest) error {
+	return r.DeployProject([]DeployRequest{req}, nil)
+}
+
+// DeployProject compiles files as one project, so POUs declared in one file
+// can be used from another, and deploys them if none has errors. The tasks
+// configured replace the running ones; without any, the PROGRAM of every file
+// that declares one runs as a cyclic task at Config.ScanTime, replacing the
+// task of the file deployed before.
+//
+// Redeployed programs are changed online: their variables keep their values
+// where name and type are unchanged. The programs are swapped while the lock
+// is held, so no task is in the middle of a cycle.
+func (r *Runtime) DeployProject(files []DeployRequest, config []storage.TaskConfig) error {
+	_, err := r.DeployVersion(files, config, "")
+	return err
+}
+
+// deploy is DeployProject for callers holding the lock
+func (r *Runtime) deploy(files []DeployRequest, config []storage.TaskConfig) error {
+	paths, err := filePaths(files)
+	if err != nil {
+		return err
 	}
 
-	// Process each timer we found
-	for timerBase := range timerBases {
-		// Try to find the timer variables
-		runningVarName := timerBase + ".Running"
-		startTimeVarName := timerBase + ".StartTime"
-		etVarName := timerBase + ".ET"
-		qVarName := timerBase + ".Q"
+	// The files are checked against each other and the other deployed files,
+	// and refused if any has errors
+	units, diags := compile(files, r.deployedFiles(paths))
+	if diags.HasErrors() {
+		return &CompileError{Diagnostics: diags}
+	}
+	for _, d := range diags {
+		log.Printf("%s: %s", d.Severity, d)
+	}
 
-		runningVar, hasRunning := r.variables[runningVarName]
-		startTimeVar, hasStartTime := r.variables[startTimeVarName]
-		etVar, hasET := r.variables[etVarName]
-		qVar, hasQ := r.variables[qVarName]
+	// Everything that can fail is tried on a copy of the library first, so a
+	// refused deploy leaves the library, variables and tasks unchanged
+	if _, _, _, err := instantiate(r.library.clone(), files, units, config); err != nil {
+		return err
+	}
 
-		// If any variables are missing, skip this timer
-		if !hasRunning || !hasStartTime || !hasET || !hasQ {
-			continue
-		}
+	// Values are saved before the variables holding them are replaced
+	r.collectRetained()
 
-		// Check if timer is running
-		isRunning, ok := runningVar.Value.(bool)
-		if !ok || !isRunning {
+	progs, tasks, created, err := instantiate(r.library, files, units, config)
+	if err != nil {
+		return err
+	}
+	for _, decl := range created {
+		v, _ := r.library.Global(decl.Name)
+		r.restoreRetained(globalNamespace+"."+decl.Name, v, true)
+	}
+	for name, v := range r.library.Globals() {
+		r.registerVariable(globalNamespace, globalNamespace+"."+name, v)
+	}
+
+	for i, file := range files {
+		// Store the AST and source code for future reference; a file
+		// deployed as AST only has no source code
+		r.astStore[file.FilePath] = file.AST
+		if file.SourceCode != "" {
+			r.codeStore[file.FilePath] = file.SourceCode
+		} else {
+			delete(r.codeStore, file.FilePath)
+		}
+
+		old := r.programs[file.FilePath]
+		prog := progs[i]
+		if prog == nil {
+			if old != nil {
+				// The file no longer declares a PROGRAM
+				delete(r.programs, file.FilePath)
+				r.unregisterNamespace(namespaceOf(file.FilePath))
+				r.replaceProgram(old, nil)
+			}
 			continue
 		}
 
-		// Parse the start time
-		startTimeStr, ok := startTimeVar.Value.(string)
-		if !ok {
-			continue
+		if old != nil {
+			onlineChange(old, prog)
 		}
-
-		startTime, err := time.Parse(time.RFC3339Nano, startTimeStr)
-		if err != nil {
+		r.registerProgram(file, prog)
+		r.programs[file.FilePath] = prog
+		if len(config) > 0 {
 			continue
 		}
-
-		// Update elapsed time
-		elapsed := time.Since(startTime)
-		etVar.Value = elapsed.String()
-		etVar.Timestamp = time.Now()
-
-		// Check if timer has expired (standard timeout of 5 seconds)
-		expiredDuration := 5 * time.Second
-
-		// Different timeouts depending on state
-		stateValue := 0
-		for name, v := range r.variables {
-			if strings.HasSuffix(name, ".CurrentState") {
-				if state, ok := v.Value.(int); ok {
-					stateValue = state
-					break
-				}
-			}
+		if old == nil || !r.replaceProgram(old, prog) {
+			r.tasks = append(r.tasks, &Task{
+				Name:     file.FilePath,
+				Program:  prog,
+				Kind:     TaskCyclic,
+				Interval: r.config.ScanTime,
+			})
 		}
+	}
+	if len(config) > 0 {
+		r.tasks = tasks
+	}
+	r.sortTasks()
+	r.generation++
 
-		// Use different timeouts based on state
-		switch stateValue {
-		case 0, 3: // Main road green, side road green
-			expiredDuration = 10 * time.Second
-		case 1, 4: // Main road yellow, side road yellow
-			expiredDuration = 3 * time.Second
-		default:
-			expiredDuration = 5 * time.Second
-		}
+	r.bindLocated()
 
-		if elapsed >= expiredDuration {
-			// Timer expired
-			if isRunningBool, _ := qVar.Value.(bool); !isRunningBool {
-				qVar.Value = true
-				qVar.Timestamp = time.Now()
-
-				// Advance state if this timer completed
-				for name, v := range r.variables {
-					if strings.HasSuffix(name, ".CurrentState") {
-						if state, ok := v.Value.(int); ok {
-							newState := (state + 1) % 7 // 0-6 states
-							v.Value = newState
-							v.Timestamp = time.Now()
-
-							// Reset timer for next state
-							runningVar.Value = true
-							startTimeVar.Value = time.Now().Format(time.RFC3339Nano)
-							qVar.Value = false
-							break
-						}
-					}
-				}
-			}
-		}
-	}
+	// Log the total variables in the runtime after deployment
+	log.Printf("Runtime now has %d total variables", len(r.variables))
 
-	// Execute all tasks in priority order
-	for _, task := range r.tasks {
-		// fmt.Printf("Executing task: %s\n", task.Name)
-		if err := task.Program.Execute(); err != nil {
-			// Handle error, update quality
-			log.Printf("Error executing task: %v", err)
-			continue
-		}
-	}
+	return nil
 }
 
-// ensureTimerRunning checks if any timer is running and starts one if needed
-func (r *Runtime) ensureTimerRunning() {
-	// Look for any timer variables
-	var anyTimerRunning bool
-	var foundTimer bool
-	var firstTimerBase string
-
-	for name, v := range r.variables {
-		if strings.HasSuffix(name, ".Running") {
-			foundTimer = true
-			timerBase := strings.TrimSuffix(name, ".Running")
-			if firstTimerBase == "" {
-				firstTimerBase = timerBase
-			}
+// instantiate registers the POUs and declares the globals of units in lib,
+// then creates the PROGRAM instance of every file that declares one and the
+// tasks configured to run them. It returns the globals it created.
+func instantiate(lib *Library, files []DeployRequest, units []*ast.CompilationUnit, config []storage.TaskConfig) ([]*Program, []*Task, []*ast.VarDecl, error) {
+	// Register the functions and function blocks declared in the files so
+	// programs from any deployed file can call them
+	for _, unit := range units {
+		lib.Register(unit)
+	}
 
-			running, ok := v.Value.(bool)
-			if ok && running {
-				anyTimerRunning = true
-				break
-			}
+	// Globals are declared before any program refers to them
+	var created []*ast.VarDecl
+	for _, unit := range units {
+		decls, err := lib.DeclareGlobals(unit)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to declare globals: %w", err)
 		}
+		created = append(created, decls...)
 	}
 
-	// If we found timers but none are running, start the first one
-	if foundTimer && !anyTimerRunning && firstTimerBase != "" {
-		runningVar, hasRunning := r.variables[firstTimerBase+".Running"]
-		startTimeVar, hasStartTime := r.variables[firstTimerBase+".StartTime"]
-		qVar, hasQ := r.variables[firstTimerBase+".Q"]
-		etVar, hasET := r.variables[firstTimerBase+".ET"]
-
-		if hasRunning && hasStartTime && hasQ && hasET {
-			runningVar.Value = true
-			startTimeVar.Value = time.Now().Format(time.RFC3339Nano)
-			qVar.Value = false
-			etVar.Value = "0s"
-
-			// Try to find a CurrentState variable to reset
-			for name, v := range r.variables {
-				if strings.HasSuffix(name, ".CurrentState") {
-					v.Value = 0
-					break
-				}
-			}
+	// Every program is instantiated before any of them replaces a running one
+	progs := make([]*Program, len(files))
+	for i, file := range files {
+		astProg, ok := units[i].MainProgram()
+		if !ok {
+			// A file of functions, function blocks and globals has no task
+			continue
+		}
+		prog, err := newProgram(file.FilePath, astProg, lib)
+		if err != nil {
+			return nil, nil, nil, err
 		}
+		prog.Code = file.SourceCode
+		progs[i] = prog
 	}
-}
-
-// DeployCode deploys the code to the runtime
-func (r *Runtime) DeployCode(req DeployRequest) error {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-
-	// Store the AST for future reference
-	r.astStore[req.FilePath] = req.AST
-
-	// Store the source code as well
-	if req.SourceCode != "" {
-		r.codeStore[req.FilePath] = req.SourceCode
+	if len(config) == 0 {
+		return progs, nil, created, nil
 	}
-
-	// Parse the AST and create a Program
-	prog, err := ParseAST(req.AST)
+	tasks, err := newTasks(config, progs)
 	if err != nil {
-		return fmt.Errorf("failed to parse AST: %w", err)
+		return nil, nil, nil, err
 	}
+	return progs, tasks, created, nil
+}
 
-	// Create a new task for the program
-	task := &Task{
-		Name:     req.FilePath,
-		Program:  prog,
-		Interval: r.config.ScanTime,
-		Priority: 0, // Default priority
+// deployedFiles returns the deployed files except those in paths
+func (r *Runtime) deployedFiles(paths map[string]bool) []DeployRequest {
+	var files []DeployRequest
+	for path, tree := range r.astStore {
+		if !paths[path] {
+			files = append(files, DeployRequest{AST: tree, SourceCode: r.codeStore[path], FilePath: path})
+		}
 	}
+	return files
+}
 
-	// Add the task to the runtime
-	r.tasks = append(r.tasks, task)
-
-	// Make sure path is properly formatted for variables
-	filePath := req.FilePath
-	// Strip any leading paths to get just the filename if it's a full path
-	if lastSlash := strings.LastIndex(filePath, "/"); lastSlash >= 0 {
-		filePath = filePath[lastSlash+1:]
+// replaceProgram makes the task running old run prog instead, or removes the
+// task if prog is nil. A fault of the task is cleared. It reports whether a
+// task was running old.
+func (r *Runtime) replaceProgram(old, prog *Program) bool {
+	for i, task := range r.tasks {
+		if task.Program != old {
+			continue
+		}
+		if prog == nil {
+			r.tasks = append(r.tasks[:i], r.tasks[i+1:]...)
+			return true
+		}
+		task.Program = prog
+		task.Fault, task.faulted = nil, false
+		return true
 	}
+	return false
+}
 
-	// Strip the extension to get a clean namespace
-	namespace := strings.TrimSuffix(filePath, filepath.Ext(filePath))
-
-	// Prevent cases where namespace would be empty
-	if namespace == "" {
-		namespace = "main"
-	}
+// registerProgram registers the variables of prog, the PROGRAM of a deployed
+// file, under the namespace of the file
+func (r *Runtime) registerProgram(file DeployRequest, prog *Program) {
+	namespace := namespaceOf(file.FilePath)
+	restart := !r.deployed[namespace]
+	r.deployed[namespace] = true
 
+	filePath := filepath.Base(file.FilePath)
 	log.Printf("Using namespace '%s' for variables from file '%s'", namespace, filePath)
 
 	varCount := len(prog.Vars)
@@ -366,8 +458,8 @@ func (r *Runtime) DeployCode(req DeployRequest) error {
 		log.Printf("WARNING: No variables found in the program for %s. Check your ST code for proper variable declarations.", filePath)
 		log.Printf("Variables should be defined in sections like VAR_INPUT, VAR_OUTPUT, or VAR.")
 		// Check if source code is available for additional logging
-		if req.SourceCode != "" {
-			log.Printf("Source code sample (first 100 chars): %s", truncateString(req.SourceCode, 100))
+		if file.SourceCode != "" {
+			log.Printf("Source code sample (first 100 chars): %s", truncateString(file.SourceCode, 100))
 		}
 	} else {
 		log.Printf("Deploying code to %s with %d variables:", filePath, varCount)
@@ -377,156 +469,67 @@ func (r *Runtime) DeployCode(req DeployRequest) error {
 		}
 	}
 
-	// Clean up any existing variables from this path before adding new ones
-	// to prevent duplicates
-	r.removeVariablesByPath(namespace)
+	// Variables of the previous layout are dropped, so removed ones disappear
+	r.unregisterNamespace(namespace)
 
-	// Make sure we have a CurrentState variable in this namespace
-	namespacedStateName := namespace + ".CurrentState"
-	r.variables[namespacedStateName] = &Variable{
-		Name:      namespacedStateName,
-		DataType:  TypeInt,
-		Value:     0,
-		Quality:   QualityGood,
-		Timestamp: time.Now(),
-		Path:      namespace,
-	}
-	log.Printf("Created CurrentState variable for namespace %s", namespace)
-
-	// Extract variables from the program and register them
-	for name, v := range prog.Vars {
-		// Skip if we just created this variable (CurrentState)
-		if name == "CurrentState" {
+	// Register the variables the program owns
+	for _, decl := range prog.ast.Vars {
+		v := prog.Vars[decl.Name]
+		if !ownsVariable(decl) {
 			continue
 		}
+		r.restoreRetained(namespace+"."+decl.Name, v, restart)
+		r.registerVariable(namespace, namespace+"."+decl.Name, v)
+	}
+}
 
-		// Register with namespaced name for direct access
-		namespacedName := namespace + "." + name
-		namespacedVariable := &Variable{
-			Name:      namespacedName,
-			DataType:  v.DataType,
-			Value:     v.Value,
-			Quality:   QualityGood,
-			Timestamp: time.Now(),
-			Path:      namespace,
-		}
-		r.variables[namespacedName] = namespacedVariable
-		log.Printf("Registered namespaced variable %s", namespacedName)
-	}
-
-	// Register TON timer instances found in source code
-	if req.SourceCode != "" {
-		// Look for timer declarations in the source code
-		timerInstances := findTimersInSourceCode(req.SourceCode)
-		for _, timerName := range timerInstances {
-			// Register timer's Q output for monitoring in namespaced form only
-			namespacedName := namespace + "." + timerName
-
-			// Register timer base
-			r.variables[namespacedName] = &Variable{
-				Name:      namespacedName,
-				DataType:  TypeString,
-				Value:     "", // Timer type
-				Quality:   QualityGood,
-				Timestamp: time.Now(),
-				Path:      namespace,
-			}
-
-			// Register Q output
-			r.variables[namespacedName+".Q"] = &Variable{
-				Name:      namespacedName + ".Q",
-				DataType:  TypeBool,
-				Value:     false,
-				Quality:   QualityGood,
-				Timestamp: time.Now(),
-				Path:      namespace,
-			}
-
-			// Register ET output
-			r.variables[namespacedName+".ET"] = &Variable{
-				Name:      namespacedName + ".ET",
-				DataType:  TypeString,
-				Value:     "0s",
-				Quality:   QualityGood,
-				Timestamp: time.Now(),
-				Path:      namespace,
-			}
-
-			// Register internal variables
-			r.variables[namespacedName+".Running"] = &Variable{
-				Name:      namespacedName + ".Running",
-				DataType:  TypeBool,
-				Value:     false,
-				Quality:   QualityGood,
-				Timestamp: time.Now(),
-				Path:      namespace,
-			}
-
-			r.variables[namespacedName+".StartTime"] = &Variable{
-				Name:      namespacedName + ".StartTime",
-				DataType:  TypeString,
-				Value:     time.Now().Format(time.RFC3339Nano),
-				Quality:   QualityGood,
-				Timestamp: time.Now(),
-				Path:      namespace,
-			}
-
-			log.Printf("Registered timer variables for %s with namespace %s", timerName, namespacedName)
-		}
+// namespaceOf returns the namespace the variables of a deployed file are
+// registered under: its file name without directory and extension
+func namespaceOf(path string) string {
+	// Strip any leading paths to get just the filename if it's a full path
+	if lastSlash := strings.LastIndex(path, "/"); lastSlash >= 0 {
+		path = path[lastSlash+1:]
 	}
 
-	// Log the total variables in the runtime after deployment
-	log.Printf("Runtime now has %d total variables", len(r.variables))
+	// Strip the extension to get a clean namespace
+	namespace := strings.TrimSuffix(path, filepath.Ext(path))
 
-	// If we still have no variables, create some test variables for debugging
-	if len(r.variables) == 0 {
-		log.Printf("No variables found in program. Creating test variables for debugging.")
-		r.RegisterTestVariables(namespace)
+	// Prevent cases where namespace would be empty
+	if namespace == "" {
+		namespace = "main"
 	}
-
-	return nil
+	return namespace
 }
 
-// findTimersInSourceCode scans source code for timer declarations
-func findTimersInSourceCode(sourceCode string) []string {
-	timerNames := []string{}
-
-	// Pattern to match variable declarations of type TON
-	// Example: "MyTimer : TON;" or "Timer1: TON ;"
-	timerMatches := regexp.MustCompile(`\b(\w+)\s*:\s*TON\b`).FindAllStringSubmatch(sourceCode, -1)
+// registerVariable exposes a program variable under its namespaced name. The
+// program's own variable is shared so reads and writes through the runtime see
+// live values; members of structs and function block instances are registered
+// as name.member and array elements as name[i] recursively.
+func (r *Runtime) registerVariable(namespace, name string, v *Variable) {
+	v.Name = name
+	v.Path = namespace
+	r.variables[name] = v
+	log.Printf("Registered namespaced variable %s", name)
 
-	for _, match := range timerMatches {
-		if len(match) > 1 {
-			timerNames = append(timerNames, match[1])
+	switch value := v.Value.(type) {
+	case composite:
+		for _, member := range value.members() {
+			if mv, ok := value.member(member); ok {
+				r.registerVariable(namespace, name+"."+member, mv)
+			}
+		}
+	case *ArrayValue:
+		for i, elem := range value.Elems {
+			r.registerVariable(namespace, name+value.indexLabel(i), elem)
 		}
 	}
-
-	return timerNames
 }
 
-// removeVariablesByPath removes all variables with a given path, including nested paths
-func (r *Runtime) removeVariablesByPath(path string) {
-	// First, identify all variables with this path or that contain this path
-	var toRemove []string
+// unregisterNamespace removes the variables registered under a namespace,
+// including members and elements. The variables themselves are untouched.
+func (r *Runtime) unregisterNamespace(namespace string) {
 	for name, v := range r.variables {
-		// Remove direct path matches
-		if v.Path == path {
-			toRemove = append(toRemove, name)
-			continue
-		}
-
-		// Also remove any variables whose names contain the namespace
-		// This catches nested variables like "main-st.main-st.Timer"
-		if strings.Contains(name, path+".") {
-			toRemove = append(toRemove, name)
-			continue
-		}
-	}
-
-	// Then remove them
-	if len(toRemove) > 0 {
-		log.Printf("Removing %d existing variables with path '%s'", len(toRemove), path)
-		for _, name := range toRemove {
+		if v.Path == namespace {
 			delete(r.variables, name)
 		}
 	}
@@ -642,9 +645,13 @@ func (r *Runtime) GetStatus() RuntimeStatus {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
-	status := "running"
-	if r.done == nil {
-		status = "stopped"
+	var faults []*diagnostics.Diagnostic
+	tasks := make([]TaskStatus, len(r.tasks))
+	for i, task := range r.tasks {
+		if task.Fault != nil {
+			faults = append(faults, task.Fault)
+		}
+		tasks[i] = task.status()
 	}
 
 	return RuntimeStatus{
@@ -652,7 +659,10 @@ func (r *Runtime) GetStatus() RuntimeStatus {
 		LastScan:      r.lastScan,
 		VariableCount: len(r.variables),
 		TaskCount:     len(r.tasks),
-		Status:        status,
+		Status:        r.mode.status(),
+		Mode:          r.mode,
+		Diagnostics:   faults,
+		Tasks:         tasks,
 	}
 }
 
@@ -709,287 +719,3 @@ func (r *Runtime) GetAllASTKeys() []string {
 
 	return keys
 }
-
-// ParseAST parses the JSON AST from Langium and converts it to a runtime Program
-func ParseAST(astJSON json.RawMessage) (*Program, error) {
-	// Create a placeholder program
-	prog := &Program{
-		Name:     "ASTProgram",
-		Version:  "1.0",
-		Modified: time.Now(),
-		Vars:     make(map[string]*Variable),
-		code:     make([]interface{}, 0), // Initialize code slice
-	}
-
-	// Parse the AST JSON
-	var astData map[string]interface{}
-	if err := json.Unmarshal(astJSON, &astData); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal AST: %w", err)
-	}
-
-	log.Printf("Parsing AST with keys: %v", getMapKeys(astData))
-
-	// Extract program name if available
-	if programName, ok := astData["name"].(string); ok {
-		prog.Name = programName
-		log.Printf("Found program name: %s", programName)
-	}
-
-	// Extract statements if available (common AST format)
-	if statements, ok := astData["statements"].([]interface{}); ok && len(statements) > 0 {
-		log.Printf("Found %d statements in the AST", len(statements))
-		prog.code = statements
-	} else if body, ok := astData["body"].([]interface{}); ok && len(body) > 0 {
-		// Alternative AST format
-		log.Printf("Found %d statements in the body", len(body))
-		prog.code = body
-	}
-
-	// Look deeper for statements if not found at top level
-	if len(prog.code) == 0 {
-		extractStatementsFromAST(astData, prog)
-	}
-
-	// Process the AST starting from the root to extract variables
-	processASTNode(astData, prog, 0)
-
-	// Log the variables extracted
-	log.Printf("Extracted %d variables and %d statements from AST",
-		len(prog.Vars), len(prog.code))
-	for varName, v := range prog.Vars {
-		log.Printf("  - %s (type: %v)", varName, v.DataType)
-	}
-
-	return prog, nil
-}
-
-// extractStatementsFromAST recursively searches for statement arrays in the AST
-func extractStatementsFromAST(node interface{}, prog *Program) {
-	switch n := node.(type) {
-	case map[string]interface{}:
-		// Look for statement arrays in this node
-		for key, value := range n {
-			if key == "statements" || key == "body" {
-				if stmts, ok := value.([]interface{}); ok && len(stmts) > 0 {
-					log.Printf("Found %d statements in %s", len(stmts), key)
-					prog.code = stmts
-					return
-				}
-			}
-
-			// Also check for common POU/program structures
-			if key == "programs" || key == "functions" || key == "functionBlocks" {
-				extractStatementsFromAST(value, prog)
-			}
-		}
-
-		// Recurse into all other fields
-		for _, value := range n {
-			extractStatementsFromAST(value, prog)
-		}
-
-	case []interface{}:
-		// Check each item in the array
-		for _, item := range n {
-			extractStatementsFromAST(item, prog)
-			// If we found statements, stop recursing
-			if len(prog.code) > 0 {
-				return
-			}
-		}
-	}
-}
-
-// getMapKeys returns a string with all keys in a map for debugging
-func getMapKeys(m map[string]interface{}) string {
-	keys := make([]string, 0, len(m))
-	for k := range m {
-		keys = append(keys, k)
-	}
-	return strings.Join(keys, ", ")
-}
-
-// processASTNode recursively processes AST nodes looking for variable declarations
-func processASTNode(node interface{}, prog *Program, depth int) {
-	// Guard against too deep recursion
-	if depth > 10 {
-		return
-	}
-
-	// Process different node types
-	switch n := node.(type) {
-	case map[string]interface{}:
-		// Check if this node is a variable declaration
-		if isVariableDeclaration(n) {
-			addVariableToProg(n, prog)
-			return
-		}
-
-		// Process all fields of the node
-		for key, value := range n {
-			// Special handling for variable sections
-			if strings.HasPrefix(strings.ToLower(key), "var") {
-				log.Printf("Found VAR section: %s", key)
-				processASTNode(value, prog, depth+1)
-				continue
-			}
-
-			// Special handling for declarations array
-			if key == "declarations" || key == "variables" || key == "varDeclarations" {
-				log.Printf("Processing %s array", key)
-				processASTNode(value, prog, depth+1)
-				continue
-			}
-
-			// Special handling for programs array
-			if key == "programs" {
-				log.Printf("Processing programs array")
-				processASTNode(value, prog, depth+1)
-				continue
-			}
-
-			// Recursively process all other objects
-			processASTNode(value, prog, depth+1)
-		}
-
-	case []interface{}:
-		// Process all elements in the array
-		for _, item := range n {
-			processASTNode(item, prog, depth+1)
-		}
-	}
-}
-
-// isVariableDeclaration checks if a node is a variable declaration
-func isVariableDeclaration(node map[string]interface{}) bool {
-	// Check for name as a basic requirement
-	if _, hasName := node["name"].(string); !hasName {
-		return false
-	}
-
-	// Check for type hints
-	if declType, ok := node["$type"].(string); ok {
-		if strings.Contains(strings.ToLower(declType), "variable") {
-			return true
-		}
-	}
-
-	// Check for type definition
-	if _, hasType := node["type"].(map[string]interface{}); hasType {
-		return true
-	}
-
-	return false
-}
-
-// addVariableToProg adds a variable declaration to the program
-func addVariableToProg(variableMap map[string]interface{}, prog *Program) {
-	if varName, ok := variableMap["name"].(string); ok {
-		// Skip empty names or reserved words
-		if varName == "" || strings.ToLower(varName) == "type" {
-			return
-		}
-
-		log.Printf("Processing variable: %s", varName)
-
-		// Determine data type
-		dataType := TypeString // Default
-		if typeInfo, ok := variableMap["type"].(map[string]interface{}); ok {
-			if typeName, ok := typeInfo["name"].(string); ok {
-				switch strings.ToUpper(typeName) {
-				case "BOOL":
-					dataType = TypeBool
-				case "INT":
-					dataType = TypeInt
-				case "REAL", "FLOAT":
-					dataType = TypeFloat
-				case "STRING":
-					dataType = TypeString
-				}
-				log.Printf("  Data type: %s", typeName)
-			}
-		}
-
-		// Initialize with default value
-		var value interface{}
-		switch dataType {
-		case TypeBool:
-			value = false
-		case TypeInt:
-			value = 0
-		case TypeFloat:
-			value = 0.0
-		case TypeString:
-			value = ""
-		}
-
-		// Check for initial value
-		if initialValue, ok := variableMap["initialValue"]; ok {
-			if initialValueMap, ok := initialValue.(map[string]interface{}); ok {
-				if litValue, ok := initialValueMap["value"]; ok {
-					value = convertLiteralValue(litValue, dataType)
-					log.Printf("  Initial value: %v", value)
-				}
-			}
-		}
-
-		// Add variable to program
-		prog.Vars[varName] = &Variable{
-			Name:      varName,
-			DataType:  dataType,
-			Value:     value,
-			Quality:   QualityGood,
-			Timestamp: time.Now(),
-		}
-
-		log.Printf("Added variable: %s (type: %v)", varName, dataType)
-	}
-}
-
-// Helper function to convert literal values from AST to appropriate Go types
-func convertLiteralValue(value interface{}, dataType DataType) interface{} {
-	switch dataType {
-	case TypeBool:
-		if strValue, ok := value.(string); ok {
-			return strings.ToLower(strValue) == "true"
-		}
-		return value == true
-	case TypeInt:
-		if floatValue, ok := value.(float64); ok {
-			return int(floatValue)
-		}
-		if strValue, ok := value.(string); ok {
-			if intValue, err := strconv.Atoi(strValue); err == nil {
-				return intValue
-			}
-		}
-		return 0
-	case TypeFloat:
-		if floatValue, ok := value.(float64); ok {
-			return floatValue
-		}
-		if strValue, ok := value.(string); ok {
-			if floatValue, err := strconv.ParseFloat(strValue, 64); err == nil {
-				return floatValue
-			}
-		}
-		return 0.0
-	case TypeString:
-		if strValue, ok := value.(string); ok {
-			return strValue
-		}
-		return fmt.Sprintf("%v", value)
-	default:
-		return value
-	}
-}
-
-// ClearAllVariables removes all variables from the runtime
-func (r *Runtime) ClearAllVariables() {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-
-	// Create a new empty map to replace the existing one
-	r.variables = make(map[string]*Variable)
-	log.Printf("Cleared all variables from runtime")
-}
@@ -0,0 +1,367 @@
+package runtime
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hyperdrive/core/apps/runtime/internal/diagnostics"
+	"github.com/hyperdrive/core/apps/runtime/internal/storage"
+)
+
+// defaultWatchdog limits the cycles of tasks when neither the task nor
+// Config.Watchdog sets a watchdog
+const defaultWatchdog = time.Second
+
+// watchdogStride is how many loop iterations run between reads of the clock
+const watchdogStride = 1024
+
+// errWatchdog aborts a cycle that ran past the watchdog of its task
+var errWatchdog = errors.New("watchdog expired")
+
+// TaskKind is what activates a task
+type TaskKind int
+
+const (
+	TaskCyclic       TaskKind = iota // Every Interval
+	TaskEvent                        // A rising edge of the Event variable
+	TaskFreewheeling                 // The completion of its last cycle
+)
+
+// String returns the name of the task kind
+func (k TaskKind) String() string {
+	switch k {
+	case TaskCyclic:
+		return "cyclic"
+	case TaskEvent:
+		return "event"
+	case TaskFreewheeling:
+		return "freewheeling"
+	default:
+		return fmt.Sprintf("UNKNOWN(%d)", int(k))
+	}
+}
+
+// TaskStats measures the cycles of a task. Jitter is how late a cyclic task
+// started after it was due; an overrun is an activation it missed because it,
+// or a task of higher priority, was still running.
+type TaskStats struct {
+	Cycles       uint64        `json:"cycles"`
+	LastStart    time.Time     `json:"lastStart"`
+	LastDuration time.Duration `json:"lastDuration"`
+	MinDuration  time.Duration `json:"minDuration"`
+	MaxDuration  time.Duration `json:"maxDuration"`
+	AvgDuration  time.Duration `json:"avgDuration"`
+	Jitter       time.Duration `json:"jitter"`
+	MaxJitter    time.Duration `json:"maxJitter"`
+	Overruns     uint64        `json:"overruns"`
+	total        time.Duration
+}
+
+// record adds a cycle that started at start and took d
+func (s *TaskStats) record(start time.Time, d time.Duration) {
+	s.Cycles++
+	s.LastStart, s.LastDuration = start, d
+	if s.Cycles == 1 || d < s.MinDuration {
+		s.MinDuration = d
+	}
+	if d > s.MaxDuration {
+		s.MaxDuration = d
+	}
+	s.total += d
+	s.AvgDuration = s.total / time.Duration(s.Cycles)
+}
+
+// TaskStatus reports the configuration, state and statistics of a task
+type TaskStatus struct {
+	Name     string        `json:"name"`
+	Program  string        `json:"program"`
+	Kind     string        `json:"kind"`
+	Interval time.Duration `json:"interval,omitempty"`
+	Event    string        `json:"event,omitempty"`
+	Priority int           `json:"priority"`
+	Watchdog time.Duration `json:"watchdog"`
+	State    string        `json:"state"` // running, error after a failed cycle, or faulted
+	Stats    TaskStats     `json:"stats"`
+	// Error of the last cycle, or the watchdog expiry of a faulted task
+	Fault *diagnostics.Diagnostic `json:"fault,omitempty"`
+}
+
+// status returns the status of the task
+func (t *Task) status() TaskStatus {
+	state := "running"
+	switch {
+	case t.faulted:
+		state = "faulted"
+	case t.Fault != nil:
+		state = "error"
+	}
+	return TaskStatus{
+		Name:     t.Name,
+		Program:  t.Program.ast.Name,
+		Kind:     t.Kind.String(),
+		Interval: t.Interval,
+		Event:    t.Event,
+		Priority: t.Priority,
+		Watchdog: t.Watchdog,
+		State:    state,
+		Stats:    t.Stats,
+		Fault:    t.Fault,
+	}
+}
+
+// newTasks creates the tasks declared in a project configuration, running
+// the programs found by name in progs
+func newTasks(config []storage.TaskConfig, progs []*Program) ([]*Task, error) {
+	byName := make(map[string]*Program)
+	for _, prog := range progs {
+		if prog != nil {
+			byName[strings.ToUpper(prog.ast.Name)] = prog
+		}
+	}
+
+	tasks := make([]*Task, 0, len(config))
+	assigned := make(map[*Program]string)
+	for _, cfg := range config {
+		if cfg.Name == "" {
+			return nil, fmt.Errorf("task of program %s has no name", cfg.Program)
+		}
+		prog, ok := byName[strings.ToUpper(cfg.Program)]
+		if !ok {
+			return nil, fmt.Errorf("task %s: program %s is not in the project", cfg.Name, cfg.Program)
+		}
+		if other, ok := assigned[prog]; ok {
+			return nil, fmt.Errorf("task %s: program %s already runs in task %s", cfg.Name, cfg.Program, other)
+		}
+		assigned[prog] = cfg.Name
+
+		task := &Task{
+			Name:     cfg.Name,
+			Program:  prog,
+			Kind:     TaskFreewheeling,
+			Priority: cfg.Priority,
+		}
+		if cfg.Watchdog != "" {
+			watchdog, err := parseDuration("watchdog", cfg.Watchdog)
+			if err != nil {
+				return nil, fmt.Errorf("task %s: %w", cfg.Name, err)
+			}
+			task.Watchdog = watchdog
+		}
+		switch {
+		case cfg.Interval != "" && cfg.Event != "":
+			return nil, fmt.Errorf("task %s has both an interval and an event", cfg.Name)
+		case cfg.Interval != "":
+			interval, err := parseDuration("interval", cfg.Interval)
+			if err != nil {
+				return nil, fmt.Errorf("task %s: %w", cfg.Name, err)
+			}
+			task.Kind, task.Interval = TaskCyclic, interval
+		case cfg.Event != "":
+			task.Kind, task.Event = TaskEvent, cfg.Event
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, nil
+}
+
+// parseDuration parses the interval or watchdog of a task, given as a Go
+// duration such as 100ms or as a TIME literal such as T#100ms
+func parseDuration(what, s string) (time.Duration, error) {
+	text := strings.ToLower(strings.TrimSpace(s))
+	for _, prefix := range []string{"time#", "t#"} {
+		text = strings.TrimPrefix(text, prefix)
+	}
+	d, err := time.ParseDuration(strings.ReplaceAll(text, "_", ""))
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q", what, s)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("%s %q must be positive", what, s)
+	}
+	return d, nil
+}
+
+// sortTasks orders the tasks by priority, keeping the order in which tasks of
+// the same priority were added, and gives those without a watchdog the
+// default one
+func (r *Runtime) sortTasks() {
+	for _, task := range r.tasks {
+		if task.Watchdog == 0 {
+			task.Watchdog = r.config.Watchdog
+		}
+		if task.Watchdog == 0 {
+			task.Watchdog = defaultWatchdog
+		}
+	}
+	sort.SliceStable(r.tasks, func(i, j int) bool {
+		return r.tasks[i].Priority < r.tasks[j].Priority
+	})
+}
+
+// schedule runs the tasks as they become due until ctx is done or the
+// runtime stops
+func (r *Runtime) schedule(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	retainTicker := time.NewTicker(retainInterval)
+	defer retainTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.done:
+			return
+		case <-timer.C:
+			timer.Reset(time.Until(r.runDue(time.Now())))
+		case <-retainTicker.C:
+			r.mu.Lock()
+			if err := r.saveRetained(); err != nil {
+				log.Printf("Could not save retained values: %v", err)
+			}
+			r.mu.Unlock()
+		}
+	}
+}
+
+// runDue runs the tasks due at now in priority order and returns when a task
+// is due next. The lock is taken for each task, so a task does not hold up
+// the API for longer than its own cycle. Event tasks are sampled every
+// Config.ScanTime.
+func (r *Runtime) runDue(now time.Time) time.Time {
+	next := now.Add(r.config.ScanTime)
+	r.mu.RLock()
+	tasks := append([]*Task(nil), r.tasks...)
+	mode, generation := r.mode, r.generation
+	r.mu.RUnlock()
+	if mode != ModeRun {
+		// Checked again every Config.ScanTime
+		return next
+	}
+
+	for _, task := range tasks {
+		r.mu.Lock()
+		if r.generation != generation {
+			// A deploy swapped the tasks; the next round runs the new ones
+			r.mu.Unlock()
+			return now
+		}
+		if task.faulted || r.mode != ModeRun {
+			r.mu.Unlock()
+			continue
+		}
+		switch task.Kind {
+		case TaskCyclic:
+			if !task.next.After(now) {
+				due := task.next
+				task.next = due.Add(task.Interval)
+				if !task.next.After(now) {
+					// Activations missed while tasks ran are skipped
+					if !due.IsZero() {
+						task.Stats.Overruns += uint64(now.Sub(due) / task.Interval)
+					}
+					task.next = now.Add(task.Interval)
+				}
+				r.runTask(task)
+				if !due.IsZero() {
+					task.Stats.Jitter = task.Stats.LastStart.Sub(due)
+					if task.Stats.Jitter > task.Stats.MaxJitter {
+						task.Stats.MaxJitter = task.Stats.Jitter
+					}
+				}
+			}
+			if task.next.Before(next) {
+				next = task.next
+			}
+		case TaskEvent:
+			if r.triggered(task) {
+				r.runTask(task)
+			}
+		case TaskFreewheeling:
+			r.runTask(task)
+			next = time.Now()
+		}
+		r.mu.Unlock()
+	}
+	return next
+}
+
+// executeCycle runs every task once in priority order, event tasks only on a
+// rising edge of their event variable
+func (r *Runtime) executeCycle() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.runCycle()
+}
+
+// runCycle is executeCycle for callers holding the lock
+func (r *Runtime) runCycle() {
+	for _, task := range r.tasks {
+		if task.faulted || task.Kind == TaskEvent && !r.triggered(task) {
+			continue
+		}
+		r.runTask(task)
+	}
+}
+
+// triggered samples the event variable of task and reports a rising edge
+func (r *Runtime) triggered(task *Task) bool {
+	v, ok := r.variables[task.Event]
+	if !ok {
+		r.faultTask(task, fmt.Errorf("event variable %s not found", task.Event))
+		return false
+	}
+	value, ok := v.Value.(bool)
+	if !ok {
+		r.faultTask(task, fmt.Errorf("event variable %s must be BOOL, got %s", task.Event, v.DataType))
+		return false
+	}
+	edge := value && !task.sampled
+	task.sampled = value
+	return edge
+}
+
+// runTask executes one cycle of task between reading the inputs and writing
+// the outputs of the process image. A cycle still running when the watchdog
+// expires is aborted and the task faulted, so it does not run again until it
+// is deployed anew.
+func (r *Runtime) runTask(task *Task) {
+	start := time.Now()
+	r.lastScan = start
+
+	// Located variables see the inputs as they were when the cycle started
+	r.readInputs()
+	task.Program.deadline = start.Add(task.Watchdog)
+	err := task.Program.Execute()
+	task.Program.deadline = time.Time{}
+	r.writeOutputs()
+
+	task.Stats.record(start, time.Since(start))
+	if r.shadow != nil {
+		r.shadow.run(r, task)
+	}
+
+	if err != nil {
+		if errors.Is(err, errWatchdog) {
+			task.faulted = true
+		}
+		r.faultTask(task, err)
+		return
+	}
+	task.Fault = nil
+}
+
+// faultTask records err as the fault of task, logging it when the task was
+// not already faulted with the same message
+func (r *Runtime) faultTask(task *Task, err error) {
+	fault := diagnostics.FromError(err, task.Name, diagnostics.CodeRuntime)
+	if task.Fault == nil || task.Fault.Message != fault.Message {
+		log.Printf("Error executing task %s: %v", task.Name, fault)
+	}
+	task.Fault = fault
+}
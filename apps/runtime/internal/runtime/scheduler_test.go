@@ -0,0 +1,175 @@
+package runtime_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hyperdrive/core/apps/runtime/internal/runtime"
+	"github.com/hyperdrive/core/apps/runtime/internal/storage"
+)
+
+func TestTaskScheduling(t *testing.T) {
+	rt, err := runtime.New(runtime.Config{ScanTime: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Failed to create runtime: %v", err)
+	}
+
+	files := []runtime.DeployRequest{{FilePath: "gvl.st", SourceCode: `
+VAR_GLOBAL
+    Start : BOOL;
+    Trace : DINT;
+END_VAR
+`}}
+	for i, name := range []string{"Fast", "Slow", "Free", "OnStart"} {
+		files = append(files, runtime.DeployRequest{
+			FilePath: strings.ToLower(name) + ".st",
+			SourceCode: fmt.Sprintf(`
+PROGRAM %s
+    VAR_EXTERNAL Trace : DINT; END_VAR
+    VAR n : INT; END_VAR
+    n := n + 1;
+    Trace := Trace * 10 + %d;
+END_PROGRAM
+`, name, i+1),
+		})
+	}
+	tasks := []storage.TaskConfig{
+		{Name: "FastTask", Priority: 1, Interval: "10ms", Program: "Fast"},
+		{Name: "SlowTask", Priority: 0, Interval: "T#30ms", Program: "Slow"},
+		{Name: "FreeTask", Priority: 2, Program: "Free"},
+		{Name: "StartTask", Priority: 2, Event: "global.Start", Program: "OnStart"},
+	}
+
+	for _, bad := range [][]storage.TaskConfig{
+		{{Name: "A", Interval: "10ms", Program: "Missing"}},
+		{{Name: "A", Interval: "10ms", Program: "Fast"}, {Name: "B", Program: "Fast"}},
+		{{Name: "A", Interval: "often", Program: "Fast"}},
+		{{Name: "A", Interval: "10ms", Event: "global.Start", Program: "Fast"}},
+	} {
+		if err := rt.DeployProject(files, bad); err == nil {
+			t.Errorf("Expected tasks %+v to be refused", bad)
+		}
+	}
+	if got := rt.GetStatus().TaskCount; got != 0 {
+		t.Fatalf("Expected refused tasks not to run, got %d tasks", got)
+	}
+	if got := rt.GetAllVariables(); len(got) != 0 {
+		t.Fatalf("Expected refused deploys not to register variables, got %v", got)
+	}
+
+	if err := rt.DeployProject(files, tasks); err != nil {
+		t.Fatalf("Failed to deploy: %v", err)
+	}
+	counts := func() [4]interface{} {
+		var n [4]interface{}
+		for i, ns := range []string{"fast", "slow", "free", "onstart"} {
+			v, _ := rt.GetVariable(ns + ".n")
+			n[i] = v.Value
+		}
+		return n
+	}
+	set := func(name string, value interface{}) {
+		v, _ := rt.GetVariable(name)
+		v.Value = value
+	}
+
+	// Higher priorities run first; the event task waits for its edge
+	if err := rt.SetMode(runtime.ModeRun); err != nil {
+		t.Fatalf("Failed to switch to RUN: %v", err)
+	}
+	t0 := time.Now()
+	if next := rt.RunDue(t0); next.After(time.Now()) {
+		t.Errorf("Expected the freewheeling task to be due again at once, got %v", next.Sub(t0))
+	}
+	if v, _ := rt.GetVariable("global.Trace"); v.Value != int32(213) {
+		t.Errorf("Expected tasks to run in priority order, got trace %v", v.Value)
+	}
+
+	rt.RunDue(t0.Add(10 * time.Millisecond))
+	rt.RunDue(t0.Add(15 * time.Millisecond))
+	rt.RunDue(t0.Add(30 * time.Millisecond))
+	set("global.Start", true)
+	rt.RunDue(t0.Add(31 * time.Millisecond))
+	rt.RunDue(t0.Add(32 * time.Millisecond))
+	set("global.Start", false)
+	rt.RunDue(t0.Add(33 * time.Millisecond))
+	set("global.Start", true)
+	rt.RunDue(t0.Add(34 * time.Millisecond))
+
+	want := [4]interface{}{int16(3), int16(2), int16(8), int16(2)}
+	if got := counts(); got != want {
+		t.Errorf("Expected fast, slow, free and event cycles %v, got %v", want, got)
+	}
+}
+
+func TestWatchdog(t *testing.T) {
+	rt, err := runtime.New(runtime.Config{ScanTime: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Failed to create runtime: %v", err)
+	}
+
+	files := []runtime.DeployRequest{
+		{FilePath: "stuck.st", SourceCode: `
+PROGRAM Stuck
+    VAR n : DINT; END_VAR
+    WHILE TRUE DO
+        n := n + 1;
+    END_WHILE;
+END_PROGRAM
+`},
+		{FilePath: "busy.st", SourceCode: `
+PROGRAM Busy
+    VAR n : INT; END_VAR
+    n := n + 1;
+END_PROGRAM
+`},
+	}
+	err = rt.DeployProject(files, []storage.TaskConfig{
+		{Name: "StuckTask", Interval: "10ms", Watchdog: "20ms", Program: "Stuck"},
+		{Name: "BusyTask", Interval: "10ms", Program: "Busy"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to deploy: %v", err)
+	}
+
+	start := time.Now()
+	rt.ExecuteCycle()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Expected the watchdog to abort the cycle, took %v", elapsed)
+	}
+	rt.ExecuteCycle()
+
+	tasks := rt.GetStatus().Tasks
+	if len(tasks) != 2 {
+		t.Fatalf("Expected 2 tasks, got %+v", tasks)
+	}
+	stuck, busy := tasks[0], tasks[1]
+	if stuck.State != "faulted" || stuck.Stats.Cycles != 1 {
+		t.Errorf("Expected the stuck task to be faulted after one cycle, got %s after %d", stuck.State, stuck.Stats.Cycles)
+	}
+	if stuck.Fault == nil || !strings.Contains(stuck.Fault.Message, "watchdog") || stuck.Fault.Line != 4 {
+		t.Errorf("Expected a watchdog fault at the loop, got %v", stuck.Fault)
+	}
+	if stuck.Stats.LastDuration < 20*time.Millisecond || stuck.Watchdog != 20*time.Millisecond {
+		t.Errorf("Expected the cycle to run for the 20ms watchdog, ran %v", stuck.Stats.LastDuration)
+	}
+	if busy.State != "running" || busy.Stats.Cycles != 2 || busy.Watchdog != time.Second {
+		t.Errorf("Expected the other task to keep running with the default watchdog, got %+v", busy)
+	}
+	if s := busy.Stats; s.MinDuration > s.AvgDuration || s.AvgDuration > s.MaxDuration {
+		t.Errorf("Expected min <= avg <= max, got %v, %v, %v", s.MinDuration, s.AvgDuration, s.MaxDuration)
+	}
+
+	// Activations missed while the task could not run count as overruns
+	if err := rt.SetMode(runtime.ModeRun); err != nil {
+		t.Fatalf("Failed to switch to RUN: %v", err)
+	}
+	t0 := time.Now()
+	rt.RunDue(t0)
+	rt.RunDue(t0.Add(35 * time.Millisecond))
+	if got := rt.GetStatus().Tasks[1].Stats.Overruns; got != 2 {
+		t.Errorf("Expected 2 overruns, got %d", got)
+	}
+}
@@ -0,0 +1,210 @@
+package runtime
+
+import (
+	"math"
+	"time"
+
+	"github.com/hyperdrive/core/apps/runtime/internal/parser/ast"
+	"github.com/hyperdrive/core/apps/runtime/internal/stdlib"
+)
+
+// clockStart is the origin of the monotonic clock timers measure time on
+var clockStart = time.Now()
+
+// clock returns the time elapsed on the runtime's monotonic clock
+func clock() Duration {
+	return Duration(time.Since(clockStart))
+}
+
+// fbState gives typed access to the variables of a function block instance
+type fbState map[string]*Variable
+
+func (s fbState) bool(name string) bool {
+	b, _ := s[name].Value.(bool)
+	return b
+}
+
+func (s fbState) time(name string) Duration {
+	d, _ := s[name].Value.(Duration)
+	return d
+}
+
+func (s fbState) int(name string) int16 {
+	n, _ := s[name].Value.(int16)
+	return n
+}
+
+func (s fbState) set(name string, value interface{}) {
+	v := s[name]
+	if v.Value != value {
+		v.Value = value
+		v.Timestamp = time.Now()
+	}
+}
+
+// standardBodies implements the standard function blocks declared in stdlib.
+// Blocks are keyed by declaration, so user-defined blocks with the same name
+// run their own body.
+var standardBodies = func() map[*ast.Program]func(fbState) {
+	bodies := map[string]func(fbState){
+		"TON":    ton,
+		"TOF":    tof,
+		"TP":     tp,
+		"CTU":    ctu,
+		"CTD":    ctd,
+		"CTUD":   ctud,
+		"R_TRIG": rTrig,
+		"F_TRIG": fTrig,
+		"SR":     sr,
+		"RS":     rs,
+	}
+	result := make(map[*ast.Program]func(fbState), len(bodies))
+	for _, pou := range stdlib.Unit.POUs {
+		result[pou] = bodies[pou.Name]
+	}
+	return result
+}()
+
+// elapsed returns the time since a timer started, limited to its preset
+func elapsed(s fbState) Duration {
+	et := clock() - s.time("START")
+	if pt := s.time("PT"); et > pt {
+		return pt
+	}
+	return et
+}
+
+// ton delays the rising edge of IN by PT
+func ton(s fbState) {
+	if !s.bool("IN") {
+		s.set("RUNNING", false)
+		s.set("Q", false)
+		s.set("ET", Duration(0))
+		return
+	}
+	if !s.bool("RUNNING") {
+		s.set("RUNNING", true)
+		s.set("START", clock())
+	}
+	et := elapsed(s)
+	s.set("ET", et)
+	s.set("Q", et >= s.time("PT"))
+}
+
+// tof delays the falling edge of IN by PT
+func tof(s fbState) {
+	if s.bool("IN") {
+		s.set("RUNNING", false)
+		s.set("Q", true)
+		s.set("ET", Duration(0))
+		return
+	}
+	if !s.bool("Q") {
+		return
+	}
+	if !s.bool("RUNNING") {
+		s.set("RUNNING", true)
+		s.set("START", clock())
+	}
+	et := elapsed(s)
+	s.set("ET", et)
+	if et >= s.time("PT") {
+		s.set("RUNNING", false)
+		s.set("Q", false)
+	}
+}
+
+// tp outputs a pulse of length PT on a rising edge of IN; edges during the
+// pulse are ignored
+func tp(s fbState) {
+	in := s.bool("IN")
+	if in && !s.bool("M") && !s.bool("RUNNING") {
+		s.set("RUNNING", true)
+		s.set("START", clock())
+	}
+	s.set("M", in)
+
+	switch {
+	case s.bool("RUNNING"):
+		et := elapsed(s)
+		s.set("ET", et)
+		if et >= s.time("PT") {
+			s.set("RUNNING", false)
+		}
+	case !in:
+		s.set("ET", Duration(0))
+	}
+	s.set("Q", s.bool("RUNNING"))
+}
+
+// ctu counts rising edges of CU up to the largest INT
+func ctu(s fbState) {
+	cu := s.bool("CU")
+	switch {
+	case s.bool("R"):
+		s.set("CV", int16(0))
+	case cu && !s.bool("M") && s.int("CV") < math.MaxInt16:
+		s.set("CV", s.int("CV")+1)
+	}
+	s.set("M", cu)
+	s.set("Q", s.int("CV") >= s.int("PV"))
+}
+
+// ctd counts rising edges of CD down from PV, loaded by LD
+func ctd(s fbState) {
+	cd := s.bool("CD")
+	switch {
+	case s.bool("LD"):
+		s.set("CV", s.int("PV"))
+	case cd && !s.bool("M") && s.int("CV") > math.MinInt16:
+		s.set("CV", s.int("CV")-1)
+	}
+	s.set("M", cd)
+	s.set("Q", s.int("CV") <= 0)
+}
+
+// ctud counts rising edges of CU up and of CD down; simultaneous edges cancel
+func ctud(s fbState) {
+	cu, cd := s.bool("CU"), s.bool("CD")
+	up, down := cu && !s.bool("MU"), cd && !s.bool("MD")
+	cv := s.int("CV")
+	switch {
+	case s.bool("R"):
+		s.set("CV", int16(0))
+	case s.bool("LD"):
+		s.set("CV", s.int("PV"))
+	case up && down:
+	case up && cv < math.MaxInt16:
+		s.set("CV", cv+1)
+	case down && cv > math.MinInt16:
+		s.set("CV", cv-1)
+	}
+	s.set("MU", cu)
+	s.set("MD", cd)
+	s.set("QU", s.int("CV") >= s.int("PV"))
+	s.set("QD", s.int("CV") <= 0)
+}
+
+// rTrig detects rising edges of CLK
+func rTrig(s fbState) {
+	clk := s.bool("CLK")
+	s.set("Q", clk && !s.bool("M"))
+	s.set("M", clk)
+}
+
+// fTrig detects falling edges of CLK
+func fTrig(s fbState) {
+	clk := s.bool("CLK")
+	s.set("Q", !clk && s.bool("M"))
+	s.set("M", clk)
+}
+
+// sr is a set-dominant bistable
+func sr(s fbState) {
+	s.set("Q1", s.bool("S1") || (!s.bool("R") && s.bool("Q1")))
+}
+
+// rs is a reset-dominant bistable
+func rs(s fbState) {
+	s.set("Q1", !s.bool("R1") && (s.bool("S") || s.bool("Q1")))
+}
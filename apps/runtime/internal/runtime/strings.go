@@ -0,0 +1,179 @@
+package runtime
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The string functions count characters from 1 and work alike on STRING and
+// WSTRING values, which are both held as Go strings. Positions and lengths
+// are counted in characters rather than bytes.
+
+// stringArgs returns the string and integer arguments of a string function,
+// in the order given by kinds: 's' for a string and 'i' for an integer
+func stringArgs(args []interface{}, kinds string) ([][]rune, []int, error) {
+	var texts [][]rune
+	var ints []int
+	for i, kind := range kinds {
+		switch kind {
+		case 's':
+			s, ok := args[i].(string)
+			if !ok {
+				return nil, nil, fmt.Errorf("invalid argument %s, expected a string", typeNameOf(args[i]))
+			}
+			texts = append(texts, []rune(s))
+		case 'i':
+			n, ok := toInt(args[i])
+			if !ok {
+				return nil, nil, fmt.Errorf("invalid argument %s, expected an integer", typeNameOf(args[i]))
+			}
+			if n < 0 {
+				return nil, nil, fmt.Errorf("negative argument %d", n)
+			}
+			ints = append(ints, n)
+		}
+	}
+	return texts, ints, nil
+}
+
+// span checks that l characters from position p lie within a string of n characters
+func span(n, l, p int) error {
+	if p < 1 || p > n+1 {
+		return fmt.Errorf("position %d out of range 1..%d", p, n+1)
+	}
+	if p-1+l > n {
+		return fmt.Errorf("%d characters from position %d exceed the length %d", l, p, n)
+	}
+	return nil
+}
+
+// stringLen implements LEN(IN)
+func stringLen(args []interface{}) (interface{}, error) {
+	texts, _, err := stringArgs(args, "s")
+	if err != nil {
+		return nil, err
+	}
+	return int16(len(texts[0])), nil
+}
+
+// stringLeft implements LEFT(IN, L), the first L characters of IN
+func stringLeft(args []interface{}) (interface{}, error) {
+	texts, ints, err := stringArgs(args, "si")
+	if err != nil {
+		return nil, err
+	}
+	in, l := texts[0], ints[0]
+	if l > len(in) {
+		l = len(in)
+	}
+	return string(in[:l]), nil
+}
+
+// stringRight implements RIGHT(IN, L), the last L characters of IN
+func stringRight(args []interface{}) (interface{}, error) {
+	texts, ints, err := stringArgs(args, "si")
+	if err != nil {
+		return nil, err
+	}
+	in, l := texts[0], ints[0]
+	if l > len(in) {
+		l = len(in)
+	}
+	return string(in[len(in)-l:]), nil
+}
+
+// stringMid implements MID(IN, L, P), the L characters of IN from position P
+func stringMid(args []interface{}) (interface{}, error) {
+	texts, ints, err := stringArgs(args, "sii")
+	if err != nil {
+		return nil, err
+	}
+	in, l, p := texts[0], ints[0], ints[1]
+	if err := span(len(in), 0, p); err != nil {
+		return nil, err
+	}
+	if p-1+l > len(in) {
+		l = len(in) - (p - 1)
+	}
+	return string(in[p-1 : p-1+l]), nil
+}
+
+// stringConcat implements CONCAT(IN1, IN2, ...)
+func stringConcat(args []interface{}) (interface{}, error) {
+	var b strings.Builder
+	for _, arg := range args {
+		s, ok := arg.(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid argument %s, expected a string", typeNameOf(arg))
+		}
+		b.WriteString(s)
+	}
+	return b.String(), nil
+}
+
+// stringInsert implements INSERT(IN1, IN2, P), inserting IN2 after the first P
+// characters of IN1
+func stringInsert(args []interface{}) (interface{}, error) {
+	texts, ints, err := stringArgs(args, "ssi")
+	if err != nil {
+		return nil, err
+	}
+	in1, in2, p := texts[0], texts[1], ints[0]
+	if p > len(in1) {
+		return nil, fmt.Errorf("position %d out of range 0..%d", p, len(in1))
+	}
+	return string(in1[:p]) + string(in2) + string(in1[p:]), nil
+}
+
+// stringDelete implements DELETE(IN, L, P), deleting L characters of IN from position P
+func stringDelete(args []interface{}) (interface{}, error) {
+	texts, ints, err := stringArgs(args, "sii")
+	if err != nil {
+		return nil, err
+	}
+	in, l, p := texts[0], ints[0], ints[1]
+	if err := span(len(in), l, p); err != nil {
+		return nil, err
+	}
+	return string(in[:p-1]) + string(in[p-1+l:]), nil
+}
+
+// stringReplace implements REPLACE(IN1, IN2, L, P), replacing L characters of IN1
+// from position P by IN2
+func stringReplace(args []interface{}) (interface{}, error) {
+	texts, ints, err := stringArgs(args, "ssii")
+	if err != nil {
+		return nil, err
+	}
+	in1, in2, l, p := texts[0], texts[1], ints[0], ints[1]
+	if err := span(len(in1), l, p); err != nil {
+		return nil, err
+	}
+	return string(in1[:p-1]) + string(in2) + string(in1[p-1+l:]), nil
+}
+
+// stringFind implements FIND(IN1, IN2), the position of the first occurrence of IN2
+// in IN1 or 0 if it does not occur
+func stringFind(args []interface{}) (interface{}, error) {
+	texts, _, err := stringArgs(args, "ss")
+	if err != nil {
+		return nil, err
+	}
+	in1, in2 := string(texts[0]), string(texts[1])
+	i := strings.Index(in1, in2)
+	if i < 0 {
+		return int16(0), nil
+	}
+	return int16(len([]rune(in1[:i])) + 1), nil
+}
+
+// limitLength limits s to n characters
+func limitLength(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	if runes := []rune(s); len(runes) > n {
+		return string(runes[:n])
+	}
+	return s
+}
@@ -0,0 +1,511 @@
+package runtime
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// typeClass groups elementary types that share a runtime representation and
+// conversion rules
+type typeClass int
+
+const (
+	classBool typeClass = iota
+	classSigned
+	classUnsigned
+	classBits
+	classReal
+	classTime
+	classTOD
+	classDate
+	classDT
+	classString
+)
+
+// typeInfo describes an elementary IEC 61131-3 data type
+type typeInfo struct {
+	name  string
+	class typeClass
+	bits  int
+}
+
+var elementaryTypes = map[DataType]typeInfo{
+	TypeBool:    {"BOOL", classBool, 1},
+	TypeSInt:    {"SINT", classSigned, 8},
+	TypeInt:     {"INT", classSigned, 16},
+	TypeDInt:    {"DINT", classSigned, 32},
+	TypeLInt:    {"LINT", classSigned, 64},
+	TypeUSInt:   {"USINT", classUnsigned, 8},
+	TypeUInt:    {"UINT", classUnsigned, 16},
+	TypeUDInt:   {"UDINT", classUnsigned, 32},
+	TypeULInt:   {"ULINT", classUnsigned, 64},
+	TypeByte:    {"BYTE", classBits, 8},
+	TypeWord:    {"WORD", classBits, 16},
+	TypeDWord:   {"DWORD", classBits, 32},
+	TypeLWord:   {"LWORD", classBits, 64},
+	TypeFloat:   {"REAL", classReal, 32},
+	TypeLReal:   {"LREAL", classReal, 64},
+	TypeTime:    {"TIME", classTime, 64},
+	TypeLTime:   {"LTIME", classTime, 64},
+	TypeDate:    {"DATE", classDate, 64},
+	TypeTOD:     {"TOD", classTOD, 64},
+	TypeDT:      {"DT", classDT, 64},
+	TypeString:  {"STRING", classString, 8},
+	TypeWString: {"WSTRING", classString, 16},
+}
+
+// typeAliases maps the long IEC spellings to their elementary type
+var typeAliases = map[string]DataType{
+	"TIME_OF_DAY":   TypeTOD,
+	"DATE_AND_TIME": TypeDT,
+}
+
+// elementaryType returns the elementary data type with the given IEC name
+func elementaryType(name string) (DataType, bool) {
+	name = strings.ToUpper(name)
+	if t, ok := typeAliases[name]; ok {
+		return t, true
+	}
+	for t, info := range elementaryTypes {
+		if info.name == name {
+			return t, true
+		}
+	}
+	return 0, false
+}
+
+// Duration is the runtime value of TIME and LTIME variables
+type Duration time.Duration
+
+// String formats the duration as an IEC literal such as T#1h2m3s500ms
+func (d Duration) String() string {
+	if d == 0 {
+		return "T#0s"
+	}
+
+	var b strings.Builder
+	b.WriteString("T#")
+	if d < 0 {
+		b.WriteByte('-')
+		d = -d
+	}
+
+	units := []struct {
+		suffix string
+		size   Duration
+	}{
+		{"d", Duration(24 * time.Hour)},
+		{"h", Duration(time.Hour)},
+		{"m", Duration(time.Minute)},
+		{"s", Duration(time.Second)},
+		{"ms", Duration(time.Millisecond)},
+		{"us", Duration(time.Microsecond)},
+		{"ns", Duration(time.Nanosecond)},
+	}
+	for _, u := range units {
+		if n := d / u.size; n > 0 {
+			fmt.Fprintf(&b, "%d%s", n, u.suffix)
+			d -= n * u.size
+		}
+	}
+	return b.String()
+}
+
+// MarshalJSON encodes the duration as its IEC literal
+func (d Duration) MarshalJSON() ([]byte, error) { return json.Marshal(d.String()) }
+
+// TimeOfDay is the runtime value of TOD variables: the time elapsed since midnight
+type TimeOfDay time.Duration
+
+// timeOfDay returns the time of day d after midnight, wrapping around so that
+// arithmetic crossing midnight stays within a day
+func timeOfDay(d time.Duration) TimeOfDay {
+	d %= 24 * time.Hour
+	if d < 0 {
+		d += 24 * time.Hour
+	}
+	return TimeOfDay(d)
+}
+
+// String formats the time of day as an IEC literal such as TOD#12:30:15.5
+func (t TimeOfDay) String() string {
+	d := time.Duration(t)
+	s := fmt.Sprintf("TOD#%02d:%02d:%02d", int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60)
+	if frac := d % time.Second; frac != 0 {
+		s += strings.TrimRight(fmt.Sprintf(".%09d", frac), "0")
+	}
+	return s
+}
+
+// MarshalJSON encodes the time of day as its IEC literal
+func (t TimeOfDay) MarshalJSON() ([]byte, error) { return json.Marshal(t.String()) }
+
+// Date is the runtime value of DATE variables, always at midnight UTC
+type Date time.Time
+
+func (d Date) String() string { return "D#" + time.Time(d).UTC().Format("2006-01-02") }
+
+// MarshalJSON encodes the date as its IEC literal
+func (d Date) MarshalJSON() ([]byte, error) { return json.Marshal(d.String()) }
+
+// DateTime is the runtime value of DT variables
+type DateTime time.Time
+
+func (dt DateTime) String() string {
+	return "DT#" + time.Time(dt).UTC().Format("2006-01-02-15:04:05.999999999")
+}
+
+// MarshalJSON encodes the date and time as its IEC literal
+func (dt DateTime) MarshalJSON() ([]byte, error) { return json.Marshal(dt.String()) }
+
+// defaultValue returns the initial value of an elementary type
+func defaultValue(t DataType) interface{} {
+	switch t {
+	case TypeBool:
+		return false
+	case TypeSInt:
+		return int8(0)
+	case TypeInt:
+		return int16(0)
+	case TypeDInt:
+		return int32(0)
+	case TypeLInt:
+		return int64(0)
+	case TypeUSInt, TypeByte:
+		return uint8(0)
+	case TypeUInt, TypeWord:
+		return uint16(0)
+	case TypeUDInt, TypeDWord:
+		return uint32(0)
+	case TypeULInt, TypeLWord:
+		return uint64(0)
+	case TypeFloat:
+		return float32(0)
+	case TypeLReal:
+		return 0.0
+	case TypeTime, TypeLTime:
+		return Duration(0)
+	case TypeTOD:
+		return TimeOfDay(0)
+	case TypeDate:
+		return Date(time.Unix(0, 0).UTC())
+	case TypeDT:
+		return DateTime(time.Unix(0, 0).UTC())
+	case TypeString, TypeWString:
+		return ""
+	default:
+		return nil
+	}
+}
+
+// valueType returns the elementary type of a runtime value. Plain Go ints come
+// from untyped integer literals and loop counters and report false: they adopt
+// the type of whatever they are combined with or assigned to.
+func valueType(v interface{}) (DataType, bool) {
+	switch v.(type) {
+	case bool:
+		return TypeBool, true
+	case int8:
+		return TypeSInt, true
+	case int16:
+		return TypeInt, true
+	case int32:
+		return TypeDInt, true
+	case int64:
+		return TypeLInt, true
+	case uint8:
+		return TypeUSInt, true
+	case uint16:
+		return TypeUInt, true
+	case uint32:
+		return TypeUDInt, true
+	case uint64:
+		return TypeULInt, true
+	case float32:
+		return TypeFloat, true
+	case float64:
+		return TypeLReal, true
+	case Duration:
+		return TypeTime, true
+	case TimeOfDay:
+		return TypeTOD, true
+	case Date:
+		return TypeDate, true
+	case DateTime:
+		return TypeDT, true
+	case string:
+		return TypeString, true
+	}
+	return 0, false
+}
+
+// typeNameOf names the type of a runtime value for error messages
+func typeNameOf(v interface{}) string {
+	if _, ok := v.(int); ok {
+		return "ANY_INT"
+	}
+	if t, ok := valueType(v); ok {
+		return t.String()
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// integerBits returns the two's complement bits of any integer value
+func integerBits(v interface{}) (uint64, bool) {
+	switch n := v.(type) {
+	case int:
+		return uint64(n), true
+	case int8:
+		return uint64(n), true
+	case int16:
+		return uint64(n), true
+	case int32:
+		return uint64(n), true
+	case int64:
+		return uint64(n), true
+	case uint8:
+		return uint64(n), true
+	case uint16:
+		return uint64(n), true
+	case uint32:
+		return uint64(n), true
+	case uint64:
+		return n, true
+	}
+	return 0, false
+}
+
+// toInt returns the value of any signed or unsigned integer as an int
+func toInt(v interface{}) (int, bool) {
+	bits, ok := integerBits(v)
+	return int(bits), ok
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	case uint8, uint16, uint32, uint64:
+		bits, _ := integerBits(n)
+		return float64(bits), true
+	}
+	if n, ok := toInt(v); ok {
+		return float64(n), true
+	}
+	return 0, false
+}
+
+// wrapInteger truncates two's complement bits to the width of an integer type,
+// giving IEC overflow wrap-around
+func wrapInteger(bits uint64, t DataType) interface{} {
+	switch t {
+	case TypeSInt:
+		return int8(bits)
+	case TypeInt:
+		return int16(bits)
+	case TypeDInt:
+		return int32(bits)
+	case TypeLInt:
+		return int64(bits)
+	case TypeUSInt, TypeByte:
+		return uint8(bits)
+	case TypeUInt, TypeWord:
+		return uint16(bits)
+	case TypeUDInt, TypeDWord:
+		return uint32(bits)
+	default:
+		return bits
+	}
+}
+
+// coerce converts a value to the representation of an elementary type under
+// the implicit conversion rules applied on assignment: integers wrap to the
+// target width and integers widen to REAL, but nothing converts across
+// categories (e.g. REAL to INT or INT to TIME) without an explicit *_TO_* call
+func coerce(val interface{}, t DataType) (interface{}, error) {
+	info, ok := elementaryTypes[t]
+	if !ok {
+		return val, nil
+	}
+
+	switch info.class {
+	case classBool:
+		if b, ok := val.(bool); ok {
+			return b, nil
+		}
+	case classSigned, classUnsigned, classBits:
+		if bits, ok := integerBits(val); ok {
+			return wrapInteger(bits, t), nil
+		}
+	case classReal:
+		if f, ok := toFloat(val); ok {
+			if info.bits == 32 {
+				return float32(f), nil
+			}
+			return f, nil
+		}
+	case classTime:
+		if d, ok := val.(Duration); ok {
+			return d, nil
+		}
+	case classTOD:
+		if tod, ok := val.(TimeOfDay); ok {
+			return tod, nil
+		}
+	case classDate:
+		if d, ok := val.(Date); ok {
+			return d, nil
+		}
+	case classDT:
+		if dt, ok := val.(DateTime); ok {
+			return dt, nil
+		}
+	case classString:
+		if s, ok := val.(string); ok {
+			return s, nil
+		}
+	}
+
+	return nil, fmt.Errorf("cannot implicitly convert %s to %s", typeNameOf(val), info.name)
+}
+
+// convertValue performs an explicit type conversion as done by the *_TO_*
+// functions: REAL to integer rounds to the nearest value, TIME converts
+// to and from milliseconds and every type converts to and from STRING
+func convertValue(val interface{}, t DataType) (interface{}, error) {
+	info, ok := elementaryTypes[t]
+	if !ok {
+		return nil, fmt.Errorf("cannot convert to %s", t)
+	}
+
+	// Numbers are parsed from strings before being converted like any other number
+	if s, ok := val.(string); ok && info.class != classString {
+		parsed, err := parseValue(strings.TrimSpace(s), info.class)
+		if err != nil {
+			return nil, fmt.Errorf("cannot convert %q to %s", s, info.name)
+		}
+		val = parsed
+	}
+
+	switch info.class {
+	case classBool:
+		switch v := val.(type) {
+		case bool:
+			return v, nil
+		default:
+			if f, ok := toFloat(v); ok {
+				return f != 0, nil
+			}
+		}
+	case classSigned, classUnsigned, classBits:
+		switch v := val.(type) {
+		case bool:
+			if v {
+				return wrapInteger(1, t), nil
+			}
+			return wrapInteger(0, t), nil
+		case float32, float64:
+			f, _ := toFloat(v)
+			return wrapInteger(uint64(int64(math.Round(f))), t), nil
+		case Duration:
+			return wrapInteger(uint64(time.Duration(v).Milliseconds()), t), nil
+		case TimeOfDay:
+			return wrapInteger(uint64(time.Duration(v).Milliseconds()), t), nil
+		default:
+			if bits, ok := integerBits(v); ok {
+				return wrapInteger(bits, t), nil
+			}
+		}
+	case classReal:
+		switch v := val.(type) {
+		case bool:
+			if v {
+				return coerce(1, t)
+			}
+			return coerce(0, t)
+		case Duration:
+			return coerce(float64(time.Duration(v).Milliseconds()), t)
+		default:
+			return coerce(v, t)
+		}
+	case classTime:
+		switch v := val.(type) {
+		case Duration:
+			return v, nil
+		case float32, float64:
+			f, _ := toFloat(v)
+			return Duration(f * float64(time.Millisecond)), nil
+		default:
+			if n, ok := toInt(v); ok {
+				return Duration(time.Duration(n) * time.Millisecond), nil
+			}
+		}
+	case classTOD:
+		switch v := val.(type) {
+		case TimeOfDay:
+			return v, nil
+		case DateTime:
+			tm := time.Time(v).UTC()
+			return TimeOfDay(tm.Sub(tm.Truncate(24 * time.Hour))), nil
+		}
+	case classDate:
+		switch v := val.(type) {
+		case Date:
+			return v, nil
+		case DateTime:
+			return Date(time.Time(v).UTC().Truncate(24 * time.Hour)), nil
+		}
+	case classDT:
+		switch v := val.(type) {
+		case DateTime:
+			return v, nil
+		case Date:
+			return DateTime(time.Time(v)), nil
+		}
+	case classString:
+		return formatValue(val), nil
+	}
+
+	return nil, fmt.Errorf("cannot convert %s to %s", typeNameOf(val), info.name)
+}
+
+// parseValue parses the text of a number, boolean or duration for conversion
+// from STRING
+func parseValue(s string, class typeClass) (interface{}, error) {
+	switch class {
+	case classBool:
+		return strconv.ParseBool(strings.ToLower(s))
+	case classReal:
+		return strconv.ParseFloat(s, 64)
+	case classSigned, classUnsigned, classBits:
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return n, nil
+		}
+		return strconv.ParseUint(s, 10, 64)
+	}
+	return nil, fmt.Errorf("cannot parse %q", s)
+}
+
+// formatValue renders a value the way the *_TO_STRING conversions do
+func formatValue(val interface{}) string {
+	switch v := val.(type) {
+	case bool:
+		if v {
+			return "TRUE"
+		}
+		return "FALSE"
+	case float32:
+		return strconv.FormatFloat(float64(v), 'g', -1, 32)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case string:
+		return v
+	}
+	return fmt.Sprint(val)
+}
@@ -0,0 +1,334 @@
+package runtime
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperdrive/core/apps/runtime/internal/parser/ast"
+)
+
+// maxTypeDepth bounds how many type aliases are followed when resolving a type
+const maxTypeDepth = 16
+
+// composite is implemented by values whose members are addressable variables
+type composite interface {
+	// member returns the variable holding the named member
+	member(name string) (*Variable, bool)
+	// members returns the member names in declaration order
+	members() []string
+}
+
+// StructValue holds the fields of a STRUCT variable
+type StructValue struct {
+	Type   *ast.StructType
+	Fields map[string]*Variable
+}
+
+// MarshalJSON encodes the struct as a map of its field values
+func (s *StructValue) MarshalJSON() ([]byte, error) {
+	values := make(map[string]interface{}, len(s.Fields))
+	for name, v := range s.Fields {
+		values[name] = v.Value
+	}
+	return json.Marshal(values)
+}
+
+func (s *StructValue) member(name string) (*Variable, bool) {
+	v, ok := s.Fields[name]
+	return v, ok
+}
+
+func (s *StructValue) members() []string {
+	names := make([]string, len(s.Type.Fields))
+	for i, f := range s.Type.Fields {
+		names[i] = f.Name
+	}
+	return names
+}
+
+// copyFrom assigns every field of src to the corresponding field of s
+func (s *StructValue) copyFrom(src *StructValue) error {
+	if s.Type.TypeName() != src.Type.TypeName() {
+		return fmt.Errorf("cannot assign %s to %s", src.Type.TypeName(), s.Type.TypeName())
+	}
+	for name, dst := range s.Fields {
+		if field, ok := src.Fields[name]; ok {
+			if err := assign(dst, field.Value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (i *FBInstance) member(name string) (*Variable, bool) {
+	v, ok := i.Vars[name]
+	return v, ok
+}
+
+func (i *FBInstance) members() []string {
+	names := make([]string, len(i.Type.Vars))
+	for idx, decl := range i.Type.Vars {
+		names[idx] = decl.Name
+	}
+	return names
+}
+
+// ArrayValue holds the elements of an ARRAY variable in row-major order
+type ArrayValue struct {
+	Type  *ast.ArrayType
+	Elems []*Variable
+}
+
+// MarshalJSON encodes the array as nested lists, one level per dimension
+func (a *ArrayValue) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.nested(0, 0))
+}
+
+func (a *ArrayValue) nested(dim, offset int) []interface{} {
+	n := a.Type.Dims[dim].Len()
+	stride := a.stride(dim)
+	values := make([]interface{}, n)
+	for i := range values {
+		if dim == len(a.Type.Dims)-1 {
+			values[i] = a.Elems[offset+i].Value
+		} else {
+			values[i] = a.nested(dim+1, offset+i*stride)
+		}
+	}
+	return values
+}
+
+// stride returns the number of elements spanned by one step in the given dimension
+func (a *ArrayValue) stride(dim int) int {
+	stride := 1
+	for _, d := range a.Type.Dims[dim+1:] {
+		stride *= d.Len()
+	}
+	return stride
+}
+
+// element returns the variable holding the element at the given indices
+func (a *ArrayValue) element(indices []int) (*Variable, error) {
+	if len(indices) != len(a.Type.Dims) {
+		return nil, fmt.Errorf("%s expects %d indices, got %d", a.Type, len(a.Type.Dims), len(indices))
+	}
+	offset := 0
+	for i, idx := range indices {
+		d := a.Type.Dims[i]
+		if idx < d.Start || idx > d.End {
+			return nil, fmt.Errorf("array index %d out of bounds %d..%d", idx, d.Start, d.End)
+		}
+		offset += (idx - d.Start) * a.stride(i)
+	}
+	return a.Elems[offset], nil
+}
+
+// indexLabel returns the subscript of the element at offset, e.g. [1, 2]
+func (a *ArrayValue) indexLabel(offset int) string {
+	indices := make([]string, len(a.Type.Dims))
+	for i, d := range a.Type.Dims {
+		stride := a.stride(i)
+		indices[i] = strconv.Itoa(d.Start + offset/stride)
+		offset %= stride
+	}
+	return "[" + strings.Join(indices, ", ") + "]"
+}
+
+// copyFrom assigns every element of src to the corresponding element of a
+func (a *ArrayValue) copyFrom(src *ArrayValue) error {
+	if len(a.Elems) != len(src.Elems) {
+		return fmt.Errorf("cannot assign %s to %s", src.Type, a.Type)
+	}
+	for i, dst := range a.Elems {
+		if err := assign(dst, src.Elems[i].Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// initFrom assigns an initializer list to the leading elements in row-major order;
+// nil entries keep the element default
+func (a *ArrayValue) initFrom(values []interface{}) error {
+	if len(values) > len(a.Elems) {
+		return fmt.Errorf("too many initial values for %s: %d", a.Type, len(values))
+	}
+	for i, val := range values {
+		if val == nil {
+			continue
+		}
+		if err := assign(a.Elems[i], val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EnumValue is a value of an enumeration type
+type EnumValue struct {
+	Type  string
+	Name  string
+	Value int
+}
+
+func (e EnumValue) String() string { return e.Name }
+
+// MarshalJSON encodes the value by its name
+func (e EnumValue) MarshalJSON() ([]byte, error) {
+	return json.Marshal(e.Name)
+}
+
+// assign stores val in v, enforcing the constraints of its declared type.
+// Structured values are copied field by field so variables never alias each other.
+func assign(v *Variable, val interface{}) error {
+	if sub, ok := v.typ.(*ast.SubrangeType); ok {
+		n, ok := toInt(val)
+		if !ok {
+			return fmt.Errorf("cannot assign %s to %s of type %s", typeNameOf(val), v.Name, sub.TypeName())
+		}
+		if n < sub.Low || n > sub.High {
+			return fmt.Errorf("value %d out of range %d..%d for %s", n, sub.Low, sub.High, v.Name)
+		}
+	}
+
+	// Variables declared in ST hold values of exactly their elementary type
+	if v.typ != nil {
+		coerced, err := coerce(val, v.DataType)
+		if err != nil {
+			return fmt.Errorf("%s: %w", v.Name, err)
+		}
+		val = coerced
+	}
+
+	// Strings declared with a maximum length are truncated to it
+	if st, ok := v.typ.(*ast.StringType); ok {
+		if s, ok := val.(string); ok {
+			val = limitLength(s, st.Length)
+		}
+	}
+
+	switch src := val.(type) {
+	case *StructValue:
+		dst, ok := v.Value.(*StructValue)
+		if !ok {
+			return fmt.Errorf("cannot assign %s to %s", src.Type.TypeName(), v.Name)
+		}
+		if dst != src {
+			if err := dst.copyFrom(src); err != nil {
+				return err
+			}
+		}
+	case *ArrayValue:
+		dst, ok := v.Value.(*ArrayValue)
+		if !ok {
+			return fmt.Errorf("cannot assign %s to %s", src.Type, v.Name)
+		}
+		if dst != src {
+			if err := dst.copyFrom(src); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		// Initializer lists such as [1, 2, 3(0)]
+		dst, ok := v.Value.(*ArrayValue)
+		if !ok {
+			return fmt.Errorf("cannot initialize %s from an array initializer", v.Name)
+		}
+		if err := dst.initFrom(src); err != nil {
+			return err
+		}
+	default:
+		v.Value = val
+	}
+
+	v.Timestamp = time.Now()
+	return nil
+}
+
+// resolveType follows references to user-defined types and returns the
+// underlying type together with the default value declared for it, if any
+func (p *Program) resolveType(t ast.DataType) (ast.DataType, ast.Expression) {
+	var init ast.Expression
+	for i := 0; i < maxTypeDepth; i++ {
+		decl, ok := p.lib.Type(t.TypeName())
+		if !ok {
+			break
+		}
+		if init == nil {
+			init = decl.InitExpr
+		}
+		if decl.Type == t {
+			break
+		}
+		t = decl.Type
+	}
+	return t, init
+}
+
+// zeroValue returns the initial value of a variable of the given type
+func (p *Program) zeroValue(t ast.DataType) (interface{}, error) {
+	switch typ := t.(type) {
+	case *ast.StructType:
+		return p.newStructValue(typ)
+	case *ast.EnumType:
+		if len(typ.Values) == 0 {
+			return nil, fmt.Errorf("enumeration %s has no values", typ.TypeName())
+		}
+		first := typ.Values[0]
+		return EnumValue{Type: typ.TypeName(), Name: first.Name, Value: first.Value}, nil
+	case *ast.SubrangeType:
+		// The lower limit is the default of a subrange
+		return typ.Low, nil
+	case *ast.ArrayType:
+		return p.newArrayValue(typ)
+	}
+	dataType, err := convertDataType(t)
+	if err != nil {
+		return nil, err
+	}
+	return defaultValue(dataType), nil
+}
+
+// newStructValue allocates and initializes the fields of a struct
+func (p *Program) newStructValue(t *ast.StructType) (*StructValue, error) {
+	s := &StructValue{
+		Type:   t,
+		Fields: make(map[string]*Variable, len(t.Fields)),
+	}
+	for _, field := range t.Fields {
+		v, err := p.newVariable(field)
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %w", t.TypeName(), field.Name, err)
+		}
+		s.Fields[field.Name] = v
+	}
+	return s, nil
+}
+
+// newArrayValue allocates and initializes the elements of an array
+func (p *Program) newArrayValue(t *ast.ArrayType) (*ArrayValue, error) {
+	if len(t.Dims) == 0 {
+		return nil, fmt.Errorf("%s has no dimensions", t)
+	}
+	size := 1
+	for _, d := range t.Dims {
+		if d.Len() <= 0 {
+			return nil, fmt.Errorf("invalid array bounds %d..%d", d.Start, d.End)
+		}
+		size *= d.Len()
+	}
+
+	a := &ArrayValue{Type: t, Elems: make([]*Variable, size)}
+	for i := range a.Elems {
+		v, err := p.newVariable(&ast.VarDecl{Name: a.indexLabel(i), Type: t.BaseType})
+		if err != nil {
+			return nil, err
+		}
+		a.Elems[i] = v
+	}
+	return a, nil
+}
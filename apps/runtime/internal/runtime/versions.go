@@ -0,0 +1,392 @@
+package runtime
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/hyperdrive/core/apps/runtime/internal/diagnostics"
+	"github.com/hyperdrive/core/apps/runtime/internal/parser/ast"
+	"github.com/hyperdrive/core/apps/runtime/internal/storage"
+)
+
+// String returns the name of the version state
+func (s VersionState) String() string {
+	switch s {
+	case VersionActive:
+		return "active"
+	case VersionTesting:
+		return "testing"
+	case VersionPending:
+		return "pending"
+	case VersionArchived:
+		return "archived"
+	default:
+		return fmt.Sprintf("UNKNOWN(%d)", int(s))
+	}
+}
+
+// Comparison counts the cycles a version in Testing ran next to the active
+// version and those in which their outputs differed
+type Comparison struct {
+	Cycles      uint64                  `json:"cycles"`
+	Mismatches  uint64                  `json:"mismatches"`
+	Differences []OutputDifference      `json:"differences,omitempty"` // Of the last cycle with a mismatch
+	Fault       *diagnostics.Diagnostic `json:"fault,omitempty"`       // Error of the last failed cycle
+}
+
+// OutputDifference is an output with different values in the active version
+// and the version in Testing
+type OutputDifference struct {
+	Name    string      `json:"name"`
+	Active  interface{} `json:"active"`
+	Testing interface{} `json:"testing"`
+}
+
+// VersionInfo describes a version: who deployed which files when
+type VersionInfo struct {
+	ID         string               `json:"id"`
+	Parent     string               `json:"parent,omitempty"`
+	State      string               `json:"state"`
+	Author     string               `json:"author,omitempty"`
+	Timestamp  time.Time            `json:"timestamp"`
+	Files      []string             `json:"files"`
+	Tasks      []storage.TaskConfig `json:"tasks,omitempty"`
+	Comparison *Comparison          `json:"comparison,omitempty"`
+}
+
+func (v *Version) info() VersionInfo {
+	info := VersionInfo{
+		ID:        v.ID,
+		State:     v.State.String(),
+		Author:    v.Author,
+		Timestamp: v.Timestamp,
+		Tasks:     v.Tasks,
+	}
+	if v.Parent != nil {
+		info.Parent = v.Parent.ID
+	}
+	for _, file := range v.Files {
+		info.Files = append(info.Files, file.FilePath)
+	}
+	if v.Comparison.Cycles > 0 || v.State == VersionTesting {
+		comparison := v.Comparison
+		info.Comparison = &comparison
+	}
+	return info
+}
+
+// DeployVersion deploys files as DeployProject does and records them as a
+// new active version deployed by author
+func (r *Runtime) DeployVersion(files []DeployRequest, config []storage.TaskConfig, author string) (*Version, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.deploy(files, config); err != nil {
+		return nil, err
+	}
+	v := r.newVersion(files, config, author)
+	r.activate(v)
+	return v, nil
+}
+
+// StageVersion checks files against the deployed ones and records them as a
+// pending version without running them
+func (r *Runtime) StageVersion(files []DeployRequest, config []storage.TaskConfig, author string) (*Version, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	paths, err := filePaths(files)
+	if err != nil {
+		return nil, err
+	}
+	if _, diags := compile(files, r.deployedFiles(paths)); diags.HasErrors() {
+		return nil, &CompileError{Diagnostics: diags}
+	}
+	return r.newVersion(files, config, author), nil
+}
+
+// TestVersion runs a pending or archived version in Testing: its programs run
+// after their active counterparts on the same inputs and their outputs are
+// compared, without writing to the process image. A version tested before
+// goes back to pending.
+func (r *Runtime) TestVersion(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	v, err := r.findVersion(id)
+	if err != nil {
+		return err
+	}
+	if v.State == VersionActive || v.State == VersionTesting {
+		return fmt.Errorf("version %s is already %s", v.ID, v.State)
+	}
+
+	sh, err := r.newShadow(v)
+	if err != nil {
+		return err
+	}
+	if r.shadow != nil {
+		r.shadow.version.State = VersionPending
+	}
+	r.shadow = sh
+	v.State = VersionTesting
+	v.Comparison = Comparison{}
+	log.Printf("Testing version %s next to %s", v.ID, r.activeID())
+	return nil
+}
+
+// ActivateVersion deploys the files of a version and makes it the active one
+func (r *Runtime) ActivateVersion(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	v, err := r.findVersion(id)
+	if err != nil {
+		return err
+	}
+	if v.State == VersionActive {
+		return nil
+	}
+	if err := r.deploy(v.Files, v.Tasks); err != nil {
+		return err
+	}
+	r.activate(v)
+	return nil
+}
+
+// Rollback deploys the parent of the active version again and makes it the
+// active one. Files deployed by the active version only are kept running.
+func (r *Runtime) Rollback() (*Version, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.version == nil || r.version.Parent == nil {
+		return nil, errors.New("the active version has no parent to roll back to")
+	}
+	parent := r.version.Parent
+	if err := r.deploy(parent.Files, parent.Tasks); err != nil {
+		return nil, err
+	}
+	r.activate(parent)
+	return parent, nil
+}
+
+// GetVersions returns every version, oldest first
+func (r *Runtime) GetVersions() []VersionInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	infos := make([]VersionInfo, len(r.versions))
+	for i, v := range r.versions {
+		infos[i] = v.info()
+	}
+	return infos
+}
+
+// GetVersion returns the version with the given ID
+func (r *Runtime) GetVersion(id string) (VersionInfo, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	v, err := r.findVersion(id)
+	if err != nil {
+		return VersionInfo{}, err
+	}
+	return v.info(), nil
+}
+
+func (r *Runtime) findVersion(id string) (*Version, error) {
+	for _, v := range r.versions {
+		if v.ID == id {
+			return v, nil
+		}
+	}
+	return nil, fmt.Errorf("no version %s", id)
+}
+
+func (r *Runtime) activeID() string {
+	if r.version == nil {
+		return "no active version"
+	}
+	return r.version.ID
+}
+
+func (r *Runtime) newVersion(files []DeployRequest, config []storage.TaskConfig, author string) *Version {
+	v := &Version{
+		ID:        fmt.Sprintf("v%d", len(r.versions)+1),
+		Timestamp: time.Now(),
+		State:     VersionPending,
+		Author:    author,
+		Files:     files,
+		Tasks:     config,
+	}
+	r.versions = append(r.versions, v)
+	return v
+}
+
+// activate makes v the active version and archives the one it replaces. A
+// version activated for the first time gets the replaced one as its parent;
+// one activated again keeps its parent, so rollbacks go further back.
+func (r *Runtime) activate(v *Version) {
+	if r.shadow != nil && r.shadow.version == v {
+		r.shadow = nil
+	}
+	if r.version != nil && r.version != v {
+		r.version.State = VersionArchived
+		if v.Parent == nil && v.Timestamp.After(r.version.Timestamp) {
+			v.Parent = r.version
+		}
+	}
+	v.State = VersionActive
+	r.version = v
+	log.Printf("Version %s is active", v.ID)
+}
+
+// filePaths returns the paths of files, refusing files included twice
+func filePaths(files []DeployRequest) (map[string]bool, error) {
+	paths := make(map[string]bool, len(files))
+	for _, file := range files {
+		if paths[file.FilePath] {
+			return nil, fmt.Errorf("file %s is included more than once", file.FilePath)
+		}
+		paths[file.FilePath] = true
+	}
+	return paths, nil
+}
+
+// shadow runs the programs of the version in Testing next to the active
+// ones. They have a library and globals of their own and only read the
+// inputs of the process image.
+type shadow struct {
+	version  *Version
+	programs map[string]*Program    // By file path
+	inputs   map[string][]ioBinding // Located inputs of the programs by file path
+}
+
+// newShadow instantiates the programs of v, compiled with the deployed files
+// it does not replace. They start from the state of the active programs, as
+// they would after an online change, so only their logic tells them apart.
+func (r *Runtime) newShadow(v *Version) (*shadow, error) {
+	paths, err := filePaths(v.Files)
+	if err != nil {
+		return nil, err
+	}
+	files := append(append([]DeployRequest(nil), v.Files...), r.deployedFiles(paths)...)
+	units, diags := compile(files, nil)
+	if diags.HasErrors() {
+		return nil, &CompileError{Diagnostics: diags}
+	}
+
+	lib := NewLibrary()
+	for _, unit := range units {
+		lib.Register(unit)
+	}
+	for _, unit := range units {
+		if _, err := lib.DeclareGlobals(unit); err != nil {
+			return nil, fmt.Errorf("failed to declare globals: %w", err)
+		}
+	}
+
+	sh := &shadow{
+		version:  v,
+		programs: make(map[string]*Program),
+		inputs:   make(map[string][]ioBinding),
+	}
+	for i, file := range v.Files {
+		astProg, ok := units[i].MainProgram()
+		if !ok {
+			continue
+		}
+		prog, err := newProgram(file.FilePath, astProg, lib)
+		if err != nil {
+			return nil, err
+		}
+		sh.programs[file.FilePath] = prog
+		if old, ok := r.programs[file.FilePath]; ok {
+			for _, decl := range prog.ast.Vars {
+				if prev, ok := old.Vars[decl.Name]; ok && ownsVariable(decl) {
+					carryOver(prog.Vars[decl.Name], prev)
+				}
+			}
+		}
+		for _, variable := range prog.Vars {
+			if variable.location == nil || variable.location.Area != 'I' {
+				continue
+			}
+			if b, err := locate(variable, variable.location); err == nil {
+				sh.inputs[file.FilePath] = append(sh.inputs[file.FilePath], b)
+			}
+		}
+	}
+	return sh, nil
+}
+
+// run executes the counterpart of active, which task has just run, and
+// compares their outputs. A counterpart stopped by the watchdog does not run
+// again.
+func (sh *shadow) run(r *Runtime, task *Task) {
+	active := task.Program
+	prog, ok := sh.programs[active.Name]
+	if !ok {
+		return
+	}
+
+	r.imageMu.Lock()
+	for _, b := range sh.inputs[active.Name] {
+		b.read(&r.image)
+	}
+	r.imageMu.Unlock()
+
+	prog.deadline = time.Now().Add(task.Watchdog)
+	err := prog.Execute()
+	prog.deadline = time.Time{}
+
+	c := &sh.version.Comparison
+	c.Cycles++
+	if err != nil {
+		c.Fault = diagnostics.FromError(err, active.Name, diagnostics.CodeRuntime)
+		if errors.Is(err, errWatchdog) {
+			delete(sh.programs, active.Name)
+		}
+		return
+	}
+	if diffs := compareOutputs(active, prog); len(diffs) > 0 {
+		c.Mismatches++
+		c.Differences = diffs
+	}
+}
+
+// compareOutputs returns the VAR_OUTPUT and located output variables of
+// testing whose values differ from those of active
+func compareOutputs(active, testing *Program) []OutputDifference {
+	namespace := namespaceOf(active.Name)
+	var diffs []OutputDifference
+	for _, decl := range testing.ast.Vars {
+		located := decl.Location != nil && decl.Location.Area == 'Q'
+		if decl.Section != ast.VarOutput && !located {
+			continue
+		}
+		tv := testing.Vars[decl.Name]
+		diff := OutputDifference{Name: namespace + "." + decl.Name, Testing: tv.Value}
+		if av, ok := active.Vars[decl.Name]; ok {
+			if sameValue(av.Value, tv.Value) {
+				continue
+			}
+			diff.Active = av.Value
+		}
+		diffs = append(diffs, diff)
+	}
+	return diffs
+}
+
+// sameValue compares values by their JSON encoding, which covers structs,
+// arrays and function block instances member by member
+func sameValue(a, b interface{}) bool {
+	ea, errA := json.Marshal(a)
+	eb, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(ea, eb)
+}
@@ -0,0 +1,141 @@
+package runtime_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hyperdrive/core/apps/runtime/internal/runtime"
+)
+
+func TestVersions(t *testing.T) {
+	rt, err := runtime.New(runtime.Config{ScanTime: time.Millisecond})
+	if err != nil {
+		t.Fatalf("Failed to create runtime: %v", err)
+	}
+
+	source := func(factor int) []runtime.DeployRequest {
+		return []runtime.DeployRequest{{FilePath: "plant.st", SourceCode: fmt.Sprintf(`
+PROGRAM Plant
+    VAR
+        count : INT;
+    END_VAR
+    VAR_OUTPUT
+        out : INT;
+    END_VAR
+    count := count + 1;
+    out := count * %d;
+END_PROGRAM
+`, factor)}}
+	}
+	out := func() interface{} {
+		t.Helper()
+		v, ok := rt.GetVariable("plant.out")
+		if !ok {
+			t.Fatalf("Variable out not registered")
+		}
+		return v.Value
+	}
+	states := func() map[string]string {
+		states := make(map[string]string)
+		for _, info := range rt.GetVersions() {
+			states[info.ID] = info.State
+		}
+		return states
+	}
+
+	// Every deploy is a version; the one it replaces becomes its parent
+	if err := rt.DeployProject(source(2), nil); err != nil {
+		t.Fatalf("Failed to deploy: %v", err)
+	}
+	v2, err := rt.DeployVersion(source(2), nil, "alice")
+	if err != nil {
+		t.Fatalf("Failed to deploy version: %v", err)
+	}
+	info, err := rt.GetVersion(v2.ID)
+	if err != nil {
+		t.Fatalf("Failed to get version: %v", err)
+	}
+	if info.State != "active" || info.Parent != "v1" || info.Author != "alice" || len(info.Files) != 1 {
+		t.Errorf("Unexpected version %+v", info)
+	}
+	if got := states(); got["v1"] != "archived" {
+		t.Errorf("Expected v1 to be archived, got %v", got)
+	}
+
+	// A staged version does not run
+	if _, err := rt.StageVersion(source(0)[:0], nil, ""); err != nil {
+		t.Fatalf("Failed to stage an empty version: %v", err)
+	}
+	if _, err := rt.StageVersion([]runtime.DeployRequest{{FilePath: "plant.st", SourceCode: "PROGRAM Plant x := ; END_PROGRAM"}}, nil, ""); err == nil {
+		t.Errorf("Expected a version that does not compile to be refused")
+	}
+	v4, err := rt.StageVersion(source(3), nil, "bob")
+	if err != nil {
+		t.Fatalf("Failed to stage version: %v", err)
+	}
+	if v4.State != runtime.VersionPending {
+		t.Errorf("Expected the staged version to be pending, got %s", v4.State)
+	}
+	rt.ExecuteCycle()
+	if got := out(); got != int16(2) {
+		t.Errorf("Expected out = 2, got %v", got)
+	}
+
+	// A version in Testing starts from the state of the active one and runs
+	// next to it; its outputs are compared without reaching the active variables
+	if err := rt.TestVersion(v4.ID); err != nil {
+		t.Fatalf("Failed to test version: %v", err)
+	}
+	if err := rt.TestVersion(v2.ID); err == nil {
+		t.Errorf("Expected testing the active version to fail")
+	}
+	rt.ExecuteCycle()
+	rt.ExecuteCycle()
+	if got := out(); got != int16(6) {
+		t.Errorf("Expected out = 6 while testing, got %v", got)
+	}
+	info, _ = rt.GetVersion(v4.ID)
+	if info.State != "testing" || info.Comparison == nil {
+		t.Fatalf("Expected a comparison of the version in Testing, got %+v", info)
+	}
+	if c := info.Comparison; c.Cycles != 2 || c.Mismatches != 2 || len(c.Differences) != 1 ||
+		c.Differences[0].Name != "plant.out" || c.Differences[0].Testing != int16(9) {
+		t.Errorf("Unexpected comparison %+v", c)
+	}
+
+	// Activating the version changes the programs online
+	if err := rt.ActivateVersion(v4.ID); err != nil {
+		t.Fatalf("Failed to activate version: %v", err)
+	}
+	rt.ExecuteCycle()
+	if got := out(); got != int16(12) {
+		t.Errorf("Expected out = 12 after activation, got %v", got)
+	}
+	info, _ = rt.GetVersion(v4.ID)
+	if info.State != "active" || info.Parent != v2.ID {
+		t.Errorf("Unexpected activated version %+v", info)
+	}
+
+	// A rollback goes back to the parent and then further back
+	parent, err := rt.Rollback()
+	if err != nil {
+		t.Fatalf("Failed to roll back: %v", err)
+	}
+	if parent.ID != v2.ID {
+		t.Errorf("Expected a rollback to %s, got %s", v2.ID, parent.ID)
+	}
+	rt.ExecuteCycle()
+	if got := out(); got != int16(10) {
+		t.Errorf("Expected out = 10 after the rollback, got %v", got)
+	}
+	if got := states(); got[v2.ID] != "active" || got[v4.ID] != "archived" {
+		t.Errorf("Unexpected states after the rollback %v", got)
+	}
+	if _, err := rt.Rollback(); err != nil {
+		t.Fatalf("Failed to roll back to v1: %v", err)
+	}
+	if _, err := rt.Rollback(); err == nil {
+		t.Errorf("Expected a rollback without a parent to fail")
+	}
+}
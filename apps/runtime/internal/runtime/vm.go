@@ -0,0 +1,430 @@
+package runtime
+
+import (
+	"fmt"
+
+	"github.com/hyperdrive/core/apps/runtime/internal/parser/ast"
+)
+
+// frameCache keeps the variables a chunk's slots were bound to, so an
+// instance whose variables do not change between calls is bound only once
+type frameCache struct {
+	chunk *chunk
+	frame []*Variable
+}
+
+// bind returns the variables for the slots of c, looked up in scope and
+// falling back to the global variables
+func (p *Program) bind(c *chunk, scope map[string]*Variable, cache *frameCache) ([]*Variable, error) {
+	if cache != nil && cache.chunk == c {
+		return cache.frame, nil
+	}
+
+	frame := make([]*Variable, len(c.slots))
+	for i, name := range c.slots {
+		if c.counters[i] {
+			// Created by the FOR loop that uses it
+			continue
+		}
+		v, ok := scope[name]
+		if !ok {
+			if v, ok = p.lib.Global(name); !ok {
+				return nil, fmt.Errorf("undefined variable: %s", name)
+			}
+		}
+		frame[i] = v
+	}
+
+	if cache != nil {
+		cache.chunk, cache.frame = c, frame
+	}
+	return frame, nil
+}
+
+// run executes a chunk against the variables bound to its slots
+func (p *Program) run(c *chunk, frame []*Variable) error {
+	stack := make([]interface{}, 0, 16)
+	var locals []interface{}
+	if c.locals > 0 {
+		locals = make([]interface{}, c.locals)
+	}
+
+	for pc := 0; pc < len(c.code); pc++ {
+		in := c.code[pc]
+		var err error
+
+		switch in.op {
+		case opConst:
+			stack = append(stack, c.consts[in.a])
+		case opLoad:
+			stack = append(stack, frame[in.a].Value)
+		case opStore:
+			v := frame[in.a]
+			if v.constant {
+				err = fmt.Errorf("cannot assign to constant %s", c.slots[in.a])
+				break
+			}
+			err = assign(v, stack[len(stack)-1])
+			stack = stack[:len(stack)-1]
+		case opRef:
+			stack = append(stack, frame[in.a])
+		case opMember:
+			top := len(stack) - 1
+			value, ok := stack[top].(*Variable).Value.(composite)
+			if !ok {
+				err = fmt.Errorf("%s has no members", c.names[in.b])
+				break
+			}
+			member, ok := value.member(c.names[in.a])
+			if !ok {
+				err = fmt.Errorf("%s has no member %s", c.names[in.b], c.names[in.a])
+				break
+			}
+			stack[top] = member
+		case opIndex:
+			base := len(stack) - in.a
+			arr, ok := stack[base-1].(*Variable).Value.(*ArrayValue)
+			if !ok {
+				err = fmt.Errorf("%s is not an array", c.names[in.c])
+				break
+			}
+			indices := make([]int, in.a)
+			for i, val := range stack[base:] {
+				var ok bool
+				if indices[i], ok = toInt(val); !ok {
+					err = fmt.Errorf("array index must be an integer, got %s", typeNameOf(val))
+					break
+				}
+			}
+			if err != nil {
+				break
+			}
+			elem, elemErr := arr.element(indices)
+			if elemErr != nil {
+				err = fmt.Errorf("%s: %w", c.names[in.b], elemErr)
+				break
+			}
+			stack = stack[:base]
+			stack[base-1] = elem
+		case opValue:
+			top := len(stack) - 1
+			stack[top] = stack[top].(*Variable).Value
+		case opAssign:
+			top := len(stack) - 1
+			err = assign(stack[top].(*Variable), stack[top-1])
+			stack = stack[:top-1]
+		case opWritable:
+			if frame[in.a].constant {
+				err = fmt.Errorf("cannot assign to constant %s", c.slots[in.a])
+			}
+		case opBinary:
+			top := len(stack) - 1
+			l, r := stack[top-1], stack[top]
+			result, ok := fastBinary(in.b, l, r)
+			if !ok {
+				result, err = evaluateBinaryOp(l, c.names[in.a], r)
+			}
+			stack = stack[:top]
+			stack[top-1] = result
+		case opUnary:
+			top := len(stack) - 1
+			stack[top], err = evaluateUnaryOp(c.names[in.a], stack[top])
+		case opList:
+			counts := c.lists[in.a]
+			base := len(stack) - len(counts)
+			var values []interface{}
+			for i, val := range stack[base:] {
+				for j := 0; j < counts[i]; j++ {
+					values = append(values, val)
+				}
+			}
+			stack = append(stack[:base], values)
+		case opCall:
+			site := c.calls[in.a]
+			var args []callArg
+			args, stack = site.args(stack)
+			var result interface{}
+			result, err = p.invokeFunction(site.pou, args)
+			stack = append(stack, result)
+		case opStandard:
+			site := c.standard[in.a]
+			base := len(stack) - len(site.positions)
+			values := make([]interface{}, len(site.positions))
+			for i, pos := range site.positions {
+				values[pos] = stack[base+i]
+			}
+			stack = stack[:base]
+			result, callErr := site.fn(values)
+			if callErr != nil {
+				err = fmt.Errorf("%s: %w", site.name, callErr)
+			}
+			stack = append(stack, result)
+		case opInvoke:
+			site := c.calls[in.a]
+			var args []callArg
+			args, stack = site.args(stack)
+			inst, ok := frame[in.b].Value.(*FBInstance)
+			if !ok {
+				err = fmt.Errorf("%s is not a function block instance", c.slots[in.b])
+				break
+			}
+			err = p.invokeFunctionBlock(inst, args)
+		case opPop:
+			stack = stack[:len(stack)-1]
+		case opJump:
+			if in.a <= pc {
+				// A loop iteration ends
+				if err = p.checkWatchdog(); err != nil {
+					break
+				}
+			}
+			pc = in.a - 1
+		case opJumpFalse:
+			top := len(stack) - 1
+			cond, ok := stack[top].(bool)
+			if !ok {
+				err = fmt.Errorf("%s condition must be BOOL, got %T", c.names[in.b], stack[top])
+				break
+			}
+			stack = stack[:top]
+			if !cond {
+				if in.a <= pc {
+					if err = p.checkWatchdog(); err != nil {
+						break
+					}
+				}
+				pc = in.a - 1
+			}
+		case opJumpTrue:
+			top := len(stack) - 1
+			cond, _ := stack[top].(bool)
+			stack = stack[:top]
+			if cond {
+				pc = in.a - 1
+			}
+		case opSetLocal:
+			locals[in.a] = stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+		case opGetLocal:
+			stack = append(stack, locals[in.a])
+		case opForInit:
+			err = p.forInit(c, frame, locals, in, stack[len(stack)-3:])
+			stack = stack[:len(stack)-3]
+		case opForTest:
+			current, ok := toInt(frame[in.a].Value)
+			if !ok {
+				err = fmt.Errorf("FOR control variable %s must be an integer, got %T", c.slots[in.a], frame[in.a].Value)
+				break
+			}
+			to, step := locals[in.b].(int), locals[in.b+1].(int)
+			if (step > 0 && current > to) || (step < 0 && current < to) {
+				pc = in.c - 1
+			}
+		case opForStep:
+			current, ok := toInt(frame[in.a].Value)
+			if !ok {
+				err = fmt.Errorf("FOR control variable %s must be an integer, got %T", c.slots[in.a], frame[in.a].Value)
+				break
+			}
+			var stepped bool
+			if stepped, err = stepCounter(frame[in.a], current, locals[in.b+1].(int)); err == nil && !stepped {
+				pc = in.c - 1
+			}
+		case opReturn:
+			return nil
+		}
+
+		if err != nil {
+			return runtimeError(err, c.stmts[pc])
+		}
+	}
+	return nil
+}
+
+// forInit checks the bounds of a FOR loop, keeps TO and BY in the locals of
+// the run and assigns FROM to the control variable
+func (p *Program) forInit(c *chunk, frame []*Variable, locals []interface{}, in instr, bounds []interface{}) error {
+	what := [...]string{"FOR start", "FOR end", "FOR step"}
+	var ints [3]int
+	for i, val := range bounds {
+		var ok bool
+		if ints[i], ok = toInt(val); !ok {
+			return fmt.Errorf("%s must be an integer, got %s", what[i], typeNameOf(val))
+		}
+	}
+	if ints[2] == 0 {
+		return fmt.Errorf("FOR step must not be zero")
+	}
+	locals[in.b], locals[in.b+1] = ints[1], ints[2]
+
+	if c.counters[in.a] {
+		frame[in.a] = &Variable{
+			Name:     c.slots[in.a],
+			DataType: TypeInt,
+			Quality:  QualityGood,
+		}
+	}
+	counter := frame[in.a]
+	if counter.constant {
+		return fmt.Errorf("cannot assign to constant %s", c.slots[in.a])
+	}
+	return assign(counter, ints[0])
+}
+
+// number is a Go type holding values of one elementary numeric type
+type number interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~float32 | ~float64
+}
+
+// fastBinary computes the operators of the fast paths for two operands of the
+// same numeric type or two BOOLs, giving the same results as evaluateBinaryOp.
+// It reports false for operands it does not handle.
+func fastBinary(op int, l, r interface{}) (interface{}, bool) {
+	if op == fastNone {
+		return nil, false
+	}
+
+	// Untyped integer literals adopt the type of the other operand
+	if lit, ok := l.(int); ok {
+		if _, ok := r.(int); !ok {
+			if l, ok = adoptLiteral(lit, r); !ok {
+				return nil, false
+			}
+		}
+	} else if lit, ok := r.(int); ok {
+		if r, ok = adoptLiteral(lit, l); !ok {
+			return nil, false
+		}
+	}
+
+	switch a := l.(type) {
+	case int:
+		if b, ok := r.(int); ok {
+			return fastNumeric(op, a, b)
+		}
+	case int8:
+		if b, ok := r.(int8); ok {
+			return fastNumeric(op, a, b)
+		}
+	case int16:
+		if b, ok := r.(int16); ok {
+			return fastNumeric(op, a, b)
+		}
+	case int32:
+		if b, ok := r.(int32); ok {
+			return fastNumeric(op, a, b)
+		}
+	case int64:
+		if b, ok := r.(int64); ok {
+			return fastNumeric(op, a, b)
+		}
+	case uint8:
+		if b, ok := r.(uint8); ok {
+			return fastNumeric(op, a, b)
+		}
+	case uint16:
+		if b, ok := r.(uint16); ok {
+			return fastNumeric(op, a, b)
+		}
+	case uint32:
+		if b, ok := r.(uint32); ok {
+			return fastNumeric(op, a, b)
+		}
+	case uint64:
+		if b, ok := r.(uint64); ok {
+			return fastNumeric(op, a, b)
+		}
+	case float32:
+		if b, ok := r.(float32); ok {
+			return fastNumeric(op, a, b)
+		}
+	case float64:
+		if b, ok := r.(float64); ok {
+			return fastNumeric(op, a, b)
+		}
+	case bool:
+		if b, ok := r.(bool); ok {
+			switch op {
+			case fastAnd:
+				return a && b, true
+			case fastOr:
+				return a || b, true
+			case fastXor, fastNE:
+				return a != b, true
+			case fastEQ:
+				return a == b, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// adoptLiteral converts an untyped integer literal to the type of typed,
+// reporting false if the type cannot hold it exactly
+func adoptLiteral(lit int, typed interface{}) (interface{}, bool) {
+	switch typed.(type) {
+	case int8:
+		return exactly[int8](lit)
+	case int16:
+		return exactly[int16](lit)
+	case int32:
+		return exactly[int32](lit)
+	case int64:
+		return exactly[int64](lit)
+	case uint8:
+		return exactly[uint8](lit)
+	case uint16:
+		return exactly[uint16](lit)
+	case uint32:
+		return exactly[uint32](lit)
+	case uint64:
+		return exactly[uint64](lit)
+	case float32:
+		return exactly[float32](lit)
+	case float64:
+		return exactly[float64](lit)
+	}
+	return nil, false
+}
+
+func exactly[T number](lit int) (interface{}, bool) {
+	v := T(lit)
+	return v, int(v) == lit && (v < 0) == (lit < 0)
+}
+
+// fastNumeric computes arithmetic and comparisons in the operands' own type,
+// which wraps on overflow like the elementary type it holds
+func fastNumeric[T number](op int, a, b T) (interface{}, bool) {
+	switch op {
+	case fastAdd:
+		return a + b, true
+	case fastSub:
+		return a - b, true
+	case fastMul:
+		return a * b, true
+	case fastLT:
+		return a < b, true
+	case fastGT:
+		return a > b, true
+	case fastLE:
+		return a <= b, true
+	case fastGE:
+		return a >= b, true
+	case fastEQ:
+		return a == b, true
+	case fastNE:
+		return a != b, true
+	}
+	return nil, false
+}
+
+// executeChunk runs the bytecode of a POU body in scope, binding its slots first
+func (p *Program) executeChunk(c *chunk, pou *ast.Program, scope map[string]*Variable, cache *frameCache) error {
+	frame, err := p.bind(c, scope, cache)
+	if err != nil {
+		return fmt.Errorf("%s: %w", pou.Name, err)
+	}
+	return p.withScope(scope, func() error {
+		return p.run(c, frame)
+	})
+}
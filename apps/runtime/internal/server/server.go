@@ -1,6 +1,7 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -60,17 +61,20 @@ func (s *Server) setupRoutes() {
 
 // DeployHandler handles code deployment to the runtime
 func (s *Server) handleDeploy(c *gin.Context) {
-	var req runtime.DeployRequest
+	var req runtime.ProjectRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
 		return
 	}
 
-	// Clear all existing variables to start fresh
-	s.runtime.ClearAllVariables()
-
-	if err := s.runtime.DeployCode(req); err != nil {
+	version, err := s.runtime.DeployVersion(req.FileList(), req.TaskList(), req.Author)
+	if err != nil {
 		log.Printf("Failed to deploy code: %v", err)
+		var compileErr *runtime.CompileError
+		if errors.As(err, &compileErr) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "diagnostics": compileErr.Diagnostics})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to deploy code: %v", err)})
 		return
 	}
@@ -81,6 +85,7 @@ func (s *Server) handleDeploy(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{
 		"status":  "success",
 		"message": "Code deployed successfully",
+		"version": version.ID,
 	})
 }
 
@@ -0,0 +1,87 @@
+package stdlib
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// functionParams names the inputs of the standard functions taking more than
+// one input, in call order. Functions with a single input, including the type
+// conversions, name it IN.
+var functionParams = map[string][]string{
+	"EXPT":    {"IN1", "IN2"},
+	"SHL":     {"IN", "N"},
+	"SHR":     {"IN", "N"},
+	"ROL":     {"IN", "N"},
+	"ROR":     {"IN", "N"},
+	"LIMIT":   {"MN", "IN", "MX"},
+	"SEL":     {"G", "IN0", "IN1"},
+	"MUX":     {"K"},
+	"MAX":     nil,
+	"MIN":     nil,
+	"LEFT":    {"IN", "L"},
+	"RIGHT":   {"IN", "L"},
+	"MID":     {"IN", "L", "P"},
+	"CONCAT":  nil,
+	"INSERT":  {"IN1", "IN2", "P"},
+	"DELETE":  {"IN", "L", "P"},
+	"REPLACE": {"IN1", "IN2", "L", "P"},
+	"FIND":    {"IN1", "IN2"},
+}
+
+// extensible gives the number of the first input of the functions taking any
+// number of inputs, which follow their fixed parameters as IN0, IN1, ... or
+// IN1, IN2, ...
+var extensible = map[string]int{
+	"MUX":    0,
+	"MAX":    1,
+	"MIN":    1,
+	"CONCAT": 1,
+}
+
+// parameterIndex returns the position of the named input of a standard function
+func parameterIndex(function, param string) (int, bool) {
+	params, ok := functionParams[function]
+	if !ok {
+		return 0, param == "IN"
+	}
+	for i, p := range params {
+		if p == param {
+			return i, true
+		}
+	}
+	if first, ok := extensible[function]; ok && strings.HasPrefix(param, "IN") {
+		if n, err := strconv.Atoi(param[2:]); err == nil && n >= first {
+			return len(params) + n - first, true
+		}
+	}
+	return 0, false
+}
+
+// Positions maps the arguments of a call to a standard function onto the
+// function's inputs. names holds the formal parameter of each argument, or ""
+// for arguments passed by position.
+func Positions(function string, names []string) ([]int, error) {
+	function = strings.ToUpper(function)
+	positions := make([]int, len(names))
+	used := make([]bool, len(names))
+	for i, name := range names {
+		pos := i
+		if name != "" {
+			var ok bool
+			if pos, ok = parameterIndex(function, strings.ToUpper(name)); !ok {
+				return nil, fmt.Errorf("%s has no input %s", function, name)
+			}
+		}
+		if pos >= len(names) {
+			return nil, fmt.Errorf("%s: inputs before %s are missing", function, name)
+		}
+		if used[pos] {
+			return nil, fmt.Errorf("%s: input %d is assigned more than once", function, pos)
+		}
+		used[pos] = true
+		positions[i] = pos
+	}
+	return positions, nil
+}
@@ -0,0 +1,84 @@
+// Package stdlib declares the IEC 61131-3 standard function blocks and the
+// inputs of the standard functions. The checker checks calls against these
+// declarations and the runtime instantiates the blocks like user-defined
+// blocks, executing their bodies natively.
+package stdlib
+
+import (
+	"github.com/hyperdrive/core/apps/runtime/internal/parser"
+	"github.com/hyperdrive/core/apps/runtime/internal/parser/ast"
+)
+
+// Blocks declares the standard function blocks. Variables in VAR sections hold
+// the state the blocks keep between calls: the previous value of an edge
+// triggered input and the start time of a running timer.
+const Blocks = `
+FUNCTION_BLOCK TON
+    VAR_INPUT IN : BOOL; PT : TIME; END_VAR
+    VAR_OUTPUT Q : BOOL; ET : TIME; END_VAR
+    VAR RUNNING : BOOL; START : TIME; END_VAR
+END_FUNCTION_BLOCK
+
+FUNCTION_BLOCK TOF
+    VAR_INPUT IN : BOOL; PT : TIME; END_VAR
+    VAR_OUTPUT Q : BOOL; ET : TIME; END_VAR
+    VAR RUNNING : BOOL; START : TIME; END_VAR
+END_FUNCTION_BLOCK
+
+FUNCTION_BLOCK TP
+    VAR_INPUT IN : BOOL; PT : TIME; END_VAR
+    VAR_OUTPUT Q : BOOL; ET : TIME; END_VAR
+    VAR RUNNING : BOOL; START : TIME; M : BOOL; END_VAR
+END_FUNCTION_BLOCK
+
+FUNCTION_BLOCK CTU
+    VAR_INPUT CU : BOOL; R : BOOL; PV : INT; END_VAR
+    VAR_OUTPUT Q : BOOL; CV : INT; END_VAR
+    VAR M : BOOL; END_VAR
+END_FUNCTION_BLOCK
+
+FUNCTION_BLOCK CTD
+    VAR_INPUT CD : BOOL; LD : BOOL; PV : INT; END_VAR
+    VAR_OUTPUT Q : BOOL; CV : INT; END_VAR
+    VAR M : BOOL; END_VAR
+END_FUNCTION_BLOCK
+
+FUNCTION_BLOCK CTUD
+    VAR_INPUT CU : BOOL; CD : BOOL; R : BOOL; LD : BOOL; PV : INT; END_VAR
+    VAR_OUTPUT QU : BOOL; QD : BOOL; CV : INT; END_VAR
+    VAR MU : BOOL; MD : BOOL; END_VAR
+END_FUNCTION_BLOCK
+
+FUNCTION_BLOCK R_TRIG
+    VAR_INPUT CLK : BOOL; END_VAR
+    VAR_OUTPUT Q : BOOL; END_VAR
+    VAR M : BOOL; END_VAR
+END_FUNCTION_BLOCK
+
+FUNCTION_BLOCK F_TRIG
+    VAR_INPUT CLK : BOOL; END_VAR
+    VAR_OUTPUT Q : BOOL; END_VAR
+    VAR M : BOOL; END_VAR
+END_FUNCTION_BLOCK
+
+FUNCTION_BLOCK SR
+    VAR_INPUT S1 : BOOL; R : BOOL; END_VAR
+    VAR_OUTPUT Q1 : BOOL; END_VAR
+END_FUNCTION_BLOCK
+
+FUNCTION_BLOCK RS
+    VAR_INPUT S : BOOL; R1 : BOOL; END_VAR
+    VAR_OUTPUT Q1 : BOOL; END_VAR
+END_FUNCTION_BLOCK
+`
+
+// Unit holds the parsed standard declarations
+var Unit = mustParse(Blocks)
+
+func mustParse(code string) *ast.CompilationUnit {
+	unit, err := parser.ParseFile("<standard>", code)
+	if err != nil {
+		panic(err)
+	}
+	return unit
+}
@@ -44,18 +44,27 @@ type ProjectConfig struct {
 	Runtime     struct {
 		ScanTime int `json:"scanTime"`
 	} `json:"runtime"`
-	Tasks []struct {
-		Name     string `json:"name"`
-		Priority int    `json:"priority"`
-		Interval string `json:"interval"`
-		Program  string `json:"program"`
-	} `json:"tasks"`
+	Tasks         []TaskConfig `json:"tasks"`
 	Configuration struct {
 		Name      string     `json:"name"`
 		Resources []Resource `json:"resources"`
 	} `json:"configuration"`
 }
 
+// TaskConfig declares a task running a program of the project. A task with
+// an Interval runs cyclically, one with an Event runs on a rising edge of that
+// BOOL variable and one with neither runs freewheeling, again as soon as its
+// last cycle completes. Priority 0 is the highest. A cycle running longer than
+// Watchdog is aborted and the task stopped.
+type TaskConfig struct {
+	Name     string `json:"name"`
+	Priority int    `json:"priority"`
+	Interval string `json:"interval,omitempty"`
+	Event    string `json:"event,omitempty"`
+	Watchdog string `json:"watchdog,omitempty"`
+	Program  string `json:"program"`
+}
+
 // StorageManager handles project storage operations
 type StorageManager struct {
 	client     *minio.Client
@@ -130,12 +139,7 @@ func (sm *StorageManager) CreateProject(ctx context.Context, name, description,
 		}{
 			ScanTime: 100,
 		},
-		Tasks: []struct {
-			Name     string `json:"name"`
-			Priority int    `json:"priority"`
-			Interval string `json:"interval"`
-			Program  string `json:"program"`
-		}{
+		Tasks: []TaskConfig{
 			{
 				Name:     "MainTask",
 				Priority: 1,
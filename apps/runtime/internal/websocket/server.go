@@ -3,6 +3,7 @@ package websocket
 import (
 	"crypto/md5"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -15,6 +16,8 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
+	"github.com/hyperdrive/core/apps/runtime/internal/diagnostics"
+	"github.com/hyperdrive/core/apps/runtime/internal/parser"
 	"github.com/hyperdrive/core/apps/runtime/internal/runtime"
 )
 
@@ -49,6 +52,14 @@ func NewServer(rt *runtime.Runtime) *Server {
 	// Set up routes
 	server.setupRoutes()
 
+	// Tell the clients when the operating mode changes
+	rt.OnModeChange(func(mode runtime.Mode) {
+		server.notifyClients(map[string]interface{}{
+			"type": "mode",
+			"mode": mode,
+		})
+	})
+
 	return server
 }
 
@@ -88,9 +99,22 @@ func (s *Server) setupRoutes() {
 		// Deploy code
 		api.POST("/deploy", s.handleDeploy)
 
+		// Versions of the deployed code
+		api.GET("/versions", s.handleGetVersions)
+		api.GET("/versions/:id", s.handleGetVersion)
+
+		// Stage a version, test it next to the active one, activate it or
+		// roll back to the parent of the active one
+		api.POST("/versions", s.handleStageVersion)
+		api.POST("/versions/:id/:command", s.handleVersionCommand)
+		api.POST("/versions/rollback", s.handleRollback)
+
 		// Get runtime status
 		api.GET("/status", s.handleStatus)
 
+		// Switch the operating mode, run a single cycle or restart
+		api.POST("/control/:command", s.handleControl)
+
 		// Get variables
 		api.GET("/variables", s.handleGetAllVariables)
 
@@ -100,6 +124,9 @@ func (s *Server) setupRoutes() {
 		// Read specific variables (supports namespaced names)
 		api.POST("/read-variables", s.handleReadVariables)
 
+		// JSON Schema of the AST accepted by compile and deploy
+		api.GET("/ast-schema", s.handleASTSchema)
+
 		// Download AST
 		api.GET("/download-ast/:path", s.handleDownloadAST)
 
@@ -175,6 +202,8 @@ func (s *Server) handleWebSocket(c *gin.Context) {
 				s.handleSubscribe(conn, msg)
 			case "read-variables":
 				s.handleReadVariablesWS(conn, msg)
+			case "control":
+				s.handleControlWS(conn, msg)
 			}
 		}
 	}
@@ -614,8 +643,8 @@ func (s *Server) handleSTFilesCount(c *gin.Context) {
 // handleCompile validates the code without deploying it
 func (s *Server) handleCompile(c *gin.Context) {
 	var req struct {
-		Files       []runtime.DeployRequest `json:"files"`
-		ProjectPath string                  `json:"projectPath,omitempty"`
+		runtime.ProjectRequest
+		ProjectPath string `json:"projectPath,omitempty"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -623,7 +652,7 @@ func (s *Server) handleCompile(c *gin.Context) {
 		return
 	}
 
-	if len(req.Files) == 0 {
+	if len(req.Files) == 0 && req.SourceCode == "" && len(req.AST) == 0 {
 		// If no files were provided but a project path was, we can assume this is a project-wide compile
 		if req.ProjectPath != "" {
 			// In a real implementation, we would find all ST files in the project and compile them
@@ -640,116 +669,75 @@ func (s *Server) handleCompile(c *gin.Context) {
 		return
 	}
 
-	// Validate all ASTs without deploying
-	var errors []string
-	for _, file := range req.Files {
-		_, err := runtime.ParseAST(file.AST)
-		if err != nil {
-			errors = append(errors, fmt.Sprintf("Error in file %s: %s", file.FilePath, err.Error()))
-		}
+	// Validate all files without deploying; diagnostics carry the file, line
+	// and column the editor underlines
+	files := req.FileList()
+	diags := s.runtime.Compile(files)
+	if diags == nil {
+		diags = diagnostics.List{}
 	}
 
-	if len(errors) > 0 {
+	if diags.HasErrors() {
+		var messages []string
+		for _, d := range diags {
+			if d.Severity == diagnostics.SeverityError {
+				messages = append(messages, d.Error())
+			}
+		}
 		c.JSON(http.StatusBadRequest, gin.H{
-			"error":   strings.Join(errors, "; "),
-			"success": false,
+			"error":       strings.Join(messages, "; "),
+			"diagnostics": diags,
+			"success":     false,
 		})
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"status":    "compiled",
-		"fileCount": len(req.Files),
-		"success":   true,
+		"status":      "compiled",
+		"fileCount":   len(files),
+		"diagnostics": diags,
+		"success":     true,
 	})
 }
 
 // handleDeploy handles code deployment requests
 func (s *Server) handleDeploy(c *gin.Context) {
-	var req runtime.DeployRequest
+	var req runtime.ProjectRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
 	log.Printf("=== DEPLOYMENT STARTED ===")
-	log.Printf("Deploying code to %s", req.FilePath)
-
-	// Print first 100 chars of source code for debugging
-	if req.SourceCode != "" {
-		sourcePreview := req.SourceCode
-		if len(sourcePreview) > 100 {
-			sourcePreview = sourcePreview[:100] + "..."
-		}
-		log.Printf("Source code preview: %s", sourcePreview)
-	}
-
-	// Validate and parse the AST - do this before deployment so we can examine variables
-	ast, err := runtime.ParseAST(req.AST)
-	if err != nil {
-		log.Printf("ERROR: AST parsing failed: %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
-
-	// Log AST information
-	if ast != nil {
-		log.Printf("AST parsed successfully: Name=%s", ast.Name)
-
-		// Print AST keys for debugging
-		astBytes, _ := json.Marshal(req.AST)
-		var astMap map[string]interface{}
-		if err := json.Unmarshal(astBytes, &astMap); err == nil {
-			keys := make([]string, 0, len(astMap))
-			for k := range astMap {
-				keys = append(keys, k)
-			}
-			log.Printf("AST root keys: %v", keys)
-		}
-
-		// Log variables found in the AST
-		log.Printf("=== VARIABLES FOUND IN AST ===")
-		if len(ast.Vars) > 0 {
-			// Format for variable list display
-			tableFormat := "%-30s | %-10s | %-15s\n"
-			log.Printf(tableFormat, "VARIABLE NAME", "TYPE", "INITIAL VALUE")
-			log.Printf("%s", strings.Repeat("-", 60))
-
-			for name, v := range ast.Vars {
-				// Format the variable type
-				typeName := "UNKNOWN"
-				switch v.DataType {
-				case runtime.TypeBool:
-					typeName = "BOOL"
-				case runtime.TypeInt:
-					typeName = "INT"
-				case runtime.TypeFloat:
-					typeName = "FLOAT"
-				case runtime.TypeString:
-					typeName = "STRING"
-				}
-
-				// Format the variable value
-				valueStr := fmt.Sprintf("%v", v.Value)
-				if len(valueStr) > 15 {
-					valueStr = valueStr[:12] + "..."
-				}
-
-				// Log in table format
-				log.Printf(tableFormat, name, typeName, valueStr)
+	files := req.FileList()
+	var paths []string
+	for _, file := range files {
+		log.Printf("Deploying code to %s", file.FilePath)
+		paths = append(paths, file.FilePath)
+
+		// Print first 100 chars of source code for debugging
+		if file.SourceCode != "" {
+			sourcePreview := file.SourceCode
+			if len(sourcePreview) > 100 {
+				sourcePreview = sourcePreview[:100] + "..."
 			}
-		} else {
-			log.Printf("No variables found in AST!")
-			log.Printf("Check your ST code for proper variable declarations in VAR_INPUT, VAR_OUTPUT, or VAR sections.")
+			log.Printf("Source code preview: %s", sourcePreview)
 		}
-	} else {
-		log.Printf("WARNING: AST parsing returned nil result!")
 	}
 
-	// Deploy the code to the runtime
-	err = s.runtime.DeployCode(req)
+	// Deploy the code to the runtime; the files are compiled as one project
+	version, err := s.runtime.DeployVersion(files, req.TaskList(), req.Author)
 	if err != nil {
 		log.Printf("ERROR: Failed to deploy code: %v", err)
+		var compileErr *runtime.CompileError
+		if errors.As(err, &compileErr) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":       err.Error(),
+				"diagnostics": compileErr.Diagnostics,
+				"success":     false,
+			})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -773,17 +761,7 @@ func (s *Server) handleDeploy(c *gin.Context) {
 			runtimeVarCount++
 
 			// Format the variable type
-			typeName := "UNKNOWN"
-			switch v.DataType {
-			case runtime.TypeBool:
-				typeName = "BOOL"
-			case runtime.TypeInt:
-				typeName = "INT"
-			case runtime.TypeFloat:
-				typeName = "FLOAT"
-			case runtime.TypeString:
-				typeName = "STRING"
-			}
+			typeName := v.DataType.String()
 
 			// Format the variable value
 			valueStr := fmt.Sprintf("%v", v.Value)
@@ -821,12 +799,110 @@ func (s *Server) handleDeploy(c *gin.Context) {
 	// Notify clients that new code has been deployed
 	s.notifyClients(map[string]interface{}{
 		"type":    "deployment",
-		"path":    req.FilePath,
+		"path":    paths[0],
+		"paths":   paths,
+		"version": version.ID,
 		"success": true,
 	})
 
 	c.JSON(http.StatusOK, gin.H{
-		"status":  "deployed",
+		"status":    "deployed",
+		"fileCount": len(files),
+		"version":   version.ID,
+		"success":   true,
+	})
+}
+
+// handleGetVersions lists every deployed or staged version, oldest first
+func (s *Server) handleGetVersions(c *gin.Context) {
+	c.JSON(http.StatusOK, s.runtime.GetVersions())
+}
+
+// handleGetVersion returns a version with the comparison of its test run
+func (s *Server) handleGetVersion(c *gin.Context) {
+	info, err := s.runtime.GetVersion(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, info)
+}
+
+// handleStageVersion records a project as a pending version without running it
+func (s *Server) handleStageVersion(c *gin.Context) {
+	var req runtime.ProjectRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	version, err := s.runtime.StageVersion(req.FileList(), req.TaskList(), req.Author)
+	if err != nil {
+		log.Printf("Failed to stage version: %v", err)
+		response := gin.H{"error": err.Error(), "success": false}
+		var compileErr *runtime.CompileError
+		if errors.As(err, &compileErr) {
+			response["diagnostics"] = compileErr.Diagnostics
+		}
+		c.JSON(http.StatusBadRequest, response)
+		return
+	}
+
+	info, _ := s.runtime.GetVersion(version.ID)
+	c.JSON(http.StatusOK, gin.H{
+		"version": info,
+		"success": true,
+	})
+}
+
+// handleVersionCommand tests or activates the version in the path
+func (s *Server) handleVersionCommand(c *gin.Context) {
+	id, command := c.Param("id"), c.Param("command")
+	var err error
+	switch command {
+	case "test":
+		err = s.runtime.TestVersion(id)
+	case "activate":
+		err = s.runtime.ActivateVersion(id)
+	default:
+		err = fmt.Errorf("unknown command %q", command)
+	}
+	s.versionResponse(c, id, command, err)
+}
+
+// handleRollback makes the parent of the active version active again
+func (s *Server) handleRollback(c *gin.Context) {
+	var id string
+	version, err := s.runtime.Rollback()
+	if err == nil {
+		id = version.ID
+	}
+	s.versionResponse(c, id, "rollback", err)
+}
+
+// versionResponse answers a version command and tells the clients about a
+// version that became active
+func (s *Server) versionResponse(c *gin.Context, id, command string, err error) {
+	if err != nil {
+		log.Printf("Version command %s failed: %v", command, err)
+		var compileErr *runtime.CompileError
+		response := gin.H{"error": err.Error(), "success": false}
+		if errors.As(err, &compileErr) {
+			response["diagnostics"] = compileErr.Diagnostics
+		}
+		c.JSON(http.StatusBadRequest, response)
+		return
+	}
+
+	info, _ := s.runtime.GetVersion(id)
+	if command != "test" {
+		s.notifyClients(map[string]interface{}{
+			"type":    "version",
+			"version": info,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"version": info,
 		"success": true,
 	})
 }
@@ -837,6 +913,59 @@ func (s *Server) handleStatus(c *gin.Context) {
 	c.JSON(http.StatusOK, status)
 }
 
+// control carries out an operator command: run, pause or stop to switch the
+// operating mode, step for a single cycle, warm-restart or cold-restart
+func (s *Server) control(command string) error {
+	switch command {
+	case "step":
+		return s.runtime.Step()
+	case "warm-restart":
+		return s.runtime.Restart(false)
+	case "cold-restart":
+		return s.runtime.Restart(true)
+	}
+	mode, err := runtime.ParseMode(command)
+	if err != nil {
+		return fmt.Errorf("unknown command %q", command)
+	}
+	return s.runtime.SetMode(mode)
+}
+
+// handleControl carries out the operator command in the path
+func (s *Server) handleControl(c *gin.Context) {
+	command := c.Param("command")
+	if err := s.control(command); err != nil {
+		log.Printf("Control command %s failed: %v", command, err)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   err.Error(),
+			"success": false,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":  s.runtime.GetStatus(),
+		"success": true,
+	})
+}
+
+// handleControlWS carries out the operator command of a control message
+func (s *Server) handleControlWS(conn *websocket.Conn, msg map[string]interface{}) {
+	command, _ := msg["command"].(string)
+	response := map[string]interface{}{
+		"type":    "control-response",
+		"id":      msg["id"],
+		"command": command,
+		"success": true,
+	}
+	if err := s.control(command); err != nil {
+		log.Printf("Control command %s failed: %v", command, err)
+		response["success"] = false
+		response["error"] = err.Error()
+	}
+	conn.WriteJSON(response)
+}
+
 // handleGetAllVariables returns all variables
 func (s *Server) handleGetAllVariables(c *gin.Context) {
 	variables := s.runtime.GetAllVariables()
@@ -964,6 +1093,11 @@ func getSubscriptionKeys(subscriptions map[string]bool) []string {
 	return keys
 }
 
+// handleASTSchema returns the JSON Schema of the AST sent with compile and deploy requests
+func (s *Server) handleASTSchema(c *gin.Context) {
+	c.Data(http.StatusOK, "application/schema+json", parser.DeploySchema)
+}
+
 // handleListASTs returns all available AST keys
 func (s *Server) handleListASTs(c *gin.Context) {
 	// Get all AST keys
@@ -1324,18 +1458,7 @@ func (s *Server) handleDebugVariables(c *gin.Context) {
 
 	// Convert DataType enum to string
 	dataTypeToString := func(dt runtime.DataType) string {
-		switch dt {
-		case runtime.TypeBool:
-			return "BOOL"
-		case runtime.TypeInt:
-			return "INT"
-		case runtime.TypeFloat:
-			return "FLOAT"
-		case runtime.TypeString:
-			return "STRING"
-		default:
-			return fmt.Sprintf("UNKNOWN(%d)", dt)
-		}
+		return dt.String()
 	}
 
 	// Convert Quality enum to string